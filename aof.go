@@ -0,0 +1,162 @@
+package canal
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// AOFWriter is a Decoder writing the keys it receives as an AOF file of RESP commands,
+// which redis loads or `redis-cli --pipe` replays: a SELECT per database, the commands
+// creating each key and a PEXPIREAT for the keys with an expiry.
+type AOFWriter struct {
+	w     *bufio.Writer
+	resp  *Writer
+	batch *batcher
+
+	key    []byte
+	expiry int64
+
+	err error
+}
+
+// NewAOFWriter returns an AOFWriter writing at most batch members of a collection
+// per command, or as many as a command may hold if batch is not positive: whatever
+// batch, a command holds at most (maxMultiBulkLength-2)/2 members to stay readable
+// by a Reader, a key larger than that is split.
+func NewAOFWriter(w io.Writer, batch int) *AOFWriter {
+	a := &AOFWriter{w: bufio.NewWriter(w)}
+	a.resp = NewWriter(a.w)
+	if batch <= 0 {
+		batch = maxMultiBulkLength
+	}
+	a.batch = newBatcher(batch, 0, a.Command)
+	return a
+}
+
+// ConvertRDBToAOF reads the RDB file r and writes it to w as an AOF file,
+// batching at most batch members per command.
+func ConvertRDBToAOF(r io.Reader, w io.Writer, batch int) error {
+	a := NewAOFWriter(w, batch)
+	if err := DecodeFile(bufio.NewReader(r), a); err != nil {
+		return err
+	}
+	return a.Flush()
+}
+
+// Err returns the first error met while writing.
+func (a *AOFWriter) Err() error {
+	return a.err
+}
+
+func (a *AOFWriter) Flush() error {
+	if a.err == nil {
+		a.err = a.w.Flush()
+	}
+	return a.err
+}
+
+// Command writes cmd to the file, it makes AOFWriter a CommandDecoder too.
+func (a *AOFWriter) Command(cmd *Command) error {
+	if a.err != nil {
+		return a.err
+	}
+	if err := a.resp.WriteMultiBulk(cmd.CommandName(), cmd.Args()...); err != nil {
+		a.err = err
+		return err
+	}
+	// the RESP writer buffers too, hand the command to a.w.
+	a.err = a.resp.Flush()
+	return a.err
+}
+
+func (a *AOFWriter) write(args ...string) {
+	cmd, _ := NewCommand(args...)
+	a.Command(cmd)
+}
+
+func (a *AOFWriter) begin(cmd string, key []byte, expiry int64) {
+	a.key, a.expiry = key, expiry
+	a.batch.begin(cmd, key)
+}
+
+func (a *AOFWriter) end() {
+	a.batch.end()
+	a.pexpireAt(a.key, a.expiry)
+	a.key = nil
+}
+
+func (a *AOFWriter) pexpireAt(key []byte, expiry int64) {
+	if expiry > 0 {
+		a.write("PEXPIREAT", string(key), strconv.FormatInt(expiry, 10))
+	}
+}
+
+func (a *AOFWriter) BeginRDB()                                 {}
+func (a *AOFWriter) Aux(key, value []byte)                     {}
+func (a *AOFWriter) ResizeDatabase(dbSize, expiresSize uint32) {}
+func (a *AOFWriter) EndDatabase(n int)                         {}
+
+func (a *AOFWriter) BeginDatabase(n int) {
+	a.write("SELECT", strconv.Itoa(n))
+}
+
+func (a *AOFWriter) Set(key, value []byte, expiry int64) {
+	a.write("SET", string(key), string(value))
+	a.pexpireAt(key, expiry)
+}
+
+func (a *AOFWriter) BeginHash(key []byte, length, expiry int64) { a.begin("HSET", key, expiry) }
+func (a *AOFWriter) Hset(key, field, value []byte)              { a.batch.add(field, value) }
+func (a *AOFWriter) EndHash(key []byte)                         { a.end() }
+
+func (a *AOFWriter) BeginSet(key []byte, cardinality, expiry int64) { a.begin("SADD", key, expiry) }
+func (a *AOFWriter) Sadd(key, member []byte)                        { a.batch.add(member) }
+func (a *AOFWriter) EndSet(key []byte)                              { a.end() }
+
+func (a *AOFWriter) BeginList(key []byte, length, expiry int64) { a.begin("RPUSH", key, expiry) }
+func (a *AOFWriter) Rpush(key, value []byte)                    { a.batch.add(value) }
+func (a *AOFWriter) EndList(key []byte)                         { a.end() }
+
+func (a *AOFWriter) BeginZSet(key []byte, cardinality, expiry int64) { a.begin("ZADD", key, expiry) }
+func (a *AOFWriter) Zadd(key []byte, score float64, member []byte) {
+	a.batch.add([]byte(formatScore(score)), member)
+}
+func (a *AOFWriter) EndZSet(key []byte) { a.end() }
+
+func (a *AOFWriter) BeginStream(key []byte, cardinality, expiry int64) {
+	a.key, a.expiry = key, expiry
+}
+
+// Xadd writes the XADD of an entry of one field, the fields and values of larger
+// entries cannot be told apart once joined: Err reports them, they go through XaddEntry.
+func (a *AOFWriter) Xadd(key, id, listpack []byte) {
+	fields, err := splitStreamEntry(listpack)
+	if err != nil {
+		if a.err == nil {
+			a.err = errors.Wrapf(err, "stream %s entry %s", key, id)
+		}
+		return
+	}
+	a.XaddEntry(key, id, fields)
+}
+
+// XaddEntry implements StreamEntryDecoder, it writes one XADD per entry.
+func (a *AOFWriter) XaddEntry(key, id []byte, fields []FieldValue) {
+	args := []string{"XADD", string(key), string(id)}
+	for _, f := range fields {
+		args = append(args, f.Field, f.Value)
+	}
+	a.write(args...)
+}
+
+func (a *AOFWriter) EndStream(key []byte) {
+	a.pexpireAt(a.key, a.expiry)
+	a.key = nil
+}
+
+func (a *AOFWriter) EndRDB() {
+	a.Flush()
+}
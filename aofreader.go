@@ -0,0 +1,195 @@
+package canal
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Types of the files of a multi-part AOF.
+const (
+	AOFBase    = 'b'
+	AOFHistory = 'h'
+	AOFIncr    = 'i'
+)
+
+// AOFFile is one of the files listed by the manifest of a multi-part AOF.
+type AOFFile struct {
+	Name string
+	Seq  int64
+	Type byte
+}
+
+// ReadAOFManifest parses the manifest of a multi-part AOF, as written by redis 7,
+// returning its files in the order they are listed.
+func ReadAOFManifest(r io.Reader) ([]AOFFile, error) {
+	var files []AOFFile
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields, err := splitManifestLine(line)
+		if err != nil {
+			return nil, err
+		}
+		if len(fields)%2 != 0 {
+			return nil, errors.Errorf("aof: invalid manifest line %q", line)
+		}
+		var f AOFFile
+		for i := 0; i < len(fields); i += 2 {
+			switch fields[i] {
+			case "file":
+				f.Name = fields[i+1]
+			case "seq":
+				if f.Seq, err = strconv.ParseInt(fields[i+1], 10, 64); err != nil {
+					return nil, errors.Errorf("aof: invalid manifest line %q", line)
+				}
+			case "type":
+				if len(fields[i+1]) != 1 {
+					return nil, errors.Errorf("aof: invalid manifest line %q", line)
+				}
+				f.Type = fields[i+1][0]
+			}
+		}
+		if f.Name == "" || f.Type == 0 {
+			return nil, errors.Errorf("aof: invalid manifest line %q", line)
+		}
+		files = append(files, f)
+	}
+	return files, scanner.Err()
+}
+
+// splitManifestLine splits a manifest line in words, which are quoted when
+// they hold spaces or special characters.
+func splitManifestLine(line string) ([]string, error) {
+	var fields []string
+	for line != "" {
+		if line[0] == '"' {
+			word, err := strconv.QuotedPrefix(line)
+			if err != nil {
+				return nil, errors.Errorf("aof: invalid manifest line %q", line)
+			}
+			unquoted, _ := strconv.Unquote(word)
+			fields = append(fields, unquoted)
+			line = strings.TrimLeft(line[len(word):], " ")
+			continue
+		}
+		n := strings.IndexByte(line, ' ')
+		if n < 0 {
+			n = len(line)
+		}
+		fields = append(fields, line[:n])
+		line = strings.TrimLeft(line[n:], " ")
+	}
+	return fields, nil
+}
+
+// DecodeAOF reads one AOF file: its RDB preamble or an RDB base file goes to d
+// and the commands which follow to cmder. The RDB may be of any version up to
+// the 11 of redis 7.2, as the base files of a multi-part AOF are.
+func DecodeAOF(r io.Reader, d Decoder, cmder CommandDecoder) error {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(9)
+	if err == nil && string(header[:5]) == "REDIS" {
+		version, _ := strconv.Atoi(string(header[5:]))
+		if err := DecodeFile(br, d); err != nil {
+			return err
+		}
+		if version >= rdbVersionChecksum {
+			if _, err := io.CopyN(ioutil.Discard, br, 8); err != nil && err != io.EOF {
+				return err
+			}
+		}
+	}
+	rd := NewReader(br)
+	for {
+		// redis 7 may annotate the commands with lines like `#TS:1628217470`.
+		if c, err := br.Peek(1); err == nil && c[0] == '#' {
+			if _, err := br.ReadSlice('\n'); err != nil {
+				return err
+			}
+			continue
+		}
+		val, telnet, _, err := rd.ReadMultiBulk()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if telnet || len(val.Array()) == 0 {
+			return errors.Errorf("aof: unexpected value %q.", val.String())
+		}
+		cmd, err := newValueCommand(val)
+		if err != nil {
+			return err
+		}
+		if err := cmder.Command(cmd); err != nil {
+			return err
+		}
+	}
+}
+
+// DecodeAOFPath reads the AOF at path, which is a single AOF file, the manifest
+// of a multi-part AOF or the directory holding it.
+func DecodeAOFPath(path string, d Decoder, cmder CommandDecoder) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		manifests, err := filepath.Glob(filepath.Join(path, "*.manifest"))
+		if err != nil {
+			return err
+		}
+		if len(manifests) != 1 {
+			return errors.Errorf("aof: expected one manifest in %s, found %d.", path, len(manifests))
+		}
+		return decodeAOFManifest(manifests[0], d, cmder)
+	}
+	if strings.HasSuffix(path, ".manifest") {
+		return decodeAOFManifest(path, d, cmder)
+	}
+	return decodeAOFFile(path, d, cmder)
+}
+
+func decodeAOFManifest(path string, d Decoder, cmder CommandDecoder) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	files, err := ReadAOFManifest(f)
+	f.Close()
+	if err != nil {
+		return errors.Wrapf(err, "manifest %s", path)
+	}
+	dir := filepath.Dir(path)
+	for _, t := range []byte{AOFBase, AOFIncr} {
+		for _, file := range files {
+			if file.Type != t {
+				continue
+			}
+			if err := decodeAOFFile(filepath.Join(dir, file.Name), d, cmder); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func decodeAOFFile(path string, d Decoder, cmder CommandDecoder) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return errors.Wrapf(DecodeAOF(f, d, cmder), "aof %s", path)
+}
@@ -0,0 +1,78 @@
+package canal
+
+// batcher groups the members of a RDB collection into multi-member commands
+// such as `SADD key m1 m2 ...`, keeping the order they were decoded in.
+type batcher struct {
+	count int // max members per command
+	bytes int // max bytes of members per command, 0 for no limit
+	emit  func(*Command) error
+	err   error
+
+	cmd  string
+	key  []byte
+	args []string
+	n    int
+	size int
+}
+
+// The batcher stops calling emit after the first error.
+func newBatcher(count, bytes int, emit func(*Command) error) *batcher {
+	// a command must stay readable by a Reader once written.
+	if max := (maxMultiBulkLength - 2) / 2; count > max {
+		count = max
+	}
+	return &batcher{count: count, bytes: bytes, emit: emit}
+}
+
+// Err returns the first error returned by emit.
+func (b *batcher) Err() error {
+	return b.err
+}
+
+func (b *batcher) begin(cmd string, key []byte) {
+	b.cmd = cmd
+	b.key = key
+	b.reset()
+}
+
+func (b *batcher) reset() {
+	b.args = append(b.args[:0], b.cmd, string(b.key))
+	b.n = 0
+	b.size = 0
+}
+
+// add appends one member, made of one or more arguments, flushing the
+// pending command first if the member would not fit in it.
+func (b *batcher) add(member ...[]byte) {
+	if b.err != nil {
+		return
+	}
+	size := 0
+	for _, arg := range member {
+		size += len(arg)
+	}
+	if b.n > 0 && (b.n >= b.count || (b.bytes > 0 && b.size+size > b.bytes)) {
+		b.flush()
+	}
+	for _, arg := range member {
+		b.args = append(b.args, string(arg))
+	}
+	b.n++
+	b.size += size
+}
+
+func (b *batcher) flush() {
+	if b.n == 0 || b.err != nil {
+		return
+	}
+	args := make([]string, len(b.args))
+	copy(args, b.args)
+	cmd, _ := NewCommand(args...)
+	b.err = b.emit(cmd)
+	b.reset()
+}
+
+func (b *batcher) end() {
+	b.flush()
+	b.key = nil
+}
@@ -0,0 +1,306 @@
+package canal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+type BufferConfig struct {
+	// Memory is the bytes of commands held in memory, the commands beyond are
+	// appended to segment files. 64MB by default.
+	Memory int
+	// SegmentSize is the bytes written to a segment file before the next one starts, 64MB by default.
+	SegmentSize int64
+	// Dir holds the segment files, the default directory for temporary files if empty.
+	Dir string
+}
+
+func NewBufferConfig() *BufferConfig {
+	return &BufferConfig{Memory: 64 << 20, SegmentSize: 64 << 20}
+}
+
+// Buffer is a CommandDecoder queueing the commands for another one, delivered in
+// order from its own goroutine, so the replication is read at full speed while a
+// slow CommandDecoder catches up. Commands are held in memory up to the limit of
+// the config, then appended to segment files until they are drained.
+//
+// Applied reports the offset of the last command the CommandDecoder processed,
+// or applied if it is an AppliedHandler, so the checkpoints and the acks to the
+// master only cover the commands delivered. Transactions are delivered as MULTI,
+// their commands and EXEC.
+type Buffer struct {
+	cfg *BufferConfig
+	d   CommandDecoder
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// mem are the commands held in memory, they are delivered before any segment.
+	mem      []*Command
+	memBytes int
+	// segments are the files of the commands spilled, oldest first, commands are
+	// appended to the last one. Commands go to segments until all are drained.
+	segments []*segment
+	applied  int64
+	closed   bool
+	err      error
+	done     chan struct{}
+}
+
+// segment is an append-only file of commands. Command appends to it holding b.mu
+// and wmu, the drain goroutine flushes it holding wmu only and reads it alone.
+type segment struct {
+	f   *os.File
+	w   *bufio.Writer
+	wmu sync.Mutex
+	rf  *os.File
+	r   *bufio.Reader
+	// size is the bytes written, written and read the commands.
+	size    int64
+	written int
+	read    int
+	flushed bool
+}
+
+// NewBuffer returns a Buffer delivering the commands to d.
+func NewBuffer(cfg *BufferConfig, d CommandDecoder) *Buffer {
+	b := &Buffer{cfg: cfg, d: d, applied: -1, done: make(chan struct{})}
+	if b.cfg.Memory <= 0 || b.cfg.SegmentSize <= 0 {
+		c := *cfg
+		if c.Memory <= 0 {
+			c.Memory = 64 << 20
+		}
+		if c.SegmentSize <= 0 {
+			c.SegmentSize = 64 << 20
+		}
+		b.cfg = &c
+	}
+	b.cond = sync.NewCond(&b.mu)
+	go b.drain()
+	return b
+}
+
+// commandSize estimates the memory held by cmd.
+func commandSize(cmd *Command) int {
+	n := 64
+	for _, arg := range cmd.D {
+		n += 16 + len(arg)
+	}
+	return n
+}
+
+// Command queues cmd, it returns the first error of the CommandDecoder or of a segment.
+func (b *Buffer) Command(cmd *Command) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return b.err
+	}
+	if b.closed {
+		return errors.Errorf("buffer is closed.")
+	}
+	size := commandSize(cmd)
+	if len(b.segments) == 0 && (b.memBytes+size <= b.cfg.Memory || len(b.mem) == 0) {
+		b.mem = append(b.mem, cmd)
+		b.memBytes += size
+		b.cond.Broadcast()
+		return nil
+	}
+	if err := b.spill(cmd); err != nil {
+		b.err = errors.Wrap(err, "buffer")
+		return b.err
+	}
+	b.cond.Broadcast()
+	return nil
+}
+
+// spill appends cmd to the last segment, b.mu is held.
+func (b *Buffer) spill(cmd *Command) error {
+	var s *segment
+	if n := len(b.segments); n > 0 && b.segments[n-1].size < b.cfg.SegmentSize {
+		s = b.segments[n-1]
+	} else {
+		f, err := ioutil.TempFile(b.cfg.Dir, "canal-buffer-")
+		if err != nil {
+			return err
+		}
+		r, err := os.Open(f.Name())
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return err
+		}
+		s = &segment{f: f, w: bufio.NewWriter(f), rf: r, r: bufio.NewReader(r)}
+		b.segments = append(b.segments, s)
+	}
+	s.wmu.Lock()
+	n, err := writeCommand(s.w, cmd)
+	s.wmu.Unlock()
+	if err != nil {
+		return err
+	}
+	s.size += int64(n)
+	s.written++
+	s.flushed = false
+	return nil
+}
+
+// next returns the next command to deliver, nil once the buffer is closed and drained.
+// A segment is flushed and read without b.mu, so Command is not held up meanwhile.
+func (b *Buffer) next() (*Command, error) {
+	b.mu.Lock()
+	for {
+		if len(b.mem) > 0 {
+			cmd := b.mem[0]
+			b.mem[0] = nil
+			b.mem = b.mem[1:]
+			b.memBytes -= commandSize(cmd)
+			b.mu.Unlock()
+			return cmd, nil
+		}
+		if len(b.segments) > 0 {
+			s := b.segments[0]
+			if s.read < s.written {
+				flush := !s.flushed
+				s.flushed = true
+				s.read++
+				b.mu.Unlock()
+				return s.next(flush)
+			}
+			// commands are appended to the last segment only, once it is drained
+			// too they are held in memory again.
+			s.close()
+			b.segments = b.segments[1:]
+			continue
+		}
+		if b.closed || b.err != nil {
+			b.mu.Unlock()
+			return nil, nil
+		}
+		b.cond.Wait()
+	}
+}
+
+// next reads the next command of the segment, flushing the commands appended first
+// if flush is set.
+func (s *segment) next(flush bool) (*Command, error) {
+	if flush {
+		s.wmu.Lock()
+		err := s.w.Flush()
+		s.wmu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return readCommand(s.r)
+}
+
+func (s *segment) close() {
+	s.f.Close()
+	s.rf.Close()
+	os.Remove(s.f.Name())
+}
+
+func (b *Buffer) drain() {
+	defer close(b.done)
+	for {
+		cmd, err := b.next()
+		if err == nil && cmd == nil {
+			return
+		}
+		if err == nil {
+			err = b.d.Command(cmd)
+		}
+		b.mu.Lock()
+		if err != nil {
+			if b.err == nil {
+				b.err = errors.Wrap(err, "buffer")
+			}
+			b.mu.Unlock()
+			return
+		}
+		if cmd.Offset >= 0 {
+			b.applied = cmd.Offset
+		}
+		b.mu.Unlock()
+	}
+}
+
+// Applied returns the offset of the last command delivered, -1 if none.
+func (b *Buffer) Applied() int64 {
+	if h, ok := b.d.(AppliedHandler); ok {
+		return h.Applied()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.applied
+}
+
+// Len returns the number of commands queued in memory and in segments.
+func (b *Buffer) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := len(b.mem)
+	for _, s := range b.segments {
+		n += s.written - s.read
+	}
+	return n
+}
+
+// Close waits until the queued commands are delivered, unless the CommandDecoder
+// failed, removes the segments and returns the first error.
+func (b *Buffer) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	b.cond.Broadcast()
+	b.mu.Unlock()
+	<-b.done
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, s := range b.segments {
+		s.close()
+	}
+	b.segments = nil
+	return b.err
+}
+
+// writeCommand writes cmd as its offset, its number of arguments and the arguments.
+func writeCommand(w *bufio.Writer, cmd *Command) (int, error) {
+	var buf [binary.MaxVarintLen64]byte
+	n, _ := w.Write(buf[:binary.PutVarint(buf[:], cmd.Offset)])
+	m, _ := w.Write(buf[:binary.PutUvarint(buf[:], uint64(len(cmd.D)))])
+	n += m
+	var err error
+	for _, arg := range cmd.D {
+		m, _ = w.Write(buf[:binary.PutUvarint(buf[:], uint64(len(arg)))])
+		n += m
+		m, err = w.WriteString(arg)
+		n += m
+		if err != nil {
+			break
+		}
+	}
+	return n, err
+}
+
+func readCommand(r *bufio.Reader) (*Command, error) {
+	offset, err := binary.ReadVarint(r)
+	if err != nil {
+		return nil, noEOF(err)
+	}
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, noEOF(err)
+	}
+	cmd := &Command{D: make([]string, n), Offset: offset}
+	for i := range cmd.D {
+		if cmd.D[i], err = readDigestString(r); err != nil {
+			return nil, err
+		}
+	}
+	return cmd, nil
+}
@@ -2,16 +2,63 @@ package canal
 
 import (
 	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
 	"log"
 	"net"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
 )
 
 type Config struct {
-	Address string
+	Address  string
+	Password string
+	// TLS, when set, connects to the master over TLS.
+	TLS *tls.Config
+
+	// Position resumes the replication where a previous run stopped,
+	// the master falls back to a full sync when it no longer has the backlog.
+	Position *Position
+
+	// Restore makes the full sync emit one RESTORE command per key
+	// instead of a command per member.
+	Restore        bool
+	RestoreReplace bool
+	RestoreAbsTTL  bool
+	// RestoreVersion is the RDB version of the DUMP payloads, it must not be newer
+	// than the one of the target redis. Zero means the latest supported version.
+	RestoreVersion int
+
+	// BatchCount makes the full sync group the members of a collection into
+	// commands of at most BatchCount members, like `SADD key m1 m2 ...`.
+	// BatchBytes also limits the bytes of members in one command.
+	// Zero BatchCount keeps one command per member.
+	BatchCount int
+	BatchBytes int
+
+	// Filter limits the databases, keys and commands delivered, nil delivers all.
+	Filter *Filter
+	// Rewrite renames the keys and databases of the delivered commands, after Filter.
+	Rewrite *Rewrite
+
+	// ExpandEvalSha delivers the EVALSHA of the stream as the EVAL of the script,
+	// known from the RDB or the SCRIPT LOAD or EVAL which loaded it, for targets
+	// which do not have the script. Unknown scripts are delivered as EVALSHA.
+	ExpandEvalSha bool
+
+	// Buffer, when set, queues the commands for the CommandDecoder in memory then
+	// in segment files, so the master is read at full speed while it catches up.
+	// Run returns once the queued commands are delivered.
+	Buffer *BufferConfig
+
+	// Capture, when set, records every byte read from the master from the reply
+	// to PSYNC on, RDB included, for ReplayCapture.
+	Capture *CaptureConfig
 }
 
 func NewConfig(addr string) *Config {
@@ -23,26 +70,51 @@ type Canal struct {
 
 	replica *replica
 
-	cmder CommandDecoder
+	cmder   CommandDecoder
+	dumper  *Dumper
+	batch   *batcher
+	filter  *Filter
+	rewrite *Rewrite
+
+	db      int
+	skipKey bool
+	cfg     *Config
+
+	scripts       scriptCache
+	expandEvalSha bool
 
-	db  int
-	cfg *Config
+	recorder *captureRecorder
+	// err is the first error met delivering the RDB, its Decoder methods return none.
+	err error
 
-	runID  string
-	offset int64
+	runID   string
+	offset  int64
+	loading bool
+	// offline canals replay files, their commands have no replication offset.
+	offline bool
+	// prev is the offset before the last value of the stream.
+	prev int64
 
-	once   sync.Once
-	closeC chan *Canal
-	closeR chan *replica
+	// multi is the MULTI of the transaction whose queued commands wait for EXEC,
+	// txDB the database it began in. pending is set meanwhile, txStart is the offset before it.
+	multi   *Command
+	queued  []*Command
+	txDB    int
+	txStart int64
+	pending int32
+
+	once      sync.Once
+	closeOnce sync.Once
+	closeC    chan *Canal
+	closeR    chan *replica
 }
 
 func NewCanal(cfg *Config) (*Canal, error) {
-	c := new(Canal)
-	c.once = sync.Once{}
-	c.closeC = make(chan *Canal)
-	c.closeR = make(chan *replica)
-	c.cfg = cfg
-	err := c.prepare()
+	c, err := newCanal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	err = c.prepare()
 	if err != nil {
 		return nil, err
 	}
@@ -50,25 +122,185 @@ func NewCanal(cfg *Config) (*Canal, error) {
 	if err != nil {
 		return nil, err
 	}
-	c.replica = newReplica(c.conn, c)
+	var rd io.Reader = c.conn
+	if cfg.Capture != nil {
+		if c.recorder, err = newRecorder(cfg.Capture, c.conn); err != nil {
+			c.conn.Close()
+			return nil, err
+		}
+		rd = c.recorder
+	}
+	c.replica = newReplica(rd, c)
 	return c, nil
 }
 
-func (c *Canal) Run(commandDecode CommandDecoder) error {
+// ReplayAOF delivers the commands of the AOF at path to commandDecode, filtered and
+// rewritten as cfg says like the ones of a master. The path is an AOF file, possibly
+// with an RDB preamble, or a multi-part AOF directory or manifest.
+func ReplayAOF(cfg *Config, path string, commandDecode CommandDecoder) error {
 	if commandDecode == nil {
 		return errors.Errorf("command decode is nil.")
 	}
+	c, err := newCanal(cfg)
+	if err != nil {
+		return err
+	}
 	c.cmder = commandDecode
-	return c.replica.dumpAndParse(c.closeR)
+	c.offline = true
+	return DecodeAOFPath(path, c, c)
+}
+
+// newCanal returns a canal which is not connected yet.
+func newCanal(cfg *Config) (*Canal, error) {
+	c := new(Canal)
+	c.once = sync.Once{}
+	c.closeC = make(chan *Canal)
+	c.closeR = make(chan *replica)
+	c.cfg = cfg
+	if cfg.Position != nil && cfg.Position.RunID != "" {
+		c.runID, c.offset = cfg.Position.RunID, cfg.Position.Offset
+	}
+	c.filter = cfg.Filter
+	c.expandEvalSha = cfg.ExpandEvalSha
+	c.rewrite = cfg.Rewrite
+	if cfg.Restore {
+		version := cfg.RestoreVersion
+		if version == 0 {
+			version = rdbVersion
+		}
+		dumper, err := NewDumper(version, c.restore)
+		if err != nil {
+			return nil, err
+		}
+		c.dumper = dumper
+	} else if cfg.BatchCount > 0 {
+		c.batch = newBatcher(cfg.BatchCount, cfg.BatchBytes, c.Command)
+	}
+	return c, nil
+}
+
+func (c *Canal) Run(commandDecode CommandDecoder) error {
+	if commandDecode == nil {
+		return errors.Errorf("command decode is nil.")
+	}
+	return c.buffered(commandDecode, func() error {
+		return c.replica.dumpAndParse(c.closeR)
+	})
+}
+
+// buffered runs run with commandDecode receiving the commands, through a Buffer
+// if the config has one.
+func (c *Canal) buffered(commandDecode CommandDecoder, run func() error) error {
+	if c.cfg.Buffer == nil {
+		c.cmder = commandDecode
+		return run()
+	}
+	b := NewBuffer(c.cfg.Buffer, commandDecode)
+	c.cmder = b
+	err := run()
+	if berr := b.Close(); err == nil {
+		err = berr
+	}
+	return err
+}
+
+// Sync runs a full sync like Run, but returns once the commands of the RDB
+// are delivered instead of following the replication stream.
+func (c *Canal) Sync(commandDecode CommandDecoder) error {
+	if commandDecode == nil {
+		return errors.Errorf("command decode is nil.")
+	}
+	return c.buffered(commandDecode, func() error {
+		return c.replica.fullSync(c)
+	})
+}
+
+// Snapshot hands the RDB of a full sync to d and returns, no command is delivered.
+func (c *Canal) Snapshot(d Decoder) error {
+	return c.replica.fullSync(d)
+}
+
+// RunSnapshot is Run handing the RDB of the full sync to d instead of turning it
+// into commands, the commands which follow go to commandDecode. The Filter applies
+// to d, not the Rewrite.
+func (c *Canal) RunSnapshot(d Decoder, commandDecode CommandDecoder) error {
+	if commandDecode == nil {
+		return errors.Errorf("command decode is nil.")
+	}
+	if c.filter != nil {
+		d = c.filter.Decoder(d)
+	}
+	c.replica.rdb = newSnapshotDecoder(d, c)
+	return c.buffered(commandDecode, func() error {
+		return c.replica.dumpAndParse(c.closeR)
+	})
+}
+
+// snapshotDecoder hands the RDB of a full sync to a Decoder, the canal keeps
+// the replication position of its aux fields.
+type snapshotDecoder struct {
+	Decoder
+	c *Canal
+}
+
+func newSnapshotDecoder(d Decoder, c *Canal) Decoder {
+	sd := &snapshotDecoder{Decoder: d, c: c}
+	if _, ok := d.(ValueInfoDecoder); ok {
+		return &snapshotInfoDecoder{sd}
+	}
+	return sd
+}
+
+func (d *snapshotDecoder) Aux(key, value []byte) {
+	d.c.Aux(key, value)
+	d.Decoder.Aux(key, value)
 }
 
+func (d *snapshotDecoder) Eviction(key []byte, lruIdle, lfuFreq int64) {
+	if eviction, ok := d.Decoder.(EvictionDecoder); ok {
+		eviction.Eviction(key, lruIdle, lfuFreq)
+	}
+}
+
+func (d *snapshotDecoder) XaddEntry(key, id []byte, fields []FieldValue) {
+	xaddEntry(d.Decoder, key, id, fields)
+}
+
+func (d *snapshotDecoder) Encoding(key []byte, typ ValueType) {
+	if encoding, ok := d.Decoder.(EncodingDecoder); ok {
+		encoding.Encoding(key, typ)
+	}
+}
+
+// snapshotInfoDecoder is a snapshotDecoder of a ValueInfoDecoder, the values are
+// only counted when the decoder wants their ValueInfo.
+type snapshotInfoDecoder struct {
+	*snapshotDecoder
+}
+
+func (d *snapshotInfoDecoder) ValueInfo(key []byte, info ValueInfo) {
+	d.Decoder.(ValueInfoDecoder).ValueInfo(key, info)
+}
+
+// RunID returns the replication ID of the master, it must be called from the CommandDecoder.
+func (c *Canal) RunID() string {
+	return c.runID
+}
+
+// Close stops Run and closes the connection to the master.
 func (c *Canal) Close() {
-	c.closeR <- c.replica
-	c.closeC <- c
+	c.closeOnce.Do(func() {
+		close(c.closeR)
+		close(c.closeC)
+		c.conn.Close()
+		if c.recorder != nil {
+			c.recorder.Close()
+		}
+	})
 }
 
 func (c *Canal) prepare() error {
-	conn, err := net.Dial("tcp", c.cfg.Address)
+	conn, err := dialRedis(c.cfg.Address, c.cfg.TLS)
 	if err != nil {
 		return err
 	}
@@ -77,6 +309,10 @@ func (c *Canal) prepare() error {
 }
 
 func (c *Canal) ack() {
+	if c.conn == nil {
+		// a replay has no master to ack.
+		return
+	}
 	go func() {
 		secondDo := func() {
 			ticker := time.NewTicker(1 * time.Second)
@@ -87,7 +323,11 @@ func (c *Canal) ack() {
 					return
 				default:
 				}
-				ack, _ := MultiBulkBytes(MultiBulkValue("replconf", "ack", c.Offset()))
+				offset := c.Offset()
+				if applier, ok := c.cmder.(AppliedHandler); ok {
+					offset = fmt.Sprintf("%d", applier.Applied())
+				}
+				ack, _ := MultiBulkBytes(MultiBulkValue("replconf", "ack", offset))
 				c.conn.Write([]byte(ack))
 				<-ticker.C
 			}
@@ -111,6 +351,20 @@ func (c *Canal) replconf() error {
 	}
 	_rd := NewReader(c.conn)
 
+	if c.cfg.Password != "" {
+		auth, _ := MultiBulkBytes(MultiBulkValue("AUTH", c.cfg.Password))
+		if _, err = c.conn.Write(auth); err != nil {
+			return err
+		}
+		reply, _, err := _rd.readLine()
+		if err != nil {
+			return err
+		}
+		if !bytes.HasPrefix(reply, []byte("+OK")) {
+			return errors.Errorf("auth failed: %s", bytes.TrimSpace(reply))
+		}
+	}
+
 	listening_port, _ := MultiBulkBytes(MultiBulkValue("REPLCONF", "listening-port", port))
 	if _, err = c.conn.Write(listening_port); err != nil {
 		return err
@@ -167,12 +421,17 @@ func (c *Canal) replconf() error {
 		log.Printf("[CANAL] replconf capa method failed.\n")
 	}
 
+	// a partial sync asks for the byte following the last one received: the offset
+	// of a Position is the one of the last byte of its command, and the master
+	// continues from the offset PSYNC names, so asking for it would replay that byte.
+	offset := strconv.FormatInt(atomic.LoadInt64(&c.offset)+1, 10)
 	if c.runID == "" {
 		c.runID = "?"
 		c.offset = -1
+		offset = c.Offset()
 	}
 
-	psync, _ := MultiBulkBytes(MultiBulkValue("psync", c.runID, c.Offset()))
+	psync, _ := MultiBulkBytes(MultiBulkValue("psync", c.runID, offset))
 	_, err = c.conn.Write(psync)
 	if err != nil {
 		return err
@@ -1,15 +1,30 @@
 package canal
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/rand"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"testing/iotest"
+	"time"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -561,3 +576,2983 @@ func testCommandResult(t *testing.T, src string, expected Value, length int) {
 	assert.Equal(t, v, expected, "Value should be equal.")
 	assert.Equal(t, length, l, "Length should be equal.")
 }
+
+// recorder keeps every Decoder callback as a line, lengths are left out because
+// the same value can be announced with a different length by each encoding.
+type recorder struct {
+	events []string
+}
+
+func (r *recorder) add(format string, args ...interface{}) {
+	r.events = append(r.events, fmt.Sprintf(format, args...))
+}
+
+func (r *recorder) BeginRDB()                                 {}
+func (r *recorder) EndRDB()                                   { r.add("end") }
+func (r *recorder) Aux(key, value []byte)                     { r.add("aux %s %s", key, value) }
+func (r *recorder) ResizeDatabase(dbSize, expiresSize uint32) {}
+func (r *recorder) BeginDatabase(n int)                       { r.add("select %d", n) }
+func (r *recorder) EndDatabase(n int)                         {}
+func (r *recorder) Set(key, value []byte, expiry int64)       { r.add("set %q %q %d", key, value, expiry) }
+func (r *recorder) BeginHash(key []byte, length, expiry int64) {
+	r.add("hash %q %d", key, expiry)
+}
+func (r *recorder) Hset(key, field, value []byte) { r.add("hset %q %q %q", key, field, value) }
+func (r *recorder) EndHash(key []byte)            { r.add("endhash %q", key) }
+func (r *recorder) BeginSet(key []byte, cardinality, expiry int64) {
+	r.add("set %q %d", key, expiry)
+}
+func (r *recorder) Sadd(key, member []byte) { r.add("sadd %q %q", key, member) }
+func (r *recorder) EndSet(key []byte)       { r.add("endset %q", key) }
+func (r *recorder) BeginList(key []byte, length, expiry int64) {
+	r.add("list %q %d", key, expiry)
+}
+func (r *recorder) Rpush(key, value []byte) { r.add("rpush %q %q", key, value) }
+func (r *recorder) EndList(key []byte)      { r.add("endlist %q", key) }
+func (r *recorder) BeginZSet(key []byte, cardinality, expiry int64) {
+	r.add("zset %q %d", key, expiry)
+}
+func (r *recorder) Zadd(key []byte, score float64, member []byte) {
+	r.add("zadd %q %v %q", key, score, member)
+}
+func (r *recorder) EndZSet(key []byte) { r.add("endzset %q", key) }
+func (r *recorder) BeginStream(key []byte, cardinality, expiry int64) {
+	r.add("stream %q %d", key, expiry)
+}
+func (r *recorder) Xadd(key, id, listpack []byte) { r.add("xadd %q %s %q", key, id, listpack) }
+func (r *recorder) XaddEntry(key, id []byte, fields []FieldValue) {
+	var args []string
+	for _, f := range fields {
+		args = append(args, f.Field, f.Value)
+	}
+	r.add("xadd %q %s %q", key, id, args)
+}
+func (r *recorder) EndStream(key []byte) { r.add("endstream %q", key) }
+
+// sampleRDB feeds d with values covering every encoding the Encoder can choose.
+func sampleRDB(d Decoder, streams bool) {
+	d.BeginRDB()
+	d.Aux([]byte("redis-ver"), []byte("5.0.4"))
+	d.BeginDatabase(0)
+	d.Set([]byte("int8"), []byte("-12"), 0)
+	d.Set([]byte("int32"), []byte("1234567"), 1893456000000)
+	d.Set([]byte("int64"), []byte("12345678901234"), 0)
+	d.Set([]byte("padded"), []byte("0012"), 0)
+	d.Set([]byte("lzf"), bytes.Repeat([]byte("canal "), 50), 0)
+	d.Set([]byte("empty"), []byte{}, 0)
+
+	d.BeginHash([]byte("hash"), 2, 0)
+	d.Hset([]byte("hash"), []byte("f1"), []byte("v1"))
+	d.Hset([]byte("hash"), []byte("f2"), []byte("-70000"))
+	d.EndHash([]byte("hash"))
+	d.BeginHash([]byte("hash:big"), 1, 0)
+	d.Hset([]byte("hash:big"), []byte("f"), bytes.Repeat([]byte("x"), 100))
+	d.EndHash([]byte("hash:big"))
+
+	// intsets are sorted, members are added in order to compare the events.
+	d.BeginSet([]byte("intset"), 3, 0)
+	d.Sadd([]byte("intset"), []byte("-100000"))
+	d.Sadd([]byte("intset"), []byte("1"))
+	d.Sadd([]byte("intset"), []byte("3"))
+	d.EndSet([]byte("intset"))
+	d.BeginSet([]byte("set"), 2, 0)
+	d.Sadd([]byte("set"), []byte("a"))
+	d.Sadd([]byte("set"), []byte("1"))
+	d.EndSet([]byte("set"))
+
+	d.BeginZSet([]byte("zset"), 3, 0)
+	d.Zadd([]byte("zset"), 1.5, []byte("a"))
+	d.Zadd([]byte("zset"), -3, []byte("b"))
+	d.Zadd([]byte("zset"), 1e21, []byte("c"))
+	d.EndZSet([]byte("zset"))
+
+	d.BeginList([]byte("list"), -1, 1893456000000)
+	for i := 0; i < 300; i++ {
+		d.Rpush([]byte("list"), []byte(strconv.Itoa(i*1000-5)))
+	}
+	d.Rpush([]byte("list"), bytes.Repeat([]byte("y"), 400))
+	d.EndList([]byte("list"))
+
+	d.BeginDatabase(3)
+	d.BeginSet([]byte("set:large"), 600, 0)
+	for i := 0; i < 600; i++ {
+		d.Sadd([]byte("set:large"), []byte(fmt.Sprintf("member:%d", i)))
+	}
+	d.EndSet([]byte("set:large"))
+	d.BeginZSet([]byte("zset:large"), 600, 0)
+	for i := 0; i < 600; i++ {
+		d.Zadd([]byte("zset:large"), float64(i)/4, []byte(fmt.Sprintf("member:%d", i)))
+	}
+	d.EndZSet([]byte("zset:large"))
+	if streams {
+		d.BeginStream([]byte("stream"), 1, 0)
+		for i := 0; i < 150; i++ {
+			if i%7 == 0 {
+				xaddEntry(d, []byte("stream"), []byte(fmt.Sprintf("1500000000%03d-%d", i/3, i%3)), []FieldValue{{"other", "1"}})
+				continue
+			}
+			xaddEntry(d, []byte("stream"), []byte(fmt.Sprintf("1500000000%03d-%d", i/3, i%3)), []FieldValue{
+				{"name", fmt.Sprintf("n %d", i)}, {"count", strconv.Itoa(i * -100)}, {"big", strconv.FormatInt(int64(i)<<40, 10)}})
+		}
+		d.EndStream([]byte("stream"))
+	}
+	d.EndDatabase(3)
+	d.EndRDB()
+}
+
+// listpackEntry returns an element of a listpack, its encoding and data followed
+// by its back length.
+func listpackEntry(entry ...byte) []byte {
+	if n := len(entry); n <= 127 {
+		return append(entry, byte(n))
+	} else {
+		return append(entry, byte(n>>7), byte(n&127)|128)
+	}
+}
+
+// listpackString returns the element of a listpack holding a string of less than 64 bytes.
+func listpackString(s string) []byte {
+	return listpackEntry(append([]byte{0x80 | byte(len(s))}, s...)...)
+}
+
+func TestReadListPack(t *testing.T) {
+	var lp []byte
+	lp = append(lp, listpackEntry(0x05)...)
+	lp = append(lp, listpackString("abc")...)
+	lp = append(lp, listpackEntry(0xDF, 0x9C)...)
+	lp = append(lp, listpackEntry(binary.LittleEndian.AppendUint16([]byte{0xF1}, uint16(0xFC18))...)...)
+	lp = append(lp, listpackEntry(0xF2, 0x60, 0x79, 0xFE)...)
+	lp = append(lp, listpackEntry(0xF2, 0x40, 0x4B, 0x4C)...)
+	n32 := int32(-2000000000)
+	lp = append(lp, listpackEntry(binary.LittleEndian.AppendUint32([]byte{0xF3}, uint32(n32))...)...)
+	n64 := int64(-1) << 40
+	lp = append(lp, listpackEntry(binary.LittleEndian.AppendUint64([]byte{0xF4}, uint64(n64))...)...)
+	lp = append(lp, listpackEntry(append([]byte{0xE0, 100}, bytes.Repeat([]byte("x"), 100)...)...)...)
+	lp = append(lp, listpackEntry(append(binary.LittleEndian.AppendUint32([]byte{0xF0}, 5000), bytes.Repeat([]byte("y"), 5000)...)...)...)
+	lp = append(lp, rdbLpEOF)
+
+	slice := newSliceBuffer(lp)
+	for _, expected := range []string{"5", "abc", "-100", "-1000", "-100000", "5000000", "-2000000000", "-1099511627776",
+		strings.Repeat("x", 100), strings.Repeat("y", 5000)} {
+		value, err := readListPackV2(slice)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, string(value))
+	}
+	// the back lengths are skipped whatever their size.
+	b, err := slice.ReadByte()
+	assert.Nil(t, err)
+	assert.Equal(t, byte(rdbLpEOF), b)
+
+	u, err := readuInt([]byte("18446744073709551615"))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(math.MaxUint64), u)
+	i, err := readInt([]byte("-5"))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(-5), i)
+	_, err = readuInt([]byte("-5"))
+	assert.NotNil(t, err)
+}
+
+func TestReadLength(t *testing.T) {
+	data := []byte{0x05, 0x41, 0x02}
+	data = append(binary.BigEndian.AppendUint32(append(data, 0x80), 70000), 0x81)
+	data = binary.BigEndian.AppendUint64(data, 1<<33)
+	d := &rdbDecode{intBuf: make([]byte, 8), r: bytes.NewReader(data)}
+	for _, expected := range []uint64{5, 0x102, 70000, 1 << 33} {
+		n, encoded, err := d.readLength()
+		assert.Nil(t, err)
+		assert.False(t, encoded)
+		assert.Equal(t, expected, n)
+	}
+}
+
+func TestReadStream(t *testing.T) {
+	// master entry 1000-5 with the fields f1 and f2.
+	lp := []byte{0, 0, 0, 0, 0, 0}
+	for _, e := range [][]byte{listpackEntry(2), listpackEntry(1), listpackEntry(2),
+		listpackString("f1"), listpackString("f2"), listpackEntry(0)} {
+		lp = append(lp, e...)
+	}
+	entries := [][][]byte{
+		// same fields as the master entry, at the same id.
+		{listpackEntry(rdbStreamItemFlangSameFields), listpackEntry(0), listpackEntry(0),
+			listpackString("v1"), listpackString("v2"), listpackEntry(5)},
+		// deleted
+		{listpackEntry(rdbStreamItemFlagDeleted | rdbStreamItemFlangSameFields), listpackEntry(5), listpackEntry(1),
+			listpackString("x"), listpackString("y"), listpackEntry(5)},
+		// fields of its own, the sequence is below the one of the master entry.
+		{listpackEntry(0), listpackEntry(10), listpackEntry(0xDF, 0xFB), listpackEntry(1),
+			listpackString("g"), listpackString("w"), listpackEntry(6)},
+	}
+	for _, entry := range entries {
+		for _, e := range entry {
+			lp = append(lp, e...)
+		}
+	}
+	lp = append(lp, rdbLpEOF)
+
+	data := []byte{1, 16}
+	data = binary.BigEndian.AppendUint64(data, 1000)
+	data = binary.BigEndian.AppendUint64(data, 5)
+	data = append(data, 0x40|byte(len(lp)>>8), byte(len(lp)))
+	data = append(data, lp...)
+	// items, last id, consumer groups.
+	data = append(data, 2, 0x43, 0xF2, 0, 0)
+
+	r := &recorder{}
+	d := &rdbDecode{event: r, intBuf: make([]byte, 8), r: bytes.NewReader(data)}
+	assert.Nil(t, d.readStream([]byte("s"), TypeStreamListPacks, 0))
+	assert.Equal(t, []string{`stream "s" 0`, `xadd "s" 1000-5 ["f1" "v1" "f2" "v2"]`, `xadd "s" 1010-0 ["g" "w"]`, `endstream "s"`}, r.events)
+}
+
+func TestEncoderRoundTrip(t *testing.T) {
+	for _, version := range []int{4, 6, 7, 8, 9} {
+		t.Run(fmt.Sprintf("v%d", version), func(t *testing.T) {
+			streams := version >= 9
+			expected := &recorder{}
+			sampleRDB(expected, streams)
+			if version < 7 {
+				expected.events = expected.events[1:] // aux fields are not saved
+			}
+
+			var buf bytes.Buffer
+			enc, err := NewEncoder(&buf, version)
+			assert.Nil(t, err)
+			sampleRDB(enc, streams)
+			assert.Nil(t, enc.Err())
+
+			got := &recorder{}
+			assert.Nil(t, DecodeFile(bytes.NewReader(buf.Bytes()), got))
+			assert.Equal(t, expected.events, got.events)
+
+			if version >= 5 {
+				data := buf.Bytes()
+				assert.Equal(t, binary.LittleEndian.Uint64(data[len(data)-8:]), Digest(data[:len(data)-8]))
+			}
+		})
+	}
+}
+
+func TestEncoderFromDecoder(t *testing.T) {
+	expected := &recorder{}
+	sampleRDB(expected, true)
+
+	var rdb bytes.Buffer
+	enc, err := NewEncoder(&rdb, rdbVersion)
+	assert.Nil(t, err)
+	sampleRDB(enc, true)
+	assert.Nil(t, enc.Err())
+
+	// the decoder hands the entries of a stream in a buffer it reuses.
+	var copied bytes.Buffer
+	enc, err = NewEncoder(&copied, rdbVersion)
+	assert.Nil(t, err)
+	assert.Nil(t, DecodeFile(bytes.NewReader(rdb.Bytes()), enc))
+	assert.Nil(t, enc.Err())
+
+	got := &recorder{}
+	assert.Nil(t, DecodeFile(bytes.NewReader(copied.Bytes()), got))
+	assert.Equal(t, expected.events, got.events)
+}
+
+func TestEncoderStreamSpaces(t *testing.T) {
+	// joined by spaces, an entry of more than one field cannot be told apart.
+	o := &rdbObject{typ: TypeStreamListPacks, key: []byte("s")}
+	assert.NotNil(t, o.xadd([]byte("1-1"), []byte("f a b c")))
+	assert.Nil(t, o.xadd([]byte("1-1"), []byte("f v")))
+	assert.Equal(t, [][]byte{[]byte("f")}, o.stream[0].fields)
+
+	var rdb bytes.Buffer
+	enc, err := NewEncoder(&rdb, rdbVersion)
+	assert.Nil(t, err)
+	enc.BeginRDB()
+	enc.BeginDatabase(0)
+	enc.BeginStream([]byte("s"), 1, 0)
+	enc.XaddEntry([]byte("s"), []byte("1-1"), []FieldValue{{"f", "a b c"}, {"g h", "i"}})
+	enc.EndStream([]byte("s"))
+	enc.EndDatabase(0)
+	enc.EndRDB()
+	assert.Nil(t, enc.Err())
+
+	// the decoder hands the entries apart to the Encoder.
+	var copied bytes.Buffer
+	enc, err = NewEncoder(&copied, rdbVersion)
+	assert.Nil(t, err)
+	assert.Nil(t, DecodeFile(bytes.NewReader(rdb.Bytes()), enc))
+	assert.Nil(t, enc.Err())
+	got := &recorder{}
+	assert.Nil(t, DecodeFile(bytes.NewReader(copied.Bytes()), got))
+	assert.Equal(t, []string{"select 0", `stream "s" 0`, `xadd "s" 1-1 ["f" "a b c" "g h" "i"]`, `endstream "s"`, "end"}, got.events)
+
+	enc, err = NewEncoder(&bytes.Buffer{}, rdbVersion)
+	assert.Nil(t, err)
+	enc.BeginStream([]byte("s"), 1, 0)
+	enc.Xadd([]byte("s"), []byte("1-1"), []byte("f a b c"))
+	assert.NotNil(t, enc.Err())
+}
+
+func TestEncoderStreamNeedsVersion(t *testing.T) {
+	enc, err := NewEncoder(&bytes.Buffer{}, 8)
+	assert.Nil(t, err)
+	sampleRDB(enc, true)
+	assert.NotNil(t, enc.Err())
+
+	_, err = NewEncoder(&bytes.Buffer{}, rdbVersion+1)
+	assert.NotNil(t, err)
+}
+
+func TestLzfCompress(t *testing.T) {
+	inputs := [][]byte{
+		bytes.Repeat([]byte("a"), 1000),
+		bytes.Repeat([]byte("hello canal "), 700),
+		[]byte(strings.Repeat("0123456789", 3) + "abcdefghijklmnopqrstuvwxyz" + strings.Repeat("0123456789", 3)),
+	}
+	for i := 0; i < 20; i++ {
+		b := randBytes(1 + randInt()%20000)
+		for j := 0; j < len(b); j += 1 + randInt()%64 {
+			b[j] = 'z' // keep some repetitions in random data
+		}
+		inputs = append(inputs, b)
+	}
+	for _, in := range inputs {
+		compressed := lzfCompress(in)
+		if compressed == nil {
+			continue
+		}
+		assert.True(t, len(compressed) < len(in)-4)
+		assert.Equal(t, in, lzfDecompress(compressed, len(in)))
+	}
+	assert.Nil(t, lzfCompress(randBytes(100)))
+}
+
+func TestDumperRoundTrip(t *testing.T) {
+	var dumps []*Dump
+	dumper, err := NewDumper(rdbVersion, func(d *Dump) error {
+		dumps = append(dumps, d)
+		return nil
+	})
+	assert.Nil(t, err)
+	sampleRDB(dumper, true)
+	assert.Nil(t, dumper.Err())
+	assertDumps(t, dumps)
+}
+
+func TestDumperFromDecoder(t *testing.T) {
+	var rdb bytes.Buffer
+	enc, err := NewEncoder(&rdb, rdbVersion)
+	assert.Nil(t, err)
+	sampleRDB(enc, true)
+	assert.Nil(t, enc.Err())
+
+	// the decoder hands the entries of a stream in a buffer it reuses.
+	var dumps []*Dump
+	dumper, err := NewDumper(rdbVersion, func(d *Dump) error {
+		dumps = append(dumps, d)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, DecodeFile(bytes.NewReader(rdb.Bytes()), dumper))
+	assert.Nil(t, dumper.Err())
+	assertDumps(t, dumps)
+}
+
+func TestDumperStreamSpaces(t *testing.T) {
+	var rdb bytes.Buffer
+	enc, err := NewEncoder(&rdb, rdbVersion)
+	assert.Nil(t, err)
+	enc.BeginRDB()
+	enc.BeginDatabase(0)
+	enc.BeginStream([]byte("s"), 1, 0)
+	enc.XaddEntry([]byte("s"), []byte("1-1"), []FieldValue{{"f", "a b c"}, {"g", "h"}})
+	enc.EndStream([]byte("s"))
+	enc.EndDatabase(0)
+	enc.EndRDB()
+	assert.Nil(t, enc.Err())
+
+	// the RESTORE commands of a full sync keep the values apart.
+	addr, _ := fakeMaster(t, rdb.Bytes())
+	cfg := NewConfig(addr)
+	cfg.Restore = true
+	c, err := NewCanal(cfg)
+	assert.Nil(t, err)
+	out := &commands{}
+	assert.Nil(t, c.Sync(out))
+	c.Close()
+	restore := out.cmds[len(out.cmds)-1]
+	assert.Equal(t, "RESTORE", restore.D[0])
+	got := &recorder{}
+	assert.Nil(t, DecodeDump([]byte(restore.D[3]), 0, []byte("s"), 0, got))
+	assert.Equal(t, `xadd "s" 1-1 ["f" "a b c" "g" "h"]`, got.events[2])
+
+	// joined by spaces, they cannot be told apart.
+	dumper, err := NewDumper(rdbVersion, func(d *Dump) error { return nil })
+	assert.Nil(t, err)
+	dumper.BeginStream([]byte("s"), 1, 0)
+	dumper.Xadd([]byte("s"), []byte("1-1"), []byte("f a b c"))
+	dumper.EndStream([]byte("s"))
+	assert.NotNil(t, dumper.Err())
+}
+
+// assertDumps checks that dumps restore the keys of sampleRDB.
+func assertDumps(t *testing.T, dumps []*Dump) {
+	expected := &recorder{}
+	sampleRDB(expected, true)
+	got := &recorder{}
+	for _, d := range dumps {
+		// DecodeDump reports every key in its own rdb and database.
+		assert.Nil(t, DecodeDump(d.Payload, d.DB, d.Key, d.Expiry, got))
+	}
+	var keys []string
+	for _, e := range expected.events {
+		if !strings.HasPrefix(e, "aux") && !strings.HasPrefix(e, "select") && e != "end" {
+			keys = append(keys, e)
+		}
+	}
+	var gotKeys []string
+	for _, e := range got.events {
+		if !strings.HasPrefix(e, "select") && e != "end" {
+			gotKeys = append(gotKeys, e)
+		}
+	}
+	assert.Equal(t, keys, gotKeys)
+	assert.Equal(t, 3, dumps[len(dumps)-1].DB)
+}
+
+func TestDumpRestore(t *testing.T) {
+	d := &Dump{Key: []byte("k"), Payload: []byte("\x00\x01v"), Idle: -1, Freq: 5}
+	assert.Equal(t, []string{"RESTORE", "k", "0", "\x00\x01v", "REPLACE", "FREQ", "5"}, d.Restore(true, false).D)
+
+	d = &Dump{Key: []byte("k"), Payload: []byte("p"), Expiry: 1, Idle: 10, Freq: -1}
+	assert.Nil(t, d.Restore(false, false))
+	assert.Equal(t, []string{"RESTORE", "k", "1", "p", "ABSTTL", "IDLETIME", "10"}, d.Restore(false, true).D)
+}
+
+type commands struct {
+	cmds []*Command
+}
+
+func (c *commands) Command(cmd *Command) error {
+	c.cmds = append(c.cmds, cmd)
+	return nil
+}
+
+func TestBatchCollections(t *testing.T) {
+	out := &commands{}
+	c := &Canal{cmder: out}
+	c.batch = newBatcher(3, 10, c.Command)
+
+	c.BeginSet([]byte("s"), 5, 0)
+	for _, m := range []string{"a", "b", "c", "d", "eeeeeeeeeeee"} {
+		c.Sadd([]byte("s"), []byte(m))
+	}
+	c.EndSet([]byte("s"))
+	c.BeginZSet([]byte("z"), 2, 0)
+	c.Zadd([]byte("z"), 1.5, []byte("m1"))
+	c.Zadd([]byte("z"), 0.1, []byte("m2"))
+	c.EndZSet([]byte("z"))
+	c.BeginHash([]byte("h"), 1, 0)
+	c.Hset([]byte("h"), []byte("f"), []byte("v"))
+	c.EndHash([]byte("h"))
+
+	var got []string
+	for _, cmd := range out.cmds {
+		got = append(got, cmd.String())
+	}
+	assert.Equal(t, []string{
+		"SADD s a b c",
+		"SADD s d",
+		"SADD s eeeeeeeeeeee",
+		"ZADD z 1.5 m1 0.1 m2",
+		"HSET h f v",
+	}, got)
+}
+
+// failingCommands records the commands it receives and fails the n-th one.
+type failingCommands struct {
+	commands
+	n int
+}
+
+func (c *failingCommands) Command(cmd *Command) error {
+	c.cmds = append(c.cmds, cmd)
+	if len(c.cmds) == c.n {
+		return errors.New("handler failed")
+	}
+	return nil
+}
+
+func TestBatchError(t *testing.T) {
+	out := &failingCommands{n: 2}
+	c := &Canal{cmder: out}
+	c.batch = newBatcher(2, 0, c.Command)
+
+	c.BeginSet([]byte("s"), 5, 0)
+	for _, m := range []string{"a", "b", "c", "d", "e"} {
+		c.Sadd([]byte("s"), []byte(m))
+	}
+	c.EndSet([]byte("s"))
+	c.Set([]byte("k"), []byte("v"), 0)
+
+	// the batch which failed is the last command delivered.
+	var got []string
+	for _, cmd := range out.cmds {
+		got = append(got, cmd.String())
+	}
+	assert.Equal(t, []string{"SADD s a b", "SADD s c d"}, got)
+	assert.EqualError(t, c.rdbErr(), "handler failed")
+
+	// a command failing without batches stops the delivery as well.
+	out = &failingCommands{n: 1}
+	c = &Canal{cmder: out}
+	c.Set([]byte("k"), []byte("v"), 0)
+	c.Set([]byte("l"), []byte("v"), 0)
+	assert.Equal(t, 1, len(out.cmds))
+	assert.EqualError(t, c.rdbErr(), "handler failed")
+}
+
+// fakeRedis accepts one connection, records the commands it receives and replies
+// an error to the commands named BAD, OK to the others.
+func fakeRedis(t *testing.T) (addr string, received chan []string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	received = make(chan []string, 100)
+	go func() {
+		defer ln.Close()
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		defer close(received)
+		rd := NewReader(conn)
+		for {
+			v, _, _, err := rd.ReadMultiBulk()
+			if err != nil {
+				return
+			}
+			var args []string
+			for _, a := range v.Array() {
+				args = append(args, a.String())
+			}
+			received <- args
+			if args[0] == "BAD" {
+				conn.Write([]byte("-ERR bad command\r\n"))
+			} else {
+				conn.Write([]byte("+OK\r\n"))
+			}
+		}
+	}()
+	return ln.Addr().String(), received
+}
+
+func TestTarget(t *testing.T) {
+	addr, received := fakeRedis(t)
+	cfg := NewTargetConfig(addr)
+	cfg.Pipeline = 2
+	cfg.DB = map[int]int{0: 3}
+	var failed []string
+	cfg.OnError = func(cmd *Command, err error) error {
+		failed = append(failed, cmd.String()+": "+err.Error())
+		return nil
+	}
+	target, err := NewTarget(cfg)
+	assert.Nil(t, err)
+
+	send := func(offset int64, args ...string) {
+		cmd, _ := NewCommand(args...)
+		cmd.Offset = offset
+		assert.Nil(t, target.Command(cmd))
+	}
+	send(-1, "SELECT", "0")
+	send(-1, "SET", "a", "1")
+	send(10, "PING")
+	send(20, "BAD")
+	send(30, "SET", "b", "x y")
+	assert.Nil(t, target.Close())
+	assert.Nil(t, target.Close())
+
+	var got [][]string
+	for args := range received {
+		got = append(got, args)
+	}
+	assert.Equal(t, [][]string{{"SELECT", "3"}, {"SET", "a", "1"}, {"BAD"}, {"SET", "b", "x y"}}, got)
+	assert.Equal(t, []string{"BAD: ERR bad command"}, failed)
+	assert.Equal(t, int64(30), target.Applied())
+}
+
+func TestGlobMatch(t *testing.T) {
+	for _, c := range []struct {
+		pattern, str string
+		match        bool
+	}{
+		{"*", "anything", true},
+		{"session:*", "session:1", true},
+		{"session:*", "user:1", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h*llo", "heeeello", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{"h[b-a]llo", "hallo", true},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{"a*b*", "ab", true},
+		{"a*", "", false},
+	} {
+		assert.Equal(t, c.match, globMatch(c.pattern, c.str), "%s %s", c.pattern, c.str)
+	}
+}
+
+func TestCommandKeys(t *testing.T) {
+	for _, c := range []struct {
+		args []string
+		keys []string
+	}{
+		{[]string{"SET", "a", "1"}, []string{"a"}},
+		{[]string{"mset", "a", "1", "b", "2"}, []string{"a", "b"}},
+		{[]string{"RENAME", "a", "b"}, []string{"a", "b"}},
+		{[]string{"BLPOP", "a", "b", "0"}, []string{"a", "b"}},
+		{[]string{"BITOP", "AND", "d", "a", "b"}, []string{"d", "a", "b"}},
+		{[]string{"ZUNIONSTORE", "d", "2", "a", "b", "WEIGHTS", "1", "2"}, []string{"d", "a", "b"}},
+		{[]string{"EVAL", "return 1", "1", "a", "arg"}, []string{"a"}},
+		{[]string{"SORT", "a", "STORE", "d"}, []string{"a", "d"}},
+		{[]string{"PUBLISH", "ch", "msg"}, nil},
+		{[]string{"FLUSHALL"}, nil},
+		{[]string{"GEOSEARCHSTORE", "d", "s", "FROMLONLAT", "0", "0", "BYRADIUS", "1", "km"}, []string{"d", "s"}},
+		{[]string{"GEORADIUS_RO", "s", "0", "0", "1", "km"}, []string{"s"}},
+		{[]string{"LMPOP", "2", "a", "b", "LEFT"}, []string{"a", "b"}},
+		{[]string{"BZMPOP", "0", "1", "a", "MIN"}, []string{"a"}},
+		{[]string{"ZUNION", "2", "a", "b"}, []string{"a", "b"}},
+		{[]string{"BITFIELD", "a", "SET", "u8", "0", "1"}, []string{"a"}},
+		{[]string{"OBJECT", "ENCODING", "a"}, []string{"a"}},
+		{[]string{"LCS", "a", "b"}, []string{"a", "b"}},
+		{[]string{"HEXPIRE", "a", "10", "FIELDS", "1", "f"}, nil},
+	} {
+		cmd, _ := NewCommand(c.args...)
+		assert.Equal(t, c.keys, cmd.Keys(), "%v", c.args)
+	}
+}
+
+func TestFilterCommand(t *testing.T) {
+	f := &Filter{
+		Keys:         []string{"session:*"},
+		KeyRegexps:   []*regexp.Regexp{regexp.MustCompile(`^user:\d+$`)},
+		SkipKeys:     []string{"session:tmp*"},
+		SkipDBs:      []int{2},
+		SkipCommands: []string{"FLUSHALL", "publish"},
+	}
+	filter := func(db int, args ...string) string {
+		cmd, _ := NewCommand(args...)
+		if cmd = f.Command(db, cmd); cmd == nil {
+			return ""
+		}
+		return cmd.String()
+	}
+	assert.Equal(t, "SET session:1 v", filter(0, "SET", "session:1", "v"))
+	assert.Equal(t, "SET user:1 v", filter(0, "SET", "user:1", "v"))
+	assert.Equal(t, "", filter(0, "SET", "user:x", "v"))
+	assert.Equal(t, "", filter(0, "SET", "session:tmp1", "v"))
+	assert.Equal(t, "", filter(2, "SET", "session:1", "v"))
+	assert.Equal(t, "", filter(0, "SELECT", "2"))
+	assert.Equal(t, "SELECT 1", filter(0, "SELECT", "1"))
+	assert.Equal(t, "", filter(0, "flushall"))
+	assert.Equal(t, "", filter(0, "PUBLISH", "ch", "msg"))
+	assert.Equal(t, "FLUSHDB", filter(0, "FLUSHDB"))
+	assert.Equal(t, "MSET session:1 a session:2 c", filter(0, "MSET", "session:1", "a", "other", "b", "session:2", "c"))
+	assert.Equal(t, "DEL user:2", filter(0, "DEL", "other", "user:2"))
+	assert.Equal(t, "RENAME session:1 session:2", filter(0, "RENAME", "session:1", "session:2"))
+	assert.Equal(t, "DEL session:1", filter(0, "RENAME", "session:1", "other"))
+	assert.Equal(t, "", filter(0, "RENAME", "other", "session:1"))
+	assert.Equal(t, "", filter(0, "SUNIONSTORE", "session:1", "other"))
+	assert.Equal(t, "", filter(0, "GEOSEARCHSTORE", "other", "session:1", "FROMLONLAT", "0", "0", "BYRADIUS", "1", "km"))
+	assert.Equal(t, "GEOSEARCHSTORE session:2 session:1 FROMLONLAT 0 0 BYRADIUS 1 km",
+		filter(0, "GEOSEARCHSTORE", "session:2", "session:1", "FROMLONLAT", "0", "0", "BYRADIUS", "1", "km"))
+	// the keys of a command missing from the tables cannot be checked.
+	assert.Equal(t, "", filter(0, "HEXPIRE", "session:1", "10", "FIELDS", "1", "f"))
+	assert.Equal(t, "PING", filter(0, "PING"))
+	assert.Equal(t, "EVAL return 0", filter(0, "EVAL", "return", "0"))
+
+	// without a key filter, they are delivered.
+	f = &Filter{SkipDBs: []int{2}}
+	assert.Equal(t, "HEXPIRE k 10 FIELDS 1 f", filter(0, "HEXPIRE", "k", "10", "FIELDS", "1", "f"))
+}
+
+func TestFilterRDB(t *testing.T) {
+	out := &commands{}
+	c := &Canal{cmder: out, loading: true}
+	c.filter = &Filter{Keys: []string{"k*"}, DBs: []int{0}, SkipCommands: []string{"hset"}}
+
+	c.BeginDatabase(0)
+	c.Set([]byte("k1"), []byte("v"), 0)
+	c.Set([]byte("x1"), []byte("v"), 0)
+	c.BeginSet([]byte("x2"), 1, 0)
+	c.Sadd([]byte("x2"), []byte("m"))
+	c.EndSet([]byte("x2"))
+	c.BeginSet([]byte("k2"), 1, 0)
+	c.Sadd([]byte("k2"), []byte("m"))
+	c.EndSet([]byte("k2"))
+	c.BeginHash([]byte("k3"), 1, 0)
+	c.Hset([]byte("k3"), []byte("f"), []byte("v"))
+	c.EndHash([]byte("k3"))
+	c.BeginDatabase(1)
+	c.Set([]byte("k1"), []byte("v"), 0)
+
+	var got []string
+	for _, cmd := range out.cmds {
+		got = append(got, cmd.String())
+	}
+	assert.Equal(t, []string{"SELECT 0", "SET k1 v", "SADD k2 m"}, got)
+}
+
+func TestRewriteCommand(t *testing.T) {
+	r := &Rewrite{
+		DB: map[int]int{0: 3},
+		Keys: []KeyRule{
+			RegexpRule(regexp.MustCompile(`^user:`), "member:"),
+			PrefixRule("tenantA:"),
+			func(db int, key string) string {
+				if db == 1 {
+					return strings.ToUpper(key)
+				}
+				return key
+			},
+		},
+	}
+	rewrite := func(db int, args ...string) string {
+		cmd, _ := NewCommand(args...)
+		if cmd = r.Command(db, cmd); cmd == nil {
+			return ""
+		}
+		return cmd.String()
+	}
+	assert.Equal(t, "SELECT 3", rewrite(0, "SELECT", "0"))
+	assert.Equal(t, "SELECT 1", rewrite(0, "SELECT", "1"))
+	assert.Equal(t, "SET tenantA:member:1 user:2", rewrite(0, "SET", "user:1", "user:2"))
+	assert.Equal(t, "MSET tenantA:a 1 tenantA:b 2", rewrite(0, "MSET", "a", "1", "b", "2"))
+	assert.Equal(t, "RENAME TENANTA:A TENANTA:B", rewrite(1, "RENAME", "a", "b"))
+	assert.Equal(t, "MOVE tenantA:a 3", rewrite(0, "MOVE", "a", "0"))
+	assert.Equal(t, "PUBLISH ch msg", rewrite(0, "PUBLISH", "ch", "msg"))
+	assert.Equal(t, "GEOSEARCHSTORE tenantA:d tenantA:s FROMMEMBER m BYRADIUS 1 km",
+		rewrite(0, "GEOSEARCHSTORE", "d", "s", "FROMMEMBER", "m", "BYRADIUS", "1", "km"))
+	assert.Equal(t, "LMPOP 2 tenantA:a tenantA:b LEFT", rewrite(0, "LMPOP", "2", "a", "b", "LEFT"))
+	// the keys of a command missing from the tables cannot be renamed.
+	assert.Equal(t, "", rewrite(0, "HEXPIRE", "a", "10", "FIELDS", "1", "f"))
+
+	// without key rules, it only has its database mapped.
+	r = &Rewrite{DB: map[int]int{0: 3}}
+	assert.Equal(t, "HEXPIRE a 10 FIELDS 1 f", rewrite(0, "HEXPIRE", "a", "10", "FIELDS", "1", "f"))
+}
+
+func TestRewriteRDB(t *testing.T) {
+	out := &commands{}
+	c := &Canal{cmder: out, loading: true}
+	c.rewrite = &Rewrite{DB: map[int]int{0: 3}, Keys: []KeyRule{PrefixRule("p:")}}
+	c.batch = newBatcher(10, 0, c.Command)
+
+	c.BeginDatabase(0)
+	c.Set([]byte("k"), []byte("v"), 0)
+	c.BeginList([]byte("l"), 2, 0)
+	c.Rpush([]byte("l"), []byte("a"))
+	c.Rpush([]byte("l"), []byte("b"))
+	c.EndList([]byte("l"))
+
+	var got []string
+	for _, cmd := range out.cmds {
+		got = append(got, cmd.String())
+	}
+	assert.Equal(t, []string{"SELECT 3", "SET p:k v", "RPUSH p:l a b"}, got)
+}
+
+// fakeMaster accepts one replica, replies OK to its handshake and a full sync of rdb to PSYNC.
+func fakeMaster(t *testing.T, rdb []byte) (addr string, received chan []string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	received = make(chan []string, 100)
+	go func() {
+		defer ln.Close()
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		defer close(received)
+		rd := NewReader(conn)
+		for {
+			v, _, _, err := rd.ReadMultiBulk()
+			if err != nil {
+				return
+			}
+			var args []string
+			for _, a := range v.Array() {
+				args = append(args, a.String())
+			}
+			received <- args
+			if strings.EqualFold(args[0], "psync") {
+				fmt.Fprintf(conn, "+FULLRESYNC 0123456789abcdef 100\r\n$%d\r\n", len(rdb))
+				conn.Write(rdb)
+				return
+			}
+			conn.Write([]byte("+OK\r\n"))
+		}
+	}()
+	return ln.Addr().String(), received
+}
+
+func TestCanalSync(t *testing.T) {
+	var rdb bytes.Buffer
+	enc, err := NewEncoder(&rdb, rdbVersion)
+	assert.Nil(t, err)
+	enc.BeginRDB()
+	enc.Aux([]byte("repl-id"), []byte("0123456789abcdef"))
+	enc.Aux([]byte("repl-offset"), []byte("100"))
+	enc.BeginDatabase(0)
+	enc.Set([]byte("k"), []byte("v"), 0)
+	enc.EndDatabase(0)
+	enc.EndRDB()
+	assert.Nil(t, enc.Err())
+
+	addr, received := fakeMaster(t, rdb.Bytes())
+	cfg := NewConfig(addr)
+	cfg.Password = "secret"
+	cfg.Position = &Position{RunID: "0123456789abcdef", Offset: 41}
+	c, err := NewCanal(cfg)
+	assert.Nil(t, err)
+	out := &commands{}
+	assert.Nil(t, c.Sync(out))
+	c.Close()
+
+	var got []string
+	for _, cmd := range out.cmds {
+		got = append(got, cmd.String())
+	}
+	assert.Equal(t, []string{"SELECT 0", "SET k v"}, got)
+	assert.Equal(t, "0123456789abcdef", c.RunID())
+	assert.Equal(t, "100", c.Offset())
+
+	var sent [][]string
+	for args := range received {
+		sent = append(sent, args)
+	}
+	assert.Equal(t, []string{"AUTH", "secret"}, sent[0])
+	assert.Equal(t, []string{"psync", "0123456789abcdef", "42"}, sent[len(sent)-1])
+
+	addr, _ = fakeMaster(t, rdb.Bytes())
+	c, err = NewCanal(NewConfig(addr))
+	assert.Nil(t, err)
+	r := &recorder{}
+	assert.Nil(t, c.Snapshot(r))
+	c.Close()
+	assert.Equal(t, []string{"aux repl-id 0123456789abcdef", "aux repl-offset 100", "select 0", `set "k" "v" 0`, "end"}, r.events)
+}
+
+func TestCanalSyncStream(t *testing.T) {
+	var rdb bytes.Buffer
+	enc, err := NewEncoder(&rdb, rdbVersion)
+	assert.Nil(t, err)
+	enc.BeginRDB()
+	enc.BeginDatabase(0)
+	enc.BeginStream([]byte("s"), 1, 0)
+	enc.XaddEntry([]byte("s"), []byte("1-1"), []FieldValue{{"f", "a b c"}, {"g", "h"}})
+	enc.EndStream([]byte("s"))
+	enc.EndDatabase(0)
+	enc.EndRDB()
+	assert.Nil(t, enc.Err())
+
+	addr, _ := fakeMaster(t, rdb.Bytes())
+	c, err := NewCanal(NewConfig(addr))
+	assert.Nil(t, err)
+	out := &commands{}
+	assert.Nil(t, c.Sync(out))
+	c.Close()
+	assert.Equal(t, []string{"XADD", "s", "1-1", "f", "a b c", "g", "h"}, out.cmds[len(out.cmds)-1].D)
+
+	// joined by spaces, the fields and values of an entry cannot be told apart.
+	c, err = newCanal(NewConfig(""))
+	assert.Nil(t, err)
+	c.cmder = out
+	c.Xadd([]byte("s"), []byte("1-2"), []byte("f v"))
+	assert.Equal(t, []string{"XADD", "s", "1-2", "f", "v"}, out.cmds[len(out.cmds)-1].D)
+	assert.Nil(t, c.rdbErr())
+	c.Xadd([]byte("s"), []byte("1-3"), []byte("f a b c"))
+	assert.NotNil(t, c.rdbErr())
+}
+
+// failedRestores fails the RESTORE commands it receives.
+type failedRestores struct {
+	restores int
+}
+
+func (f *failedRestores) Command(cmd *Command) error {
+	if cmd.CommandName() != "RESTORE" {
+		return nil
+	}
+	f.restores++
+	return errors.New("restore failed")
+}
+
+func TestCanalSyncRestoreError(t *testing.T) {
+	var rdb bytes.Buffer
+	enc, err := NewEncoder(&rdb, rdbVersion)
+	assert.Nil(t, err)
+	enc.BeginRDB()
+	enc.BeginDatabase(0)
+	enc.Set([]byte("a"), []byte("1"), 0)
+	enc.Set([]byte("b"), []byte("2"), 0)
+	enc.EndDatabase(0)
+	enc.EndRDB()
+	assert.Nil(t, enc.Err())
+
+	for _, run := range []func(c *Canal, out CommandDecoder) error{
+		func(c *Canal, out CommandDecoder) error { return c.Sync(out) },
+		func(c *Canal, out CommandDecoder) error { return c.Run(out) },
+	} {
+		addr, _ := fakeMaster(t, rdb.Bytes())
+		cfg := NewConfig(addr)
+		cfg.Restore = true
+		c, err := NewCanal(cfg)
+		assert.Nil(t, err)
+		out := &failedRestores{}
+		err = run(c, out)
+		c.Close()
+		assert.EqualError(t, err, "restore failed")
+		assert.Equal(t, 1, out.restores)
+	}
+}
+
+func TestPositionSave(t *testing.T) {
+	path := t.TempDir() + "/checkpoint.json"
+	pos, err := LoadPosition(path)
+	assert.Nil(t, err)
+	assert.Nil(t, pos)
+	assert.Nil(t, (&Position{RunID: "abc", Offset: 12}).Save(path))
+	pos, err = LoadPosition(path)
+	assert.Nil(t, err)
+	assert.Equal(t, &Position{RunID: "abc", Offset: 12}, pos)
+}
+
+func TestJSONWriter(t *testing.T) {
+	var buf bytes.Buffer
+	j := NewJSONWriter(&buf, EscapedEncoding)
+	j.BeginRDB()
+	j.Aux([]byte("repl-id"), []byte("abc"))
+	j.BeginDatabase(1)
+	j.Set([]byte("k"), []byte("v\xff\\"), 1893456000000)
+	j.BeginZSet([]byte("z"), 2, 0)
+	j.Zadd([]byte("z"), 1.5, []byte("m"))
+	j.Zadd([]byte("z"), math.Inf(1), []byte("n"))
+	j.EndZSet([]byte("z"))
+	j.BeginStream([]byte("st"), 1, 0)
+	j.XaddEntry([]byte("st"), []byte("1-1"), []FieldValue{{"f", "a b"}, {"g", "h"}})
+	j.Xadd([]byte("st"), []byte("1-2"), []byte("f v"))
+	j.EndStream([]byte("st"))
+	j.EndDatabase(1)
+	j.EndRDB()
+	cmd, _ := NewCommand("MSET", "a", "1", "b", "2")
+	cmd.Offset = 42
+	assert.Nil(t, j.Command(cmd))
+	assert.Nil(t, j.Flush())
+
+	var events []Event
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var e Event
+		assert.Nil(t, json.Unmarshal([]byte(line), &e))
+		assert.True(t, e.Time > 0)
+		assert.Equal(t, "abc", e.RunID)
+		e.Time, e.RunID = 0, ""
+		events = append(events, e)
+	}
+	assert.Equal(t, []Event{
+		{Op: "select", DB: 1, Args: []interface{}{"1"}, Offset: -1, Source: SourceRDB},
+		{Op: "set", DB: 1, Keys: []string{"k"}, Args: []interface{}{`v\xff\\`}, Expiry: 1893456000000, Offset: -1, Source: SourceRDB},
+		{Op: "zadd", DB: 1, Keys: []string{"z"}, Args: []interface{}{1.5, "m"}, Offset: -1, Source: SourceRDB},
+		{Op: "zadd", DB: 1, Keys: []string{"z"}, Args: []interface{}{"+Inf", "n"}, Offset: -1, Source: SourceRDB},
+		{Op: "xadd", DB: 1, Keys: []string{"st"}, Args: []interface{}{"1-1", "f", "a b", "g", "h"}, Offset: -1, Source: SourceRDB},
+		{Op: "xadd", DB: 1, Keys: []string{"st"}, Args: []interface{}{"1-2", "f", "v"}, Offset: -1, Source: SourceRDB},
+		{Op: "mset", DB: 1, Keys: []string{"a", "b"}, Args: []interface{}{"a", "1", "b", "2"}, Offset: 42, Source: SourceStream},
+	}, events)
+
+	// the commands of an AOF have no offset.
+	buf.Reset()
+	j = NewJSONWriter(&buf, EscapedEncoding)
+	j.Source = SourceAOF
+	cmd, _ = NewCommand("SET", "a", "1")
+	cmd.Offset = -1
+	assert.Nil(t, j.Command(cmd))
+	assert.Nil(t, j.Flush())
+	var e Event
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &e))
+	assert.Equal(t, SourceAOF, e.Source)
+
+	// joined by spaces, the fields and values of an entry cannot be told apart.
+	j = NewJSONWriter(&bytes.Buffer{}, EscapedEncoding)
+	j.Xadd([]byte("st"), []byte("1-1"), []byte("f a b c"))
+	assert.NotNil(t, j.Err())
+
+	for _, enc := range []BinaryEncoding{EscapedEncoding, Base64Encoding} {
+		raw := []byte("a\\x\xff\x00é")
+		b, err := DecodeBinary(NewJSONWriter(nil, enc).Binary(raw), enc)
+		assert.Nil(t, err)
+		assert.Equal(t, raw, b)
+	}
+}
+
+func TestConvertRDBToAOF(t *testing.T) {
+	var rdb bytes.Buffer
+	enc, err := NewEncoder(&rdb, rdbVersion)
+	assert.Nil(t, err)
+	enc.BeginRDB()
+	enc.BeginDatabase(0)
+	enc.Set([]byte("s"), []byte("a b"), 1893456000000)
+	enc.BeginList([]byte("l"), 3, 0)
+	for _, v := range []string{"x", "y", "z"} {
+		enc.Rpush([]byte("l"), []byte(v))
+	}
+	enc.EndList([]byte("l"))
+	enc.EndDatabase(0)
+	enc.BeginDatabase(1)
+	enc.BeginZSet([]byte("z"), 1, 1893456000000)
+	enc.Zadd([]byte("z"), 2.5, []byte("m"))
+	enc.EndZSet([]byte("z"))
+	enc.EndDatabase(1)
+	enc.EndRDB()
+	assert.Nil(t, enc.Err())
+
+	for batch, want := range map[int][]string{
+		0: {"SELECT 0", "SET s a b", "PEXPIREAT s 1893456000000", "RPUSH l x y z",
+			"SELECT 1", "ZADD z 2.5 m", "PEXPIREAT z 1893456000000"},
+		2: {"SELECT 0", "SET s a b", "PEXPIREAT s 1893456000000", "RPUSH l x y", "RPUSH l z",
+			"SELECT 1", "ZADD z 2.5 m", "PEXPIREAT z 1893456000000"},
+	} {
+		var aof bytes.Buffer
+		assert.Nil(t, ConvertRDBToAOF(bytes.NewReader(rdb.Bytes()), &aof, batch))
+		rd := NewReader(&aof)
+		var got []string
+		for {
+			v, _, _, err := rd.ReadMultiBulk()
+			if err == io.EOF {
+				break
+			}
+			assert.Nil(t, err)
+			cmd, _ := newValueCommand(v)
+			got = append(got, cmd.String())
+		}
+		assert.Equal(t, want, got, "batch %d", batch)
+	}
+}
+
+func TestConvertRDBToAOFStream(t *testing.T) {
+	var rdb bytes.Buffer
+	enc, err := NewEncoder(&rdb, rdbVersion)
+	assert.Nil(t, err)
+	enc.BeginRDB()
+	enc.BeginDatabase(0)
+	enc.BeginStream([]byte("s"), 1, 0)
+	enc.XaddEntry([]byte("s"), []byte("1-1"), []FieldValue{{"f", "a b c"}, {"g", "h"}})
+	enc.EndStream([]byte("s"))
+	enc.EndDatabase(0)
+	enc.EndRDB()
+	assert.Nil(t, enc.Err())
+
+	var aof bytes.Buffer
+	assert.Nil(t, ConvertRDBToAOF(bytes.NewReader(rdb.Bytes()), &aof, 0))
+	rd := NewReader(&aof)
+	var got [][]string
+	for {
+		v, _, _, err := rd.ReadMultiBulk()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		cmd, _ := newValueCommand(v)
+		got = append(got, cmd.D)
+	}
+	assert.Equal(t, [][]string{{"SELECT", "0"}, {"XADD", "s", "1-1", "f", "a b c", "g", "h"}}, got)
+
+	// joined by spaces, the fields and values of an entry cannot be told apart.
+	a := NewAOFWriter(&bytes.Buffer{}, 0)
+	a.Xadd([]byte("s"), []byte("1-1"), []byte("f a b c"))
+	assert.NotNil(t, a.Err())
+}
+
+func TestReadAOFManifest(t *testing.T) {
+	manifest := "file appendonly.aof.1.base.rdb seq 1 type b\n" +
+		"file appendonly.aof.1.incr.aof seq 1 type h\n" +
+		"file \"append only.aof.2.incr.aof\" seq 2 type i\n"
+	files, err := ReadAOFManifest(strings.NewReader(manifest))
+	assert.Nil(t, err)
+	assert.Equal(t, []AOFFile{
+		{Name: "appendonly.aof.1.base.rdb", Seq: 1, Type: AOFBase},
+		{Name: "appendonly.aof.1.incr.aof", Seq: 1, Type: AOFHistory},
+		{Name: "append only.aof.2.incr.aof", Seq: 2, Type: AOFIncr},
+	}, files)
+	_, err = ReadAOFManifest(strings.NewReader("file x seq 1\n"))
+	assert.NotNil(t, err)
+}
+
+func TestDecodeAOF(t *testing.T) {
+	var rdb bytes.Buffer
+	enc, err := NewEncoder(&rdb, rdbVersion)
+	assert.Nil(t, err)
+	enc.BeginRDB()
+	enc.BeginDatabase(0)
+	enc.Set([]byte("base"), []byte("1"), 0)
+	enc.Set([]byte("skip"), []byte("1"), 0)
+	enc.EndDatabase(0)
+	enc.EndRDB()
+	assert.Nil(t, enc.Err())
+	resp := func(args ...string) string {
+		b, _ := MultiBulkBytes(MultiBulkValue(args[0], stringArgs(args[1:])...))
+		return string(b)
+	}
+	incr := "#TS:1628217470\r\n" + resp("SELECT", "0") + resp("SET", "k", "a b") + resp("SET", "skip", "2")
+
+	// a single file with an RDB preamble.
+	r := &recorder{}
+	out := &commands{}
+	assert.Nil(t, DecodeAOF(io.MultiReader(bytes.NewReader(rdb.Bytes()), strings.NewReader(incr)), r, out))
+	assert.Equal(t, []string{"select 0", `set "base" "1" 0`, `set "skip" "1" 0`, "end"}, r.events)
+	assert.Equal(t, 3, len(out.cmds))
+	assert.Equal(t, []string{"SET", "k", "a b"}, out.cmds[1].D)
+
+	// a multi-part AOF through canal.
+	dir := t.TempDir()
+	assert.Nil(t, ioutil.WriteFile(dir+"/appendonly.aof.1.base.rdb", rdb.Bytes(), 0644))
+	assert.Nil(t, ioutil.WriteFile(dir+"/appendonly.aof.1.incr.aof", []byte(resp("SET", "old", "1")), 0644))
+	assert.Nil(t, ioutil.WriteFile(dir+"/appendonly.aof.2.incr.aof", []byte(incr), 0644))
+	assert.Nil(t, ioutil.WriteFile(dir+"/appendonly.aof.manifest", []byte(
+		"file appendonly.aof.1.base.rdb seq 1 type b\n"+
+			"file appendonly.aof.1.incr.aof seq 1 type h\n"+
+			"file appendonly.aof.2.incr.aof seq 2 type i\n"), 0644))
+	cfg := NewConfig("")
+	cfg.Filter = &Filter{SkipKeys: []string{"skip"}}
+	out = &commands{}
+	assert.Nil(t, ReplayAOF(cfg, dir, out))
+	var got []string
+	for _, cmd := range out.cmds {
+		assert.Equal(t, int64(-1), cmd.Offset)
+		got = append(got, cmd.String())
+	}
+	assert.Equal(t, []string{"SELECT 0", "SET base 1", "SELECT 0", "SET k a b"}, got)
+}
+
+func stringArgs(args []string) []interface{} {
+	res := make([]interface{}, len(args))
+	for i, arg := range args {
+		res[i] = arg
+	}
+	return res
+}
+
+func TestAnalyzer(t *testing.T) {
+	var rdb bytes.Buffer
+	enc, err := NewEncoder(&rdb, rdbVersion)
+	assert.Nil(t, err)
+	enc.BeginRDB()
+	enc.BeginDatabase(0)
+	enc.Set([]byte("user:1"), []byte("hello"), 1893456000000)
+	enc.Set([]byte("counter"), []byte("42"), 0)
+	enc.BeginSet([]byte("ids"), 3, 0)
+	for _, m := range []string{"1", "2", "70000"} {
+		enc.Sadd([]byte("ids"), []byte(m))
+	}
+	enc.EndSet([]byte("ids"))
+	enc.EndDatabase(0)
+	enc.BeginDatabase(2)
+	enc.BeginHash([]byte("user:2"), 2, 0)
+	enc.Hset([]byte("user:2"), []byte("name"), []byte("bob"))
+	enc.Hset([]byte("user:2"), []byte("bio"), bytes.Repeat([]byte("x"), 1000))
+	enc.EndHash([]byte("user:2"))
+	enc.EndDatabase(2)
+	enc.EndRDB()
+	assert.Nil(t, enc.Err())
+
+	a := NewAnalyzer(2)
+	var keys []*KeyMemory
+	a.OnKey = func(k *KeyMemory) { keys = append(keys, k) }
+	assert.Nil(t, DecodeFile(bytes.NewReader(rdb.Bytes()), a))
+
+	assert.Equal(t, 4, len(keys))
+	assert.Equal(t, &KeyMemory{DB: 0, Key: "user:1", Type: "string", Encoding: "embstr",
+		Bytes: 88, Elements: 1, LargestElement: 5, Expiry: 1893456000000, Serialized: 6}, keys[0])
+	assert.Equal(t, &KeyMemory{DB: 0, Key: "counter", Type: "string", Encoding: "int",
+		Bytes: 56, Elements: 1, LargestElement: 2, Serialized: 2}, keys[1])
+	assert.Equal(t, "intset", keys[2].Encoding)
+	assert.Equal(t, int64(80), keys[2].Bytes)
+	assert.Equal(t, "hash", keys[3].Type)
+	assert.Equal(t, 2, keys[3].DB)
+	assert.Equal(t, int64(1000), keys[3].LargestElement)
+	assert.True(t, keys[3].Bytes > 1000)
+
+	r := a.Report()
+	assert.Equal(t, []*KeyMemory{keys[3], keys[0]}, r.Largest)
+	assert.Equal(t, int64(4), r.Total.Keys)
+	assert.Equal(t, int64(1), r.Total.Expires)
+	assert.Equal(t, int64(3), r.DBs[0].Keys)
+	assert.Equal(t, int64(2), r.Types["string"].Keys)
+	assert.Equal(t, int64(2), r.Prefixes["user"].Keys)
+	assert.Equal(t, int64(2), r.Prefixes[""].Keys)
+	assert.Equal(t, keys[3].Bytes+keys[0].Bytes, r.Prefixes["user"].Bytes)
+
+	assert.Equal(t, int64(8), mallocSize(3))
+	assert.Equal(t, int64(48), mallocSize(33))
+	assert.Equal(t, int64(160), mallocSize(129))
+	assert.Equal(t, int64(1280), mallocSize(1025))
+}
+
+type valueInfos struct {
+	Nop
+	types map[string]ValueType
+	infos map[string]ValueInfo
+}
+
+func (v *valueInfos) Encoding(key []byte, typ ValueType) {
+	v.types[string(key)] = typ
+}
+
+func (v *valueInfos) ValueInfo(key []byte, info ValueInfo) {
+	v.infos[string(key)] = info
+}
+
+func TestValueInfo(t *testing.T) {
+	var rdb bytes.Buffer
+	enc, err := NewEncoder(&rdb, rdbVersion)
+	assert.Nil(t, err)
+	enc.BeginRDB()
+	enc.BeginDatabase(0)
+	enc.Set([]byte("s"), []byte("hello"), 0)
+	enc.BeginSet([]byte("ids"), 3, 0)
+	for _, m := range []string{"1", "2", "3"} {
+		enc.Sadd([]byte("ids"), []byte(m))
+	}
+	enc.EndSet([]byte("ids"))
+	enc.BeginHash([]byte("h"), 2, 0)
+	enc.Hset([]byte("h"), []byte("a"), []byte("1"))
+	enc.Hset([]byte("h"), []byte("b"), []byte("2"))
+	enc.EndHash([]byte("h"))
+	enc.BeginList([]byte("l"), 2, 0)
+	enc.Rpush([]byte("l"), []byte("x"))
+	enc.Rpush([]byte("l"), []byte("y"))
+	enc.EndList([]byte("l"))
+	enc.EndDatabase(0)
+	enc.EndRDB()
+	assert.Nil(t, enc.Err())
+
+	v := &valueInfos{types: make(map[string]ValueType), infos: make(map[string]ValueInfo)}
+	assert.Nil(t, DecodeFile(bytes.NewReader(rdb.Bytes()), v))
+	assert.Equal(t, ValueInfo{Length: 6, Elements: 1}, v.infos["s"])
+	// an intset of 3 int16 and its 8 bytes header, with the length of the string.
+	assert.Equal(t, ValueInfo{Length: 15, Elements: 3}, v.infos["ids"])
+	assert.Equal(t, int64(4), v.infos["h"].Elements)
+	assert.Equal(t, int64(1), v.infos["l"].Elements)
+	assert.Equal(t, map[string]ValueType{"s": TypeString, "ids": TypeSetIntset, "h": TypeHashZiplist, "l": TypeListQuicklist}, v.types)
+
+	// the wrappers only ask for the ValueInfo the decoder wants.
+	f := &Filter{}
+	_, ok := f.Decoder(&recorder{}).(ValueInfoDecoder)
+	assert.False(t, ok)
+	_, ok = newSnapshotDecoder(f.Decoder(&recorder{}), &Canal{}).(ValueInfoDecoder)
+	assert.False(t, ok)
+	v = &valueInfos{types: make(map[string]ValueType), infos: make(map[string]ValueInfo)}
+	d := newSnapshotDecoder(f.Decoder(v), &Canal{})
+	assert.Nil(t, DecodeFile(bytes.NewReader(rdb.Bytes()), d))
+	assert.Equal(t, ValueInfo{Length: 15, Elements: 3}, v.infos["ids"])
+}
+
+func TestDiffRDB(t *testing.T) {
+	write := func(fn func(enc *Encoder)) []byte {
+		var rdb bytes.Buffer
+		enc, err := NewEncoder(&rdb, rdbVersion)
+		assert.Nil(t, err)
+		enc.BeginRDB()
+		fn(enc)
+		enc.EndRDB()
+		assert.Nil(t, enc.Err())
+		return rdb.Bytes()
+	}
+	set := func(enc *Encoder, key string, members ...string) {
+		enc.BeginSet([]byte(key), int64(len(members)), 0)
+		for _, m := range members {
+			enc.Sadd([]byte(key), []byte(m))
+		}
+		enc.EndSet([]byte(key))
+	}
+	source := write(func(enc *Encoder) {
+		enc.BeginDatabase(0)
+		enc.Set([]byte("same"), []byte("v"), 1000)
+		enc.Set([]byte("changed"), []byte("a"), 0)
+		enc.Set([]byte("missing"), []byte("v"), 0)
+		set(enc, "set", "a", "b", "c")
+		enc.Set([]byte("typed"), []byte("v"), 0)
+		enc.Set([]byte("ttl"), []byte("v"), 1000)
+		enc.EndDatabase(0)
+		enc.BeginDatabase(1)
+		enc.Set([]byte("same"), []byte("v"), 0)
+		enc.EndDatabase(1)
+	})
+	target := write(func(enc *Encoder) {
+		enc.BeginDatabase(0)
+		enc.Set([]byte("ttl"), []byte("v"), 5000)
+		set(enc, "typed", "v")
+		set(enc, "set", "c", "a", "b")
+		enc.Set([]byte("changed"), []byte("b"), 0)
+		enc.Set([]byte("same"), []byte("v"), 1500)
+		enc.Set([]byte("extra"), []byte("v"), 0)
+		enc.EndDatabase(0)
+		enc.BeginDatabase(1)
+		enc.Set([]byte("same"), []byte("v"), 0)
+		enc.EndDatabase(1)
+	})
+
+	for _, maxKeys := range []int{0, 2} {
+		var diffs []string
+		summary, err := DiffRDB(bytes.NewReader(source), bytes.NewReader(target),
+			&DiffOptions{ExpiryTolerance: time.Second, MaxKeys: maxKeys, TempDir: t.TempDir()},
+			func(d *KeyDiff) error {
+				diffs = append(diffs, fmt.Sprintf("%d %s %s", d.DB, d.Key, d.Kind))
+				return nil
+			})
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"0 changed value", "0 extra extra", "0 missing missing",
+			"0 ttl expiry", "0 typed type"}, diffs, "max keys %d", maxKeys)
+		assert.Equal(t, &DiffSummary{SourceKeys: 7, TargetKeys: 7, Equal: 3, Missing: 1, Extra: 1,
+			Type: 1, Value: 1, Expiry: 1}, summary)
+	}
+}
+
+// liveMaster is fakeMaster sending the commands after the full sync,
+// it keeps the connection open until the client closes it.
+func liveMaster(t *testing.T, rdb []byte, cmds ...[]string) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go func() {
+		defer ln.Close()
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		rd := NewReader(conn)
+		for {
+			v, _, _, err := rd.ReadMultiBulk()
+			if err != nil {
+				return
+			}
+			if !strings.EqualFold(v.Array()[0].String(), "psync") {
+				conn.Write([]byte("+OK\r\n"))
+				continue
+			}
+			fmt.Fprintf(conn, "+FULLRESYNC 0123456789abcdef 100\r\n$%d\r\n", len(rdb))
+			conn.Write(rdb)
+			// the stream starts with a PING, as the one of redis.
+			wr := NewWriter(conn)
+			wr.WriteMultiBulk("PING")
+			for _, cmd := range cmds {
+				args := make([]interface{}, len(cmd)-1)
+				for i, a := range cmd[1:] {
+					args[i] = a
+				}
+				wr.WriteMultiBulk(cmd[0], args...)
+			}
+			wr.Flush()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// dumpTarget is a redis answering the commands Verify sends with the keys of dumps.
+func dumpTarget(t *testing.T, dumps []*Dump) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	keys := make(map[int]map[string]*Dump)
+	for _, d := range dumps {
+		if keys[d.DB] == nil {
+			keys[d.DB] = make(map[string]*Dump)
+		}
+		keys[d.DB][string(d.Key)] = d
+	}
+	go func() {
+		defer ln.Close()
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		rd, wr := NewReader(conn), NewWriter(conn)
+		db := 0
+		for {
+			v, _, _, err := rd.ReadMultiBulk()
+			if err != nil {
+				return
+			}
+			args := v.Array()
+			switch strings.ToUpper(args[0].String()) {
+			case "INFO":
+				// leave time for the commands following the full sync to arrive.
+				time.Sleep(50 * time.Millisecond)
+				var info strings.Builder
+				info.WriteString("# Keyspace\r\n")
+				for n := range keys {
+					fmt.Fprintf(&info, "db%d:keys=%d,expires=0,avg_ttl=0\r\n", n, len(keys[n]))
+				}
+				wr.WriteString(info.String())
+			case "SELECT":
+				db, _ = strconv.Atoi(args[1].String())
+				wr.WriteSimpleString("OK")
+			case "SCAN":
+				var names []Value
+				for k := range keys[db] {
+					names = append(names, StringValue(k))
+				}
+				wr.WriteArray([]Value{StringValue("0"), ArrayValue(names)})
+			case "DUMP":
+				if d, ok := keys[db][args[1].String()]; ok {
+					wr.WriteBytes(d.Payload)
+				} else {
+					wr.WriteNull()
+				}
+			case "PTTL":
+				wr.WriteInteger(-1)
+			}
+			wr.Flush()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestVerify(t *testing.T) {
+	source := func(d Decoder) {
+		d.BeginRDB()
+		d.BeginDatabase(0)
+		d.Set([]byte("a"), []byte("1"), 0)
+		d.Set([]byte("b"), []byte("2"), 0)
+		d.BeginSet([]byte("c"), 2, 0)
+		d.Sadd([]byte("c"), []byte("x"))
+		d.Sadd([]byte("c"), []byte("y"))
+		d.EndSet([]byte("c"))
+		d.Set([]byte("d"), []byte("4"), 0)
+		d.EndDatabase(0)
+		d.EndRDB()
+	}
+	var rdb bytes.Buffer
+	enc, err := NewEncoder(&rdb, rdbVersion)
+	assert.Nil(t, err)
+	source(enc)
+	assert.Nil(t, enc.Err())
+
+	var dumps []*Dump
+	dumper, err := NewDumper(rdbVersion, func(d *Dump) error {
+		dumps = append(dumps, d)
+		return nil
+	})
+	assert.Nil(t, err)
+	dumper.BeginRDB()
+	dumper.BeginDatabase(3)
+	dumper.Set([]byte("a"), []byte("1"), 0)
+	dumper.Set([]byte("b"), []byte("3"), 0)
+	dumper.BeginSet([]byte("c"), 2, 0)
+	dumper.Sadd([]byte("c"), []byte("y"))
+	dumper.Sadd([]byte("c"), []byte("x"))
+	dumper.EndSet([]byte("c"))
+	dumper.Set([]byte("e"), []byte("5"), 0)
+	dumper.EndDatabase(3)
+	dumper.EndRDB()
+	assert.Nil(t, dumper.Err())
+
+	cfg := &VerifyConfig{
+		Source: NewConfig(liveMaster(t, rdb.Bytes(), []string{"SELECT", "0"}, []string{"SET", "b", "3"})),
+		Target: NewTargetConfig(dumpTarget(t, dumps)),
+	}
+	cfg.Target.DB = map[int]int{0: 3}
+	var diffs []string
+	summary, err := Verify(cfg, func(d *KeyDiff) error {
+		diffs = append(diffs, fmt.Sprintf("%d %s %s", d.DB, d.Key, d.Kind))
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"3 d missing", "3 e extra"}, diffs)
+	assert.Equal(t, &DiffSummary{SourceKeys: 4, TargetKeys: 4, Equal: 2, Missing: 1, Extra: 1, Changed: 1}, summary)
+}
+
+func TestChangeDecoder(t *testing.T) {
+	var changes []Change
+	d := NewChangeDecoder(func(c Change) error {
+		changes = append(changes, c)
+		return nil
+	})
+	d.now = func() int64 { return 1000 }
+
+	d.BeginDatabase(2)
+	d.Set([]byte("s"), []byte("v"), 5000)
+	d.BeginHash([]byte("h"), 1, 9000)
+	d.Hset([]byte("h"), []byte("f"), []byte("1"))
+	d.EndHash([]byte("h"))
+	d.BeginStream([]byte("st"), 1, 0)
+	d.XaddEntry([]byte("st"), []byte("1-1"), []FieldValue{{"f", "a b"}, {"g", "h"}})
+	d.Xadd([]byte("st"), []byte("1-2"), []byte("f v"))
+	d.EndStream([]byte("st"))
+	d.EndDatabase(2)
+	rdb := ChangeHeader{DB: 2, Offset: -1}
+	assert.Equal(t, []Change{
+		&StringSet{ChangeHeader: rdb, Key: "s", Value: "v", ExpireAt: 5000},
+		&HashFieldsSet{ChangeHeader: rdb, Key: "h", Fields: []FieldValue{{"f", "1"}}},
+		&ExpireSet{ChangeHeader: rdb, Key: "h", ExpireAt: 9000},
+		&StreamAdd{ChangeHeader: rdb, Key: "st", ID: "1-1", Fields: []FieldValue{{"f", "a b"}, {"g", "h"}}},
+		&StreamAdd{ChangeHeader: rdb, Key: "st", ID: "1-2", Fields: []FieldValue{{"f", "v"}}},
+	}, changes)
+	assert.Nil(t, d.Err())
+
+	changes = nil
+	cmds := [][]string{
+		{"SELECT", "1"},
+		{"SET", "a", "1", "PX", "500", "NX"},
+		{"setex", "b", "2", "x"},
+		{"MSET", "c", "3", "d", "4"},
+		{"HSET", "h", "f", "1", "g", "2"},
+		{"RPUSH", "l", "x", "y"},
+		{"ZADD", "z", "GT", "1.5", "m"},
+		{"ZADD", "z", "INCR", "1", "m"},
+		{"XADD", "x", "MAXLEN", "~", "100", "*", "f", "v"},
+		{"EXPIREAT", "a", "10"},
+		{"PERSIST", "a"},
+		{"DEL", "a", "b"},
+		{"SET", "a", "1", "EX"},
+		{"FLUSHALL"},
+		{"PING"},
+		{"ping"},
+	}
+	for i, args := range cmds {
+		assert.Nil(t, d.Command(&Command{D: args, Offset: int64(i)}))
+	}
+	h := func(offset int64) ChangeHeader { return ChangeHeader{DB: 1, Offset: offset} }
+	assert.Equal(t, []Change{
+		&StringSet{ChangeHeader: h(1), Key: "a", Value: "1", ExpireAt: 1500},
+		&StringSet{ChangeHeader: h(2), Key: "b", Value: "x", ExpireAt: 3000},
+		&StringSet{ChangeHeader: h(3), Key: "c", Value: "3"},
+		&StringSet{ChangeHeader: h(3), Key: "d", Value: "4"},
+		&HashFieldsSet{ChangeHeader: h(4), Key: "h", Fields: []FieldValue{{"f", "1"}, {"g", "2"}}},
+		&ListPush{ChangeHeader: h(5), Key: "l", Side: ListRight, Values: []string{"x", "y"}},
+		&ZSetAdd{ChangeHeader: h(6), Key: "z", Members: []ScoredMember{{"m", 1.5}}, Flags: []string{"GT"}},
+		&RawCommand{ChangeHeader: h(7), Command: &Command{D: cmds[7], Offset: 7}},
+		&StreamAdd{ChangeHeader: h(8), Key: "x", ID: "*", Fields: []FieldValue{{"f", "v"}}},
+		&ExpireSet{ChangeHeader: h(9), Key: "a", ExpireAt: 10000},
+		&ExpireSet{ChangeHeader: h(10), Key: "a"},
+		&KeysDeleted{ChangeHeader: h(11), Keys: []string{"a", "b"}},
+		&RawCommand{ChangeHeader: h(12), Command: &Command{D: cmds[12], Offset: 12}},
+		&DBFlushed{ChangeHeader: h(13), All: true},
+	}, changes)
+	assert.Equal(t, Ping, (&Command{D: []string{"ping"}}).Type())
+
+	// joined by spaces, the fields and values of an entry cannot be told apart.
+	d.Xadd([]byte("st"), []byte("1-3"), []byte("f a b c"))
+	assert.NotNil(t, d.Err())
+}
+
+// txCommands records the commands delivered but the PINGs, until the command STOP.
+type txCommands struct {
+	cmds []*Command
+}
+
+var errStop = errors.New("stop")
+
+func (c *txCommands) Command(cmd *Command) error {
+	switch cmd.D[0] {
+	case "STOP":
+		return errStop
+	case "PING":
+		return nil
+	}
+	c.cmds = append(c.cmds, cmd)
+	return nil
+}
+
+// continueMaster accepts one replica and continues its replication with cmds,
+// it sends the arguments of PSYNC to psync.
+func continueMaster(t *testing.T, cmds ...[]string) (addr string, psync chan []string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	psync = make(chan []string, 1)
+	go func() {
+		defer ln.Close()
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		rd := NewReader(conn)
+		for {
+			v, _, _, err := rd.ReadMultiBulk()
+			if err != nil {
+				return
+			}
+			vals := v.Array()
+			if !strings.EqualFold(vals[0].String(), "psync") {
+				conn.Write([]byte("+OK\r\n"))
+				continue
+			}
+			psync <- []string{vals[1].String(), vals[2].String()}
+			conn.Write([]byte("+CONTINUE\r\n"))
+			wr := NewWriter(conn)
+			for _, cmd := range cmds {
+				args := make([]interface{}, len(cmd)-1)
+				for i, a := range cmd[1:] {
+					args[i] = a
+				}
+				wr.WriteMultiBulk(cmd[0], args...)
+			}
+			wr.Flush()
+		}
+	}()
+	return ln.Addr().String(), psync
+}
+
+// TestCanalResume checks that a canal resumed from the position of the last command
+// it delivered asks for the byte following it, so no command is replayed or lost.
+func TestCanalResume(t *testing.T) {
+	cmds := [][]string{{"SET", "a", "1"}, {"SET", "b", "2"}, {"STOP"}}
+	addr, psync := continueMaster(t, cmds...)
+	cfg := NewConfig(addr)
+	cfg.Position = &Position{RunID: "0123456789abcdef", Offset: 41}
+	c, err := NewCanal(cfg)
+	assert.Nil(t, err)
+	var out txCommands
+	assert.Equal(t, errStop, c.Run(&out))
+	c.Close()
+	assert.Equal(t, []string{"0123456789abcdef", "42"}, <-psync)
+	// SET a 1 takes 27 bytes, the offset of a command is the one of its last byte.
+	assert.Equal(t, 2, len(out.cmds))
+	assert.Equal(t, int64(68), out.cmds[0].Offset)
+	assert.Equal(t, int64(95), out.cmds[1].Offset)
+
+	// stopped after SET a 1, the canal resumes at the first byte of SET b 2.
+	addr, psync = continueMaster(t, cmds[1:]...)
+	cfg = NewConfig(addr)
+	cfg.Position = &Position{RunID: "0123456789abcdef", Offset: out.cmds[0].Offset}
+	c, err = NewCanal(cfg)
+	assert.Nil(t, err)
+	out = txCommands{}
+	assert.Equal(t, errStop, c.Run(&out))
+	c.Close()
+	assert.Equal(t, []string{"0123456789abcdef", "69"}, <-psync)
+	assert.Equal(t, 1, len(out.cmds))
+	assert.Equal(t, "SET b 2", out.cmds[0].String())
+	assert.Equal(t, int64(95), out.cmds[0].Offset)
+}
+
+// txGroups records the transactions apart.
+type txGroups struct {
+	txCommands
+	txs []*Transaction
+}
+
+func (g *txGroups) Transaction(tx *Transaction) error {
+	g.txs = append(g.txs, tx)
+	return nil
+}
+
+func TestTransaction(t *testing.T) {
+	var rdb bytes.Buffer
+	enc, err := NewEncoder(&rdb, rdbVersion)
+	assert.Nil(t, err)
+	enc.BeginRDB()
+	enc.EndRDB()
+	assert.Nil(t, enc.Err())
+	stream := [][]string{
+		{"SELECT", "1"},
+		{"SET", "a", "1"},
+		{"MULTI"},
+		{"SET", "b", "2"},
+		{"SELECT", "2"},
+		{"INCR", "c"},
+		{"EXEC"},
+		{"MULTI"},
+		{"SET", "d", "4"},
+		{"DISCARD"},
+		{"SET", "e", "5"},
+		{"STOP"},
+	}
+	run := func(decoder CommandDecoder) {
+		c, err := NewCanal(NewConfig(liveMaster(t, rdb.Bytes(), stream...)))
+		assert.Nil(t, err)
+		defer c.Close()
+		assert.Equal(t, errStop, c.Run(decoder))
+	}
+	args := func(cmds []*Command) (args [][]string) {
+		for _, cmd := range cmds {
+			args = append(args, cmd.D)
+		}
+		return args
+	}
+
+	var cmds txCommands
+	run(&cmds)
+	assert.Equal(t, [][]string{{"SELECT", "1"}, {"SET", "a", "1"}, {"MULTI"}, {"SET", "b", "2"}, {"SELECT", "2"},
+		{"INCR", "c"}, {"EXEC"}, {"SET", "e", "5"}}, args(cmds.cmds))
+	// the commands of the transaction carry the offset before it, EXEC the one after.
+	before, exec := cmds.cmds[1].Offset, cmds.cmds[6].Offset
+	for _, cmd := range cmds.cmds[2:6] {
+		assert.Equal(t, before, cmd.Offset)
+	}
+	assert.Equal(t, before+int64(len("*1\r\n$5\r\nMULTI\r\n*3\r\n$3\r\nSET\r\n$1\r\nb\r\n$1\r\n2\r\n*2\r\n$6\r\nSELECT\r\n$1\r\n2\r\n"+
+		"*2\r\n$4\r\nINCR\r\n$1\r\nc\r\n*1\r\n$4\r\nEXEC\r\n")), exec)
+
+	var groups txGroups
+	run(&groups)
+	assert.Equal(t, [][]string{{"SELECT", "1"}, {"SET", "a", "1"}, {"SET", "e", "5"}}, args(groups.cmds))
+	assert.Equal(t, 1, len(groups.txs))
+	assert.Equal(t, 1, groups.txs[0].DB)
+	assert.Equal(t, exec, groups.txs[0].Offset)
+	assert.Equal(t, [][]string{{"SET", "b", "2"}, {"SELECT", "2"}, {"INCR", "c"}}, args(groups.txs[0].Commands))
+}
+
+func TestScripts(t *testing.T) {
+	script := "return redis.call('SET', KEYS[1], ARGV[1])"
+	sha := ScriptSHA(script)
+	c, err := newCanal(&Config{ExpandEvalSha: true})
+	assert.Nil(t, err)
+	c.offline = true
+	var cmds commands
+	c.cmder = &cmds
+	for _, args := range [][]string{
+		{"EVALSHA", sha, "1", "k", "v"},
+		{"SCRIPT", "LOAD", script},
+		{"EVALSHA", strings.ToUpper(sha), "1", "k", "v"},
+		{"SCRIPT", "FLUSH"},
+		{"EVALSHA", sha, "1", "k", "v"},
+	} {
+		assert.Nil(t, c.Command(&Command{D: args, Offset: -1}))
+	}
+	assert.Equal(t, []string{"EVALSHA", sha, "1", "k", "v"}, cmds.cmds[0].D)
+	assert.Equal(t, []string{"EVAL", script, "1", "k", "v"}, cmds.cmds[2].D)
+	assert.True(t, cmds.cmds[2].Opaque())
+	assert.False(t, cmds.cmds[1].Opaque())
+	assert.Equal(t, []string{"EVALSHA", sha, "1", "k", "v"}, cmds.cmds[4].D)
+
+	// the scripts of an RDB are lua aux fields.
+	c.Aux([]byte("lua"), []byte(script))
+	got, ok := c.Script(strings.ToUpper(sha))
+	assert.True(t, ok)
+	assert.Equal(t, script, got)
+
+	var changes []Change
+	d := NewChangeDecoder(func(c Change) error {
+		changes = append(changes, c)
+		return nil
+	})
+	assert.Nil(t, d.Command(&Command{D: []string{"EVAL", script, "1", "k", "v"}, Offset: 1}))
+	assert.Nil(t, d.Command(&Command{D: []string{"EVALSHA", sha, "2", "k"}, Offset: 2}))
+	assert.Equal(t, &ScriptRun{ChangeHeader: ChangeHeader{Offset: 1}, Script: script, SHA: sha,
+		Keys: []string{"k"}, Args: []string{"v"}}, changes[0])
+	assert.IsType(t, &RawCommand{}, changes[1])
+}
+
+// seqWorker records the commands of a dispatcher worker with the order they were processed in.
+type seqWorker struct {
+	seq  *int64
+	cmds []*Command
+	at   []int64
+}
+
+func (w *seqWorker) Command(cmd *Command) error {
+	if cmd.Type() == Set {
+		time.Sleep(time.Duration(len(cmd.D[1])) * time.Microsecond)
+	}
+	w.cmds = append(w.cmds, cmd)
+	w.at = append(w.at, atomic.AddInt64(w.seq, 1))
+	return nil
+}
+
+func TestDispatcher(t *testing.T) {
+	var seq int64
+	workers := make([]*seqWorker, 4)
+	d := NewDispatcher(&DispatcherConfig{Workers: 4, Queue: 2}, func(i int) CommandDecoder {
+		workers[i] = &seqWorker{seq: &seq}
+		return workers[i]
+	})
+	offset := int64(0)
+	send := func(args ...string) {
+		offset++
+		assert.Nil(t, d.Command(&Command{D: args, Offset: offset}))
+	}
+	send("SELECT", "2")
+	for i := 0; i < 50; i++ {
+		send("SET", fmt.Sprintf("k%d", i%10), strconv.Itoa(i))
+	}
+	send("FLUSHDB")
+	for i := 50; i < 100; i++ {
+		send("SET", fmt.Sprintf("k%d", i%10), strconv.Itoa(i))
+	}
+	send("MULTI")
+	send("SET", "k1", "100")
+	send("SET", "k2", "101")
+	send("EXEC")
+	send("PING")
+	send("ping")
+	assert.Nil(t, d.Close())
+	assert.Equal(t, offset, d.Applied())
+
+	var flushAt int64
+	values := make(map[string][]int)
+	for _, w := range workers {
+		if len(w.cmds) == 0 {
+			continue
+		}
+		// every worker first selects the database of its commands.
+		assert.Equal(t, []string{"SELECT", "2"}, w.cmds[0].D)
+		for i, cmd := range w.cmds[1:] {
+			switch cmd.Type() {
+			case FlushDB:
+				flushAt = w.at[i+1]
+			case Set:
+				if n, _ := strconv.Atoi(cmd.D[2]); n < 100 {
+					values[cmd.D[1]] = append(values[cmd.D[1]], n)
+				}
+			}
+		}
+	}
+	assert.True(t, flushAt > 0)
+	for _, w := range workers {
+		for i, cmd := range w.cmds {
+			if cmd.Type() != Set {
+				continue
+			}
+			if n, _ := strconv.Atoi(cmd.D[2]); n < 50 {
+				assert.True(t, w.at[i] < flushAt)
+			} else {
+				assert.True(t, w.at[i] > flushAt)
+			}
+		}
+	}
+	// PING is not dispatched.
+	for _, w := range workers {
+		for _, cmd := range w.cmds {
+			assert.NotEqual(t, Ping, cmd.Type())
+		}
+	}
+	// the transaction runs on one worker as a barrier.
+	last := workers[0].cmds[len(workers[0].cmds)-4:]
+	assert.Equal(t, [][]string{{"MULTI"}, {"SET", "k1", "100"}, {"SET", "k2", "101"}, {"EXEC"}},
+		[][]string{last[0].D, last[1].D, last[2].D, last[3].D})
+	// the commands of a key keep their order.
+	for k, v := range values {
+		assert.Equal(t, 10, len(v), k)
+		assert.True(t, sort.IntsAreSorted(v), k)
+	}
+}
+
+// gatedCommands records the commands once gate is closed.
+type gatedCommands struct {
+	gate chan struct{}
+	cmds []*Command
+}
+
+func (g *gatedCommands) Command(cmd *Command) error {
+	<-g.gate
+	g.cmds = append(g.cmds, cmd)
+	return nil
+}
+
+func TestBuffer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "canal-buffer")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	out := &gatedCommands{gate: make(chan struct{})}
+	b := NewBuffer(&BufferConfig{Memory: 1024, SegmentSize: 512, Dir: dir}, out)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, b.Command(&Command{D: []string{"SET", fmt.Sprintf("k%d", i), "v"}, Offset: int64(i)}))
+	}
+	// the commands beyond the memory limit are spilled to several segments.
+	files, _ := ioutil.ReadDir(dir)
+	assert.True(t, len(files) > 1)
+	assert.Equal(t, int64(-1), b.Applied())
+
+	close(out.gate)
+	assert.Nil(t, b.Close())
+	assert.Equal(t, 100, len(out.cmds))
+	for i, cmd := range out.cmds {
+		assert.Equal(t, []string{"SET", fmt.Sprintf("k%d", i), "v"}, cmd.D)
+		assert.Equal(t, int64(i), cmd.Offset)
+	}
+	assert.Equal(t, int64(99), b.Applied())
+	assert.Equal(t, 0, b.Len())
+	files, _ = ioutil.ReadDir(dir)
+	assert.Equal(t, 0, len(files))
+}
+
+// signalReader closes read when it is first read.
+type signalReader struct {
+	r    io.Reader
+	read chan struct{}
+	once bool
+}
+
+func (s *signalReader) Read(p []byte) (int, error) {
+	if !s.once {
+		s.once = true
+		close(s.read)
+	}
+	return s.r.Read(p)
+}
+
+func TestBufferReadsUnlocked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "canal-buffer")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	out := &gatedCommands{gate: make(chan struct{})}
+	b := NewBuffer(&BufferConfig{Memory: 1, SegmentSize: 1 << 20, Dir: dir}, out)
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, b.Command(&Command{D: []string{"SET", fmt.Sprintf("k%d", i), "v"}, Offset: int64(i)}))
+	}
+	// the segment is read through a pipe, fed once the buffer was used meanwhile.
+	b.mu.Lock()
+	s := b.segments[0]
+	file := s.r
+	pr, pw := io.Pipe()
+	sr := &signalReader{r: pr, read: make(chan struct{})}
+	s.r = bufio.NewReader(sr)
+	b.mu.Unlock()
+
+	close(out.gate)
+	<-sr.read
+	done := make(chan error, 1)
+	go func() {
+		b.Len()
+		done <- b.Command(&Command{D: []string{"SET", "k10", "v"}, Offset: 10})
+	}()
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("the buffer is locked while a segment is read")
+	}
+	// the segment holds k10 as well once flushed.
+	s.wmu.Lock()
+	assert.Nil(t, s.w.Flush())
+	s.wmu.Unlock()
+	go func() {
+		io.Copy(pw, file)
+		pw.Close()
+	}()
+	assert.Nil(t, b.Close())
+	assert.Equal(t, 11, len(out.cmds))
+	for i, cmd := range out.cmds {
+		assert.Equal(t, int64(i), cmd.Offset)
+	}
+}
+
+func TestCapture(t *testing.T) {
+	dir, err := ioutil.TempDir("", "canal-capture")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	var rdb bytes.Buffer
+	enc, err := NewEncoder(&rdb, rdbVersion)
+	assert.Nil(t, err)
+	enc.BeginRDB()
+	enc.BeginDatabase(0)
+	enc.Set([]byte("a"), []byte("1"), 0)
+	enc.EndDatabase(0)
+	enc.EndRDB()
+	assert.Nil(t, enc.Err())
+
+	cfg := NewConfig(liveMaster(t, rdb.Bytes(), []string{"SELECT", "0"}, []string{"SET", "b", "2"},
+		[]string{"DEL", "a"}, []string{"STOP"}))
+	cfg.Capture = &CaptureConfig{Dir: dir, SegmentSize: 32}
+	c, err := NewCanal(cfg)
+	assert.Nil(t, err)
+	var live txCommands
+	assert.Equal(t, errStop, c.Run(&live))
+	c.Close()
+	assert.True(t, IsCapture(dir))
+
+	var replayed txCommands
+	assert.Equal(t, errStop, ReplayCapture(NewConfig(""), dir, &replayed))
+	assert.Equal(t, len(live.cmds), len(replayed.cmds))
+	for i := range live.cmds {
+		assert.Equal(t, live.cmds[i].D, replayed.cmds[i].D)
+		assert.Equal(t, live.cmds[i].Offset, replayed.cmds[i].Offset)
+	}
+	assert.Equal(t, []string{"DEL", "a"}, replayed.cmds[len(replayed.cmds)-1].D)
+
+	// a capture is not recorded over another one.
+	addr, _ := fakeMaster(t, nil)
+	cfg = NewConfig(addr)
+	cfg.Capture = &CaptureConfig{Dir: dir, SegmentSize: 32}
+	_, err = NewCanal(cfg)
+	assert.NotNil(t, err)
+
+	r, err := OpenCapture(dir)
+	assert.Nil(t, err)
+	defer r.Close()
+	rec, err := r.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), rec.Offset)
+	assert.True(t, bytes.HasPrefix(rec.Data, []byte("+FULLRESYNC")))
+
+	// every read is a record, segments rotate once they are full.
+	small := filepath.Join(dir, "small")
+	data := strings.Repeat("0123456789", 10)
+	capture, err := newRecorder(&CaptureConfig{Dir: small, SegmentSize: 32}, iotest.OneByteReader(strings.NewReader(data)))
+	assert.Nil(t, err)
+	_, err = io.Copy(ioutil.Discard, capture)
+	assert.Nil(t, err)
+	assert.Nil(t, capture.Close())
+	files, _ := ioutil.ReadDir(small)
+	assert.True(t, len(files) > 1)
+	r, err = OpenCapture(small)
+	assert.Nil(t, err)
+	got, err := ioutil.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, data, string(got))
+	r.Close()
+}
+
+// writeCapture writes a capture segment in dir with a record per time in
+// milliseconds, the first one holding the full sync of rdb.
+func writeCapture(t *testing.T, dir string, rdb []byte, records map[int64][][]string) {
+	var times []int64
+	for ms := range records {
+		times = append(times, ms)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	var seg bytes.Buffer
+	seg.WriteString(captureMagic)
+	offset := int64(0)
+	for i, ms := range times {
+		var data bytes.Buffer
+		if i == 0 {
+			fmt.Fprintf(&data, "+FULLRESYNC 0123456789abcdef 100\r\n$%d\r\n", len(rdb))
+			data.Write(rdb)
+		}
+		wr := NewWriter(&data)
+		if i == 0 {
+			wr.WriteMultiBulk("PING")
+		}
+		for _, cmd := range records[ms] {
+			args := make([]interface{}, len(cmd)-1)
+			for i, a := range cmd[1:] {
+				args[i] = a
+			}
+			wr.WriteMultiBulk(cmd[0], args...)
+		}
+		wr.Flush()
+		var buf [binary.MaxVarintLen64]byte
+		seg.Write(buf[:binary.PutVarint(buf[:], ms)])
+		seg.Write(buf[:binary.PutVarint(buf[:], offset)])
+		seg.Write(buf[:binary.PutUvarint(buf[:], uint64(data.Len()))])
+		seg.Write(data.Bytes())
+		offset += int64(data.Len())
+	}
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("%020d%s", 0, captureExt)), seg.Bytes(), 0644))
+}
+
+func TestPointInTime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "canal-restore")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	var rdb bytes.Buffer
+	enc, err := NewEncoder(&rdb, rdbVersion)
+	assert.Nil(t, err)
+	enc.BeginRDB()
+	enc.BeginDatabase(0)
+	enc.Set([]byte("a"), []byte("1"), 0)
+	enc.BeginList([]byte("l"), 2, 0)
+	enc.Rpush([]byte("l"), []byte("x"))
+	enc.Rpush([]byte("l"), []byte("y"))
+	enc.EndList([]byte("l"))
+	enc.EndDatabase(0)
+	enc.EndRDB()
+	assert.Nil(t, enc.Err())
+
+	writeCapture(t, dir, rdb.Bytes(), map[int64][][]string{
+		1000: {{"SELECT", "0"}, {"SET", "b", "2"}, {"INCRBY", "b", "5"}, {"RPUSH", "l", "z"}, {"LPOP", "l"},
+			{"HSET", "h", "f", "1"}, {"HINCRBY", "h", "f", "2"}, {"ZADD", "z", "1", "m"}, {"ZINCRBY", "z", "2", "m"},
+			{"SADD", "s", "p", "q"}, {"SREM", "s", "p"}, {"XADD", "st", "MAXLEN", "=", "1", "1-0", "k", "v"},
+			{"PEXPIREAT", "a", "1500"}, {"EVAL", "return 1", "0"},
+			{"MULTI"}, {"SET", "t", "1"}, {"RENAME", "t", "u"}, {"EXEC"}},
+		2000: {{"FLUSHALL"}},
+		3000: {{"SET", "c", "3"}, {"SET", "d", "4"}, {"SETBIT", "d", "7", "1"}},
+	})
+	before := []string{
+		"select 0",
+		`set "a" "1" 1500`,
+		`set "b" "7" 0`,
+		`hash "h" 0`, `hset "h" "f" "3"`, `endhash "h"`,
+		`list "l" 0`, `rpush "l" "y"`, `rpush "l" "z"`, `endlist "l"`,
+		`set "s" 0`, `sadd "s" "q"`, `endset "s"`,
+		`stream "st" 0`, `xadd "st" 1-0 ["k" "v"]`, `endstream "st"`,
+		`set "u" "1" 0`,
+		`zset "z" 0`, `zadd "z" 3 "m"`, `endzset "z"`,
+		"end",
+	}
+
+	// the EVAL cannot be applied, it fails unless it is allowed.
+	var out recorder
+	_, err = RestoreCapture(NewConfig(""), dir, PointInTime{Offset: -1, Time: time.Unix(1, 999e6)}, &out)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "eval")
+	assert.Empty(t, out.events)
+
+	res, err := RestoreCapture(NewConfig(""), dir, PointInTime{Offset: -1, Time: time.Unix(1, 999e6), AllowSkipped: true}, &out)
+	assert.Nil(t, err)
+	assert.Equal(t, before, out.events)
+	assert.Equal(t, time.Unix(1, 0), res.Time)
+	assert.Equal(t, map[string]int{"eval": 1}, res.Skipped)
+
+	// the same point by offset, the one before the FLUSHALL.
+	var replayed txCommands
+	assert.Nil(t, ReplayCapture(NewConfig(""), dir, &replayed))
+	var flush int64
+	for i, cmd := range replayed.cmds {
+		if cmd.D[0] == "FLUSHALL" {
+			flush = replayed.cmds[i-1].Offset
+		}
+	}
+	out = recorder{}
+	res, err = RestoreCapture(NewConfig(""), dir, PointInTime{Offset: flush, AllowSkipped: true}, &out)
+	assert.Nil(t, err)
+	assert.Equal(t, before, out.events)
+	assert.Equal(t, flush, res.Offset)
+
+	// to the end, the keys written after the flush but the one SETBIT dropped.
+	var cmds txCommands
+	res, err = RestoreCaptureCommands(NewConfig(""), dir, PointInTime{Offset: -1, AllowSkipped: true}, &cmds)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Unix(3, 0), res.Time)
+	assert.Equal(t, map[string]int{"eval": 1, "setbit": 1}, res.Skipped)
+	assert.Equal(t, 2, len(cmds.cmds))
+	assert.Equal(t, []string{"SET", "c", "3"}, cmds.cmds[1].D)
+
+	_, err = RestoreCapture(NewConfig(""), dir, PointInTime{Offset: -1, Time: time.Unix(0, 5e8), AllowSkipped: true}, &out)
+	assert.NotNil(t, err)
+}
+
+func TestPointInTimeStreamSpaces(t *testing.T) {
+	dir, err := ioutil.TempDir("", "canal-restore")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	var rdb bytes.Buffer
+	enc, err := NewEncoder(&rdb, rdbVersion)
+	assert.Nil(t, err)
+	enc.BeginRDB()
+	enc.EndRDB()
+	assert.Nil(t, enc.Err())
+	writeCapture(t, dir, rdb.Bytes(), map[int64][][]string{
+		1000: {{"SELECT", "0"}, {"XADD", "st", "1-0", "k", "v w", "x", "y"}},
+	})
+
+	// the Encoder gets the values apart, joined by spaces they do not pair.
+	var restored bytes.Buffer
+	enc, err = NewEncoder(&restored, rdbVersion)
+	assert.Nil(t, err)
+	_, err = RestoreCapture(NewConfig(""), dir, PointInTime{Offset: -1}, enc)
+	assert.Nil(t, err)
+	assert.Nil(t, enc.Err())
+	out := &recorder{}
+	assert.Nil(t, DecodeFile(bytes.NewReader(restored.Bytes()), out))
+	assert.Equal(t, []string{"select 0", `stream "st" 0`, `xadd "st" 1-0 ["k" "v w" "x" "y"]`, `endstream "st"`, "end"}, out.events)
+
+	var cmds txCommands
+	_, err = RestoreCaptureCommands(NewConfig(""), dir, PointInTime{Offset: -1}, &cmds)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"XADD", "st", "1-0", "k", "v w", "x", "y"}, cmds.cmds[len(cmds.cmds)-1].D)
+}
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "canal-store")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	var rdb bytes.Buffer
+	enc, err := NewEncoder(&rdb, rdbVersion)
+	assert.Nil(t, err)
+	enc.BeginRDB()
+	enc.BeginDatabase(0)
+	enc.Set([]byte("a"), []byte("1"), 0)
+	enc.BeginZSet([]byte("z"), 2, 0)
+	enc.Zadd([]byte("z"), 2, []byte("y"))
+	enc.Zadd([]byte("z"), 1, []byte("x"))
+	enc.EndZSet([]byte("z"))
+	enc.EndDatabase(0)
+	enc.EndRDB()
+	assert.Nil(t, enc.Err())
+
+	cfg := NewConfig(liveMaster(t, rdb.Bytes(), []string{"SELECT", "0"}, []string{"APPEND", "a", "2"},
+		[]string{"HSET", "h", "f", "v", "g", "w"}, []string{"HDEL", "h", "g"},
+		[]string{"RPUSH", "l", "1", "2", "3"}, []string{"LTRIM", "l", "1", "-1"},
+		[]string{"SADD", "s", "b", "a"}, []string{"ZADD", "z", "XX", "5", "x"},
+		[]string{"XADD", "st", "5-1", "k", "v w"}, []string{"SET", "gone", "v", "PXAT", "1"},
+		[]string{"MULTI"}, []string{"SELECT", "1"}, []string{"SET", "b", "1"}, []string{"EXEC"},
+		[]string{"STOP"}))
+	cfg.Capture = NewCaptureConfig(dir)
+	c, err := NewCanal(cfg)
+	assert.Nil(t, err)
+	live := NewStore()
+	var changes []Change
+	live.Watch(func(change Change) { changes = append(changes, change) })
+	stop := &stopStore{Store: live}
+	assert.Equal(t, errStop, c.RunSnapshot(live, stop))
+	c.Close()
+
+	check := func(s *Store) {
+		v, ok := s.Get(0, "a")
+		assert.True(t, ok)
+		assert.Equal(t, "12", v)
+		assert.Equal(t, map[string]string{"f": "v"}, s.HGetAll(0, "h"))
+		v, ok = s.HGet(0, "h", "f")
+		assert.Equal(t, "v", v)
+		assert.Equal(t, []string{"2", "3"}, s.LRange(0, "l", 0, -1))
+		assert.Equal(t, []string{"a", "b"}, s.SMembers(0, "s"))
+		assert.True(t, s.SIsMember(0, "s", "a"))
+		assert.Equal(t, []ScoredMember{{"y", 2}, {"x", 5}}, s.ZRange(0, "z", 0, -1))
+		assert.Equal(t, []StreamEntry{{ID: "5-1", Fields: []FieldValue{{"k", "v w"}}}}, s.XRange(0, "st", 0))
+		assert.False(t, s.Exists(0, "gone"))
+		assert.Equal(t, "none", s.Type(0, "gone"))
+		assert.Equal(t, "hash", s.Type(0, "h"))
+		assert.Equal(t, []string{"a", "h", "l", "s", "st", "z"}, s.Keys(0))
+		v, _ = s.Get(1, "b")
+		assert.Equal(t, "1", v)
+		_, ok = s.Get(0, "h")
+		assert.False(t, ok)
+		assert.Empty(t, s.Skipped())
+	}
+	check(live)
+	assert.Equal(t, &DatasetLoaded{ChangeHeader: ChangeHeader{Offset: -1}, Keys: 2}, changes[0])
+	assert.Equal(t, &HashFieldsSet{ChangeHeader: ChangeHeader{DB: 0, Offset: changes[2].Header().Offset},
+		Key: "h", Fields: []FieldValue{{"f", "v"}, {"g", "w"}}}, changes[2])
+	assert.Equal(t, "b", changes[len(changes)-1].(*StringSet).Key)
+	assert.Equal(t, 1, changes[len(changes)-1].Header().DB)
+
+	// the recorded stream gives the same dataset.
+	replayed := NewStore()
+	assert.Equal(t, errStop, ReplayCaptureSnapshot(NewConfig(""), dir, replayed, &stopStore{Store: replayed}))
+	check(replayed)
+	assert.Equal(t, live.Offset(), replayed.Offset())
+}
+
+// stopStore is a Store stopping at the command STOP.
+type stopStore struct {
+	*Store
+}
+
+func (s *stopStore) Command(cmd *Command) error {
+	if cmd.D[0] == "STOP" {
+		return errStop
+	}
+	return s.Store.Command(cmd)
+}
+
+// chanCommands sends the commands delivered to a channel.
+type chanCommands chan *Command
+
+func (c chanCommands) Command(cmd *Command) error {
+	c <- cmd
+	return nil
+}
+
+// nextWrite returns the next command received which is not a PING.
+func nextWrite(t *testing.T, c chanCommands) *Command {
+	for {
+		select {
+		case cmd := <-c:
+			if cmd.D[0] != "PING" {
+				return cmd
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no command relayed")
+			return nil
+		}
+	}
+}
+
+func TestRelay(t *testing.T) {
+	ids := 0
+	defer func(random func() string) { replicationID = random }(replicationID)
+	replicationID = func() string {
+		ids++
+		return fmt.Sprintf("%040x", ids)
+	}
+	relay := NewRelay(&RelayConfig{Backlog: 256, Password: "secret"})
+	defer relay.Close()
+	relay.BeginRDB()
+	relay.BeginDatabase(0)
+	relay.Set([]byte("a"), []byte("1"), 0)
+	relay.EndDatabase(0)
+	relay.EndRDB()
+	relay.Command(&Command{D: []string{"SELECT", "2"}})
+	relay.Command(&Command{D: []string{"SET", "b", "2"}})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go relay.Serve(ln)
+
+	// a full sync of the dataset, then the stream.
+	cfg := NewConfig(ln.Addr().String())
+	cfg.Password = "secret"
+	c, err := NewCanal(cfg)
+	assert.Nil(t, err)
+	defer c.Close()
+	store := NewStore()
+	loaded := make(chan bool, 2)
+	store.Watch(func(change Change) {
+		if _, ok := change.(*DatasetLoaded); ok {
+			loaded <- true
+		}
+	})
+	cmds := make(chanCommands, 16)
+	go c.RunSnapshot(store, cmds)
+	select {
+	case <-loaded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no full sync")
+	}
+
+	relay.Command(&Command{D: []string{"SET", "c", "3"}})
+	assert.Equal(t, []string{"SELECT", "2"}, nextWrite(t, cmds).D)
+	cmd := nextWrite(t, cmds)
+	assert.Equal(t, []string{"SET", "c", "3"}, cmd.D)
+	id, offset := relay.Position()
+	assert.Equal(t, offset, cmd.Offset)
+	v, _ := store.Get(0, "a")
+	assert.Equal(t, "1", v)
+	v, _ = store.Get(2, "b")
+	assert.Equal(t, "2", v)
+
+	// a partial resync from the backlog.
+	cfg.Position = &Position{RunID: id, Offset: offset}
+	partial, err := NewCanal(cfg)
+	assert.Nil(t, err)
+	defer partial.Close()
+	resumed := make(chanCommands, 16)
+	go partial.Run(resumed)
+	relay.Command(&Command{D: []string{"DEL", "c"}})
+	_, offset = relay.Position()
+	for _, ch := range []chanCommands{cmds, resumed} {
+		cmd := nextWrite(t, ch)
+		assert.Equal(t, []string{"DEL", "c"}, cmd.D)
+		assert.Equal(t, offset, cmd.Offset)
+	}
+
+	// out of the backlog, a full sync again.
+	for i := 0; i < 20; i++ {
+		relay.Command(&Command{D: []string{"SET", "k", strconv.Itoa(i)}})
+	}
+	stale, err := NewCanal(cfg)
+	assert.Nil(t, err)
+	defer stale.Close()
+	resynced := NewStore()
+	resynced.Watch(func(change Change) {
+		if _, ok := change.(*DatasetLoaded); ok {
+			loaded <- true
+		}
+	})
+	go stale.RunSnapshot(resynced, make(chanCommands, 64))
+	select {
+	case <-loaded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no full sync")
+	}
+	v, _ = resynced.Get(2, "k")
+	assert.Equal(t, "19", v)
+	assert.False(t, resynced.Exists(2, "c"))
+}
+
+func TestPublisher(t *testing.T) {
+	p := NewPublisher(&PublisherConfig{Backlog: 2})
+	defer p.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go p.Serve(ln)
+
+	subscribe := func(query string) (net.Conn, *json.Decoder) {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		assert.Nil(t, err)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte(query + "\n"))
+		return conn, json.NewDecoder(conn)
+	}
+	next := func(dec *json.Decoder) Event {
+		var e Event
+		assert.Nil(t, dec.Decode(&e))
+		return e
+	}
+	conn, dec := subscribe("db=1&key=a*")
+	defer conn.Close()
+	for deadline := time.Now().Add(5 * time.Second); p.Subscribers() == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	p.Command(&Command{D: []string{"SELECT", "1"}, Offset: 10})
+	p.Command(&Command{D: []string{"SET", "a", "1"}, Offset: 20})
+	p.Command(&Command{D: []string{"SET", "b", "2"}, Offset: 30})
+	p.Command(&Command{D: []string{"PING"}, Offset: 40})
+	p.Transaction(&Transaction{DB: 1, Offset: 60, Commands: []*Command{
+		{D: []string{"SET", "a", "3"}, Offset: 40},
+		{D: []string{"DEL", "b", "a"}, Offset: 40},
+	}})
+
+	e := next(dec)
+	assert.Equal(t, "set", e.Op)
+	assert.Equal(t, 1, e.DB)
+	assert.Equal(t, []string{"a"}, e.Keys)
+	assert.Equal(t, int64(20), e.Offset)
+	var ops []string
+	for i := 0; i < 4; i++ {
+		e := next(dec)
+		assert.Equal(t, int64(60), e.Offset)
+		ops = append(ops, e.Op)
+		if e.Op == "del" {
+			assert.Equal(t, []string{"a"}, e.Keys)
+		}
+	}
+	assert.Equal(t, []string{"multi", "set", "del", "exec"}, ops)
+
+	// resumes after the offset over tcp and http
+	resumed, dec := subscribe("offset=20&binary=base64")
+	defer resumed.Close()
+	e = next(dec)
+	assert.Equal(t, "set", e.Op)
+	assert.Equal(t, []string{"Yg=="}, e.Keys)
+	assert.Equal(t, int64(30), e.Offset)
+
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+	req, _ := http.NewRequest("GET", srv.URL+"?command=del", nil)
+	req.Header.Set("Last-Event-ID", "30")
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	buf := make([]byte, 4096)
+	var body string
+	for !strings.Contains(body, "\n\n") {
+		n, err := resp.Body.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body += string(buf[:n])
+	}
+	assert.True(t, strings.HasPrefix(body, "data: {\"op\":\"multi\""), body)
+	assert.Contains(t, body, "id: 60\ndata: {\"op\":\"exec\"")
+	assert.Contains(t, body, `"op":"del","db":1,"keys":["b","a"]`)
+
+	// the backlog keeps 2 to 4 changes, a full sync empties it
+	for i := 0; i < 3; i++ {
+		p.Command(&Command{D: []string{"SET", "c", "1"}, Offset: int64(70 + i)})
+	}
+	resp, err = http.Get(srv.URL + "?offset=20")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusGone, resp.StatusCode)
+	resp, err = http.Get(srv.URL + "?offset=60&bad=1")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	p.Command(&Command{D: []string{"SET", "a", "1"}, Offset: -1})
+	var failed map[string]interface{}
+	for dec.Decode(&failed) == nil && failed["error"] == nil {
+	}
+	assert.Contains(t, failed["error"], "resynced")
+	late, dec := subscribe("offset=72")
+	defer late.Close()
+	assert.Nil(t, dec.Decode(&failed))
+	assert.Contains(t, failed["error"], "not in the backlog")
+}
+
+func TestKeySlot(t *testing.T) {
+	assert.Equal(t, 12182, KeySlot("foo"))
+	assert.Equal(t, 12739, KeySlot("123456789"))
+	assert.Equal(t, KeySlot("user1000"), KeySlot("{user1000}.following"))
+	assert.Equal(t, KeySlot("user1000"), KeySlot("x{user1000}{y}"))
+	// an empty hash tag hashes the whole key.
+	assert.NotEqual(t, KeySlot("bar"), KeySlot("{}bar"))
+	assert.Equal(t, -1, commandSlot(&Command{D: []string{"FLUSHALL"}}))
+	assert.Equal(t, 12182, commandSlot(&Command{D: []string{"SET", "foo", "1"}}))
+}
+
+// respValue encodes v, strings, ints and slices of them, in RESP.
+func respValue(v interface{}) string {
+	switch v := v.(type) {
+	case int:
+		return fmt.Sprintf(":%d\r\n", v)
+	case string:
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+	case []interface{}:
+		s := fmt.Sprintf("*%d\r\n", len(v))
+		for _, e := range v {
+			s += respValue(e)
+		}
+		return s
+	}
+	panic("unsupported value")
+}
+
+// clusterSeed is a cluster node answering CLUSTER SHARDS, or CLUSTER SLOTS when
+// the reply of topology is not for SHARDS.
+func clusterSeed(t *testing.T, topology func() (shards bool, reply string)) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go func() {
+		defer ln.Close()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				rd := NewReader(conn)
+				for {
+					v, _, _, err := rd.ReadMultiBulk()
+					if err != nil {
+						return
+					}
+					args := v.Array()
+					shards, reply := topology()
+					if len(args) < 2 || !strings.EqualFold(args[0].String(), "cluster") {
+						conn.Write([]byte("+OK\r\n"))
+					} else if strings.EqualFold(args[1].String(), "shards") == shards {
+						conn.Write([]byte(reply))
+					} else {
+						conn.Write([]byte("-ERR unknown subcommand\r\n"))
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestCluster(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cluster")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	var rdb bytes.Buffer
+	enc, err := NewEncoder(&rdb, rdbVersion)
+	assert.Nil(t, err)
+	enc.BeginRDB()
+	enc.Aux([]byte("repl-id"), []byte("0123456789abcdef"))
+	enc.Aux([]byte("repl-offset"), []byte("100"))
+	enc.EndRDB()
+	assert.Nil(t, enc.Err())
+
+	a := liveMaster(t, rdb.Bytes(), []string{"SELECT", "0"}, []string{"SET", "foo", "1"})
+	// b runs redis 7.2, its full sync is an RDB of version 11.
+	b := liveMaster(t, redis7RDB(), []string{"SELECT", "0"}, []string{"SET", "bar", "2"})
+	node := func(addr string) []interface{} {
+		host, port, _ := net.SplitHostPort(addr)
+		n, _ := strconv.Atoi(port)
+		return []interface{}{host, n}
+	}
+	var topology atomic.Value
+	topology.Store(respValue([]interface{}{
+		[]interface{}{0, 8191, append(node(a), "aaaa"), []interface{}{"127.0.0.1", 1}},
+		[]interface{}{8192, 16383, append(node(b), "bbbb")},
+	}))
+	shards := int32(0)
+	seed := clusterSeed(t, func() (bool, string) {
+		return atomic.LoadInt32(&shards) == 1, topology.Load().(string)
+	})
+
+	cfg := NewClusterConfig("127.0.0.1:1", seed)
+	cfg.Checkpoints = dir
+	cfg.Refresh = 50 * time.Millisecond
+	cl, err := NewCluster(cfg)
+	assert.Nil(t, err)
+	cmds := make(chan *ClusterCommand, 16)
+	done := make(chan error, 1)
+	go func() {
+		done <- cl.Run(func(cmd *ClusterCommand) error {
+			cmds <- cmd
+			return nil
+		})
+	}()
+	got := make(map[string]*ClusterCommand)
+	for got["foo"] == nil || got["bar"] == nil {
+		select {
+		case cmd := <-cmds:
+			if cmd.Type() == Set {
+				got[cmd.D[1]] = cmd
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no command replicated")
+		}
+	}
+	assert.Equal(t, "aaaa", got["foo"].Node)
+	assert.Equal(t, a, got["foo"].Addr)
+	assert.Equal(t, 12182, got["foo"].Slot)
+	assert.Equal(t, "bbbb", got["bar"].Node)
+	assert.Equal(t, KeySlot("bar"), got["bar"].Slot)
+	nodes := cl.Nodes()
+	assert.Equal(t, 2, len(nodes))
+	assert.Equal(t, [][2]int{{0, 8191}}, nodes[0].Slots)
+	offset := got["foo"].Offset
+	assert.Equal(t, Position{RunID: "0123456789abcdef", Offset: offset}, cl.Positions()["aaaa"])
+
+	// a replica of aaaa takes its slots over, it is asked to continue from its position.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer ln.Close()
+	psync := make(chan []string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		rd := NewReader(conn)
+		for {
+			v, _, _, err := rd.ReadMultiBulk()
+			if err != nil {
+				return
+			}
+			if vals := v.Array(); strings.EqualFold(vals[0].String(), "psync") {
+				psync <- []string{vals[1].String(), vals[2].String()}
+				fmt.Fprintf(conn, "+CONTINUE\r\n")
+				continue
+			}
+			conn.Write([]byte("+OK\r\n"))
+		}
+	}()
+	shard := func(id, addr string, first, last int) []interface{} {
+		host, port, _ := net.SplitHostPort(addr)
+		n, _ := strconv.Atoi(port)
+		return []interface{}{"slots", []interface{}{first, last}, "nodes", []interface{}{
+			[]interface{}{"id", id, "port", n, "ip", host, "endpoint", host, "role", "master", "health", "online"},
+		}}
+	}
+	topology.Store(respValue([]interface{}{
+		shard("cccc", ln.Addr().String(), 0, 8191),
+		shard("bbbb", b, 8192, 16383),
+	}))
+	atomic.StoreInt32(&shards, 1)
+	select {
+	case args := <-psync:
+		assert.Equal(t, []string{"0123456789abcdef", strconv.FormatInt(offset+1, 10)}, args)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the new master was not synced")
+	}
+	assert.Equal(t, "cccc", cl.Nodes()[0].ID)
+
+	cl.Close()
+	assert.Nil(t, <-done)
+	pos, err := LoadPosition(filepath.Join(dir, "aaaa.json"))
+	assert.Nil(t, err)
+	assert.Equal(t, offset, pos.Offset)
+	pos, err = LoadPosition(filepath.Join(dir, "bbbb.json"))
+	assert.Nil(t, err)
+	assert.Equal(t, got["bar"].Offset, pos.Offset)
+}
+
+func TestStoreDropsKeys(t *testing.T) {
+	s := NewStore()
+	s.BeginRDB()
+	s.BeginDatabase(0)
+	s.BeginSet([]byte("s1"), 3, 0)
+	for _, m := range []string{"a", "b", "c"} {
+		s.Sadd([]byte("s1"), []byte(m))
+	}
+	s.EndSet([]byte("s1"))
+	s.BeginSet([]byte("s2"), 2, 0)
+	s.Sadd([]byte("s2"), []byte("b"))
+	s.Sadd([]byte("s2"), []byte("c"))
+	s.EndSet([]byte("s2"))
+	s.BeginZSet([]byte("z"), 4, 0)
+	for _, m := range []string{"a", "b", "c", "d"} {
+		s.Zadd([]byte("z"), 0, []byte(m))
+	}
+	s.EndZSet([]byte("z"))
+	s.BeginStream([]byte("st"), 1, 0)
+	s.XaddEntry([]byte("st"), []byte("1-1"), []FieldValue{{"k", "v w"}, {"f", "g"}})
+	s.EndStream([]byte("st"))
+	s.Set([]byte("bits"), []byte("x"), 0)
+	s.EndDatabase(0)
+	s.EndRDB()
+	assert.Equal(t, []StreamEntry{{ID: "1-1", Fields: []FieldValue{{"k", "v w"}, {"f", "g"}}}}, s.XRange(0, "st", 0))
+
+	var changes []Change
+	s.Watch(func(change Change) { changes = append(changes, change) })
+	for _, args := range [][]string{
+		{"SINTERSTORE", "i", "s1", "s2"}, {"SUNIONSTORE", "u", "s2", "none"}, {"SDIFFSTORE", "d", "s1", "s2"},
+		{"ZREMRANGEBYLEX", "z", "(a", "[c"},
+	} {
+		assert.Nil(t, s.Command(&Command{D: args}))
+	}
+	assert.Equal(t, []string{"b", "c"}, s.SMembers(0, "i"))
+	assert.Equal(t, []string{"b", "c"}, s.SMembers(0, "u"))
+	assert.Equal(t, []string{"a"}, s.SMembers(0, "d"))
+	assert.Equal(t, []ScoredMember{{"a", 0}, {"d", 0}}, s.ZRange(0, "z", 0, -1))
+	assert.Empty(t, s.Skipped())
+
+	// the keys of the commands which cannot be applied are dropped, not left stale.
+	changes = nil
+	assert.Nil(t, s.Command(&Command{D: []string{"SETBIT", "bits", "7", "1"}, Offset: 10}))
+	assert.Nil(t, s.Command(&Command{D: []string{"GEOADD", "geo", "13.36", "38.11", "Palermo"}, Offset: 20}))
+	assert.False(t, s.Exists(0, "bits"))
+	assert.False(t, s.Exists(0, "geo"))
+	assert.Equal(t, map[string]int{"setbit": 1, "geoadd": 1}, s.Skipped())
+	assert.Len(t, changes, 2)
+	dropped := changes[0].(*KeysDropped)
+	assert.Equal(t, []string{"bits"}, dropped.Keys)
+	assert.Equal(t, int64(10), dropped.Offset)
+	assert.Equal(t, "SETBIT", dropped.Command.D[0])
+	assert.NotNil(t, dropped.Err)
+
+	// a stream entry whose fields cannot be told apart is not guessed.
+	s.BeginRDB()
+	s.BeginDatabase(0)
+	s.BeginStream([]byte("st"), 1, 0)
+	s.Xadd([]byte("st"), []byte("1-1"), []byte("k v w"))
+	s.EndStream([]byte("st"))
+	s.EndDatabase(0)
+	s.EndRDB()
+	assert.Empty(t, s.XRange(0, "st", 0))
+	assert.Equal(t, 1, s.Skipped()["xadd"])
+}
+
+func TestRelaySkipped(t *testing.T) {
+	relay := NewRelay(NewRelayConfig())
+	defer relay.Close()
+	load := func() {
+		relay.BeginRDB()
+		relay.BeginDatabase(0)
+		relay.Set([]byte("a"), []byte("1"), 0)
+		relay.EndDatabase(0)
+		relay.EndRDB()
+	}
+	snapshot := func() error {
+		relay.mu.Lock()
+		defer relay.mu.Unlock()
+		_, err := relay.snapshot()
+		return err
+	}
+	load()
+	assert.Nil(t, snapshot())
+
+	// the dataset misses the SETBIT, it is not served until the next full sync.
+	relay.Command(&Command{D: []string{"SETBIT", "b", "7", "1"}})
+	err := snapshot()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "setbit")
+	load()
+	assert.Nil(t, snapshot())
+	assert.Empty(t, relay.Store().Skipped())
+}
+
+func TestClusterCaptureRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cluster")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	var rdb bytes.Buffer
+	enc, err := NewEncoder(&rdb, rdbVersion)
+	assert.Nil(t, err)
+	enc.BeginRDB()
+	enc.EndRDB()
+	assert.Nil(t, enc.Err())
+
+	// the master is started again between the runs of the cluster.
+	run := func() {
+		addr := liveMaster(t, rdb.Bytes(), []string{"SELECT", "0"}, []string{"SET", "foo", "1"})
+		host, port, _ := net.SplitHostPort(addr)
+		n, _ := strconv.Atoi(port)
+		seed := clusterSeed(t, func() (bool, string) {
+			return false, respValue([]interface{}{[]interface{}{0, 16383, []interface{}{host, n, "aaaa"}}})
+		})
+		cfg := NewClusterConfig(seed)
+		cfg.Config.Capture = NewCaptureConfig(dir)
+		cl, err := NewCluster(cfg)
+		assert.Nil(t, err)
+		cmds := make(chan *ClusterCommand, 16)
+		done := make(chan error, 1)
+		go func() {
+			done <- cl.Run(func(cmd *ClusterCommand) error {
+				cmds <- cmd
+				return nil
+			})
+		}()
+		for set := false; !set; {
+			select {
+			case cmd := <-cmds:
+				set = cmd.Type() == Set
+			case <-time.After(5 * time.Second):
+				t.Fatal("no command replicated")
+			}
+		}
+		cl.Close()
+		assert.Nil(t, <-done)
+	}
+	run()
+	run()
+
+	runs, err := ioutil.ReadDir(filepath.Join(dir, "aaaa"))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(runs))
+	for _, r := range runs {
+		assert.True(t, IsCapture(filepath.Join(dir, "aaaa", r.Name())))
+	}
+}
+
+// rdbString returns a string of an RDB of less than 16384 bytes, rdbLen a length.
+func rdbString(s []byte) []byte {
+	if len(s) < 64 {
+		return append([]byte{byte(len(s))}, s...)
+	}
+	return append([]byte{0x40 | byte(len(s)>>8), byte(len(s))}, s...)
+}
+
+func rdbLen(n uint64) []byte {
+	if n < 64 {
+		return []byte{byte(n)}
+	}
+	return binary.BigEndian.AppendUint64([]byte{rdb64bitLen}, n)
+}
+
+// listpackOf returns the listpack of elements, the integers encoded as such.
+func listpackOf(elements ...string) []byte {
+	lp := newListpack()
+	for _, e := range elements {
+		lp.append([]byte(e))
+	}
+	return lp.bytes()
+}
+
+// redis7RDB returns an RDB as redis 7.2 saves it, with the listpack encodings,
+// a function library and a stream with a consumer group.
+func redis7RDB() []byte {
+	rdb := []byte("REDIS0011")
+	rdb = append(rdb, rdbOpCodeAux)
+	rdb = append(append(rdb, rdbString([]byte("redis-ver"))...), rdbString([]byte("7.2.4"))...)
+	rdb = append(rdb, rdbOpCodeAux)
+	rdb = append(append(rdb, rdbString([]byte("repl-id"))...), rdbString([]byte("0123456789abcdef"))...)
+	rdb = append(rdb, rdbOpCodeFunction2)
+	rdb = append(rdb, rdbString([]byte("#!lua name=lib\nredis.register_function('f', function() return 1 end)"))...)
+	rdb = append(rdb, rdbOpCodeSelectDB, 0, rdbOpCodeResizeDB, 6, 0)
+
+	rdb = append(append(rdb, byte(TypeHashListpack)), rdbString([]byte("h"))...)
+	rdb = append(rdb, rdbString(listpackOf("f", "v w", "n", "12"))...)
+	rdb = append(append(rdb, byte(TypeZSetListpack)), rdbString([]byte("z"))...)
+	rdb = append(rdb, rdbString(listpackOf("a", "1", "b", "2.5"))...)
+	rdb = append(append(rdb, byte(TypeSetListpack)), rdbString([]byte("s"))...)
+	rdb = append(rdb, rdbString(listpackOf("x", "7"))...)
+	// a packed node then a plain one, of an element too large for a listpack.
+	rdb = append(append(rdb, byte(TypeListQuicklist2)), rdbString([]byte("l"))...)
+	rdb = append(rdb, 2, rdbQuicklistNodePacked)
+	rdb = append(rdb, rdbString(listpackOf("1", "two"))...)
+	rdb = append(rdb, rdbQuicklistNodePlain)
+	rdb = append(rdb, rdbString(bytes.Repeat([]byte("p"), 100))...)
+
+	// a stream of one entry, read by the consumer c of the group g.
+	ms := uint64(1700000000000)
+	rdb = append(append(rdb, byte(TypeStreamListPacks3)), rdbString([]byte("st"))...)
+	id := binary.BigEndian.AppendUint64(binary.BigEndian.AppendUint64(nil, ms), 0)
+	rdb = append(append(rdb, 1), rdbString(id)...)
+	lp := newListpack()
+	for _, i := range []int64{1, 0, 1} { // count, deleted, fields of the master entry
+		lp.appendInt(i)
+	}
+	lp.append([]byte("f"))
+	lp.appendInt(0)
+	lp.appendInt(rdbStreamItemFlangSameFields)
+	lp.appendInt(0)
+	lp.appendInt(0)
+	lp.append([]byte("v w"))
+	lp.appendInt(4)
+	rdb = append(rdb, rdbString(lp.bytes())...)
+	// length, last id, first id, max deleted id, entries added.
+	for _, n := range []uint64{1, ms, 0, ms, 0, 0, 0, 1} {
+		rdb = append(rdb, rdbLen(n)...)
+	}
+	rdb = append(append(rdb, 1), rdbString([]byte("g"))...)
+	rdb = append(append(append(rdb, rdbLen(ms)...), 0), 1) // last id, entries read
+	rdb = append(append(rdb, 1), id...)                    // the pending entry
+	rdb = append(binary.LittleEndian.AppendUint64(rdb, ms+5), 1)
+	rdb = append(append(rdb, 1), rdbString([]byte("c"))...)
+	rdb = binary.LittleEndian.AppendUint64(binary.LittleEndian.AppendUint64(rdb, ms+5), ms+5)
+	rdb = append(append(rdb, 1), id...)
+
+	rdb = append(rdb, byte(TypeString))
+	rdb = append(append(rdb, rdbString([]byte("after"))...), rdbString([]byte("1"))...)
+	rdb = append(rdb, rdbOpCodeEOF)
+	return binary.LittleEndian.AppendUint64(rdb, Digest(rdb))
+}
+
+func TestDecodeRedis7(t *testing.T) {
+	events := []string{
+		"aux redis-ver 7.2.4", "aux repl-id 0123456789abcdef", "select 0",
+		`hash "h" 0`, `hset "h" "f" "v w"`, `hset "h" "n" "12"`, `endhash "h"`,
+		`zset "z" 0`, `zadd "z" 1 "a"`, `zadd "z" 2.5 "b"`, `endzset "z"`,
+		`set "s" 0`, `sadd "s" "x"`, `sadd "s" "7"`, `endset "s"`,
+		`list "l" 0`, `rpush "l" "1"`, `rpush "l" "two"`, `rpush "l" "` + strings.Repeat("p", 100) + `"`, `endlist "l"`,
+		`stream "st" 0`, `xadd "st" 1700000000000-0 ["f" "v w"]`, `endstream "st"`,
+		`set "after" "1" 0`, "end",
+	}
+	r := &recorder{}
+	assert.Nil(t, DecodeFile(bytes.NewReader(redis7RDB()), r))
+	assert.Equal(t, events, r.events)
+
+	// the base file of the multi-part AOF of redis 7, then the commands which follow.
+	dir := t.TempDir()
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "appendonly.aof.1.base.rdb"), redis7RDB(), 0644))
+	incr, _ := MultiBulkBytes(MultiBulkValue("SET", "after", "2"))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "appendonly.aof.1.incr.aof"), append([]byte("*2\r\n$6\r\nSELECT\r\n$1\r\n0\r\n"), incr...), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "appendonly.aof.manifest"), []byte(
+		"file appendonly.aof.1.base.rdb seq 1 type b\nfile appendonly.aof.1.incr.aof seq 1 type i\n"), 0644))
+	store := NewStore()
+	assert.Nil(t, DecodeAOFPath(dir, store, store))
+	assert.Equal(t, []string{"after", "h", "l", "s", "st", "z"}, store.Keys(0))
+	v, _ := store.Get(0, "after")
+	assert.Equal(t, "2", v)
+	assert.Equal(t, []ScoredMember{{"a", 1}, {"b", 2.5}}, store.ZRange(0, "z", 0, -1))
+
+	// the newer versions are refused up front.
+	rdb := append([]byte("REDIS0012"), rdbOpCodeEOF)
+	err := DecodeFile(bytes.NewReader(rdb), &recorder{})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "version 12 is not supported")
+}
+
+func TestVerifyRedis7(t *testing.T) {
+	// the DUMP payload of a hash of redis 7.2.
+	payload := append([]byte{byte(TypeHashListpack)}, rdbString(listpackOf("f", "v"))...)
+	payload = binary.LittleEndian.AppendUint16(payload, 11)
+	payload = binary.LittleEndian.AppendUint64(payload, Digest(payload))
+	r := &recorder{}
+	assert.Nil(t, DecodeDump(payload, 0, []byte("h"), 0, r))
+	assert.Equal(t, []string{"select 0", `hash "h" 0`, `hset "h" "f" "v"`, `endhash "h"`, "end"}, r.events)
+
+	payload = append(payload[:len(payload)-10], 12, 0)
+	payload = binary.LittleEndian.AppendUint64(payload, Digest(payload))
+	err := DecodeDump(payload, 0, []byte("h"), 0, r)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "DUMP version 12 is not supported")
+
+	// a newer target is refused before the source is synced.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		rd, wr := NewReader(conn), NewWriter(conn)
+		for {
+			if _, _, _, err := rd.ReadMultiBulk(); err != nil {
+				return
+			}
+			wr.WriteString("# Server\r\nredis_version:7.4.1\r\n")
+			wr.Flush()
+		}
+	}()
+	_, err = Verify(&VerifyConfig{Source: NewConfig("127.0.0.1:1"), Target: NewTargetConfig(ln.Addr().String())},
+		func(d *KeyDiff) error { return nil })
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "redis 7.4.1")
+}
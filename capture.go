@@ -0,0 +1,312 @@
+package canal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// captureMagic starts every segment of a capture.
+const captureMagic = "CANALCAP1"
+
+// captureExt is the extension of the segments of a capture, named after the
+// stream offset of their first byte.
+const captureExt = ".capture"
+
+type CaptureConfig struct {
+	// Dir holds the segments of the capture, it is created if needed. A capture is
+	// recorded from the start of the stream, Dir must not hold one already.
+	Dir string
+	// SegmentSize is the bytes written to a segment before the next one starts, 64MB by default.
+	SegmentSize int64
+}
+
+func NewCaptureConfig(dir string) *CaptureConfig {
+	return &CaptureConfig{Dir: dir, SegmentSize: 64 << 20}
+}
+
+// CaptureRecord is a read from the master, Offset is the position of its first
+// byte in the stream captured, from the reply to PSYNC on.
+type CaptureRecord struct {
+	Time   time.Time
+	Offset int64
+	Data   []byte
+}
+
+// captureRecorder tees the bytes read from the master to the segments of a capture.
+type captureRecorder struct {
+	r   io.Reader
+	cfg *CaptureConfig
+
+	mu     sync.Mutex
+	f      *os.File
+	w      *bufio.Writer
+	offset int64
+	size   int64
+	err    error
+}
+
+func newRecorder(cfg *CaptureConfig, r io.Reader) (*captureRecorder, error) {
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return nil, err
+	}
+	if IsCapture(cfg.Dir) {
+		return nil, errors.Errorf("%s already holds a capture.", cfg.Dir)
+	}
+	rec := &captureRecorder{r: r, cfg: cfg}
+	if rec.cfg.SegmentSize <= 0 {
+		c := *cfg
+		c.SegmentSize = 64 << 20
+		rec.cfg = &c
+	}
+	return rec, nil
+}
+
+// Read reads from the master and records what it read, a failure to record is
+// logged once and the stream goes on unrecorded.
+func (rec *captureRecorder) Read(p []byte) (int, error) {
+	n, err := rec.r.Read(p)
+	if n > 0 {
+		rec.mu.Lock()
+		if rec.err == nil {
+			if rec.err = rec.record(p[:n]); rec.err != nil {
+				log.Printf("[CANAL] capture failed, the stream is not recorded any more: %v.\n", rec.err)
+			}
+		}
+		rec.mu.Unlock()
+	}
+	return n, err
+}
+
+// record appends data to the segment being written, rec.mu is held.
+func (rec *captureRecorder) record(data []byte) error {
+	if rec.f == nil || rec.size >= rec.cfg.SegmentSize {
+		if err := rec.rotate(); err != nil {
+			return err
+		}
+	}
+	var buf [binary.MaxVarintLen64]byte
+	n := 0
+	for _, v := range []int64{time.Now().UnixNano() / int64(time.Millisecond), rec.offset} {
+		m, _ := rec.w.Write(buf[:binary.PutVarint(buf[:], v)])
+		n += m
+	}
+	m, _ := rec.w.Write(buf[:binary.PutUvarint(buf[:], uint64(len(data)))])
+	n += m
+	m, err := rec.w.Write(data)
+	if err == nil {
+		err = rec.w.Flush()
+	}
+	rec.size += int64(n + m)
+	rec.offset += int64(len(data))
+	return err
+}
+
+// rotate closes the segment being written and starts the next one, rec.mu is held.
+func (rec *captureRecorder) rotate() error {
+	if err := rec.closeSegment(); err != nil {
+		return err
+	}
+	name := filepath.Join(rec.cfg.Dir, fmt.Sprintf("%020d%s", rec.offset, captureExt))
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	rec.f, rec.w, rec.size = f, bufio.NewWriter(f), int64(len(captureMagic))
+	_, err = rec.w.WriteString(captureMagic)
+	return err
+}
+
+func (rec *captureRecorder) closeSegment() error {
+	if rec.f == nil {
+		return nil
+	}
+	err := rec.w.Flush()
+	if cerr := rec.f.Close(); err == nil {
+		err = cerr
+	}
+	rec.f, rec.w = nil, nil
+	return err
+}
+
+func (rec *captureRecorder) Close() error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	err := rec.closeSegment()
+	if rec.err == nil {
+		rec.err = errors.Errorf("capture is closed.")
+	}
+	return err
+}
+
+// CaptureReader reads the records of a capture, in order. Read returns the
+// bytes of the stream captured, so it can stand for the master.
+type CaptureReader struct {
+	paths []string
+	f     *os.File
+	r     *bufio.Reader
+	// data is the rest of the record being read by Read.
+	data []byte
+}
+
+// OpenCapture opens the capture recorded in dir.
+func OpenCapture(dir string) (*CaptureReader, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+captureExt))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, errors.Errorf("no capture in %s.", dir)
+	}
+	sort.Strings(paths)
+	return &CaptureReader{paths: paths}, nil
+}
+
+// IsCapture reports whether path is a directory holding a capture.
+func IsCapture(path string) bool {
+	paths, _ := filepath.Glob(filepath.Join(path, "*"+captureExt))
+	return len(paths) > 0
+}
+
+// Next returns the next record, io.EOF after the last one.
+func (c *CaptureReader) Next() (*CaptureRecord, error) {
+	for c.r == nil {
+		if len(c.paths) == 0 {
+			return nil, io.EOF
+		}
+		if err := c.open(); err != nil {
+			return nil, err
+		}
+	}
+	ms, err := binary.ReadVarint(c.r)
+	if err == io.EOF {
+		// the next segment.
+		c.f.Close()
+		c.f, c.r = nil, nil
+		return c.Next()
+	}
+	if err != nil {
+		return nil, err
+	}
+	rec := &CaptureRecord{Time: time.Unix(0, ms*int64(time.Millisecond))}
+	if rec.Offset, err = binary.ReadVarint(c.r); err != nil {
+		return nil, noEOF(err)
+	}
+	n, err := binary.ReadUvarint(c.r)
+	if err != nil {
+		return nil, noEOF(err)
+	}
+	rec.Data = make([]byte, n)
+	if _, err := io.ReadFull(c.r, rec.Data); err != nil {
+		return nil, noEOF(err)
+	}
+	return rec, nil
+}
+
+func (c *CaptureReader) open() error {
+	path := c.paths[0]
+	c.paths = c.paths[1:]
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(f)
+	magic := make([]byte, len(captureMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != captureMagic {
+		f.Close()
+		return errors.Errorf("%s is not a capture segment.", filepath.Base(path))
+	}
+	c.f, c.r = f, r
+	return nil
+}
+
+func (c *CaptureReader) Read(p []byte) (int, error) {
+	for len(c.data) == 0 {
+		rec, err := c.Next()
+		if err != nil {
+			return 0, err
+		}
+		c.data = rec.Data
+	}
+	n := copy(p, c.data)
+	c.data = c.data[n:]
+	return n, nil
+}
+
+func (c *CaptureReader) Close() error {
+	if c.f != nil {
+		return c.f.Close()
+	}
+	return nil
+}
+
+// ReplayCapture delivers the commands of the capture recorded in dir to commandDecode,
+// as Run did for the master it was recorded from, with the same offsets. The Filter,
+// Rewrite and the other options of cfg apply, its address is not used. A capture
+// of a partial sync needs the Position the recording canal resumed from.
+func ReplayCapture(cfg *Config, dir string, commandDecode CommandDecoder) error {
+	return replayCapture(cfg, dir, nil, commandDecode)
+}
+
+// ReplayCaptureSnapshot is ReplayCapture handing the RDB of the capture to d, as RunSnapshot.
+func ReplayCaptureSnapshot(cfg *Config, dir string, d Decoder, commandDecode CommandDecoder) error {
+	return replayCapture(cfg, dir, d, commandDecode)
+}
+
+func replayCapture(cfg *Config, dir string, d Decoder, commandDecode CommandDecoder) error {
+	if commandDecode == nil {
+		return errors.Errorf("command decode is nil.")
+	}
+	r, err := OpenCapture(dir)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	c, err := captureCanal(cfg, r, d)
+	if err != nil {
+		return err
+	}
+	return c.replay(commandDecode)
+}
+
+// captureCanal returns a canal reading the capture of r as its master, handing
+// the RDB to d if it is not nil.
+func captureCanal(cfg *Config, r io.Reader, d Decoder) (*Canal, error) {
+	c, err := newCanal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if c.runID == "" {
+		// as replconf asks for a full sync.
+		c.runID, c.offset = "?", -1
+	}
+	c.replica = newReplica(r, c)
+	if d != nil {
+		if c.filter != nil {
+			d = c.filter.Decoder(d)
+		}
+		c.replica.rdb = newSnapshotDecoder(d, c)
+	}
+	return c, nil
+}
+
+// replay runs a canal of captureCanal to the end of its capture.
+func (c *Canal) replay(commandDecode CommandDecoder) error {
+	err := c.buffered(commandDecode, func() error {
+		return c.replica.dumpAndParse(c.closeR)
+	})
+	if cause := errors.Cause(err); cause == io.EOF || cause == io.ErrUnexpectedEOF {
+		// the capture ends where the recording stopped, maybe in the middle of a command.
+		return nil
+	}
+	return err
+}
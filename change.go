@@ -0,0 +1,519 @@
+package canal
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Change is a typed change of the data of redis, built by ChangeDecoder from the keys
+// of a full sync or the commands of the replication stream: *StringSet, *HashFieldsSet,
+// *HashFieldsDeleted, *ListPush, *SetAdd, *SetRemove, *ZSetAdd, *ZSetRemove, *StreamAdd,
+// *ExpireSet, *KeysDeleted, *KeyRenamed, *DBFlushed, *ScriptRun or *RawCommand for the
+// other commands.
+type Change interface {
+	Header() *ChangeHeader
+}
+
+// ChangeHeader is where a Change comes from.
+type ChangeHeader struct {
+	DB int
+	// Offset is the replication offset of the command, -1 for the keys of a full sync.
+	Offset int64
+}
+
+func (h *ChangeHeader) Header() *ChangeHeader {
+	return h
+}
+
+// StringSet sets the string value of a key.
+type StringSet struct {
+	ChangeHeader
+	Key   string
+	Value string
+	// ExpireAt is the unix time in milliseconds the key expires at, 0 if it does not.
+	ExpireAt int64
+	// KeepTTL keeps the expiry the key had, ExpireAt is then 0.
+	KeepTTL bool
+}
+
+// FieldValue is a field of a hash and its value.
+type FieldValue struct {
+	Field string
+	Value string
+}
+
+// HashFieldsSet sets fields of a hash.
+type HashFieldsSet struct {
+	ChangeHeader
+	Key    string
+	Fields []FieldValue
+	// OnlyNew only sets the fields which do not exist, as HSETNX.
+	OnlyNew bool
+}
+
+// HashFieldsDeleted deletes fields of a hash.
+type HashFieldsDeleted struct {
+	ChangeHeader
+	Key    string
+	Fields []string
+}
+
+// ListSide is the end of a list values are pushed to.
+type ListSide int
+
+const (
+	ListLeft ListSide = iota
+	ListRight
+)
+
+// ListPush pushes values to a list, in order.
+type ListPush struct {
+	ChangeHeader
+	Key    string
+	Side   ListSide
+	Values []string
+	// OnlyExisting only pushes if the list exists, as LPUSHX and RPUSHX.
+	OnlyExisting bool
+}
+
+// SetAdd adds members to a set.
+type SetAdd struct {
+	ChangeHeader
+	Key     string
+	Members []string
+}
+
+// SetRemove removes members from a set.
+type SetRemove struct {
+	ChangeHeader
+	Key     string
+	Members []string
+}
+
+// ScoredMember is a member of a sorted set and its score.
+type ScoredMember struct {
+	Member string
+	Score  float64
+}
+
+// ZSetAdd adds members to a sorted set or updates their scores.
+type ZSetAdd struct {
+	ChangeHeader
+	Key     string
+	Members []ScoredMember
+	// Flags are the options of ZADD, like NX or GT, upper case.
+	Flags []string
+}
+
+// ZSetRemove removes members from a sorted set.
+type ZSetRemove struct {
+	ChangeHeader
+	Key     string
+	Members []string
+}
+
+// StreamAdd adds an entry to a stream.
+type StreamAdd struct {
+	ChangeHeader
+	Key    string
+	ID     string
+	Fields []FieldValue
+}
+
+// ExpireSet sets the expiry of a key, or removes it when ExpireAt is 0 as PERSIST.
+type ExpireSet struct {
+	ChangeHeader
+	Key string
+	// ExpireAt is the unix time in milliseconds the key expires at.
+	ExpireAt int64
+}
+
+// KeysDeleted deletes keys.
+type KeysDeleted struct {
+	ChangeHeader
+	Keys []string
+}
+
+// KeyRenamed renames a key, only if NewKey does not exist when OnlyNew is set as RENAMENX.
+type KeyRenamed struct {
+	ChangeHeader
+	Key     string
+	NewKey  string
+	OnlyNew bool
+}
+
+// DBFlushed deletes every key of the database, or of all of them when All is set.
+type DBFlushed struct {
+	ChangeHeader
+	All bool
+}
+
+// ScriptRun runs a script, as EVAL or EVALSHA. It is opaque: the keys it declares
+// are known, not how it changes them.
+type ScriptRun struct {
+	ChangeHeader
+	// Script is the body of the script, empty for an EVALSHA.
+	Script string
+	SHA    string
+	Keys   []string
+	Args   []string
+}
+
+// RawCommand is a command without a typed Change.
+type RawCommand struct {
+	ChangeHeader
+	Command *Command
+}
+
+// ChangeDecoder is a Decoder and a CommandDecoder handing typed Changes to a function,
+// for sinks which do not parse redis commands. It is used with Canal.RunSnapshot, or
+// Canal.Run which delivers the full sync as commands too. SELECT, PING and REPLCONF
+// are not changes.
+type ChangeDecoder struct {
+	fn func(Change) error
+
+	db int
+	// collection being decoded and its expiry.
+	key    string
+	expiry int64
+
+	err error
+	// now returns the unix time in milliseconds relative expiries start from.
+	now func() int64
+}
+
+// NewChangeDecoder returns a ChangeDecoder calling fn with every change.
+func NewChangeDecoder(fn func(Change) error) *ChangeDecoder {
+	return &ChangeDecoder{fn: fn, now: func() int64 {
+		return time.Now().UnixNano() / int64(time.Millisecond)
+	}}
+}
+
+// Err returns the first error fn returned for the keys of an RDB.
+func (c *ChangeDecoder) Err() error {
+	return c.err
+}
+
+func (c *ChangeDecoder) emit(changes ...Change) error {
+	for _, change := range changes {
+		if c.err != nil {
+			return c.err
+		}
+		c.err = c.fn(change)
+	}
+	return c.err
+}
+
+// Command hands the changes of cmd to the function.
+func (c *ChangeDecoder) Command(cmd *Command) error {
+	switch cmd.Type() {
+	case Select:
+		if len(cmd.D) > 1 {
+			if n, err := strconv.Atoi(cmd.D[1]); err == nil {
+				c.db = n
+			}
+		}
+		return nil
+	case Ping:
+		return nil
+	}
+	if strings.EqualFold(cmd.CommandName(), "replconf") {
+		return nil
+	}
+	h := ChangeHeader{DB: c.db, Offset: cmd.Offset}
+	changes := c.parse(h, cmd)
+	if changes == nil {
+		changes = []Change{&RawCommand{ChangeHeader: h, Command: cmd}}
+	}
+	return c.emit(changes...)
+}
+
+// parse returns the changes of cmd, nil if it has no typed changes or its arguments are not valid.
+func (c *ChangeDecoder) parse(h ChangeHeader, cmd *Command) []Change {
+	args := cmd.D[1:]
+	switch cmd.Type() {
+	case Set:
+		return c.parseSet(h, args)
+	case SetNX, GetSet:
+		if len(args) == 2 {
+			return []Change{&StringSet{ChangeHeader: h, Key: args[0], Value: args[1]}}
+		}
+	case SetEX, PsetEX:
+		if len(args) == 3 {
+			unit := int64(1000)
+			if cmd.Type() == PsetEX {
+				unit = 1
+			}
+			if ttl, err := strconv.ParseInt(args[1], 10, 64); err == nil {
+				return []Change{&StringSet{ChangeHeader: h, Key: args[0], Value: args[2], ExpireAt: c.now() + ttl*unit}}
+			}
+		}
+	case Mset, MsetNX:
+		if len(args) > 0 && len(args)%2 == 0 {
+			var changes []Change
+			for i := 0; i < len(args); i += 2 {
+				changes = append(changes, &StringSet{ChangeHeader: h, Key: args[i], Value: args[i+1]})
+			}
+			return changes
+		}
+	case Hset, HmSet, HsetNx:
+		if len(args) >= 3 && len(args)%2 == 1 {
+			set := &HashFieldsSet{ChangeHeader: h, Key: args[0], OnlyNew: cmd.Type() == HsetNx}
+			for i := 1; i < len(args); i += 2 {
+				set.Fields = append(set.Fields, FieldValue{args[i], args[i+1]})
+			}
+			return []Change{set}
+		}
+	case Hdel:
+		if len(args) >= 2 {
+			return []Change{&HashFieldsDeleted{ChangeHeader: h, Key: args[0], Fields: args[1:]}}
+		}
+	case Lpush, LpushX, Rpush, RpushX:
+		if len(args) >= 2 {
+			push := &ListPush{ChangeHeader: h, Key: args[0], Values: args[1:], Side: ListLeft}
+			if t := cmd.Type(); t == Rpush || t == RpushX {
+				push.Side = ListRight
+			}
+			push.OnlyExisting = cmd.Type() == LpushX || cmd.Type() == RpushX
+			return []Change{push}
+		}
+	case Sadd:
+		if len(args) >= 2 {
+			return []Change{&SetAdd{ChangeHeader: h, Key: args[0], Members: args[1:]}}
+		}
+	case Srem:
+		if len(args) >= 2 {
+			return []Change{&SetRemove{ChangeHeader: h, Key: args[0], Members: args[1:]}}
+		}
+	case Zadd:
+		return c.parseZadd(h, args)
+	case Zrem:
+		if len(args) >= 2 {
+			return []Change{&ZSetRemove{ChangeHeader: h, Key: args[0], Members: args[1:]}}
+		}
+	case Xadd:
+		return c.parseXadd(h, args)
+	case Expire, Pexpire, ExpireAt, PexpireAt:
+		if len(args) >= 2 {
+			n, err := strconv.ParseInt(args[1], 10, 64)
+			if err != nil {
+				return nil
+			}
+			switch cmd.Type() {
+			case Expire:
+				n = c.now() + n*1000
+			case Pexpire:
+				n = c.now() + n
+			case ExpireAt:
+				n *= 1000
+			}
+			return []Change{&ExpireSet{ChangeHeader: h, Key: args[0], ExpireAt: n}}
+		}
+	case Persist:
+		if len(args) == 1 {
+			return []Change{&ExpireSet{ChangeHeader: h, Key: args[0]}}
+		}
+	case Delete, Unlink:
+		if len(args) >= 1 {
+			return []Change{&KeysDeleted{ChangeHeader: h, Keys: args}}
+		}
+	case Rename, RenameNX:
+		if len(args) == 2 {
+			return []Change{&KeyRenamed{ChangeHeader: h, Key: args[0], NewKey: args[1], OnlyNew: cmd.Type() == RenameNX}}
+		}
+	case Eval, EvalSha:
+		if len(args) < 2 {
+			return nil
+		}
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 0 || n > len(args)-2 {
+			return nil
+		}
+		run := &ScriptRun{ChangeHeader: h, SHA: strings.ToLower(args[0]), Keys: args[2 : 2+n], Args: args[2+n:]}
+		if cmd.Type() == Eval {
+			run.Script, run.SHA = args[0], ScriptSHA(args[0])
+		}
+		return []Change{run}
+	case FlushDB, FlushAll:
+		return []Change{&DBFlushed{ChangeHeader: h, All: cmd.Type() == FlushAll}}
+	}
+	return nil
+}
+
+// parseSet parses SET key value [NX|XX] [GET] [EX s|PX ms|EXAT s|PXAT ms|KEEPTTL].
+func (c *ChangeDecoder) parseSet(h ChangeHeader, args []string) []Change {
+	if len(args) < 2 {
+		return nil
+	}
+	set := &StringSet{ChangeHeader: h, Key: args[0], Value: args[1]}
+	for i := 2; i < len(args); i++ {
+		switch opt := strings.ToUpper(args[i]); opt {
+		case "NX", "XX", "GET":
+		case "KEEPTTL":
+			set.KeepTTL = true
+		case "EX", "PX", "EXAT", "PXAT":
+			if i+1 >= len(args) {
+				return nil
+			}
+			i++
+			n, err := strconv.ParseInt(args[i], 10, 64)
+			if err != nil {
+				return nil
+			}
+			switch opt {
+			case "EX":
+				set.ExpireAt = c.now() + n*1000
+			case "PX":
+				set.ExpireAt = c.now() + n
+			case "EXAT":
+				set.ExpireAt = n * 1000
+			default:
+				set.ExpireAt = n
+			}
+		default:
+			return nil
+		}
+	}
+	return []Change{set}
+}
+
+// parseZadd parses ZADD key [NX|XX] [GT|LT] [CH] score member [score member ...],
+// ZADD INCR has no typed change as the score it sets is not known.
+func (c *ChangeDecoder) parseZadd(h ChangeHeader, args []string) []Change {
+	if len(args) < 3 {
+		return nil
+	}
+	add := &ZSetAdd{ChangeHeader: h, Key: args[0]}
+	i := 1
+	for ; i < len(args); i++ {
+		opt := strings.ToUpper(args[i])
+		if opt != "NX" && opt != "XX" && opt != "GT" && opt != "LT" && opt != "CH" {
+			break
+		}
+		add.Flags = append(add.Flags, opt)
+	}
+	if (len(args)-i)%2 != 0 || i == len(args) {
+		return nil
+	}
+	for ; i < len(args); i += 2 {
+		score, err := strconv.ParseFloat(args[i], 64)
+		if err != nil {
+			return nil
+		}
+		add.Members = append(add.Members, ScoredMember{Member: args[i+1], Score: score})
+	}
+	return []Change{add}
+}
+
+// parseXadd parses XADD key [NOMKSTREAM] [MAXLEN|MINID [=|~] threshold [LIMIT count]] id field value ...,
+// the trimming of the stream is not part of the change.
+func (c *ChangeDecoder) parseXadd(h ChangeHeader, args []string) []Change {
+	if len(args) < 4 {
+		return nil
+	}
+	i := 1
+	for i < len(args) {
+		switch strings.ToUpper(args[i]) {
+		case "NOMKSTREAM":
+			i++
+			continue
+		case "MAXLEN", "MINID":
+			i++
+			if i < len(args) && (args[i] == "=" || args[i] == "~") {
+				i++
+			}
+			i++
+			if i < len(args) && strings.EqualFold(args[i], "LIMIT") {
+				i += 2
+			}
+			continue
+		}
+		break
+	}
+	if i >= len(args) || (len(args)-i-1)%2 != 0 || len(args)-i-1 == 0 {
+		return nil
+	}
+	add := &StreamAdd{ChangeHeader: h, Key: args[0], ID: args[i]}
+	for i++; i < len(args); i += 2 {
+		add.Fields = append(add.Fields, FieldValue{args[i], args[i+1]})
+	}
+	return []Change{add}
+}
+
+func (c *ChangeDecoder) rdb() ChangeHeader {
+	return ChangeHeader{DB: c.db, Offset: -1}
+}
+
+func (c *ChangeDecoder) begin(key []byte, expiry int64) {
+	c.key, c.expiry = string(key), expiry
+}
+
+// end sets the expiry of the collection decoded.
+func (c *ChangeDecoder) end() {
+	if c.expiry > 0 {
+		c.emit(&ExpireSet{ChangeHeader: c.rdb(), Key: c.key, ExpireAt: c.expiry})
+	}
+	c.key = ""
+}
+
+func (c *ChangeDecoder) BeginRDB()                                 {}
+func (c *ChangeDecoder) EndRDB()                                   {}
+func (c *ChangeDecoder) Aux(key, value []byte)                     {}
+func (c *ChangeDecoder) ResizeDatabase(dbSize, expiresSize uint32) {}
+func (c *ChangeDecoder) EndDatabase(n int)                         {}
+
+func (c *ChangeDecoder) BeginDatabase(n int) {
+	c.db = n
+}
+
+func (c *ChangeDecoder) Set(key, value []byte, expiry int64) {
+	c.emit(&StringSet{ChangeHeader: c.rdb(), Key: string(key), Value: string(value), ExpireAt: expiry})
+}
+
+func (c *ChangeDecoder) BeginHash(key []byte, length, expiry int64) { c.begin(key, expiry) }
+func (c *ChangeDecoder) Hset(key, field, value []byte) {
+	c.emit(&HashFieldsSet{ChangeHeader: c.rdb(), Key: c.key, Fields: []FieldValue{{string(field), string(value)}}})
+}
+func (c *ChangeDecoder) EndHash(key []byte) { c.end() }
+
+func (c *ChangeDecoder) BeginSet(key []byte, cardinality, expiry int64) { c.begin(key, expiry) }
+func (c *ChangeDecoder) Sadd(key, member []byte) {
+	c.emit(&SetAdd{ChangeHeader: c.rdb(), Key: c.key, Members: []string{string(member)}})
+}
+func (c *ChangeDecoder) EndSet(key []byte) { c.end() }
+
+func (c *ChangeDecoder) BeginList(key []byte, length, expiry int64) { c.begin(key, expiry) }
+func (c *ChangeDecoder) Rpush(key, value []byte) {
+	c.emit(&ListPush{ChangeHeader: c.rdb(), Key: c.key, Side: ListRight, Values: []string{string(value)}})
+}
+func (c *ChangeDecoder) EndList(key []byte) { c.end() }
+
+func (c *ChangeDecoder) BeginZSet(key []byte, cardinality, expiry int64) { c.begin(key, expiry) }
+func (c *ChangeDecoder) Zadd(key []byte, score float64, member []byte) {
+	c.emit(&ZSetAdd{ChangeHeader: c.rdb(), Key: c.key, Members: []ScoredMember{{string(member), score}}})
+}
+func (c *ChangeDecoder) EndZSet(key []byte) { c.end() }
+
+func (c *ChangeDecoder) BeginStream(key []byte, cardinality, expiry int64) { c.begin(key, expiry) }
+
+// Xadd adds an entry of one field, the fields and values of larger entries cannot
+// be told apart once joined: Err reports them, they go through XaddEntry.
+func (c *ChangeDecoder) Xadd(key, id, listpack []byte) {
+	fields, err := splitStreamEntry(listpack)
+	if err != nil {
+		if c.err == nil {
+			c.err = errors.Wrapf(err, "stream %s entry %s", key, id)
+		}
+		return
+	}
+	c.XaddEntry(key, id, fields)
+}
+
+// XaddEntry implements StreamEntryDecoder.
+func (c *ChangeDecoder) XaddEntry(key, id []byte, fields []FieldValue) {
+	c.emit(&StreamAdd{ChangeHeader: c.rdb(), Key: c.key, ID: string(id), Fields: append([]FieldValue(nil), fields...)})
+}
+func (c *ChangeDecoder) EndStream(key []byte) { c.end() }
@@ -0,0 +1,55 @@
+package canal
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// Position is where a replica stands in the replication stream of a master:
+// the replication ID and the offset of the last byte applied.
+type Position struct {
+	RunID  string `json:"run_id"`
+	Offset int64  `json:"offset"`
+}
+
+// LoadPosition reads the position saved in the file at path, nil if there is none.
+func LoadPosition(path string) (*Position, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	pos := new(Position)
+	if err := json.Unmarshal(data, pos); err != nil {
+		return nil, errors.Wrapf(err, "checkpoint %s", path)
+	}
+	return pos, nil
+}
+
+// Save writes the position to the file at path, replacing it atomically.
+func (p *Position) Save(path string) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,520 @@
+package canal
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ClusterSlots is the number of hash slots of a redis cluster.
+const ClusterSlots = 16384
+
+// KeySlot returns the hash slot of key in a redis cluster: the CRC16 of the key,
+// or of its hash tag, the part between the first { and the next } when not empty.
+func KeySlot(key string) int {
+	if i := strings.IndexByte(key, '{'); i >= 0 {
+		if j := strings.IndexByte(key[i+1:], '}'); j > 0 {
+			key = key[i+1 : i+1+j]
+		}
+	}
+	return int(crc16([]byte(key)) % ClusterSlots)
+}
+
+// commandSlot returns the hash slot of the keys of cmd, -1 if it has none.
+func commandSlot(cmd *Command) int {
+	keys := cmd.Keys()
+	if len(keys) == 0 {
+		return -1
+	}
+	return KeySlot(keys[0])
+}
+
+// ClusterNode is a master of a redis cluster.
+type ClusterNode struct {
+	ID   string
+	Addr string
+	// Slots are the ranges of hash slots the master serves, first and last included.
+	Slots [][2]int
+}
+
+// serves reports whether the node serves one of the slots of other.
+func (n *ClusterNode) serves(other *ClusterNode) bool {
+	for _, a := range n.Slots {
+		for _, b := range other.Slots {
+			if a[0] <= b[1] && b[0] <= a[1] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ClusterCommand is a command replicated from a master of a cluster.
+type ClusterCommand struct {
+	*Command
+	// Node is the ID of the master, Addr its address.
+	Node string
+	Addr string
+	// Slot is the hash slot of the keys of the command, -1 for the commands
+	// without keys like MULTI or FLUSHALL.
+	Slot int
+}
+
+type ClusterConfig struct {
+	// Seeds are addresses of nodes of the cluster, the topology is asked to the
+	// first which answers.
+	Seeds []string
+	// Config is the Config of the canals of the masters, but for the Address and
+	// the Position. The Capture and the Buffer of a master get a directory named
+	// after its node ID in theirs; each run of the canal of a master captures to
+	// a directory of its own in it, named after the UTC time it started at.
+	Config *Config
+	// Checkpoints, when set, is the directory the position of each master is saved
+	// in, a file named after its node ID, once a second and when its canal stops.
+	// The canals resume from them.
+	Checkpoints string
+	// Refresh is the interval of the discoveries of the topology, 10 seconds by
+	// default. The end of the link to a master also triggers one.
+	Refresh time.Duration
+}
+
+func NewClusterConfig(seeds ...string) *ClusterConfig {
+	return &ClusterConfig{Seeds: seeds, Config: NewConfig(""), Refresh: 10 * time.Second}
+}
+
+// Cluster replicates a redis cluster: it discovers the masters with CLUSTER SHARDS,
+// or CLUSTER SLOTS before redis 7, from a seed and runs a canal per master. The
+// masters may run redis up to 7.2, whose full syncs are RDB version 11 at most.
+//
+// The topology is discovered again periodically to follow resharding and failovers:
+// the canals of the nodes which are not masters any more are stopped, the new
+// masters get one. A master promoted in place of a failed one resumes from the
+// position of the master whose slots it took, the replication ID of which it
+// keeps, or full syncs.
+type Cluster struct {
+	cfg *ClusterConfig
+
+	mu sync.Mutex
+	// nodes are the masters of the last topology discovered, links the canals running.
+	nodes     []ClusterNode
+	links     map[string]*clusterLink
+	positions map[string]*Position
+	wg        sync.WaitGroup
+
+	// deliver makes the calls of fn one at a time.
+	deliver sync.Mutex
+	fn      func(*ClusterCommand) error
+
+	refresh   chan struct{}
+	failed    chan error
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// clusterLink is the canal of a master.
+type clusterLink struct {
+	cl   *Cluster
+	node ClusterNode
+	c    *Canal
+	// saved is the time the position was last saved at.
+	saved time.Time
+	// err is the error of fn which stopped the canal.
+	err error
+}
+
+func NewCluster(cfg *ClusterConfig) (*Cluster, error) {
+	if len(cfg.Seeds) == 0 {
+		return nil, errors.Errorf("cluster has no seed.")
+	}
+	if cfg.Config == nil {
+		c := *cfg
+		c.Config = NewConfig("")
+		cfg = &c
+	}
+	return &Cluster{
+		cfg:       cfg,
+		links:     make(map[string]*clusterLink),
+		positions: make(map[string]*Position),
+		refresh:   make(chan struct{}, 1),
+		failed:    make(chan error, 1),
+		closed:    make(chan struct{}),
+	}, nil
+}
+
+// Run replicates the masters until Close or until fn fails, fn is called with the
+// commands of all masters, one at a time. The commands of a master come in order,
+// the ones of different masters are interleaved.
+func (cl *Cluster) Run(fn func(*ClusterCommand) error) error {
+	if fn == nil {
+		return errors.Errorf("cluster command func is nil.")
+	}
+	cl.fn = fn
+	defer cl.stop()
+	refresh := cl.cfg.Refresh
+	if refresh <= 0 {
+		refresh = 10 * time.Second
+	}
+	ticker := time.NewTicker(refresh)
+	defer ticker.Stop()
+	discovered := false
+	for {
+		nodes, err := cl.discover()
+		if err != nil && !discovered {
+			return err
+		}
+		if err != nil {
+			log.Printf("[CANAL] cluster discovery failed: %v\n", err)
+		} else {
+			discovered = true
+			cl.update(nodes)
+		}
+		select {
+		case <-cl.closed:
+			return nil
+		case err := <-cl.failed:
+			return err
+		case <-ticker.C:
+		case <-cl.refresh:
+			// a link which ends right away must not make a busy loop.
+			select {
+			case <-cl.closed:
+				return nil
+			case <-time.After(time.Second):
+			}
+		}
+	}
+}
+
+// Nodes returns the masters of the last topology discovered.
+func (cl *Cluster) Nodes() []ClusterNode {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return append([]ClusterNode(nil), cl.nodes...)
+}
+
+// Positions returns the positions reached in the replication of the masters, by node ID.
+func (cl *Cluster) Positions() map[string]Position {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	positions := make(map[string]Position, len(cl.positions))
+	for id, pos := range cl.positions {
+		positions[id] = *pos
+	}
+	return positions
+}
+
+// Close stops Run and the canals.
+func (cl *Cluster) Close() {
+	cl.closeOnce.Do(func() {
+		close(cl.closed)
+	})
+}
+
+// stop closes the canals and waits for them.
+func (cl *Cluster) stop() {
+	cl.mu.Lock()
+	for _, l := range cl.links {
+		l.c.Close()
+	}
+	cl.mu.Unlock()
+	cl.wg.Wait()
+}
+
+// discover asks the topology to the seeds, then to the masters known.
+func (cl *Cluster) discover() ([]ClusterNode, error) {
+	addrs := append([]string(nil), cl.cfg.Seeds...)
+	for _, n := range cl.Nodes() {
+		addrs = append(addrs, n.Addr)
+	}
+	var err error
+	for _, addr := range addrs {
+		var nodes []ClusterNode
+		if nodes, err = clusterTopology(addr, cl.cfg.Config.Password, cl.cfg.Config.TLS); err == nil {
+			return nodes, nil
+		}
+	}
+	return nil, err
+}
+
+// update stops the canals of the nodes which are not masters any more and starts
+// the ones of the new masters.
+func (cl *Cluster) update(nodes []ClusterNode) {
+	cl.mu.Lock()
+	masters := make(map[string]bool, len(nodes))
+	for _, n := range nodes {
+		masters[n.ID] = true
+	}
+	for id, l := range cl.links {
+		if !masters[id] {
+			log.Printf("[CANAL] cluster node %s at %s is not a master any more.\n", id, l.node.Addr)
+			l.c.Close()
+		}
+	}
+	var starts []ClusterNode
+	var positions []*Position
+	for _, n := range nodes {
+		if l, ok := cl.links[n.ID]; ok {
+			l.node.Slots = n.Slots
+			continue
+		}
+		pos, err := cl.position(n, masters)
+		if err != nil {
+			log.Printf("[CANAL] cluster node %s at %s: %v\n", n.ID, n.Addr, err)
+			continue
+		}
+		starts, positions = append(starts, n), append(positions, pos)
+	}
+	cl.nodes = nodes
+	cl.mu.Unlock()
+
+	for i, n := range starts {
+		if err := cl.start(n, positions[i]); err != nil {
+			log.Printf("[CANAL] cluster node %s at %s: %v\n", n.ID, n.Addr, err)
+		}
+	}
+}
+
+// start runs the canal of the master n from pos.
+func (cl *Cluster) start(n ClusterNode, pos *Position) error {
+	cfg := *cl.cfg.Config
+	cfg.Address, cfg.Position = n.Addr, pos
+	if cfg.Capture != nil {
+		capture := *cfg.Capture
+		// a capture is never recorded over, the canals started again get a new one.
+		capture.Dir = filepath.Join(capture.Dir, n.ID, time.Now().UTC().Format("20060102T150405.000000000Z"))
+		cfg.Capture = &capture
+	}
+	if cfg.Buffer != nil && cfg.Buffer.Dir != "" {
+		buffer := *cfg.Buffer
+		buffer.Dir = filepath.Join(buffer.Dir, n.ID)
+		cfg.Buffer = &buffer
+	}
+	c, err := NewCanal(&cfg)
+	if err != nil {
+		return err
+	}
+	l := &clusterLink{cl: cl, node: n, c: c}
+	cl.mu.Lock()
+	cl.links[n.ID] = l
+	cl.wg.Add(1)
+	cl.mu.Unlock()
+	go cl.run(l)
+	return nil
+}
+
+// position returns the position the master n resumes from: its own, or the one
+// of a master of the previous topology it replaced, nil for a full sync. cl.mu is held.
+func (cl *Cluster) position(n ClusterNode, masters map[string]bool) (*Position, error) {
+	if pos := cl.positions[n.ID]; pos != nil {
+		return pos, nil
+	}
+	if cl.cfg.Checkpoints != "" {
+		pos, err := LoadPosition(cl.checkpoint(n.ID))
+		if err != nil || pos != nil {
+			return pos, err
+		}
+	}
+	for i := range cl.nodes {
+		if old := &cl.nodes[i]; !masters[old.ID] && old.serves(&n) && cl.positions[old.ID] != nil {
+			log.Printf("[CANAL] cluster node %s replaces %s, resuming from its position.\n", n.ID, old.ID)
+			return cl.positions[old.ID], nil
+		}
+	}
+	return nil, nil
+}
+
+// checkpoint returns the path of the checkpoint of the node id.
+func (cl *Cluster) checkpoint(id string) string {
+	return filepath.Join(cl.cfg.Checkpoints, id+".json")
+}
+
+// run runs the canal of l until it stops.
+func (cl *Cluster) run(l *clusterLink) {
+	defer cl.wg.Done()
+	err := l.c.Run(l)
+	l.c.Close()
+	cl.mu.Lock()
+	if cl.links[l.node.ID] == l {
+		delete(cl.links, l.node.ID)
+	}
+	pos := cl.positions[l.node.ID]
+	cl.mu.Unlock()
+	if pos != nil && cl.cfg.Checkpoints != "" {
+		if err := pos.Save(cl.checkpoint(l.node.ID)); err != nil {
+			log.Printf("[CANAL] cluster node %s checkpoint: %v\n", l.node.ID, err)
+		}
+	}
+	select {
+	case <-cl.closed:
+		return
+	default:
+	}
+	if l.err != nil {
+		select {
+		case cl.failed <- l.err:
+		default:
+		}
+		return
+	}
+	if err != nil {
+		log.Printf("[CANAL] cluster node %s at %s: %v\n", l.node.ID, l.node.Addr, err)
+	}
+	select {
+	case cl.refresh <- struct{}{}:
+	default:
+	}
+}
+
+func (l *clusterLink) Command(cmd *Command) error {
+	cl := l.cl
+	cl.deliver.Lock()
+	err := cl.fn(&ClusterCommand{Command: cmd, Node: l.node.ID, Addr: l.node.Addr, Slot: commandSlot(cmd)})
+	cl.deliver.Unlock()
+	if err != nil {
+		l.err = err
+		return err
+	}
+	if cmd.Offset < 0 {
+		return nil
+	}
+	runID := l.c.RunID()
+	if runID == "" || runID == "?" {
+		return nil
+	}
+	pos := &Position{RunID: runID, Offset: cmd.Offset}
+	cl.mu.Lock()
+	cl.positions[l.node.ID] = pos
+	cl.mu.Unlock()
+	if cl.cfg.Checkpoints != "" && time.Since(l.saved) >= time.Second {
+		l.saved = time.Now()
+		return pos.Save(cl.checkpoint(l.node.ID))
+	}
+	return nil
+}
+
+// clusterTopology returns the masters of the cluster the node at addr is part of.
+func clusterTopology(addr, password string, tlsConfig *tls.Config) ([]ClusterNode, error) {
+	conn, err := dialRedis(addr, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	rd, wr := NewReader(conn), NewWriter(conn)
+	do := func(args ...interface{}) (Value, error) {
+		if err := wr.WriteMultiBulk(args[0].(string), args[1:]...); err != nil {
+			return Value{}, err
+		}
+		if err := wr.Flush(); err != nil {
+			return Value{}, err
+		}
+		reply, _, err := rd.ReadValue()
+		if err != nil {
+			return Value{}, err
+		}
+		if reply.Type() == Error {
+			return Value{}, errors.Errorf("%s: %s", args[0], reply.String())
+		}
+		return reply, nil
+	}
+	if password != "" {
+		if _, err := do("AUTH", password); err != nil {
+			return nil, err
+		}
+	}
+	var nodes []ClusterNode
+	if reply, err := do("CLUSTER", "SHARDS"); err == nil {
+		nodes = clusterShards(reply, tlsConfig != nil)
+	} else if reply, err := do("CLUSTER", "SLOTS"); err == nil {
+		nodes = clusterSlots(reply)
+	} else {
+		return nil, err
+	}
+	if len(nodes) == 0 {
+		return nil, errors.Errorf("cluster at %s has no master serving slots.", addr)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Slots[0][0] < nodes[j].Slots[0][0] })
+	return nodes, nil
+}
+
+// clusterShards returns the masters of a reply to CLUSTER SHARDS, their TLS port
+// when tlsPort is set.
+func clusterShards(reply Value, tlsPort bool) []ClusterNode {
+	var nodes []ClusterNode
+	for _, shard := range reply.Array() {
+		fields := shard.Array()
+		var slots [][2]int
+		var master *ClusterNode
+		for i := 0; i+1 < len(fields); i += 2 {
+			switch fields[i].String() {
+			case "slots":
+				ranges := fields[i+1].Array()
+				for j := 0; j+1 < len(ranges); j += 2 {
+					slots = append(slots, [2]int{ranges[j].Integer(), ranges[j+1].Integer()})
+				}
+			case "nodes":
+				for _, node := range fields[i+1].Array() {
+					attrs := make(map[string]string)
+					kv := node.Array()
+					for k := 0; k+1 < len(kv); k += 2 {
+						attrs[kv[k].String()] = kv[k+1].String()
+					}
+					if attrs["role"] != "master" || attrs["health"] == "fail" {
+						continue
+					}
+					host := attrs["endpoint"]
+					if host == "" || host == "?" {
+						host = attrs["ip"]
+					}
+					port := attrs["port"]
+					if tlsPort && attrs["tls-port"] != "" {
+						port = attrs["tls-port"]
+					}
+					master = &ClusterNode{ID: attrs["id"], Addr: net.JoinHostPort(host, port)}
+				}
+			}
+		}
+		if master != nil && len(slots) > 0 {
+			master.Slots = slots
+			nodes = append(nodes, *master)
+		}
+	}
+	return nodes
+}
+
+// clusterSlots returns the masters of a reply to CLUSTER SLOTS.
+func clusterSlots(reply Value) []ClusterNode {
+	var nodes []ClusterNode
+	index := make(map[string]int)
+	for _, r := range reply.Array() {
+		vals := r.Array()
+		if len(vals) < 3 {
+			continue
+		}
+		master := vals[2].Array()
+		if len(master) < 2 {
+			continue
+		}
+		addr := net.JoinHostPort(master[0].String(), strconv.Itoa(master[1].Integer()))
+		id := addr
+		if len(master) > 2 && master[2].String() != "" {
+			id = master[2].String()
+		}
+		i, ok := index[id]
+		if !ok {
+			i = len(nodes)
+			index[id] = i
+			nodes = append(nodes, ClusterNode{ID: id, Addr: addr})
+		}
+		nodes[i].Slots = append(nodes[i].Slots, [2]int{vals[0].Integer(), vals[1].Integer()})
+	}
+	return nodes
+}
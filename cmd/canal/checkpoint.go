@@ -0,0 +1,39 @@
+package main
+
+import (
+	"canal"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+func runCheckpoint(args []string) error {
+	if len(args) < 1 || (args[0] != "show" && args[0] != "reset") {
+		return errors.Errorf("usage: canal checkpoint show|reset -file path")
+	}
+	fs := flag.NewFlagSet("checkpoint "+args[0], flag.ExitOnError)
+	file := fs.String("file", "", "checkpoint file")
+	fs.Parse(args[1:])
+	if *file == "" {
+		return errors.Errorf("-file is required")
+	}
+
+	if args[0] == "reset" {
+		if err := os.Remove(*file); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	pos, err := canal.LoadPosition(*file)
+	if err != nil {
+		return err
+	}
+	if pos == nil {
+		fmt.Println("no checkpoint saved.")
+		return nil
+	}
+	fmt.Printf("run_id %s\noffset %d\n", pos.RunID, pos.Offset)
+	return nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bufio"
+	"canal"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+func runCluster(args []string) error {
+	fs := flag.NewFlagSet("cluster", flag.ExitOnError)
+	var opts masterOptions
+	opts.register(fs)
+	checkpoints := fs.String("checkpoints", "", "directory to resume from and save the position of each master to")
+	refresh := fs.Duration("refresh", 0, "interval of the discoveries of the topology (default 10s)")
+	fs.Parse(args)
+
+	cfg, err := opts.config()
+	if err != nil {
+		return err
+	}
+	ccfg := canal.NewClusterConfig(strings.Split(opts.addr, ",")...)
+	ccfg.Config, ccfg.Checkpoints = cfg, *checkpoints
+	if *refresh > 0 {
+		ccfg.Refresh = *refresh
+	}
+	cl, err := canal.NewCluster(ccfg)
+	if err != nil {
+		return err
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		cl.Close()
+	}()
+	w := bufio.NewWriter(os.Stdout)
+	return cl.Run(func(cmd *canal.ClusterCommand) error {
+		if _, err := fmt.Fprintf(w, "%s %d %d %s\n", cmd.Node, cmd.Slot, cmd.Offset, quoteArgs(cmd.D)); err != nil {
+			return err
+		}
+		return w.Flush()
+	})
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bufio"
+	"canal"
+	"flag"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+func runConvert(args []string) error {
+	fs := flag.NewFlagSet("convert", flag.ExitOnError)
+	var opts filterOptions
+	opts.register(fs)
+	format := fs.String("format", "aof", "output format: aof, json or rdb")
+	binary := fs.String("binary", "escaped", "encoding of keys and values in json: escaped or base64")
+	version := fs.Int("rdb-version", 9, "RDB version of the rdb format")
+	batch := fs.Int("batch", 0, "members of a collection per aof command, 0 for as many as a command holds")
+	fs.Parse(args)
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		return errors.Errorf("usage: canal convert [flags] dump.rdb [output]")
+	}
+	filter, err := opts.filter()
+	if err != nil {
+		return err
+	}
+
+	in, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	var w io.Writer = os.Stdout
+	if fs.NArg() == 2 {
+		out, err := os.Create(fs.Arg(1))
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+		w = out
+	}
+	d, done, err := rdbOutput(w, *format, *binary, *version, *batch)
+	if err != nil {
+		return err
+	}
+	if d == nil {
+		return errors.Errorf("unknown format %q", *format)
+	}
+	if filter != nil {
+		d = filter.Decoder(d)
+	}
+	if err := canal.DecodeFile(bufio.NewReader(in), d); err != nil {
+		return err
+	}
+	return done()
+}
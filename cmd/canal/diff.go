@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"canal"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// diffReport writes the differences as a JSON document, the differences
+// first as they are found, then the summary.
+type diffReport struct {
+	f     *os.File
+	w     *bufio.Writer
+	enc   canal.BinaryEncoding
+	count int
+}
+
+// openDiffReport starts the report written to path, - for stdout, or returns nil without a path.
+func openDiffReport(path string, enc canal.BinaryEncoding) (*diffReport, error) {
+	if path == "" {
+		return nil, nil
+	}
+	r := &diffReport{enc: enc}
+	var w io.Writer = os.Stdout
+	if path != "-" {
+		f, err := os.Create(path)
+		if err != nil {
+			return nil, err
+		}
+		r.f, w = f, f
+	}
+	r.w = bufio.NewWriter(w)
+	r.w.WriteString("{\"differences\": [")
+	return r, nil
+}
+
+func (r *diffReport) close() {
+	if r != nil && r.f != nil {
+		r.f.Close()
+	}
+}
+
+func (r *diffReport) add(d *canal.KeyDiff) error {
+	if r.count > 0 {
+		r.w.WriteString(",")
+	}
+	r.count++
+	diff := *d
+	diff.Key = canal.EncodeBinary([]byte(d.Key), r.enc)
+	line, err := json.Marshal(&diff)
+	if err != nil {
+		return err
+	}
+	r.w.WriteString("\n  ")
+	_, err = r.w.Write(line)
+	return err
+}
+
+func (r *diffReport) end(s *canal.DiffSummary) error {
+	summary, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(r.w, "\n],\n\"summary\": %s}\n", summary)
+	return r.w.Flush()
+}
+
+func runDiff(args []string) error {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	output := fs.String("o", "", "file of the detailed JSON report, - for stdout")
+	binary := fs.String("binary", "escaped", "encoding of binary keys in the report: escaped or base64")
+	tolerance := fs.Duration("ttl-tolerance", 0, "how much the expiries of a key may differ")
+	maxKeys := fs.Int("max-keys", 1<<20, "key digests held in memory, more are sorted in temporary files")
+	tmp := fs.String("tmp", "", "directory of the temporary files")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		return errors.Errorf("usage: canal diff [flags] source.rdb target.rdb")
+	}
+	enc, err := binaryEncoding(*binary)
+	if err != nil {
+		return err
+	}
+
+	source, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	target, err := os.Open(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+
+	report, err := openDiffReport(*output, enc)
+	if err != nil {
+		return err
+	}
+	defer report.close()
+	opts := &canal.DiffOptions{ExpiryTolerance: *tolerance, MaxKeys: *maxKeys, TempDir: *tmp}
+	summary, err := canal.DiffRDB(source, target, opts, func(d *canal.KeyDiff) error {
+		if report != nil {
+			return report.add(d)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if report != nil {
+		if err := report.end(summary); err != nil {
+			return err
+		}
+	}
+
+	// the summary goes to stderr when the report is written to stdout.
+	var w io.Writer = os.Stdout
+	if *output == "-" {
+		w = os.Stderr
+	}
+	printDiffSummary(w, summary)
+	if n := summary.Differences(); n > 0 {
+		return errors.Errorf("%d keys differ", n)
+	}
+	return nil
+}
+
+func printDiffSummary(w io.Writer, s *canal.DiffSummary) {
+	fmt.Fprintf(w, "source keys  %d\ntarget keys  %d\nequal        %d\nmissing      %d\nextra        %d\n"+
+		"type         %d\nvalue        %d\nexpiry       %d\n",
+		s.SourceKeys, s.TargetKeys, s.Equal, s.Missing, s.Extra, s.Type, s.Value, s.Expiry)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"canal"
+	"flag"
+	"io"
+	"os"
+)
+
+func runDump(args []string) error {
+	fs := flag.NewFlagSet("dump", flag.ExitOnError)
+	var opts masterOptions
+	opts.register(fs)
+	output := fs.String("o", "-", "output file, - for stdout")
+	format := fs.String("format", "rdb", "output format: rdb, aof, json or text")
+	binary := fs.String("binary", "escaped", "encoding of keys and values in json: escaped or base64")
+	version := fs.Int("rdb-version", 9, "RDB version of the rdb format and of RESTORE payloads")
+	restore := fs.Bool("restore", false, "write one RESTORE command per key in the aof or text formats")
+	batch := fs.Int("batch", 0, "group up to this many members of a collection per command")
+	fs.Parse(args)
+
+	cfg, err := opts.config()
+	if err != nil {
+		return err
+	}
+	cfg.Restore, cfg.RestoreVersion, cfg.BatchCount = *restore, *version, *batch
+	var w io.Writer = os.Stdout
+	if *output != "-" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	c, err := canal.NewCanal(cfg)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if !*restore {
+		d, done, err := rdbOutput(w, *format, *binary, *version, *batch)
+		if err != nil {
+			return err
+		}
+		if d != nil {
+			if err := c.Snapshot(filtered(cfg, d)); err != nil {
+				return err
+			}
+			return done()
+		}
+	}
+	out, err := newCommandWriter(w, *format, *binary, false)
+	if err != nil {
+		return err
+	}
+	if err := c.Sync(out); err != nil {
+		return err
+	}
+	return out.Flush()
+}
+
+// filtered returns d behind the filter of cfg, if any.
+func filtered(cfg *canal.Config, d canal.Decoder) canal.Decoder {
+	if cfg.Filter != nil {
+		return cfg.Filter.Decoder(d)
+	}
+	return d
+}
+
+// rdbOutput returns a Decoder writing an RDB to w in the format and the function
+// ending the output, or a nil Decoder for the formats written from commands.
+func rdbOutput(w io.Writer, format, binary string, version, batch int) (canal.Decoder, func() error, error) {
+	switch format {
+	case "rdb":
+		enc, err := canal.NewEncoder(w, version)
+		if err != nil {
+			return nil, nil, err
+		}
+		return enc, enc.Err, nil
+	case "json":
+		enc, err := binaryEncoding(binary)
+		if err != nil {
+			return nil, nil, err
+		}
+		j := canal.NewJSONWriter(w, enc)
+		return j, j.Flush, nil
+	case "aof":
+		a := canal.NewAOFWriter(w, batch)
+		return a, a.Flush, nil
+	}
+	return nil, nil, nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"canal"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func runInspect(args []string) error {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	format := fs.String("format", "text", "output format: text, json, or csv for a row per key")
+	top := fs.Int("top", 10, "number of biggest keys to list")
+	separator := fs.String("separator", ":", "separator ending the key prefixes to aggregate by")
+	output := fs.String("o", "-", "output file, - for stdout")
+	var filter filterOptions
+	filter.register(fs)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.Errorf("usage: canal inspect [flags] dump.rdb")
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var w io.Writer = os.Stdout
+	if *output != "-" {
+		out, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+		w = out
+	}
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	a := canal.NewAnalyzer(*top)
+	a.Separator = *separator
+	var rows *csv.Writer
+	switch *format {
+	case "text", "json":
+	case "csv":
+		rows = csv.NewWriter(bw)
+		rows.Write([]string{"db", "type", "key", "bytes", "encoding", "elements", "largest_element", "expiry", "serialized"})
+		a.OnKey = func(k *canal.KeyMemory) {
+			rows.Write([]string{
+				strconv.Itoa(k.DB), k.Type, k.Key, strconv.FormatInt(k.Bytes, 10), k.Encoding,
+				strconv.FormatInt(k.Elements, 10), strconv.FormatInt(k.LargestElement, 10), formatExpiry(k.Expiry),
+				strconv.FormatInt(k.Serialized, 10),
+			})
+		}
+	default:
+		return errors.Errorf("unknown format %q", *format)
+	}
+	ft, err := filter.filter()
+	if err != nil {
+		return err
+	}
+	var d canal.Decoder = a
+	if ft != nil {
+		d = ft.Decoder(a)
+	}
+	if err := canal.DecodeFile(bufio.NewReader(f), d); err != nil {
+		return err
+	}
+
+	switch *format {
+	case "csv":
+		rows.Flush()
+		return rows.Error()
+	case "json":
+		enc := json.NewEncoder(bw)
+		enc.SetIndent("", "  ")
+		return enc.Encode(a.Report())
+	}
+	printReport(bw, a.Report())
+	return nil
+}
+
+func formatExpiry(ms int64) string {
+	if ms <= 0 {
+		return ""
+	}
+	return time.Unix(0, ms*int64(time.Millisecond)).UTC().Format(time.RFC3339)
+}
+
+func printReport(w io.Writer, r *canal.MemoryReport) {
+	aux := make([]string, 0, len(r.Aux))
+	for k := range r.Aux {
+		aux = append(aux, k)
+	}
+	sort.Strings(aux)
+	for _, k := range aux {
+		fmt.Fprintf(w, "%-16s %s\n", k, r.Aux[k])
+	}
+	fmt.Fprintf(w, "\ntotal: %d keys, %d expires, %d elements, %d bytes\n",
+		r.Total.Keys, r.Total.Expires, r.Total.Elements, r.Total.Bytes)
+
+	dbs := make([]int, 0, len(r.DBs))
+	for db := range r.DBs {
+		dbs = append(dbs, db)
+	}
+	sort.Ints(dbs)
+	fmt.Fprintf(w, "\ndatabases:\n")
+	for _, db := range dbs {
+		printStats(w, "db"+strconv.Itoa(db), r.DBs[db])
+	}
+	for _, group := range []struct {
+		title string
+		stats map[string]*canal.MemoryStats
+	}{{"types", r.Types}, {"encodings", r.Encodings}, {"prefixes", r.Prefixes}} {
+		names := make([]string, 0, len(group.stats))
+		for name := range group.stats {
+			names = append(names, name)
+		}
+		// the biggest first.
+		sort.Slice(names, func(i, j int) bool {
+			return group.stats[names[i]].Bytes > group.stats[names[j]].Bytes
+		})
+		fmt.Fprintf(w, "\n%s:\n", group.title)
+		for _, name := range names {
+			printStats(w, quoteArgs([]string{name}), group.stats[name])
+		}
+	}
+	if len(r.Largest) > 0 {
+		fmt.Fprintf(w, "\nbiggest keys:\n")
+		for _, k := range r.Largest {
+			fmt.Fprintf(w, "  db%d %-6s %-10s %10d bytes %8d elements  %s\n",
+				k.DB, k.Type, k.Encoding, k.Bytes, k.Elements, quoteArgs([]string{k.Key}))
+		}
+	}
+}
+
+func printStats(w io.Writer, name string, s *canal.MemoryStats) {
+	fmt.Fprintf(w, "  %-20s %8d keys %8d expires %10d elements %12d bytes\n", name, s.Keys, s.Expires, s.Elements, s.Bytes)
+}
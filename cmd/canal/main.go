@@ -0,0 +1,58 @@
+// Command canal replicates a redis master: it prints, dumps or replays its data
+// and inspects RDB files.
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+)
+
+type subcommand struct {
+	name  string
+	usage string
+	run   func(args []string) error
+}
+
+var subcommands = []subcommand{
+	{"tail", "follow a master and print its commands", runTail},
+	{"dump", "full sync a master into an RDB, AOF or JSON file", runDump},
+	{"sync", "replicate a master into another redis", runSync},
+	{"replay", "replay an AOF, multi-part AOF or capture to stdout or another redis", runReplay},
+	{"cluster", "follow the masters of a redis cluster and print their commands", runCluster},
+	{"publish", "publish the changes of a master to subscribers over TCP or HTTP", runPublish},
+	{"relay", "serve the replication stream of a master to redis replicas", runRelay},
+	{"restore", "restore the dataset of a capture at an offset or a time", runRestore},
+	{"convert", "convert an RDB file to AOF, JSON or another RDB version", runConvert},
+	{"diff", "compare two RDB files key by key", runDiff},
+	{"verify", "check a redis replicated by sync matches its master", runVerify},
+	{"inspect", "estimate the memory of the keys of an RDB file", runInspect},
+	{"checkpoint", "show or reset a saved replication position", runCheckpoint},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: canal <command> [flags]\n\ncommands:\n")
+	for _, sub := range subcommands {
+		fmt.Fprintf(os.Stderr, "  %-11s %s\n", sub.name, sub.usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nrun `canal <command> -h` for the flags of a command.\n")
+}
+
+func main() {
+	log.SetOutput(os.Stderr)
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	for _, sub := range subcommands {
+		if sub.name == os.Args[1] {
+			if err := sub.run(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "canal %s: %v\n", sub.name, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+	usage()
+	os.Exit(2)
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"canal"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// listFlag collects the values of a flag given several times.
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, ",") }
+
+func (l *listFlag) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// intsFlag collects comma separated integers of a flag given several times.
+type intsFlag []int
+
+func (l *intsFlag) String() string {
+	s := make([]string, len(*l))
+	for i, n := range *l {
+		s[i] = strconv.Itoa(n)
+	}
+	return strings.Join(s, ",")
+}
+
+func (l *intsFlag) Set(v string) error {
+	for _, f := range strings.Split(v, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil {
+			return err
+		}
+		*l = append(*l, n)
+	}
+	return nil
+}
+
+// tlsOptions builds the TLS configuration of a connection.
+type tlsOptions struct {
+	enabled  bool
+	ca       string
+	cert     string
+	key      string
+	insecure bool
+}
+
+func (o *tlsOptions) register(fs *flag.FlagSet, prefix string) {
+	fs.BoolVar(&o.enabled, prefix+"tls", false, "connect over TLS")
+	fs.StringVar(&o.ca, prefix+"tls-ca", "", "CA certificate file to verify the server")
+	fs.StringVar(&o.cert, prefix+"tls-cert", "", "client certificate file")
+	fs.StringVar(&o.key, prefix+"tls-key", "", "client key file")
+	fs.BoolVar(&o.insecure, prefix+"tls-insecure", false, "do not verify the server certificate")
+}
+
+func (o *tlsOptions) config() (*tls.Config, error) {
+	if !o.enabled {
+		return nil, nil
+	}
+	cfg := &tls.Config{InsecureSkipVerify: o.insecure}
+	if o.ca != "" {
+		pem, err := ioutil.ReadFile(o.ca)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificate in %s", o.ca)
+		}
+	}
+	if o.cert != "" {
+		cert, err := tls.LoadX509KeyPair(o.cert, o.key)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// filterOptions are the flags selecting the keys, databases and commands.
+type filterOptions struct {
+	keys         listFlag
+	keyRegexps   listFlag
+	skipKeys     listFlag
+	skipRegexps  listFlag
+	dbs          intsFlag
+	skipDBs      intsFlag
+	commands     listFlag
+	skipCommands listFlag
+}
+
+func (o *filterOptions) register(fs *flag.FlagSet) {
+	fs.Var(&o.keys, "keys", "only keys matching this glob pattern, may be repeated")
+	fs.Var(&o.keyRegexps, "key-regexp", "only keys matching this regular expression, may be repeated")
+	fs.Var(&o.skipKeys, "skip-keys", "skip keys matching this glob pattern, may be repeated")
+	fs.Var(&o.skipRegexps, "skip-key-regexp", "skip keys matching this regular expression, may be repeated")
+	fs.Var(&o.dbs, "db", "only these databases, comma separated")
+	fs.Var(&o.skipDBs, "skip-db", "skip these databases, comma separated")
+	fs.Var(&o.commands, "commands", "only these commands, may be repeated")
+	fs.Var(&o.skipCommands, "skip-commands", "skip these commands, may be repeated")
+}
+
+func (o *filterOptions) filter() (*canal.Filter, error) {
+	f := &canal.Filter{
+		Keys:         o.keys,
+		SkipKeys:     o.skipKeys,
+		DBs:          o.dbs,
+		SkipDBs:      o.skipDBs,
+		Commands:     splitList(o.commands),
+		SkipCommands: splitList(o.skipCommands),
+	}
+	var err error
+	if f.KeyRegexps, err = compileAll(o.keyRegexps); err != nil {
+		return nil, err
+	}
+	if f.SkipKeyRegexps, err = compileAll(o.skipRegexps); err != nil {
+		return nil, err
+	}
+	if len(f.Keys)+len(f.KeyRegexps)+len(f.SkipKeys)+len(f.SkipKeyRegexps)+
+		len(f.DBs)+len(f.SkipDBs)+len(f.Commands)+len(f.SkipCommands) == 0 {
+		return nil, nil
+	}
+	return f, nil
+}
+
+// masterOptions are the flags of the commands replicating a master.
+type masterOptions struct {
+	addr     string
+	password string
+	capture  string
+	tls      tlsOptions
+	filterOptions
+}
+
+func (o *masterOptions) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.addr, "addr", "127.0.0.1:6379", "address of the master")
+	fs.StringVar(&o.password, "password", "", "password of the master")
+	fs.StringVar(&o.capture, "capture", "", "directory to record the replication stream to, for replay")
+	o.tls.register(fs, "")
+	o.filterOptions.register(fs)
+}
+
+func (o *masterOptions) config() (*canal.Config, error) {
+	cfg := canal.NewConfig(o.addr)
+	cfg.Password = o.password
+	if o.capture != "" {
+		cfg.Capture = canal.NewCaptureConfig(o.capture)
+	}
+	var err error
+	if cfg.TLS, err = o.tls.config(); err != nil {
+		return nil, err
+	}
+	if cfg.Filter, err = o.filter(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func compileAll(exprs []string) ([]*regexp.Regexp, error) {
+	var res []*regexp.Regexp
+	for _, expr := range exprs {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// splitList splits the comma separated values of a list flag.
+func splitList(l listFlag) []string {
+	var res []string
+	for _, v := range l {
+		for _, f := range strings.Split(v, ",") {
+			if f = strings.TrimSpace(f); f != "" {
+				res = append(res, f)
+			}
+		}
+	}
+	return res
+}
+
+// targetOptions are the flags of the commands writing to a redis.
+type targetOptions struct {
+	addr     string
+	password string
+	pipeline int
+	tls      tlsOptions
+}
+
+func (o *targetOptions) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.addr, "target", "", "address of the target redis")
+	fs.StringVar(&o.password, "target-password", "", "password of the target redis")
+	fs.IntVar(&o.pipeline, "pipeline", 128, "commands sent to the target before waiting for replies")
+	o.tls.register(fs, "target-")
+}
+
+func (o *targetOptions) target() (*canal.Target, error) {
+	cfg := canal.NewTargetConfig(o.addr)
+	cfg.Password, cfg.Pipeline = o.password, o.pipeline
+	var err error
+	if cfg.TLS, err = o.tls.config(); err != nil {
+		return nil, err
+	}
+	return canal.NewTarget(cfg)
+}
+
+// rewriteOptions are the flags renaming keys and databases.
+type rewriteOptions struct {
+	dbMap  string
+	prefix string
+}
+
+func (o *rewriteOptions) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.dbMap, "db-map", "", "databases to remap, like 0:3,1:4")
+	fs.StringVar(&o.prefix, "prefix", "", "prefix prepended to every key")
+}
+
+func (o *rewriteOptions) rewrite() (*canal.Rewrite, error) {
+	if o.dbMap == "" && o.prefix == "" {
+		return nil, nil
+	}
+	r := &canal.Rewrite{}
+	var err error
+	if r.DB, err = parseDBMap(o.dbMap); err != nil {
+		return nil, err
+	}
+	if o.prefix != "" {
+		r.Keys = []canal.KeyRule{canal.PrefixRule(o.prefix)}
+	}
+	return r, nil
+}
+
+// parseDBMap parses databases mappings like 0:3,1:4.
+func parseDBMap(s string) (map[int]int, error) {
+	if s == "" {
+		return nil, nil
+	}
+	m := make(map[int]int)
+	for _, pair := range strings.Split(s, ",") {
+		fields := strings.SplitN(pair, ":", 2)
+		if len(fields) != 2 {
+			return nil, errors.Errorf("invalid database mapping %q", pair)
+		}
+		from, err := strconv.Atoi(strings.TrimSpace(fields[0]))
+		if err != nil {
+			return nil, errors.Errorf("invalid database mapping %q", pair)
+		}
+		to, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+		if err != nil {
+			return nil, errors.Errorf("invalid database mapping %q", pair)
+		}
+		m[from] = to
+	}
+	return m, nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"canal"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// commandWriter is a CommandDecoder writing the commands as text, JSON lines or RESP,
+// the latter being the format of an AOF file.
+type commandWriter struct {
+	format string
+	w      *bufio.Writer
+	resp   *canal.Writer
+	json   *canal.JSONWriter
+	// runID returns the replication ID written in JSON events.
+	runID func() string
+	// sync flushes every command, for the output to be followed live.
+	sync bool
+}
+
+func newCommandWriter(w io.Writer, format string, binary string, sync bool) (*commandWriter, error) {
+	cw := &commandWriter{format: format, w: bufio.NewWriter(w), sync: sync}
+	switch format {
+	case "text":
+	case "json":
+		enc, err := binaryEncoding(binary)
+		if err != nil {
+			return nil, err
+		}
+		cw.json = canal.NewJSONWriter(cw.w, enc)
+	case "aof", "resp":
+		cw.resp = canal.NewWriter(cw.w)
+	default:
+		return nil, errors.Errorf("unknown format %q", format)
+	}
+	return cw, nil
+}
+
+func binaryEncoding(name string) (canal.BinaryEncoding, error) {
+	switch name {
+	case "escaped":
+		return canal.EscapedEncoding, nil
+	case "base64":
+		return canal.Base64Encoding, nil
+	}
+	return 0, errors.Errorf("unknown binary encoding %q", name)
+}
+
+func (cw *commandWriter) Command(cmd *canal.Command) error {
+	var err error
+	switch cw.format {
+	case "text":
+		_, err = fmt.Fprintf(cw.w, "%d %s\n", cmd.Offset, quoteArgs(cmd.D))
+	case "json":
+		if cw.runID != nil {
+			cw.json.RunID = cw.runID()
+		}
+		if err = cw.json.Command(cmd); err == nil && cw.sync {
+			err = cw.json.Flush()
+		}
+	default:
+		if err = cw.resp.WriteMultiBulk(cmd.CommandName(), cmd.Args()...); err == nil {
+			err = cw.resp.Flush()
+		}
+	}
+	if err == nil && cw.sync {
+		err = cw.w.Flush()
+	}
+	return err
+}
+
+func (cw *commandWriter) Flush() error {
+	if cw.json != nil {
+		if err := cw.json.Flush(); err != nil {
+			return err
+		}
+	}
+	return cw.w.Flush()
+}
+
+// quoteArgs joins the arguments, quoting the ones which are empty or not plain words.
+func quoteArgs(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = arg
+		if arg == "" || strings.IndexFunc(arg, func(r rune) bool { return r <= ' ' || r == '"' || r > '~' }) >= 0 {
+			quoted[i] = strconv.Quote(arg)
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
+// checkpointer saves the replication position at most once a second,
+// offset returns the offset of the last command applied.
+type checkpointer struct {
+	path   string
+	c      *canal.Canal
+	offset func() int64
+	saved  time.Time
+}
+
+// update saves the position if the last save is old enough,
+// it must be called from the CommandDecoder of the canal.
+func (cp *checkpointer) update() error {
+	if cp == nil || time.Since(cp.saved) < time.Second {
+		return nil
+	}
+	return cp.save()
+}
+
+func (cp *checkpointer) save() error {
+	if cp == nil {
+		return nil
+	}
+	runID, offset := cp.c.RunID(), cp.offset()
+	if runID == "" || runID == "?" || offset < 0 {
+		return nil
+	}
+	cp.saved = time.Now()
+	return (&canal.Position{RunID: runID, Offset: offset}).Save(cp.path)
+}
+
+// loadCheckpoint returns the position saved at path, nil without a path.
+func loadCheckpoint(path string) (*canal.Position, error) {
+	if path == "" {
+		return nil, nil
+	}
+	return canal.LoadPosition(path)
+}
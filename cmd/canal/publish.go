@@ -0,0 +1,65 @@
+package main
+
+import (
+	"canal"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+func runPublish(args []string) error {
+	fs := flag.NewFlagSet("publish", flag.ExitOnError)
+	var opts masterOptions
+	opts.register(fs)
+	listen := fs.String("listen", "", "address to serve the subscribers on, one JSON event per line")
+	httpAddr := fs.String("http", "", "address to serve the subscribers on as server-sent events")
+	backlog := fs.Int("backlog", 10000, "changes kept for the subscribers resuming from an offset")
+	fs.Parse(args)
+
+	if *listen == "" && *httpAddr == "" {
+		return errors.Errorf("-listen or -http is required")
+	}
+	cfg, err := opts.config()
+	if err != nil {
+		return err
+	}
+	pcfg := canal.NewPublisherConfig()
+	pcfg.Backlog = *backlog
+	p := canal.NewPublisher(pcfg)
+	defer p.Close()
+	if *listen != "" {
+		ln, err := net.Listen("tcp", *listen)
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := p.Serve(ln); err != nil {
+				log.Printf("[CANAL] publish: %v\n", err)
+			}
+		}()
+	}
+	if *httpAddr != "" {
+		ln, err := net.Listen("tcp", *httpAddr)
+		if err != nil {
+			return err
+		}
+		srv := &http.Server{Handler: p}
+		defer srv.Close()
+		go func() {
+			if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+				log.Printf("[CANAL] publish: %v\n", err)
+			}
+		}()
+	}
+
+	c, err := canal.NewCanal(cfg)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	closeOnSignal(c)
+	return c.Run(p)
+}
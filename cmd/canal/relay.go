@@ -0,0 +1,45 @@
+package main
+
+import (
+	"canal"
+	"flag"
+	"log"
+	"net"
+)
+
+func runRelay(args []string) error {
+	fs := flag.NewFlagSet("relay", flag.ExitOnError)
+	var opts masterOptions
+	opts.register(fs)
+	listen := fs.String("listen", "127.0.0.1:6380", "address to serve the replicas on")
+	backlog := fs.Int("backlog", 1<<20, "bytes of the stream kept for partial resyncs")
+	auth := fs.String("auth", "", "password the replicas must give")
+	rdbVersion := fs.Int("rdb-version", 9, "RDB version of the full syncs")
+	fs.Parse(args)
+
+	cfg, err := opts.config()
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", *listen)
+	if err != nil {
+		return err
+	}
+	rcfg := canal.NewRelayConfig()
+	rcfg.Backlog, rcfg.Password, rcfg.RDBVersion = *backlog, *auth, *rdbVersion
+	relay := canal.NewRelay(rcfg)
+	defer relay.Close()
+	go func() {
+		if err := relay.Serve(ln); err != nil {
+			log.Printf("[CANAL] relay: %v\n", err)
+		}
+	}()
+
+	c, err := canal.NewCanal(cfg)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	closeOnSignal(c)
+	return c.RunSnapshot(relay, relay)
+}
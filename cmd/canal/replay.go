@@ -0,0 +1,65 @@
+package main
+
+import (
+	"canal"
+	"flag"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+func runReplay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	var filter filterOptions
+	filter.register(fs)
+	var target targetOptions
+	target.register(fs)
+	var rewrite rewriteOptions
+	rewrite.register(fs)
+	format := fs.String("format", "text", "output format without -target: text, json or resp")
+	binary := fs.String("binary", "escaped", "encoding of keys and values in json: escaped or base64")
+	batch := fs.Int("batch", 0, "group up to this many members of a collection of the RDB preamble per command")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.Errorf("usage: canal replay [flags] appendonly.aof|appendonlydir|capturedir")
+	}
+	// a directory recorded with -capture is replayed as the master it was recorded from.
+	replay := canal.ReplayAOF
+	capture := canal.IsCapture(fs.Arg(0))
+	if capture {
+		replay = canal.ReplayCapture
+	}
+
+	cfg := canal.NewConfig("")
+	cfg.BatchCount = *batch
+	var err error
+	if cfg.Filter, err = filter.filter(); err != nil {
+		return err
+	}
+	if cfg.Rewrite, err = rewrite.rewrite(); err != nil {
+		return err
+	}
+	if target.addr == "" {
+		out, err := newCommandWriter(os.Stdout, *format, *binary, false)
+		if err != nil {
+			return err
+		}
+		if out.json != nil && !capture {
+			// the commands of an AOF have no offset, they are not the ones of a full sync.
+			out.json.Source = canal.SourceAOF
+		}
+		if err := replay(cfg, fs.Arg(0), out); err != nil {
+			return err
+		}
+		return out.Flush()
+	}
+	t, err := target.target()
+	if err != nil {
+		return err
+	}
+	err = replay(cfg, fs.Arg(0), t)
+	if terr := t.Close(); err == nil {
+		err = terr
+	}
+	return err
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"canal"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func runRestore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	var filter filterOptions
+	filter.register(fs)
+	var target targetOptions
+	target.register(fs)
+	var rewrite rewriteOptions
+	rewrite.register(fs)
+	offset := fs.Int64("offset", -1, "restore up to this replication offset, -1 for no limit")
+	at := fs.String("time", "", "restore up to this time, RFC 3339 like 2006-01-02T15:04:05Z07:00")
+	output := fs.String("o", "-", "output file without -target, - for stdout")
+	format := fs.String("format", "rdb", "output format without -target: rdb, aof or json")
+	binary := fs.String("binary", "escaped", "encoding of keys and values in json: escaped or base64")
+	version := fs.Int("rdb-version", 9, "RDB version of the rdb format")
+	batch := fs.Int("batch", 0, "group up to this many members of a collection per command")
+	skipped := fs.Bool("allow-skipped", false, "drop the keys of the commands which cannot be applied instead of failing")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.Errorf("usage: canal restore [flags] capturedir")
+	}
+
+	point := canal.PointInTime{Offset: *offset, AllowSkipped: *skipped}
+	if *at != "" {
+		t, err := time.Parse(time.RFC3339, *at)
+		if err != nil {
+			return err
+		}
+		point.Time = t
+	}
+	cfg := canal.NewConfig("")
+	cfg.BatchCount = *batch
+	var err error
+	if cfg.Filter, err = filter.filter(); err != nil {
+		return err
+	}
+	if cfg.Rewrite, err = rewrite.rewrite(); err != nil {
+		return err
+	}
+
+	var res *canal.Restored
+	if target.addr != "" {
+		t, err := target.target()
+		if err != nil {
+			return err
+		}
+		res, err = canal.RestoreCaptureCommands(cfg, fs.Arg(0), point, t)
+		if terr := t.Close(); err == nil {
+			err = terr
+		}
+		if err != nil {
+			return err
+		}
+	} else {
+		var w io.Writer = os.Stdout
+		if *output != "-" {
+			f, err := os.Create(*output)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+		d, done, err := rdbOutput(w, *format, *binary, *version, *batch)
+		if err != nil {
+			return err
+		}
+		if d == nil {
+			return errors.Errorf("unknown format %q", *format)
+		}
+		if res, err = canal.RestoreCapture(cfg, fs.Arg(0), point, d); err != nil {
+			return err
+		}
+		if err := done(); err != nil {
+			return err
+		}
+	}
+	// the output may be stdout, the summary goes to stderr.
+	fmt.Fprintf(os.Stderr, "offset       %d\ntime         %s\ncommands     %d\n",
+		res.Offset, res.Time.Format(time.RFC3339), res.Commands)
+	for name, n := range res.Skipped {
+		fmt.Fprintf(os.Stderr, "skipped      %d %s\n", n, name)
+	}
+	return nil
+}
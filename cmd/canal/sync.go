@@ -0,0 +1,152 @@
+package main
+
+import (
+	"canal"
+	"flag"
+
+	"github.com/pkg/errors"
+)
+
+// applier is a Target, or a Dispatcher of several.
+type applier interface {
+	canal.CommandDecoder
+	canal.AppliedHandler
+	Close() error
+}
+
+type syncer struct {
+	target applier
+	cp     *checkpointer
+}
+
+func (s *syncer) Command(cmd *canal.Command) error {
+	if err := s.target.Command(cmd); err != nil {
+		return err
+	}
+	return s.cp.update()
+}
+
+func (s *syncer) Applied() int64 {
+	return s.target.Applied()
+}
+
+// txSyncer hands the transactions to a Dispatcher at once, so they go to one target connection.
+type txSyncer struct {
+	*syncer
+	d *canal.Dispatcher
+}
+
+func (s *txSyncer) Transaction(tx *canal.Transaction) error {
+	if err := s.d.Transaction(tx); err != nil {
+		return err
+	}
+	return s.cp.update()
+}
+
+// dispatch returns a Dispatcher to workers targets, closing them once it is closed.
+func dispatch(target *targetOptions, workers int) (*targetDispatcher, error) {
+	var targets []*canal.Target
+	for i := 0; i < workers; i++ {
+		t, err := target.target()
+		if err != nil {
+			for _, t := range targets {
+				t.Close()
+			}
+			return nil, err
+		}
+		targets = append(targets, t)
+	}
+	d := canal.NewDispatcher(canal.NewDispatcherConfig(workers), func(i int) canal.CommandDecoder {
+		return targets[i]
+	})
+	return &targetDispatcher{Dispatcher: d, targets: targets}, nil
+}
+
+type targetDispatcher struct {
+	*canal.Dispatcher
+	targets []*canal.Target
+}
+
+func (d *targetDispatcher) Close() error {
+	err := d.Dispatcher.Close()
+	for _, t := range d.targets {
+		if terr := t.Close(); err == nil {
+			err = terr
+		}
+	}
+	return err
+}
+
+func runSync(args []string) error {
+	fs := flag.NewFlagSet("sync", flag.ExitOnError)
+	var opts masterOptions
+	opts.register(fs)
+	var target targetOptions
+	target.register(fs)
+	var rewrite rewriteOptions
+	rewrite.register(fs)
+	restore := fs.Bool("restore", false, "full sync keys with RESTORE commands")
+	replace := fs.Bool("replace", false, "replace existing keys of the target on RESTORE")
+	version := fs.Int("rdb-version", 9, "RDB version of the RESTORE payloads")
+	batch := fs.Int("batch", 0, "group up to this many members of a collection per command")
+	workers := fs.Int("workers", 1, "target connections commands are dispatched to by key")
+	buffer := fs.Int("buffer", 0, "bytes of commands queued in memory for the target, then in files, 0 for no buffer")
+	bufferDir := fs.String("buffer-dir", "", "directory of the files of the buffer")
+	expand := fs.Bool("expand-evalsha", false, "send EVALSHA as the EVAL of the script loaded by the master")
+	checkpoint := fs.String("checkpoint", "", "file to resume from and save the replication position to")
+	fs.Parse(args)
+
+	if target.addr == "" {
+		return errors.Errorf("-target is required")
+	}
+	cfg, err := opts.config()
+	if err != nil {
+		return err
+	}
+	cfg.Restore, cfg.RestoreReplace, cfg.RestoreVersion, cfg.BatchCount = *restore, *replace, *version, *batch
+	cfg.ExpandEvalSha = *expand
+	if *buffer > 0 {
+		cfg.Buffer = canal.NewBufferConfig()
+		cfg.Buffer.Memory, cfg.Buffer.Dir = *buffer, *bufferDir
+	}
+	if cfg.Position, err = loadCheckpoint(*checkpoint); err != nil {
+		return err
+	}
+	if cfg.Rewrite, err = rewrite.rewrite(); err != nil {
+		return err
+	}
+	var t applier
+	var d *targetDispatcher
+	if *workers > 1 {
+		d, err = dispatch(&target, *workers)
+		t = d
+	} else {
+		t, err = target.target()
+	}
+	if err != nil {
+		return err
+	}
+	c, err := canal.NewCanal(cfg)
+	if err != nil {
+		t.Close()
+		return err
+	}
+	defer c.Close()
+	s := &syncer{target: t}
+	if *checkpoint != "" {
+		s.cp = &checkpointer{path: *checkpoint, c: c, offset: t.Applied}
+	}
+	closeOnSignal(c)
+	if d != nil {
+		err = c.Run(&txSyncer{syncer: s, d: d.Dispatcher})
+	} else {
+		err = c.Run(s)
+	}
+	if terr := t.Close(); err == nil {
+		err = terr
+	}
+	if cerr := s.cp.save(); err == nil {
+		err = cerr
+	}
+	return err
+}
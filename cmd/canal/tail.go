@@ -0,0 +1,73 @@
+package main
+
+import (
+	"canal"
+	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+type tailer struct {
+	out    *commandWriter
+	cp     *checkpointer
+	offset int64
+}
+
+func (t *tailer) Command(cmd *canal.Command) error {
+	if err := t.out.Command(cmd); err != nil {
+		return err
+	}
+	if cmd.Offset >= 0 {
+		t.offset = cmd.Offset
+	}
+	return t.cp.update()
+}
+
+func runTail(args []string) error {
+	fs := flag.NewFlagSet("tail", flag.ExitOnError)
+	var opts masterOptions
+	opts.register(fs)
+	format := fs.String("format", "text", "output format: text, json or resp")
+	binary := fs.String("binary", "escaped", "encoding of keys and values in json: escaped or base64")
+	checkpoint := fs.String("checkpoint", "", "file to resume from and save the replication position to")
+	fs.Parse(args)
+
+	cfg, err := opts.config()
+	if err != nil {
+		return err
+	}
+	if cfg.Position, err = loadCheckpoint(*checkpoint); err != nil {
+		return err
+	}
+	out, err := newCommandWriter(os.Stdout, *format, *binary, true)
+	if err != nil {
+		return err
+	}
+	c, err := canal.NewCanal(cfg)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	out.runID = c.RunID
+	t := &tailer{out: out, offset: -1}
+	if *checkpoint != "" {
+		t.cp = &checkpointer{path: *checkpoint, c: c, offset: func() int64 { return t.offset }}
+	}
+	closeOnSignal(c)
+	err = c.Run(t)
+	if err := t.cp.save(); err != nil {
+		return err
+	}
+	return err
+}
+
+// closeOnSignal closes c on SIGINT or SIGTERM, making Run return.
+func closeOnSignal(c *canal.Canal) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		c.Close()
+	}()
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"canal"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func runVerify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	var opts masterOptions
+	opts.register(fs)
+	var target targetOptions
+	target.register(fs)
+	var rewrite rewriteOptions
+	rewrite.register(fs)
+	output := fs.String("o", "", "file of the detailed JSON report, - for stdout")
+	binary := fs.String("binary", "escaped", "encoding of binary keys in the report: escaped or base64")
+	tolerance := fs.Duration("ttl-tolerance", time.Second, "how much the expiries of a key may differ")
+	scanCount := fs.Int("scan-count", 1000, "COUNT of the SCANs of the target")
+	maxKeys := fs.Int("max-keys", 1<<20, "key digests held in memory, more are sorted in temporary files")
+	tmp := fs.String("tmp", "", "directory of the temporary files")
+	fs.Parse(args)
+
+	if target.addr == "" {
+		return errors.Errorf("-target is required")
+	}
+	enc, err := binaryEncoding(*binary)
+	if err != nil {
+		return err
+	}
+	cfg := &canal.VerifyConfig{ScanCount: *scanCount}
+	if cfg.Source, err = opts.config(); err != nil {
+		return err
+	}
+	if cfg.Source.Rewrite, err = rewrite.rewrite(); err != nil {
+		return err
+	}
+	cfg.Target = canal.NewTargetConfig(target.addr)
+	cfg.Target.Password, cfg.Target.Pipeline = target.password, target.pipeline
+	if cfg.Target.TLS, err = target.tls.config(); err != nil {
+		return err
+	}
+	cfg.DiffOptions = canal.DiffOptions{ExpiryTolerance: *tolerance, MaxKeys: *maxKeys, TempDir: *tmp}
+
+	report, err := openDiffReport(*output, enc)
+	if err != nil {
+		return err
+	}
+	defer report.close()
+	start := time.Now()
+	summary, err := canal.Verify(cfg, func(d *canal.KeyDiff) error {
+		if report != nil {
+			return report.add(d)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if report != nil {
+		if err := report.end(summary); err != nil {
+			return err
+		}
+	}
+	var w io.Writer = os.Stdout
+	if *output == "-" {
+		w = os.Stderr
+	}
+	printDiffSummary(w, summary)
+	fmt.Fprintf(w, "changed      %d\nduration     %s\n", summary.Changed, time.Since(start).Round(time.Millisecond))
+	if n := summary.Differences(); n > 0 {
+		return errors.Errorf("%d keys differ", n)
+	}
+	return nil
+}
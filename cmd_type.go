@@ -76,14 +76,31 @@ const (
 	PfAdd        CommandType = "pfadd"
 	PfMerge      CommandType = "pfmerge"
 	PsetX        CommandType = "psetx"
+	Unlink       CommandType = "unlink"
+	RenameNX     CommandType = "renamenx"
+	Hdel         CommandType = "hdel"
+	Xadd         CommandType = "xadd"
+	FlushAll     CommandType = "flushall"
+	FlushDB      CommandType = "flushdb"
+	SwapDB       CommandType = "swapdb"
+	Publish      CommandType = "publish"
+	Multi        CommandType = "multi"
+	Exec         CommandType = "exec"
+	Discard      CommandType = "discard"
+	Eval         CommandType = "eval"
+	EvalSha      CommandType = "evalsha"
+	Script       CommandType = "script"
+	PsetEX       CommandType = "psetex"
 )
 
 var CommandTypeMap = map[string]CommandType{
+	"ping":             Ping,
 	"select":           Select,
 	"zadd":             Zadd,
 	"sadd":             Sadd,
 	"zrem":             Zrem,
 	"delete":           Delete,
+	"del":              Delete,
 	"lpush":            Lpush,
 	"lpushx":           LpushX,
 	"rpush":            Rpush,
@@ -140,4 +157,19 @@ var CommandTypeMap = map[string]CommandType{
 	"pfadd":            PfAdd,
 	"pfmerge":          PfMerge,
 	"psetx":            PsetX,
+	"unlink":           Unlink,
+	"renamenx":         RenameNX,
+	"hdel":             Hdel,
+	"xadd":             Xadd,
+	"flushall":         FlushAll,
+	"flushdb":          FlushDB,
+	"swapdb":           SwapDB,
+	"publish":          Publish,
+	"multi":            Multi,
+	"exec":             Exec,
+	"discard":          Discard,
+	"eval":             Eval,
+	"evalsha":          EvalSha,
+	"script":           Script,
+	"psetex":           PsetEX,
 }
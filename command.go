@@ -10,6 +10,9 @@ import (
 type Command struct {
 	T CommandType
 	D []string
+	// Offset is the replication offset of the master once the command is applied,
+	// -1 for the commands of a full sync which only is consistent once all are applied.
+	Offset int64
 }
 
 func (c *Command) String() string {
@@ -17,7 +20,7 @@ func (c *Command) String() string {
 }
 
 func (c *Command) Type() CommandType {
-	cmdType, exists := CommandTypeMap[c.D[0]]
+	cmdType, exists := CommandTypeMap[strings.ToLower(c.D[0])]
 	if !exists {
 		return Undefined
 	}
@@ -36,13 +39,19 @@ func (c *Command) Args() []interface{} {
 	return args
 }
 
-func buildStrCommand(s string) []string {
-	return strings.Split(s, " ")
-}
-
 func NewCommand(args ...string) (*Command, error) {
 	if len(args) == 0 {
 		return nil, errors.New("Empty args.")
 	}
-	return &Command{D: args}, nil
+	return &Command{D: args, Offset: -1}, nil
+}
+
+// newValueCommand builds a command from a RESP array, keeping arguments with spaces intact.
+func newValueCommand(val Value) (*Command, error) {
+	vals := val.Array()
+	args := make([]string, len(vals))
+	for i := range vals {
+		args[i] = vals[i].String()
+	}
+	return NewCommand(args...)
 }
@@ -25,8 +25,65 @@ const (
 	TypeHashZiplist     ValueType = 13
 	TypeListQuicklist   ValueType = 14
 	TypeStreamListPacks ValueType = 15
+
+	// the encodings of redis 7, RDB versions 10 and 11.
+	TypeHashListpack     ValueType = 16
+	TypeZSetListpack     ValueType = 17
+	TypeListQuicklist2   ValueType = 18
+	TypeStreamListPacks2 ValueType = 19
+	TypeSetListpack      ValueType = 20
+	TypeStreamListPacks3 ValueType = 21
 )
 
+// Name returns the redis type of values serialized with t, like "hash".
+func (t ValueType) Name() string {
+	switch t {
+	case TypeString:
+		return "string"
+	case TypeList, TypeListZiplist, TypeListQuicklist, TypeListQuicklist2:
+		return "list"
+	case TypeSet, TypeSetIntset, TypeSetListpack:
+		return "set"
+	case TypeZSet, TypeZSet2, TypeZSetZiplist, TypeZSetListpack:
+		return "zset"
+	case TypeHash, TypeHashZipmap, TypeHashZiplist, TypeHashListpack:
+		return "hash"
+	case TypeModule, TypeModule2:
+		return "module"
+	case TypeStreamListPacks, TypeStreamListPacks2, TypeStreamListPacks3:
+		return "stream"
+	}
+	return "unknown"
+}
+
+// Encoding returns the name OBJECT ENCODING gives to values serialized with t,
+// strings are "string" as their encoding depends on the value.
+func (t ValueType) Encoding() string {
+	switch t {
+	case TypeString:
+		return "string"
+	case TypeList:
+		return "linkedlist"
+	case TypeListZiplist, TypeZSetZiplist, TypeHashZiplist:
+		return "ziplist"
+	case TypeListQuicklist, TypeListQuicklist2:
+		return "quicklist"
+	case TypeSet, TypeHash:
+		return "hashtable"
+	case TypeSetIntset:
+		return "intset"
+	case TypeZSet, TypeZSet2:
+		return "skiplist"
+	case TypeHashZipmap:
+		return "zipmap"
+	case TypeStreamListPacks, TypeStreamListPacks2, TypeStreamListPacks3, TypeHashListpack, TypeZSetListpack, TypeSetListpack:
+		return "listpack"
+	case TypeModule, TypeModule2:
+		return "module"
+	}
+	return "unknown"
+}
+
 const (
 	rdbVersion  = 9
 	rdb6bitLen  = 0
@@ -36,6 +93,14 @@ const (
 	rdbEncVal   = 3
 	rdbLenErr   = math.MaxUint64
 
+	// rdbReadVersion is the newest version decoded, the one of redis 7.2, rdbVersion
+	// the newest one encoded.
+	rdbReadVersion = 11
+
+	// the functions of redis 7, the libraries of the release candidates were saved with the second.
+	rdbOpCodeFunction2     = 245
+	rdbOpCodeFunctionPreGA = 246
+
 	rdbOpCodeModuleAux = 247
 	rdbOpCodeIdle      = 248
 	rdbOpCodeFreq      = 249
@@ -61,6 +126,27 @@ const (
 	rdbSaveNode        = 0
 	rdbSaveAofPreamble = (1 << 0)
 
+	// first rdb version that supports each feature, used by the encoder.
+	rdbVersionCompact     = 2
+	rdbVersionExpiryMS    = 3
+	rdbVersionHashZiplist = 4
+	rdbVersionChecksum    = 5
+	rdbVersionAux         = 7
+	rdbVersionZSet2       = 8
+	rdbVersionStream      = 9
+
+	rdbHashMaxZiplistEntries  = 512
+	rdbHashMaxZiplistValue    = 64
+	rdbSetMaxIntsetEntries    = 512
+	rdbZSetMaxZiplistEntries  = 128
+	rdbZSetMaxZiplistValue    = 64
+	rdbListMaxZiplistEntries  = 512
+	rdbListMaxZiplistValue    = 64
+	rdbQuicklistNodeEntries   = 128
+	rdbQuicklistNodeBytes     = 8192
+	rdbStreamNodeMaxEntries   = 100
+	rdbEncodeBufferMaxEntries = 512
+
 	rdbEncInt8  = 0
 	rdbEncInt16 = 1
 	rdbEncInt32 = 2
@@ -116,4 +202,8 @@ const (
 	rdbStreamItemFlagNone        = 0        /* No special flags. */
 	rdbStreamItemFlagDeleted     = (1 << 0) /* Entry was deleted. Skip it. */
 	rdbStreamItemFlangSameFields = (1 << 1) /* Same fields as master entry. */
+
+	// the containers of the nodes of a quicklist from RDB version 10.
+	rdbQuicklistNodePlain  = 1
+	rdbQuicklistNodePacked = 2
 )
@@ -0,0 +1,25 @@
+package canal
+
+// crc16 is the CRC16 redis cluster hashes keys with, the XMODEM variant:
+//
+// Name: XMODEM
+// Width: 16 bits
+// Poly: 0x1021
+// Init: 0x0000
+// Reflected In: False
+// Reflected Out: False
+// Xor Out: 0x0000
+func crc16(b []byte) uint16 {
+	var crc uint16
+	for _, v := range b {
+		crc ^= uint16(v) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
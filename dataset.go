@@ -0,0 +1,1198 @@
+package canal
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// dataset is the data of a master held in memory: it is loaded from an RDB as a
+// Decoder, the commands of the replication stream are applied to it and it hands
+// itself to another Decoder as an RDB.
+type dataset struct {
+	dbs map[int]map[string]*entry
+	// db is the database being loaded or selected by the commands.
+	db int
+	// parser parses the commands applied, its now is the time relative expiries start from.
+	parser *ChangeDecoder
+
+	// key and cur are the collection being loaded.
+	key string
+	cur *entry
+	// err is the first entry of a stream which could not be loaded, its Decoder methods return none.
+	err error
+}
+
+// entry is a key of the dataset, its value is the field of its type.
+type entry struct {
+	typ    ValueType
+	str    string
+	list   []string
+	set    map[string]bool
+	hash   map[string]string
+	zset   map[string]float64
+	stream []streamItem
+	// expiry is the unix time in milliseconds the key expires at, 0 if it does not.
+	expiry int64
+}
+
+// streamItem is an entry of a stream.
+type streamItem struct {
+	ms, seq uint64
+	fields  []FieldValue
+}
+
+func newDataset(now func() int64) *dataset {
+	return &dataset{dbs: make(map[int]map[string]*entry), parser: &ChangeDecoder{now: now}}
+}
+
+func (ds *dataset) keys(db int) map[string]*entry {
+	keys, ok := ds.dbs[db]
+	if !ok {
+		keys = make(map[string]*entry)
+		ds.dbs[db] = keys
+	}
+	return keys
+}
+
+func (ds *dataset) get(key string) *entry {
+	return ds.dbs[ds.db][key]
+}
+
+// lookup returns the entry of key, created with typ if it does not exist. It fails
+// if the key holds another type.
+func (ds *dataset) lookup(key string, typ ValueType) (*entry, error) {
+	e := ds.get(key)
+	if e == nil {
+		e = &entry{typ: typ}
+		switch typ {
+		case TypeSet:
+			e.set = make(map[string]bool)
+		case TypeHash:
+			e.hash = make(map[string]string)
+		case TypeZSet:
+			e.zset = make(map[string]float64)
+		}
+		ds.keys(ds.db)[key] = e
+		return e, nil
+	}
+	if e.typ != typ {
+		return nil, errors.Errorf("%s holds the wrong kind of value.", key)
+	}
+	return e, nil
+}
+
+// typed returns the entry of key if it holds typ, nil if it does not exist.
+func (ds *dataset) typed(key string, typ ValueType) (*entry, error) {
+	e := ds.get(key)
+	if e != nil && e.typ != typ {
+		return nil, errors.Errorf("%s holds the wrong kind of value.", key)
+	}
+	return e, nil
+}
+
+// prune deletes key once its collection is empty.
+func (ds *dataset) prune(key string) {
+	e := ds.get(key)
+	if e == nil {
+		return
+	}
+	if (e.typ == TypeList && len(e.list) == 0) || (e.typ == TypeSet && len(e.set) == 0) ||
+		(e.typ == TypeHash && len(e.hash) == 0) || (e.typ == TypeZSet && len(e.zset) == 0) {
+		delete(ds.dbs[ds.db], key)
+	}
+}
+
+func (ds *dataset) BeginRDB()                                 {}
+func (ds *dataset) EndRDB()                                   {}
+func (ds *dataset) Aux(key, value []byte)                     {}
+func (ds *dataset) ResizeDatabase(dbSize, expiresSize uint32) {}
+func (ds *dataset) BeginDatabase(n int)                       { ds.db = n }
+func (ds *dataset) EndDatabase(n int)                         {}
+
+func (ds *dataset) Set(key, value []byte, expiry int64) {
+	ds.keys(ds.db)[string(key)] = &entry{typ: TypeString, str: string(value), expiry: expiry}
+}
+
+func (ds *dataset) begin(key []byte, typ ValueType, expiry int64) {
+	delete(ds.keys(ds.db), string(key))
+	ds.key = string(key)
+	ds.cur, _ = ds.lookup(ds.key, typ)
+	ds.cur.expiry = expiry
+}
+
+func (ds *dataset) end(key []byte) {
+	ds.prune(ds.key)
+	ds.key, ds.cur = "", nil
+}
+
+func (ds *dataset) BeginHash(key []byte, length, expiry int64) { ds.begin(key, TypeHash, expiry) }
+func (ds *dataset) Hset(key, field, value []byte)              { ds.cur.hash[string(field)] = string(value) }
+func (ds *dataset) EndHash(key []byte)                         { ds.end(key) }
+
+func (ds *dataset) BeginSet(key []byte, cardinality, expiry int64) { ds.begin(key, TypeSet, expiry) }
+func (ds *dataset) Sadd(key, member []byte)                        { ds.cur.set[string(member)] = true }
+func (ds *dataset) EndSet(key []byte)                              { ds.end(key) }
+
+func (ds *dataset) BeginList(key []byte, length, expiry int64) { ds.begin(key, TypeList, expiry) }
+func (ds *dataset) Rpush(key, value []byte)                    { ds.cur.list = append(ds.cur.list, string(value)) }
+func (ds *dataset) EndList(key []byte)                         { ds.end(key) }
+
+func (ds *dataset) BeginZSet(key []byte, cardinality, expiry int64) { ds.begin(key, TypeZSet, expiry) }
+func (ds *dataset) Zadd(key []byte, score float64, member []byte) {
+	ds.cur.zset[string(member)] = score
+}
+func (ds *dataset) EndZSet(key []byte) { ds.end(key) }
+
+func (ds *dataset) BeginStream(key []byte, cardinality, expiry int64) {
+	ds.begin(key, TypeStreamListPacks, expiry)
+}
+func (ds *dataset) Xadd(key, id, listpack []byte) {
+	fields, err := splitStreamEntry(listpack)
+	if err != nil {
+		if ds.err == nil {
+			ds.err = errors.Wrapf(err, "stream %s entry %s", key, id)
+		}
+		return
+	}
+	ds.XaddEntry(key, id, fields)
+}
+
+func (ds *dataset) XaddEntry(key, id []byte, fields []FieldValue) {
+	ms, seq, err := parseStreamID(id)
+	if err != nil {
+		return
+	}
+	fields = append([]FieldValue(nil), fields...)
+	ds.cur.stream = append(ds.cur.stream, streamItem{ms: ms, seq: seq, fields: fields})
+}
+
+// EndStream keeps empty streams, they exist until they are deleted.
+func (ds *dataset) EndStream(key []byte) { ds.key, ds.cur = "", nil }
+
+// apply applies cmd to the dataset and returns its changes, the commands the
+// ChangeDecoder has no typed changes for as a RawCommand. It fails if the command
+// is not supported, as a script, or does not fit the data.
+func (ds *dataset) apply(cmd *Command) ([]Change, error) {
+	name := strings.ToLower(cmd.D[0])
+	args := cmd.D[1:]
+	switch name {
+	case "select":
+		if len(args) > 0 {
+			n, err := strconv.Atoi(args[0])
+			if err != nil {
+				return nil, errors.Errorf("invalid database %s.", args[0])
+			}
+			ds.db = n
+		}
+		return nil, nil
+	case "ping", "replconf", "multi", "exec", "discard", "publish", "spublish", "script",
+		"xgroup", "xack", "xclaim", "xautoclaim", "xsetid":
+		// the stream goes on or the consumer groups change, not the data.
+		return nil, nil
+	}
+	h := ChangeHeader{DB: ds.db, Offset: cmd.Offset}
+	if err := ds.applyRaw(name, args); err != errNotRaw {
+		if err != nil {
+			return nil, err
+		}
+		return []Change{&RawCommand{ChangeHeader: h, Command: cmd}}, nil
+	}
+	changes := ds.parser.parse(h, cmd)
+	if changes == nil {
+		return nil, errors.Errorf("%s is not supported.", name)
+	}
+	for _, change := range changes {
+		if err := ds.change(change); err != nil {
+			return nil, err
+		}
+	}
+	if name == "xadd" {
+		if err := ds.trimAdded(args); err != nil {
+			return nil, err
+		}
+	}
+	return changes, nil
+}
+
+var errNotRaw = errors.New("not a raw command")
+
+// drop deletes the keys of cmd, which could not be applied: they may differ from
+// the master. It returns them, none if the keys of cmd are not known.
+func (ds *dataset) drop(cmd *Command) []string {
+	keys := cmd.Keys()
+	for _, key := range keys {
+		delete(ds.dbs[ds.db], key)
+	}
+	return keys
+}
+
+// change applies a change parsed from a command.
+func (ds *dataset) change(change Change) error {
+	switch ch := change.(type) {
+	case *StringSet:
+		e := ds.get(ch.Key)
+		expiry := ch.ExpireAt
+		if ch.KeepTTL && e != nil {
+			expiry = e.expiry
+		}
+		ds.keys(ds.db)[ch.Key] = &entry{typ: TypeString, str: ch.Value, expiry: expiry}
+	case *HashFieldsSet:
+		e, err := ds.lookup(ch.Key, TypeHash)
+		if err != nil {
+			return err
+		}
+		for _, f := range ch.Fields {
+			if _, ok := e.hash[f.Field]; ok && ch.OnlyNew {
+				continue
+			}
+			e.hash[f.Field] = f.Value
+		}
+	case *HashFieldsDeleted:
+		e, err := ds.typed(ch.Key, TypeHash)
+		if err != nil || e == nil {
+			return err
+		}
+		for _, f := range ch.Fields {
+			delete(e.hash, f)
+		}
+		ds.prune(ch.Key)
+	case *ListPush:
+		if ch.OnlyExisting && ds.get(ch.Key) == nil {
+			return nil
+		}
+		e, err := ds.lookup(ch.Key, TypeList)
+		if err != nil {
+			return err
+		}
+		for _, v := range ch.Values {
+			if ch.Side == ListLeft {
+				e.list = append([]string{v}, e.list...)
+			} else {
+				e.list = append(e.list, v)
+			}
+		}
+	case *SetAdd:
+		e, err := ds.lookup(ch.Key, TypeSet)
+		if err != nil {
+			return err
+		}
+		for _, m := range ch.Members {
+			e.set[m] = true
+		}
+	case *SetRemove:
+		e, err := ds.typed(ch.Key, TypeSet)
+		if err != nil || e == nil {
+			return err
+		}
+		for _, m := range ch.Members {
+			delete(e.set, m)
+		}
+		ds.prune(ch.Key)
+	case *ZSetAdd:
+		return ds.zadd(ch.Key, ch.Flags, ch.Members)
+	case *ZSetRemove:
+		e, err := ds.typed(ch.Key, TypeZSet)
+		if err != nil || e == nil {
+			return err
+		}
+		for _, m := range ch.Members {
+			delete(e.zset, m)
+		}
+		ds.prune(ch.Key)
+	case *StreamAdd:
+		return ds.xadd(ch)
+	case *ExpireSet:
+		if e := ds.get(ch.Key); e != nil {
+			e.expiry = ch.ExpireAt
+		}
+	case *KeysDeleted:
+		for _, key := range ch.Keys {
+			delete(ds.keys(ds.db), key)
+		}
+	case *KeyRenamed:
+		e := ds.get(ch.Key)
+		if e == nil {
+			return errors.Errorf("no such key %s.", ch.Key)
+		}
+		if ch.OnlyNew && ds.get(ch.NewKey) != nil {
+			return nil
+		}
+		keys := ds.keys(ds.db)
+		delete(keys, ch.Key)
+		keys[ch.NewKey] = e
+	case *DBFlushed:
+		if ch.All {
+			ds.dbs = make(map[int]map[string]*entry)
+		} else {
+			delete(ds.dbs, ds.db)
+		}
+	case *ScriptRun:
+		return errors.Errorf("the changes of a script are not known.")
+	}
+	return nil
+}
+
+// zadd adds members with the NX, XX, GT, LT and INCR flags of ZADD.
+func (ds *dataset) zadd(key string, flags []string, members []ScoredMember) error {
+	e, err := ds.lookup(key, TypeZSet)
+	if err != nil {
+		return err
+	}
+	has := func(flag string) bool {
+		for _, f := range flags {
+			if f == flag {
+				return true
+			}
+		}
+		return false
+	}
+	for _, m := range members {
+		score, ok := e.zset[m.Member]
+		switch {
+		case ok && has("NX"), !ok && has("XX"):
+			continue
+		case has("INCR"):
+			m.Score += score
+		}
+		if ok && ((has("GT") && m.Score <= score) || (has("LT") && m.Score >= score)) {
+			continue
+		}
+		e.zset[m.Member] = m.Score
+	}
+	ds.prune(key)
+	return nil
+}
+
+func (ds *dataset) xadd(add *StreamAdd) error {
+	e, err := ds.lookup(add.Key, TypeStreamListPacks)
+	if err != nil {
+		return err
+	}
+	var lastMs, lastSeq uint64
+	if n := len(e.stream); n > 0 {
+		lastMs, lastSeq = e.stream[n-1].ms, e.stream[n-1].seq
+	}
+	var ms, seq uint64
+	switch {
+	case add.ID == "*":
+		ms = uint64(ds.parser.now())
+		if ms <= lastMs {
+			ms, seq = lastMs, lastSeq+1
+		}
+	case strings.HasSuffix(add.ID, "-*"):
+		if ms, err = strconv.ParseUint(strings.TrimSuffix(add.ID, "-*"), 10, 64); err != nil {
+			return errors.Errorf("invalid stream id %s.", add.ID)
+		}
+		if ms == lastMs && len(e.stream) > 0 {
+			seq = lastSeq + 1
+		}
+	default:
+		if !strings.Contains(add.ID, "-") {
+			add.ID += "-0"
+		}
+		if ms, seq, err = parseStreamID([]byte(add.ID)); err != nil {
+			return err
+		}
+	}
+	add.ID = strconv.FormatUint(ms, 10) + "-" + strconv.FormatUint(seq, 10)
+	fields := append([]FieldValue(nil), add.Fields...)
+	e.stream = append(e.stream, streamItem{ms: ms, seq: seq, fields: fields})
+	return nil
+}
+
+// trimAdded trims the stream of XADD key [NOMKSTREAM] [MAXLEN|MINID ...] as it says.
+func (ds *dataset) trimAdded(args []string) error {
+	for i := 1; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "NOMKSTREAM":
+			continue
+		case "MAXLEN", "MINID":
+			return ds.xtrim(args[0], args[i:])
+		}
+		break
+	}
+	return nil
+}
+
+// xtrim trims a stream as MAXLEN|MINID [=|~] threshold says, exactly: the master
+// sends the trimming it did.
+func (ds *dataset) xtrim(key string, args []string) error {
+	e, err := ds.typed(key, TypeStreamListPacks)
+	if err != nil || e == nil {
+		return err
+	}
+	if len(args) > 1 && (args[1] == "=" || args[1] == "~") {
+		args = append(args[:1:1], args[2:]...)
+	}
+	if len(args) < 2 {
+		return errors.Errorf("stream trimming has no threshold.")
+	}
+	if strings.EqualFold(args[0], "MAXLEN") {
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 0 {
+			return errors.Errorf("invalid maxlen %s.", args[1])
+		}
+		if len(e.stream) > n {
+			e.stream = e.stream[len(e.stream)-n:]
+		}
+		return nil
+	}
+	id := args[1]
+	if !strings.Contains(id, "-") {
+		id += "-0"
+	}
+	ms, seq, err := parseStreamID([]byte(id))
+	if err != nil {
+		return err
+	}
+	i := sort.Search(len(e.stream), func(i int) bool {
+		s := e.stream[i]
+		return s.ms > ms || (s.ms == ms && s.seq >= seq)
+	})
+	e.stream = e.stream[i:]
+	return nil
+}
+
+// applyRaw applies the commands the ChangeDecoder has no typed changes for,
+// errNotRaw if name is not one of them.
+func (ds *dataset) applyRaw(name string, args []string) error {
+	argc := map[string]int{
+		"incr": 1, "decr": 1, "incrby": 2, "decrby": 2, "incrbyfloat": 2, "append": 2, "setrange": 3,
+		"getdel": 1, "getex": 1, "lpop": 1, "rpop": 1, "lset": 3, "lrem": 3, "ltrim": 3, "linsert": 4,
+		"rpoplpush": 2, "lmove": 4, "smove": 3, "hincrby": 3, "hincrbyfloat": 3, "zincrby": 3,
+		"sinterstore": 2, "sunionstore": 2, "sdiffstore": 2, "zadd": 3, "zremrangebyscore": 3,
+		"zremrangebyrank": 3, "zremrangebylex": 3, "zpopmin": 1, "zpopmax": 1,
+		"xdel": 2, "xtrim": 3, "move": 2, "copy": 2, "swapdb": 2,
+	}
+	n, ok := argc[name]
+	if !ok {
+		return errNotRaw
+	}
+	if name == "zadd" && !hasArg(args, "INCR") {
+		return errNotRaw
+	}
+	if len(args) < n {
+		return errors.Errorf("%s has too few arguments.", name)
+	}
+	switch name {
+	case "incr", "decr", "incrby", "decrby":
+		by := int64(1)
+		if len(args) > 1 {
+			var err error
+			if by, err = strconv.ParseInt(args[1], 10, 64); err != nil {
+				return errors.Errorf("invalid increment %s.", args[1])
+			}
+		}
+		if strings.HasPrefix(name, "decr") {
+			by = -by
+		}
+		return ds.incr(args[0], func(s string) (string, error) {
+			if s == "" {
+				s = "0"
+			}
+			n, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				return "", errors.Errorf("%s is not an integer.", args[0])
+			}
+			return strconv.FormatInt(n+by, 10), nil
+		})
+	case "incrbyfloat":
+		return ds.incr(args[0], func(s string) (string, error) {
+			return addFloat(s, args[1])
+		})
+	case "append":
+		return ds.incr(args[0], func(s string) (string, error) { return s + args[1], nil })
+	case "setrange":
+		off, err := strconv.Atoi(args[1])
+		if err != nil || off < 0 {
+			return errors.Errorf("invalid offset %s.", args[1])
+		}
+		return ds.incr(args[0], func(s string) (string, error) {
+			b := []byte(s)
+			if n := off + len(args[2]); n > len(b) {
+				b = append(b, make([]byte, n-len(b))...)
+			}
+			copy(b[off:], args[2])
+			return string(b), nil
+		})
+	case "getdel":
+		delete(ds.keys(ds.db), args[0])
+	case "getex":
+		return ds.getex(args)
+	case "lpop", "rpop":
+		e, err := ds.typed(args[0], TypeList)
+		if err != nil || e == nil {
+			return err
+		}
+		count := 1
+		if len(args) > 1 {
+			if count, err = strconv.Atoi(args[1]); err != nil || count < 0 {
+				return errors.Errorf("invalid count %s.", args[1])
+			}
+		}
+		if count > len(e.list) {
+			count = len(e.list)
+		}
+		if name == "lpop" {
+			e.list = e.list[count:]
+		} else {
+			e.list = e.list[:len(e.list)-count]
+		}
+		ds.prune(args[0])
+	case "lset":
+		e, err := ds.typed(args[0], TypeList)
+		if err != nil || e == nil {
+			return errors.Errorf("no such key %s.", args[0])
+		}
+		i, ok := listIndex(args[1], len(e.list))
+		if !ok || i >= len(e.list) {
+			return errors.Errorf("index %s out of range.", args[1])
+		}
+		e.list[i] = args[2]
+	case "lrem":
+		return ds.lrem(args)
+	case "ltrim":
+		e, err := ds.typed(args[0], TypeList)
+		if err != nil || e == nil {
+			return err
+		}
+		start, stop, ok := listRange(args[1], args[2], len(e.list))
+		if !ok {
+			return errors.Errorf("invalid range %s %s.", args[1], args[2])
+		}
+		e.list = append([]string(nil), e.list[start:stop]...)
+		ds.prune(args[0])
+	case "linsert":
+		e, err := ds.typed(args[0], TypeList)
+		if err != nil || e == nil {
+			return err
+		}
+		for i, v := range e.list {
+			if v != args[2] {
+				continue
+			}
+			if strings.EqualFold(args[1], "after") {
+				i++
+			}
+			e.list = append(e.list[:i], append([]string{args[3]}, e.list[i:]...)...)
+			break
+		}
+	case "rpoplpush":
+		return ds.lmove(args[0], args[1], "RIGHT", "LEFT")
+	case "lmove":
+		return ds.lmove(args[0], args[1], strings.ToUpper(args[2]), strings.ToUpper(args[3]))
+	case "smove":
+		src, err := ds.typed(args[0], TypeSet)
+		if err != nil || src == nil || !src.set[args[2]] {
+			return err
+		}
+		dst, err := ds.lookup(args[1], TypeSet)
+		if err != nil {
+			return err
+		}
+		delete(src.set, args[2])
+		dst.set[args[2]] = true
+		ds.prune(args[0])
+	case "sinterstore", "sunionstore", "sdiffstore":
+		return ds.setStore(name, args[0], args[1:])
+	case "hincrby", "hincrbyfloat":
+		e, err := ds.lookup(args[0], TypeHash)
+		if err != nil {
+			return err
+		}
+		v := e.hash[args[1]]
+		if name == "hincrby" {
+			by, err := strconv.ParseInt(args[2], 10, 64)
+			if v == "" {
+				v = "0"
+			}
+			n, verr := strconv.ParseInt(v, 10, 64)
+			if err != nil || verr != nil {
+				ds.prune(args[0])
+				return errors.Errorf("%s %s is not an integer.", args[0], args[1])
+			}
+			e.hash[args[1]] = strconv.FormatInt(n+by, 10)
+			return nil
+		}
+		if v, err = addFloat(v, args[2]); err != nil {
+			ds.prune(args[0])
+			return err
+		}
+		e.hash[args[1]] = v
+	case "zincrby":
+		by, err := strconv.ParseFloat(args[1], 64)
+		if err != nil {
+			return errors.Errorf("invalid increment %s.", args[1])
+		}
+		return ds.zadd(args[0], []string{"INCR"}, []ScoredMember{{Member: args[2], Score: by}})
+	case "zadd":
+		return ds.zaddIncr(args)
+	case "zremrangebyscore", "zremrangebyrank", "zremrangebylex":
+		return ds.zremRange(name, args)
+	case "zpopmin", "zpopmax":
+		e, err := ds.typed(args[0], TypeZSet)
+		if err != nil || e == nil {
+			return err
+		}
+		count := 1
+		if len(args) > 1 {
+			if count, err = strconv.Atoi(args[1]); err != nil || count < 0 {
+				return errors.Errorf("invalid count %s.", args[1])
+			}
+		}
+		members := sortedMembers(e.zset)
+		if name == "zpopmax" {
+			for i, j := 0, len(members)-1; i < j; i, j = i+1, j-1 {
+				members[i], members[j] = members[j], members[i]
+			}
+		}
+		for i := 0; i < count && i < len(members); i++ {
+			delete(e.zset, members[i])
+		}
+		ds.prune(args[0])
+	case "xdel":
+		e, err := ds.typed(args[0], TypeStreamListPacks)
+		if err != nil || e == nil {
+			return err
+		}
+		ids := make(map[[2]uint64]bool)
+		for _, id := range args[1:] {
+			if !strings.Contains(id, "-") {
+				id += "-0"
+			}
+			ms, seq, err := parseStreamID([]byte(id))
+			if err != nil {
+				return err
+			}
+			ids[[2]uint64{ms, seq}] = true
+		}
+		kept := e.stream[:0]
+		for _, s := range e.stream {
+			if !ids[[2]uint64{s.ms, s.seq}] {
+				kept = append(kept, s)
+			}
+		}
+		e.stream = kept
+	case "xtrim":
+		return ds.xtrim(args[0], args[1:])
+	case "move", "copy":
+		return ds.copy(name, args)
+	case "swapdb":
+		a, aerr := strconv.Atoi(args[0])
+		b, berr := strconv.Atoi(args[1])
+		if aerr != nil || berr != nil {
+			return errors.Errorf("invalid databases %s %s.", args[0], args[1])
+		}
+		ds.dbs[a], ds.dbs[b] = ds.dbs[b], ds.dbs[a]
+		for _, n := range []int{a, b} {
+			if ds.dbs[n] == nil {
+				delete(ds.dbs, n)
+			}
+		}
+	}
+	return nil
+}
+
+func hasArg(args []string, opt string) bool {
+	for _, arg := range args {
+		if strings.EqualFold(arg, opt) {
+			return true
+		}
+	}
+	return false
+}
+
+// incr sets the string of key to what fn returns for its value, empty if it does not exist.
+func (ds *dataset) incr(key string, fn func(string) (string, error)) error {
+	e, err := ds.typed(key, TypeString)
+	if err != nil {
+		return err
+	}
+	var v string
+	if e != nil {
+		v = e.str
+	}
+	if v, err = fn(v); err != nil {
+		return err
+	}
+	if e == nil {
+		e = &entry{typ: TypeString}
+		ds.keys(ds.db)[key] = e
+	}
+	e.str = v
+	return nil
+}
+
+func addFloat(v, by string) (string, error) {
+	if v == "" {
+		v = "0"
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return "", errors.Errorf("%s is not a float.", v)
+	}
+	b, err := strconv.ParseFloat(by, 64)
+	if err != nil {
+		return "", errors.Errorf("invalid increment %s.", by)
+	}
+	return formatScore(f + b), nil
+}
+
+// getex applies GETEX key [EX s|PX ms|EXAT s|PXAT ms|PERSIST].
+func (ds *dataset) getex(args []string) error {
+	e := ds.get(args[0])
+	if e == nil || len(args) < 2 {
+		return nil
+	}
+	opt := strings.ToUpper(args[1])
+	if opt == "PERSIST" {
+		e.expiry = 0
+		return nil
+	}
+	if len(args) < 3 {
+		return errors.Errorf("getex %s has no time.", opt)
+	}
+	n, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		return errors.Errorf("invalid time %s.", args[2])
+	}
+	switch opt {
+	case "EX":
+		e.expiry = ds.parser.now() + n*1000
+	case "PX":
+		e.expiry = ds.parser.now() + n
+	case "EXAT":
+		e.expiry = n * 1000
+	case "PXAT":
+		e.expiry = n
+	}
+	return nil
+}
+
+// lrem applies LREM key count element.
+func (ds *dataset) lrem(args []string) error {
+	e, err := ds.typed(args[0], TypeList)
+	if err != nil || e == nil {
+		return err
+	}
+	count, err := strconv.Atoi(args[1])
+	if err != nil {
+		return errors.Errorf("invalid count %s.", args[1])
+	}
+	removed := 0
+	match := func(i int) bool {
+		if e.list[i] != args[2] || (count != 0 && removed == abs(count)) {
+			return false
+		}
+		removed++
+		return true
+	}
+	var kept []string
+	if count >= 0 {
+		for i := range e.list {
+			if !match(i) {
+				kept = append(kept, e.list[i])
+			}
+		}
+	} else {
+		for i := len(e.list) - 1; i >= 0; i-- {
+			if !match(i) {
+				kept = append([]string{e.list[i]}, kept...)
+			}
+		}
+	}
+	e.list = kept
+	ds.prune(args[0])
+	return nil
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// lmove moves an element from the from side of the list src to the to side of dst.
+func (ds *dataset) lmove(src, dst, from, to string) error {
+	e, err := ds.typed(src, TypeList)
+	if err != nil || e == nil || len(e.list) == 0 {
+		return err
+	}
+	if _, err := ds.typed(dst, TypeList); err != nil {
+		return err
+	}
+	var v string
+	if from == "LEFT" {
+		v, e.list = e.list[0], e.list[1:]
+	} else {
+		v, e.list = e.list[len(e.list)-1], e.list[:len(e.list)-1]
+	}
+	ds.prune(src)
+	d, _ := ds.lookup(dst, TypeList)
+	if to == "LEFT" {
+		d.list = append([]string{v}, d.list...)
+	} else {
+		d.list = append(d.list, v)
+	}
+	return nil
+}
+
+// listIndex returns the index of a list of n elements a possibly negative index is.
+func listIndex(s string, n int) (int, bool) {
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, false
+	}
+	if i < 0 {
+		i += n
+	}
+	return i, i >= 0
+}
+
+// listRange returns the slice bounds of the inclusive range start stop of a list of n elements.
+func listRange(start, stop string, n int) (int, int, bool) {
+	i, err := strconv.Atoi(start)
+	if err != nil {
+		return 0, 0, false
+	}
+	j, err := strconv.Atoi(stop)
+	if err != nil {
+		return 0, 0, false
+	}
+	if i < 0 {
+		i += n
+	}
+	if j < 0 {
+		j += n
+	}
+	if i < 0 {
+		i = 0
+	}
+	if j >= n {
+		j = n - 1
+	}
+	if i > j {
+		return 0, 0, true
+	}
+	return i, j + 1, true
+}
+
+// zaddIncr applies ZADD key [NX|XX] [GT|LT] [CH] INCR score member.
+func (ds *dataset) zaddIncr(args []string) error {
+	var flags []string
+	i := 1
+	for ; i < len(args)-2; i++ {
+		flags = append(flags, strings.ToUpper(args[i]))
+	}
+	score, err := strconv.ParseFloat(args[i], 64)
+	if err != nil {
+		return errors.Errorf("invalid score %s.", args[i])
+	}
+	return ds.zadd(args[0], flags, []ScoredMember{{Member: args[i+1], Score: score}})
+}
+
+// setStore applies SINTERSTORE, SUNIONSTORE and SDIFFSTORE destination key [key ...].
+func (ds *dataset) setStore(name, dst string, keys []string) error {
+	result := make(map[string]bool)
+	for i, key := range keys {
+		e, err := ds.typed(key, TypeSet)
+		if err != nil {
+			return err
+		}
+		var set map[string]bool
+		if e != nil {
+			set = e.set
+		}
+		switch {
+		case i == 0 || name == "sunionstore":
+			for m := range set {
+				result[m] = true
+			}
+		case name == "sinterstore":
+			for m := range result {
+				if !set[m] {
+					delete(result, m)
+				}
+			}
+		default:
+			for m := range set {
+				delete(result, m)
+			}
+		}
+	}
+	delete(ds.keys(ds.db), dst)
+	if len(result) > 0 {
+		ds.keys(ds.db)[dst] = &entry{typ: TypeSet, set: result}
+	}
+	return nil
+}
+
+// zremRange applies ZREMRANGEBYSCORE key min max, ZREMRANGEBYRANK key start stop
+// and ZREMRANGEBYLEX key min max.
+func (ds *dataset) zremRange(name string, args []string) error {
+	e, err := ds.typed(args[0], TypeZSet)
+	if err != nil || e == nil {
+		return err
+	}
+	members := sortedMembers(e.zset)
+	if name == "zremrangebyrank" {
+		start, stop, ok := listRange(args[1], args[2], len(members))
+		if !ok {
+			return errors.Errorf("invalid range %s %s.", args[1], args[2])
+		}
+		for _, m := range members[start:stop] {
+			delete(e.zset, m)
+		}
+		ds.prune(args[0])
+		return nil
+	}
+	if name == "zremrangebylex" {
+		in, err := lexRange(args[1], args[2])
+		if err != nil {
+			return err
+		}
+		for _, m := range members {
+			if in(m) {
+				delete(e.zset, m)
+			}
+		}
+		ds.prune(args[0])
+		return nil
+	}
+	min, minEx, err := parseScoreBound(args[1])
+	if err != nil {
+		return err
+	}
+	max, maxEx, err := parseScoreBound(args[2])
+	if err != nil {
+		return err
+	}
+	for _, m := range members {
+		s := e.zset[m]
+		if (s > min || (s == min && !minEx)) && (s < max || (s == max && !maxEx)) {
+			delete(e.zset, m)
+		}
+	}
+	ds.prune(args[0])
+	return nil
+}
+
+// parseScoreBound parses a score bound of a range, exclusive when it starts with (.
+func parseScoreBound(s string) (float64, bool, error) {
+	exclusive := strings.HasPrefix(s, "(")
+	switch v := strings.TrimPrefix(s, "("); strings.ToLower(v) {
+	case "-inf":
+		return math.Inf(-1), exclusive, nil
+	case "+inf", "inf":
+		return math.Inf(1), exclusive, nil
+	default:
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return 0, false, errors.Errorf("invalid score %s.", s)
+		}
+		return f, exclusive, nil
+	}
+}
+
+// lexRange returns whether a member is in the lexicographical range min max of
+// ZRANGEBYLEX, its bounds - and + or [ and ( inclusive and exclusive members.
+func lexRange(min, max string) (func(string) bool, error) {
+	bound := func(s string, low bool) (func(string) bool, error) {
+		switch {
+		case s == "-" && low, s == "+" && !low:
+			return func(string) bool { return true }, nil
+		case s == "+" && low, s == "-" && !low:
+			return func(string) bool { return false }, nil
+		case strings.HasPrefix(s, "[") && low:
+			return func(m string) bool { return m >= s[1:] }, nil
+		case strings.HasPrefix(s, "(") && low:
+			return func(m string) bool { return m > s[1:] }, nil
+		case strings.HasPrefix(s, "["):
+			return func(m string) bool { return m <= s[1:] }, nil
+		case strings.HasPrefix(s, "("):
+			return func(m string) bool { return m < s[1:] }, nil
+		}
+		return nil, errors.Errorf("invalid lexicographical bound %s.", s)
+	}
+	lo, err := bound(min, true)
+	if err != nil {
+		return nil, err
+	}
+	hi, err := bound(max, false)
+	if err != nil {
+		return nil, err
+	}
+	return func(m string) bool { return lo(m) && hi(m) }, nil
+}
+
+// sortedMembers returns the members of a sorted set by score, then member.
+func sortedMembers(zset map[string]float64) []string {
+	members := make([]string, 0, len(zset))
+	for m := range zset {
+		members = append(members, m)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		a, b := zset[members[i]], zset[members[j]]
+		if a != b {
+			return a < b
+		}
+		return members[i] < members[j]
+	})
+	return members
+}
+
+// copy applies MOVE key db and COPY source destination [DB db] [REPLACE].
+func (ds *dataset) copy(name string, args []string) error {
+	e := ds.get(args[0])
+	if e == nil {
+		return nil
+	}
+	db, key, replace := ds.db, args[0], false
+	if name == "copy" {
+		key = args[1]
+		for i := 2; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "REPLACE":
+				replace = true
+			case "DB":
+				if i+1 < len(args) {
+					i++
+					n, err := strconv.Atoi(args[i])
+					if err != nil {
+						return errors.Errorf("invalid database %s.", args[i])
+					}
+					db = n
+				}
+			}
+		}
+	} else {
+		n, err := strconv.Atoi(args[1])
+		if err != nil {
+			return errors.Errorf("invalid database %s.", args[1])
+		}
+		db = n
+	}
+	keys := ds.keys(db)
+	if _, ok := keys[key]; ok && !replace {
+		return nil
+	}
+	if name == "move" {
+		delete(ds.dbs[ds.db], args[0])
+		keys[key] = e
+		return nil
+	}
+	keys[key] = e.clone()
+	return nil
+}
+
+func (e *entry) clone() *entry {
+	c := &entry{typ: e.typ, str: e.str, expiry: e.expiry}
+	c.list = append([]string(nil), e.list...)
+	c.stream = append([]streamItem(nil), e.stream...)
+	if e.set != nil {
+		c.set = make(map[string]bool, len(e.set))
+		for m := range e.set {
+			c.set[m] = true
+		}
+	}
+	if e.hash != nil {
+		c.hash = make(map[string]string, len(e.hash))
+		for f, v := range e.hash {
+			c.hash[f] = v
+		}
+	}
+	if e.zset != nil {
+		c.zset = make(map[string]float64, len(e.zset))
+		for m, s := range e.zset {
+			c.zset[m] = s
+		}
+	}
+	return c
+}
+
+// decode hands the dataset to d as an RDB, databases and keys in order. The keys
+// expired at now, unix time in milliseconds, are left out, none if now is 0.
+func (ds *dataset) decode(d Decoder, now int64) {
+	d.BeginRDB()
+	dbs := make([]int, 0, len(ds.dbs))
+	for n := range ds.dbs {
+		dbs = append(dbs, n)
+	}
+	sort.Ints(dbs)
+	for _, n := range dbs {
+		var keys []string
+		expires := 0
+		for key, e := range ds.dbs[n] {
+			if e.expiry > 0 && now > 0 && e.expiry <= now {
+				continue
+			}
+			if e.expiry > 0 {
+				expires++
+			}
+			keys = append(keys, key)
+		}
+		if len(keys) == 0 {
+			continue
+		}
+		sort.Strings(keys)
+		d.BeginDatabase(n)
+		d.ResizeDatabase(uint32(len(keys)), uint32(expires))
+		for _, key := range keys {
+			ds.dbs[n][key].decode(d, []byte(key))
+		}
+		d.EndDatabase(n)
+	}
+	d.EndRDB()
+}
+
+func (e *entry) decode(d Decoder, key []byte) {
+	switch e.typ {
+	case TypeString:
+		d.Set(key, []byte(e.str), e.expiry)
+	case TypeList:
+		d.BeginList(key, int64(len(e.list)), e.expiry)
+		for _, v := range e.list {
+			d.Rpush(key, []byte(v))
+		}
+		d.EndList(key)
+	case TypeSet:
+		d.BeginSet(key, int64(len(e.set)), e.expiry)
+		members := make([]string, 0, len(e.set))
+		for m := range e.set {
+			members = append(members, m)
+		}
+		sort.Strings(members)
+		for _, m := range members {
+			d.Sadd(key, []byte(m))
+		}
+		d.EndSet(key)
+	case TypeHash:
+		d.BeginHash(key, int64(len(e.hash)), e.expiry)
+		fields := make([]string, 0, len(e.hash))
+		for f := range e.hash {
+			fields = append(fields, f)
+		}
+		sort.Strings(fields)
+		for _, f := range fields {
+			d.Hset(key, []byte(f), []byte(e.hash[f]))
+		}
+		d.EndHash(key)
+	case TypeZSet:
+		d.BeginZSet(key, int64(len(e.zset)), e.expiry)
+		for _, m := range sortedMembers(e.zset) {
+			d.Zadd(key, e.zset[m], []byte(m))
+		}
+		d.EndZSet(key)
+	case TypeStreamListPacks:
+		d.BeginStream(key, int64(len(e.stream)), e.expiry)
+		for _, s := range e.stream {
+			xaddEntry(d, key, []byte(strconv.FormatUint(s.ms, 10)+"-"+strconv.FormatUint(s.seq, 10)), s.fields)
+		}
+		d.EndStream(key)
+	}
+}
@@ -2,7 +2,10 @@ package canal
 
 import (
 	"bufio"
+	"bytes"
 	"io"
+
+	"github.com/pkg/errors"
 )
 
 type ByteReader interface {
@@ -19,6 +22,18 @@ type CommandDecoder interface {
 	Command(cmd *Command) error
 }
 
+// AppliedHandler may be implemented by a CommandDecoder applying commands asynchronously,
+// canal then acks the offset of the last applied command instead of the offset read.
+type AppliedHandler interface {
+	Applied() int64
+}
+
+// TransactionDecoder may be implemented by a CommandDecoder to receive the commands
+// of a MULTI/EXEC block at once, instead of MULTI, the commands and EXEC one by one.
+type TransactionDecoder interface {
+	Transaction(tx *Transaction) error
+}
+
 // A Decodr must be implemented to parse a RDB io.Reader &  parse a command io.Reader
 type Decoder interface {
 	// BeginDatabase is called when database n Begins.
@@ -75,6 +90,75 @@ type Decoder interface {
 	RDBDecoder
 }
 
+// EvictionDecoder may be implemented by a Decoder to receive the LRU idle time (seconds)
+// or the LFU frequency saved with a key, -1 when absent. It is called before the key callbacks.
+type EvictionDecoder interface {
+	Eviction(key []byte, lruIdle, lfuFreq int64)
+}
+
+// EncodingDecoder may be implemented by a Decoder to know the type a value is
+// serialized with, like TypeListQuicklist or TypeSetIntset. It is called before the key callbacks.
+type EncodingDecoder interface {
+	Encoding(key []byte, typ ValueType)
+}
+
+// ValueInfo is how a value is serialized in an RDB, its type is the one passed to Encoding.
+type ValueInfo struct {
+	// Length is the number of bytes of the serialized value, its type and key excluded.
+	Length int64
+	// Elements is the count the value is serialized with: the members of a list, set,
+	// sorted set or hash, the entries of a ziplist or zipmap, where a field and its value
+	// are two entries, the integers of an intset, the ziplists of a quicklist or the
+	// listpacks of a stream. It is 1 for a string.
+	Elements int64
+}
+
+// ValueInfoDecoder may be implemented by a Decoder to know how each value is serialized.
+// It is called after the key callbacks, once the value is read.
+type ValueInfoDecoder interface {
+	ValueInfo(key []byte, info ValueInfo)
+}
+
+// StreamEntryDecoder may be implemented by a Decoder to receive the fields and values
+// of a stream entry apart, as they may hold spaces. The RDB decoder and a dataset call
+// it instead of Xadd, fields is reused once it returns.
+type StreamEntryDecoder interface {
+	XaddEntry(key, id []byte, fields []FieldValue)
+}
+
+// xaddEntry hands an entry of a stream to d, apart if d is a StreamEntryDecoder,
+// else its fields and values joined by spaces.
+func xaddEntry(d Decoder, key, id []byte, fields []FieldValue) {
+	if entries, ok := d.(StreamEntryDecoder); ok {
+		entries.XaddEntry(key, id, fields)
+		return
+	}
+	d.Xadd(key, id, joinStreamFields(fields))
+}
+
+// joinStreamFields joins the fields and values of a stream entry by spaces for Xadd.
+func joinStreamFields(fields []FieldValue) []byte {
+	var b []byte
+	for i, f := range fields {
+		if i > 0 {
+			b = append(b, ' ')
+		}
+		b = append(append(append(b, f.Field...), ' '), f.Value...)
+	}
+	return b
+}
+
+// splitStreamEntry returns the field and value of a stream entry Xadd passes. Joined
+// by spaces, the fields and values of an entry of more than one field, or holding
+// spaces, cannot be told apart: they must be passed to XaddEntry.
+func splitStreamEntry(listpack []byte) ([]FieldValue, error) {
+	parts := bytes.Split(listpack, []byte(" "))
+	if len(parts) != 2 {
+		return nil, errors.Errorf("the fields and values of stream entry %q cannot be told apart, use XaddEntry", listpack)
+	}
+	return []FieldValue{{string(parts[0]), string(parts[1])}}, nil
+}
+
 type Closer interface {
 	io.Closer
 }
@@ -0,0 +1,404 @@
+package canal
+
+import (
+	"bufio"
+	"container/heap"
+	"crypto/sha1"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Kinds of KeyDiff.
+const (
+	// DiffMissing is a key of the source the target does not have.
+	DiffMissing = "missing"
+	// DiffExtra is a key of the target the source does not have.
+	DiffExtra = "extra"
+	DiffType  = "type"
+	DiffValue = "value"
+	// DiffExpiry is a key whose expiries differ by more than the tolerance,
+	// or which expires in one snapshot only.
+	DiffExpiry = "expiry"
+)
+
+// KeyDiff is a key which differs between two snapshots, Kind tells how.
+type KeyDiff struct {
+	DB           int    `json:"db"`
+	Key          string `json:"key"`
+	Kind         string `json:"kind"`
+	SourceType   string `json:"source_type,omitempty"`
+	TargetType   string `json:"target_type,omitempty"`
+	SourceExpiry int64  `json:"source_expiry,omitempty"`
+	TargetExpiry int64  `json:"target_expiry,omitempty"`
+}
+
+// DiffSummary counts the keys compared and their differences.
+type DiffSummary struct {
+	SourceKeys int64 `json:"source_keys"`
+	TargetKeys int64 `json:"target_keys"`
+	Equal      int64 `json:"equal"`
+	Missing    int64 `json:"missing"`
+	Extra      int64 `json:"extra"`
+	Type       int64 `json:"type"`
+	Value      int64 `json:"value"`
+	Expiry     int64 `json:"expiry"`
+	// Changed are the keys which differ but changed while they were compared,
+	// they are not differences.
+	Changed int64 `json:"changed,omitempty"`
+}
+
+// Differences returns the number of keys which differ.
+func (s *DiffSummary) Differences() int64 {
+	return s.Missing + s.Extra + s.Type + s.Value + s.Expiry
+}
+
+func (s *DiffSummary) add(kind string) {
+	switch kind {
+	case DiffMissing:
+		s.Missing++
+	case DiffExtra:
+		s.Extra++
+	case DiffType:
+		s.Type++
+	case DiffValue:
+		s.Value++
+	case DiffExpiry:
+		s.Expiry++
+	}
+}
+
+// DiffOptions tune DiffRDB.
+type DiffOptions struct {
+	// ExpiryTolerance is how much the expiries of a key may differ.
+	ExpiryTolerance time.Duration
+	// MaxKeys is the number of key digests held in memory, more are sorted in
+	// temporary files, 1M keys by default.
+	MaxKeys int
+	// TempDir holds the temporary files, the default directory for temporary files if empty.
+	TempDir string
+}
+
+const defaultDiffMaxKeys = 1 << 20
+
+// DiffRDB compares the RDB files source and target key by key, calling fn with
+// each key which differs, in the order of the databases and keys. Only the digests
+// of the keys are kept, sorted in temporary files beyond opts.MaxKeys, so the
+// memory used is bounded whatever the size of the files. opts may be nil.
+func DiffRDB(source, target io.Reader, opts *DiffOptions, fn func(*KeyDiff) error) (*DiffSummary, error) {
+	if opts == nil {
+		opts = &DiffOptions{}
+	}
+	src := newDigestSorter(opts)
+	defer src.close()
+	if err := src.decode(source); err != nil {
+		return nil, errors.Wrap(err, "source")
+	}
+	dst := newDigestSorter(opts)
+	defer dst.close()
+	if err := dst.decode(target); err != nil {
+		return nil, errors.Wrap(err, "target")
+	}
+
+	a, err := src.sorted()
+	if err != nil {
+		return nil, err
+	}
+	b, err := dst.sorted()
+	if err != nil {
+		return nil, err
+	}
+	return diffDigests(a, b, opts.ExpiryTolerance, nil, fn)
+}
+
+// diffDigests merges the sorted digests a and b, calling fn with each key which
+// differs, unless changed reports the key changed while the digests were taken.
+func diffDigests(a, b digestSource, tolerance time.Duration, changed func(*KeyDiff) bool,
+	fn func(*KeyDiff) error) (*DiffSummary, error) {
+	x, err := a.next()
+	if err != nil {
+		return nil, err
+	}
+	y, err := b.next()
+	if err != nil {
+		return nil, err
+	}
+	summary := &DiffSummary{}
+	ms := int64(tolerance / time.Millisecond)
+	for x != nil || y != nil {
+		var diff *KeyDiff
+		switch {
+		case y == nil || (x != nil && digestLess(x, y)):
+			summary.SourceKeys++
+			diff = &KeyDiff{DB: x.DB, Key: x.Key, Kind: DiffMissing, SourceType: x.Type, SourceExpiry: x.Expiry}
+			x, err = a.next()
+		case x == nil || digestLess(y, x):
+			summary.TargetKeys++
+			diff = &KeyDiff{DB: y.DB, Key: y.Key, Kind: DiffExtra, TargetType: y.Type, TargetExpiry: y.Expiry}
+			y, err = b.next()
+		default:
+			summary.SourceKeys++
+			summary.TargetKeys++
+			if kind := compareDigests(x, y, ms); kind != "" {
+				diff = &KeyDiff{DB: x.DB, Key: x.Key, Kind: kind, SourceType: x.Type, TargetType: y.Type,
+					SourceExpiry: x.Expiry, TargetExpiry: y.Expiry}
+			} else {
+				summary.Equal++
+			}
+			if x, err = a.next(); err == nil {
+				y, err = b.next()
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		if diff == nil {
+			continue
+		}
+		if changed != nil && changed(diff) {
+			summary.Changed++
+			continue
+		}
+		summary.add(diff.Kind)
+		if err := fn(diff); err != nil {
+			return nil, err
+		}
+	}
+	return summary, nil
+}
+
+// compareDigests returns how the digests of the same key differ, "" if they do not.
+func compareDigests(x, y *KeyDigest, tolerance int64) string {
+	switch {
+	case x.Type != y.Type:
+		return DiffType
+	case x.Digest != y.Digest:
+		return DiffValue
+	case (x.Expiry > 0) != (y.Expiry > 0) || x.Expiry-y.Expiry > tolerance || y.Expiry-x.Expiry > tolerance:
+		return DiffExpiry
+	}
+	return ""
+}
+
+func digestLess(x, y *KeyDigest) bool {
+	if x.DB != y.DB {
+		return x.DB < y.DB
+	}
+	return x.Key < y.Key
+}
+
+// digestSorter sorts the digests of an RDB, the digests beyond max are sorted
+// in runs written to temporary files and merged.
+type digestSorter struct {
+	max     int
+	dir     string
+	digests []*KeyDigest
+	runs    []*os.File
+}
+
+func newDigestSorter(opts *DiffOptions) *digestSorter {
+	s := &digestSorter{max: opts.MaxKeys, dir: opts.TempDir}
+	if s.max <= 0 {
+		s.max = defaultDiffMaxKeys
+	}
+	return s
+}
+
+func (s *digestSorter) decode(r io.Reader) error {
+	d := NewDigester(s.add)
+	if err := DecodeFile(bufio.NewReader(r), d); err != nil {
+		return err
+	}
+	return d.Err()
+}
+
+func (s *digestSorter) add(k *KeyDigest) error {
+	s.digests = append(s.digests, k)
+	if len(s.digests) >= s.max {
+		return s.spill()
+	}
+	return nil
+}
+
+// spill writes the digests in memory to a sorted run.
+func (s *digestSorter) spill() error {
+	sort.Slice(s.digests, func(i, j int) bool { return digestLess(s.digests[i], s.digests[j]) })
+	f, err := ioutil.TempFile(s.dir, "canal-diff-")
+	if err != nil {
+		return err
+	}
+	s.runs = append(s.runs, f)
+	w := bufio.NewWriter(f)
+	for _, k := range s.digests {
+		if err := writeDigest(w, k); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	s.digests = s.digests[:0]
+	_, err = f.Seek(0, io.SeekStart)
+	return err
+}
+
+// sorted returns the digests in order, once all of them are added.
+func (s *digestSorter) sorted() (digestSource, error) {
+	if len(s.runs) == 0 {
+		sort.Slice(s.digests, func(i, j int) bool { return digestLess(s.digests[i], s.digests[j]) })
+		return &sliceDigests{digests: s.digests}, nil
+	}
+	if len(s.digests) > 0 {
+		if err := s.spill(); err != nil {
+			return nil, err
+		}
+	}
+	m := &mergeDigests{}
+	for _, f := range s.runs {
+		src := &fileDigests{r: bufio.NewReader(f)}
+		k, err := src.next()
+		if err != nil {
+			return nil, err
+		}
+		if k != nil {
+			m.heads = append(m.heads, mergeHead{k, src})
+		}
+	}
+	heap.Init(m)
+	return m, nil
+}
+
+func (s *digestSorter) close() {
+	for _, f := range s.runs {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	s.runs = nil
+}
+
+// digestSource returns sorted digests, nil after the last one.
+type digestSource interface {
+	next() (*KeyDigest, error)
+}
+
+type sliceDigests struct {
+	digests []*KeyDigest
+}
+
+func (s *sliceDigests) next() (*KeyDigest, error) {
+	if len(s.digests) == 0 {
+		return nil, nil
+	}
+	k := s.digests[0]
+	s.digests = s.digests[1:]
+	return k, nil
+}
+
+type fileDigests struct {
+	r *bufio.Reader
+}
+
+func (s *fileDigests) next() (*KeyDigest, error) {
+	k, err := readDigest(s.r)
+	if err == io.EOF {
+		return nil, nil
+	}
+	return k, err
+}
+
+type mergeHead struct {
+	k   *KeyDigest
+	src digestSource
+}
+
+// mergeDigests merges sorted runs, it is a heap of their smallest digest.
+type mergeDigests struct {
+	heads []mergeHead
+}
+
+func (m *mergeDigests) Len() int           { return len(m.heads) }
+func (m *mergeDigests) Less(i, j int) bool { return digestLess(m.heads[i].k, m.heads[j].k) }
+func (m *mergeDigests) Swap(i, j int)      { m.heads[i], m.heads[j] = m.heads[j], m.heads[i] }
+func (m *mergeDigests) Push(x interface{}) { m.heads = append(m.heads, x.(mergeHead)) }
+func (m *mergeDigests) Pop() interface{} {
+	x := m.heads[len(m.heads)-1]
+	m.heads = m.heads[:len(m.heads)-1]
+	return x
+}
+
+func (m *mergeDigests) next() (*KeyDigest, error) {
+	if len(m.heads) == 0 {
+		return nil, nil
+	}
+	k := m.heads[0].k
+	next, err := m.heads[0].src.next()
+	if err != nil {
+		return nil, err
+	}
+	if next == nil {
+		heap.Pop(m)
+	} else {
+		m.heads[0].k = next
+		heap.Fix(m, 0)
+	}
+	return k, nil
+}
+
+// writeDigest writes k as its database, key, type, expiry and digest.
+func writeDigest(w *bufio.Writer, k *KeyDigest) error {
+	var n [binary.MaxVarintLen64]byte
+	w.Write(n[:binary.PutUvarint(n[:], uint64(k.DB))])
+	w.Write(n[:binary.PutUvarint(n[:], uint64(len(k.Key)))])
+	w.WriteString(k.Key)
+	w.Write(n[:binary.PutUvarint(n[:], uint64(len(k.Type)))])
+	w.WriteString(k.Type)
+	w.Write(n[:binary.PutVarint(n[:], k.Expiry)])
+	_, err := w.Write(k.Digest[:])
+	return err
+}
+
+func readDigest(r *bufio.Reader) (*KeyDigest, error) {
+	db, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	k := &KeyDigest{DB: int(db)}
+	if k.Key, err = readDigestString(r); err != nil {
+		return nil, err
+	}
+	if k.Type, err = readDigestString(r); err != nil {
+		return nil, err
+	}
+	if k.Expiry, err = binary.ReadVarint(r); err != nil {
+		return nil, noEOF(err)
+	}
+	if _, err := io.ReadFull(r, k.Digest[:sha1.Size]); err != nil {
+		return nil, noEOF(err)
+	}
+	return k, nil
+}
+
+func readDigestString(r *bufio.Reader) (string, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", noEOF(err)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", noEOF(err)
+	}
+	return string(b), nil
+}
+
+// noEOF turns an EOF in the middle of a record in an unexpected EOF.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,125 @@
+package canal
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"hash"
+	"math"
+)
+
+// KeyDigest identifies the content of a key whatever the encoding its value is
+// serialized with: the digests of two keys are equal if their values are.
+type KeyDigest struct {
+	DB     int
+	Key    string
+	Type   string
+	Digest [sha1.Size]byte
+	// Expiry is the unix time in milliseconds the key expires at, 0 if it does not.
+	Expiry int64
+}
+
+// Digester is a Decoder computing the digest of each key, handed to OnKey.
+// The members of sets, sorted sets and hashes are digested in any order,
+// the elements of lists and streams in their order.
+type Digester struct {
+	OnKey func(*KeyDigest) error
+
+	db  int
+	key *KeyDigest
+	// ordered digest of lists and streams, or the xor of the member digests.
+	h   hash.Hash
+	xor [sha1.Size]byte
+	err error
+}
+
+// NewDigester returns a Digester handing the digest of each key to fn.
+func NewDigester(fn func(*KeyDigest) error) *Digester {
+	return &Digester{OnKey: fn, h: sha1.New()}
+}
+
+// Err returns the first error returned by OnKey.
+func (d *Digester) Err() error {
+	return d.err
+}
+
+func (d *Digester) begin(typ string, key []byte, expiry int64) {
+	d.key = &KeyDigest{DB: d.db, Key: string(key), Type: typ, Expiry: expiry}
+	d.h.Reset()
+	d.xor = [sha1.Size]byte{}
+}
+
+// write adds the length prefixed values to the ordered digest.
+func (d *Digester) write(values ...[]byte) {
+	var n [binary.MaxVarintLen64]byte
+	for _, v := range values {
+		d.h.Write(n[:binary.PutUvarint(n[:], uint64(len(v)))])
+		d.h.Write(v)
+	}
+}
+
+// member adds the digest of the values to the unordered digest.
+func (d *Digester) member(values ...[]byte) {
+	d.h.Reset()
+	d.write(values...)
+	var sum [sha1.Size]byte
+	d.h.Sum(sum[:0])
+	for i := range d.xor {
+		d.xor[i] ^= sum[i]
+	}
+}
+
+func (d *Digester) end(ordered bool) {
+	if ordered {
+		d.h.Sum(d.key.Digest[:0])
+	} else {
+		d.h.Reset()
+		d.h.Write(d.xor[:])
+		d.h.Sum(d.key.Digest[:0])
+	}
+	if d.err == nil && d.OnKey != nil {
+		d.err = d.OnKey(d.key)
+	}
+	d.key = nil
+}
+
+func (d *Digester) BeginRDB()                                 {}
+func (d *Digester) EndRDB()                                   {}
+func (d *Digester) Aux(key, value []byte)                     {}
+func (d *Digester) ResizeDatabase(dbSize, expiresSize uint32) {}
+func (d *Digester) EndDatabase(n int)                         {}
+
+func (d *Digester) BeginDatabase(n int) {
+	d.db = n
+}
+
+func (d *Digester) Set(key, value []byte, expiry int64) {
+	d.begin("string", key, expiry)
+	d.write(value)
+	d.end(true)
+}
+
+func (d *Digester) BeginHash(key []byte, length, expiry int64) { d.begin("hash", key, expiry) }
+func (d *Digester) Hset(key, field, value []byte)              { d.member(field, value) }
+func (d *Digester) EndHash(key []byte)                         { d.end(false) }
+
+func (d *Digester) BeginSet(key []byte, cardinality, expiry int64) { d.begin("set", key, expiry) }
+func (d *Digester) Sadd(key, member []byte)                        { d.member(member) }
+func (d *Digester) EndSet(key []byte)                              { d.end(false) }
+
+func (d *Digester) BeginList(key []byte, length, expiry int64) { d.begin("list", key, expiry) }
+func (d *Digester) Rpush(key, value []byte)                    { d.write(value) }
+func (d *Digester) EndList(key []byte)                         { d.end(true) }
+
+func (d *Digester) BeginZSet(key []byte, cardinality, expiry int64) { d.begin("zset", key, expiry) }
+func (d *Digester) Zadd(key []byte, score float64, member []byte) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], math.Float64bits(score))
+	d.member(member, b[:])
+}
+func (d *Digester) EndZSet(key []byte) { d.end(false) }
+
+func (d *Digester) BeginStream(key []byte, cardinality, expiry int64) {
+	d.begin("stream", key, expiry)
+}
+func (d *Digester) Xadd(key, id, listpack []byte) { d.write(id, listpack) }
+func (d *Digester) EndStream(key []byte)          { d.end(true) }
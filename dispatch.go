@@ -0,0 +1,342 @@
+package canal
+
+import (
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+type DispatcherConfig struct {
+	// Workers is the number of CommandDecoders commands are dispatched to, 4 by default.
+	Workers int
+	// Queue is the number of commands queued per worker, Command blocks when the
+	// queue of the worker of a command is full. 1024 by default.
+	Queue int
+}
+
+func NewDispatcherConfig(workers int) *DispatcherConfig {
+	return &DispatcherConfig{Workers: workers, Queue: 1024}
+}
+
+// Dispatcher is a CommandDecoder handing commands to worker CommandDecoders running
+// in their own goroutines, so a slow worker does not stall the replication.
+//
+// The commands of a key always go to the same worker, in order. Commands whose keys
+// go to different workers and commands without keys, like FLUSHDB or SWAPDB, are
+// barriers: they run once every worker is done, and the others wait for them.
+// Every worker receives the SELECT of the database of its commands, PING and
+// REPLCONF are not dispatched. Transactions, passed to Transaction or as MULTI,
+// commands and EXEC, go to one worker, as a barrier when their keys do not.
+//
+// Applied reports the offset below which every command was processed, or applied
+// by the worker when it is an AppliedHandler, so the master is acked what the
+// workers are done with.
+type Dispatcher struct {
+	workers []*dispatchWorker
+	// db is the database selected in the stream, tx the transaction whose EXEC is awaited.
+	db int
+	tx *Transaction
+
+	mu sync.Mutex
+	// idle is signaled when a worker is done with a command.
+	idle *sync.Cond
+	// seen is the offset of the last command received.
+	seen int64
+	err  error
+	wg   sync.WaitGroup
+}
+
+type dispatchWorker struct {
+	d     CommandDecoder
+	queue chan *dispatchItem
+	// db is the database selected for the worker, it is only used by its goroutine.
+	db int
+	// waiting are the offsets received before the commands queued and not processed
+	// yet, oldest first, last the offset of the last command queued.
+	waiting []int64
+	last    int64
+}
+
+type dispatchItem struct {
+	db  int
+	cmd *Command
+	tx  *Transaction
+	// prev is the offset received before the command.
+	prev int64
+}
+
+// NewDispatcher starts the workers returned by newWorker for 0 to cfg.Workers-1.
+func NewDispatcher(cfg *DispatcherConfig, newWorker func(i int) CommandDecoder) *Dispatcher {
+	n, queue := cfg.Workers, cfg.Queue
+	if n <= 0 {
+		n = 4
+	}
+	if queue <= 0 {
+		queue = 1024
+	}
+	d := &Dispatcher{seen: -1}
+	d.idle = sync.NewCond(&d.mu)
+	for i := 0; i < n; i++ {
+		w := &dispatchWorker{d: newWorker(i), queue: make(chan *dispatchItem, queue), last: -1}
+		d.workers = append(d.workers, w)
+		d.wg.Add(1)
+		go d.run(w)
+	}
+	return d
+}
+
+// Command dispatches cmd, it returns the first error of a worker.
+func (d *Dispatcher) Command(cmd *Command) error {
+	if err := d.Err(); err != nil {
+		return err
+	}
+	if tx := d.tx; tx != nil {
+		if cmd.Type() != Exec {
+			tx.Commands = append(tx.Commands, cmd)
+			return nil
+		}
+		d.tx, tx.Offset = nil, cmd.Offset
+		return d.Transaction(tx)
+	}
+	switch cmd.Type() {
+	case Select:
+		if len(cmd.D) > 1 {
+			if n, err := strconv.Atoi(cmd.D[1]); err == nil {
+				d.db = n
+			}
+		}
+		d.see(cmd.Offset)
+		return nil
+	case Multi:
+		// a transaction delivered command by command, as through a Buffer.
+		d.tx = &Transaction{DB: d.db}
+		return nil
+	case Ping:
+		d.see(cmd.Offset)
+		return nil
+	}
+	if strings.EqualFold(cmd.CommandName(), "replconf") {
+		d.see(cmd.Offset)
+		return nil
+	}
+	d.dispatch(&dispatchItem{db: d.db, cmd: cmd}, cmd.Keys(), cmd)
+	return d.Err()
+}
+
+// Transaction dispatches the commands of tx to one worker, which delivers them to
+// the Transaction method of its CommandDecoder when it has one.
+func (d *Dispatcher) Transaction(tx *Transaction) error {
+	if err := d.Err(); err != nil {
+		return err
+	}
+	var keys []string
+	keyless := false
+	for _, cmd := range tx.Commands {
+		if cmd.Type() == Select && len(cmd.D) > 1 {
+			if n, err := strconv.Atoi(cmd.D[1]); err == nil {
+				d.db = n
+			}
+			continue
+		}
+		k := cmd.Keys()
+		if len(k) == 0 || len(dbIndexes(cmd.D)) > 0 {
+			keyless = true
+		}
+		keys = append(keys, k...)
+	}
+	if keyless {
+		keys = nil
+	}
+	d.dispatch(&dispatchItem{db: tx.DB, tx: tx}, keys, nil)
+	return d.Err()
+}
+
+// dispatch queues item to the worker of keys, or as a barrier if they go to
+// several workers or there are none. cmd is the command of the item, nil for a transaction.
+func (d *Dispatcher) dispatch(item *dispatchItem, keys []string, cmd *Command) {
+	w := d.worker(keys)
+	if cmd != nil && len(dbIndexes(cmd.D)) > 0 {
+		// MOVE, COPY ... DB and SWAPDB change other databases.
+		w = nil
+	}
+	offset := item.offset()
+	if w != nil {
+		d.mu.Lock()
+		d.queue(w, item, offset)
+		d.mu.Unlock()
+		w.queue <- item
+		return
+	}
+	d.mu.Lock()
+	d.wait()
+	w = d.workers[0]
+	d.queue(w, item, offset)
+	d.mu.Unlock()
+	w.queue <- item
+	d.mu.Lock()
+	d.wait()
+	d.mu.Unlock()
+}
+
+// queue records item is queued to w, d.mu is held.
+func (d *Dispatcher) queue(w *dispatchWorker, item *dispatchItem, offset int64) {
+	item.prev = d.seen
+	w.waiting = append(w.waiting, d.seen)
+	if offset >= 0 {
+		d.seen = offset
+		w.last = offset
+	}
+}
+
+// wait waits until every worker is done with its commands, d.mu is held.
+func (d *Dispatcher) wait() {
+	for {
+		busy := false
+		for _, w := range d.workers {
+			if len(w.waiting) > 0 {
+				busy = true
+				break
+			}
+		}
+		if !busy || d.err != nil {
+			return
+		}
+		d.idle.Wait()
+	}
+}
+
+func (d *Dispatcher) see(offset int64) {
+	if offset < 0 {
+		return
+	}
+	d.mu.Lock()
+	d.seen = offset
+	d.mu.Unlock()
+}
+
+// worker returns the worker of keys, nil if they go to several workers or there are none.
+func (d *Dispatcher) worker(keys []string) *dispatchWorker {
+	var w *dispatchWorker
+	for _, key := range keys {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		kw := d.workers[h.Sum32()%uint32(len(d.workers))]
+		if w != nil && kw != w {
+			return nil
+		}
+		w = kw
+	}
+	return w
+}
+
+func (item *dispatchItem) offset() int64 {
+	if item.tx != nil {
+		return item.tx.Offset
+	}
+	return item.cmd.Offset
+}
+
+func (d *Dispatcher) run(w *dispatchWorker) {
+	defer d.wg.Done()
+	for item := range w.queue {
+		if d.Err() == nil {
+			d.fail(w.apply(item))
+		}
+		d.mu.Lock()
+		w.waiting = w.waiting[1:]
+		d.idle.Broadcast()
+		d.mu.Unlock()
+	}
+}
+
+// apply delivers item to the CommandDecoder of the worker, after the SELECT of its database.
+func (w *dispatchWorker) apply(item *dispatchItem) error {
+	if item.db != w.db {
+		cmd, _ := NewCommand("SELECT", strconv.Itoa(item.db))
+		cmd.Offset = item.prev
+		if err := w.d.Command(cmd); err != nil {
+			return err
+		}
+		w.db = item.db
+	}
+	if item.cmd != nil {
+		return w.d.Command(item.cmd)
+	}
+	tx := item.tx
+	defer func() {
+		for _, cmd := range tx.Commands {
+			if cmd.Type() == Select && len(cmd.D) > 1 {
+				if n, err := strconv.Atoi(cmd.D[1]); err == nil {
+					w.db = n
+				}
+			}
+		}
+	}()
+	if decoder, ok := w.d.(TransactionDecoder); ok {
+		return decoder.Transaction(tx)
+	}
+	start := item.prev
+	if len(tx.Commands) > 0 {
+		start = tx.Commands[0].Offset
+	}
+	multi := &Command{D: []string{"MULTI"}, Offset: start}
+	if err := w.d.Command(multi); err != nil {
+		return err
+	}
+	for _, cmd := range tx.Commands {
+		if err := w.d.Command(cmd); err != nil {
+			return err
+		}
+	}
+	return w.d.Command(&Command{D: []string{"EXEC"}, Offset: tx.Offset})
+}
+
+// Applied returns the replication offset every command up to was processed, -1 if none.
+func (d *Dispatcher) Applied() int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	applied := d.seen
+	for _, w := range d.workers {
+		if len(w.waiting) > 0 && w.waiting[0] < applied {
+			applied = w.waiting[0]
+		}
+		// an AppliedHandler may be behind the commands it processed.
+		if h, ok := w.d.(AppliedHandler); ok && w.last >= 0 {
+			if n := h.Applied(); n < w.last && n < applied {
+				applied = n
+			}
+		}
+	}
+	return applied
+}
+
+func (d *Dispatcher) Err() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.err
+}
+
+func (d *Dispatcher) fail(err error) {
+	if err == nil {
+		return
+	}
+	d.mu.Lock()
+	if d.err == nil {
+		d.err = errors.Wrap(err, "dispatch")
+	}
+	d.idle.Broadcast()
+	d.mu.Unlock()
+}
+
+// Close waits for the workers to process the queued commands and returns the
+// first error of a worker. The worker CommandDecoders are not closed.
+func (d *Dispatcher) Close() error {
+	for _, w := range d.workers {
+		close(w.queue)
+	}
+	d.wg.Wait()
+	return d.Err()
+}
@@ -0,0 +1,205 @@
+package canal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Dump is the DUMP payload of one key.
+type Dump struct {
+	DB      int
+	Key     []byte
+	Payload []byte
+	// Expiry is the unix time in milliseconds the key expires at, 0 if it does not.
+	Expiry int64
+	// Idle is the LRU idle time in seconds and Freq the LFU counter, -1 when not saved.
+	Idle int64
+	Freq int64
+}
+
+// Restore returns the RESTORE command recreating the key, nil if the key already expired.
+func (d *Dump) Restore(replace, absTTL bool) *Command {
+	ttl := d.Expiry
+	if ttl > 0 && !absTTL {
+		ttl -= time.Now().UnixNano() / int64(time.Millisecond)
+		if ttl <= 0 {
+			return nil
+		}
+	}
+	args := []string{"RESTORE", string(d.Key), strconv.FormatInt(ttl, 10), string(d.Payload)}
+	if replace {
+		args = append(args, "REPLACE")
+	}
+	if absTTL && ttl > 0 {
+		args = append(args, "ABSTTL")
+	}
+	if d.Idle >= 0 {
+		args = append(args, "IDLETIME", strconv.FormatInt(d.Idle, 10))
+	} else if d.Freq >= 0 {
+		args = append(args, "FREQ", strconv.FormatInt(d.Freq, 10))
+	}
+	cmd, _ := NewCommand(args...)
+	return cmd
+}
+
+// Dumper implements Decoder and builds the DUMP payload of every key it receives,
+// it is the counterpart of DecodeDump.
+type Dumper struct {
+	version int
+	fn      func(*Dump) error
+
+	db   int
+	obj  *rdbObject
+	idle int64
+	freq int64
+
+	err error
+}
+
+// NewDumper returns a Dumper calling fn with the payload of each key, encoded with the given RDB version.
+// The Dumper stops calling fn after the first error.
+func NewDumper(version int, fn func(*Dump) error) (*Dumper, error) {
+	if version < rdbVersionChecksum || version > rdbVersion {
+		return nil, errors.Errorf("rdb: unsupported DUMP version number %d", version)
+	}
+	return &Dumper{version: version, fn: fn, idle: -1, freq: -1}, nil
+}
+
+// Err returns the first error returned by the callback or met while encoding.
+func (d *Dumper) Err() error {
+	return d.err
+}
+
+func (d *Dumper) fail(err error) {
+	if d.err == nil && err != nil {
+		d.err = err
+	}
+}
+
+func (d *Dumper) BeginRDB()                                 {}
+func (d *Dumper) EndRDB()                                   {}
+func (d *Dumper) Aux(key, value []byte)                     {}
+func (d *Dumper) ResizeDatabase(dbSize, expiresSize uint32) {}
+func (d *Dumper) BeginDatabase(n int)                       { d.db = n }
+func (d *Dumper) EndDatabase(n int)                         {}
+
+func (d *Dumper) Eviction(key []byte, lruIdle, lfuFreq int64) {
+	d.idle, d.freq = lruIdle, lfuFreq
+}
+
+func (d *Dumper) Set(key, value []byte, expiry int64) {
+	d.obj = &rdbObject{typ: TypeString, key: key, expiry: expiry, values: [][]byte{value}}
+	d.dump()
+}
+
+func (d *Dumper) BeginHash(key []byte, length, expiry int64) {
+	d.obj = &rdbObject{typ: TypeHash, key: key, expiry: expiry, length: length}
+}
+
+func (d *Dumper) Hset(key, field, value []byte) {
+	if d.obj != nil {
+		d.obj.fields = append(d.obj.fields, field)
+		d.obj.values = append(d.obj.values, value)
+	}
+}
+
+func (d *Dumper) EndHash(key []byte) { d.dump() }
+
+func (d *Dumper) BeginSet(key []byte, cardinality, expiry int64) {
+	d.obj = &rdbObject{typ: TypeSet, key: key, expiry: expiry, length: cardinality}
+}
+
+func (d *Dumper) Sadd(key, member []byte) {
+	if d.obj != nil {
+		d.obj.values = append(d.obj.values, member)
+	}
+}
+
+func (d *Dumper) EndSet(key []byte) { d.dump() }
+
+func (d *Dumper) BeginList(key []byte, length, expiry int64) {
+	d.obj = &rdbObject{typ: TypeList, key: key, expiry: expiry, length: length}
+}
+
+func (d *Dumper) Rpush(key, value []byte) {
+	if d.obj != nil {
+		d.obj.values = append(d.obj.values, value)
+	}
+}
+
+func (d *Dumper) EndList(key []byte) { d.dump() }
+
+func (d *Dumper) BeginZSet(key []byte, cardinality, expiry int64) {
+	d.obj = &rdbObject{typ: TypeZSet, key: key, expiry: expiry, length: cardinality}
+}
+
+func (d *Dumper) Zadd(key []byte, score float64, member []byte) {
+	if d.obj != nil {
+		d.obj.values = append(d.obj.values, member)
+		d.obj.scores = append(d.obj.scores, score)
+	}
+}
+
+func (d *Dumper) EndZSet(key []byte) { d.dump() }
+
+func (d *Dumper) BeginStream(key []byte, cardinality, expiry int64) {
+	d.obj = &rdbObject{typ: TypeStreamListPacks, key: key, expiry: expiry, length: -1}
+}
+
+// Xadd adds an entry of one field, the fields and values of larger entries cannot be
+// told apart once joined: Err reports them, they go through XaddEntry.
+func (d *Dumper) Xadd(key, id, listpack []byte) {
+	if d.obj != nil {
+		d.fail(d.obj.xadd(id, listpack))
+	}
+}
+
+// XaddEntry implements StreamEntryDecoder, the fields and values may hold spaces.
+func (d *Dumper) XaddEntry(key, id []byte, fields []FieldValue) {
+	if d.obj != nil {
+		d.fail(d.obj.xaddEntry(id, fields))
+	}
+}
+
+func (d *Dumper) EndStream(key []byte) { d.dump() }
+
+func (d *Dumper) dump() {
+	obj := d.obj
+	idle, freq := d.idle, d.freq
+	d.obj, d.idle, d.freq = nil, -1, -1
+	if d.err != nil || obj == nil || (len(obj.values) == 0 && obj.typ != TypeStreamListPacks) {
+		return
+	}
+	payload, err := dumpPayload(obj, d.version)
+	if err != nil {
+		d.fail(err)
+		return
+	}
+	d.fail(d.fn(&Dump{DB: d.db, Key: obj.key, Payload: payload, Expiry: obj.expiry, Idle: idle, Freq: freq}))
+}
+
+// dumpPayload serializes o as the DUMP command does: the type, the value,
+// the RDB version and the CRC64 of all of the previous bytes.
+func dumpPayload(o *rdbObject, version int) ([]byte, error) {
+	if o.typ == TypeStreamListPacks && version < rdbVersionStream {
+		return nil, errors.Errorf("rdb: stream %s needs DUMP version %d", o.key, rdbVersionStream)
+	}
+	var buf bytes.Buffer
+	enc := &rdbEncode{w: &buf, version: version, intBuf: make([]byte, 8)}
+	typ := o.encoding(version)
+	buf.WriteByte(byte(typ))
+	if err := enc.writeValue(o, typ); err != nil {
+		return nil, err
+	}
+	footer := make([]byte, 2, 10)
+	binary.LittleEndian.PutUint16(footer, uint16(version))
+	buf.Write(footer)
+	footer = footer[:8]
+	binary.LittleEndian.PutUint64(footer, Digest(buf.Bytes()))
+	buf.Write(footer)
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,1039 @@
+package canal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// Encoder implements Decoder and writes every callback it receives as a RDB file,
+// so the output of DecodeFile / DecodeStream can be filtered or transformed and saved again.
+// Small collections are written with the compact encodings the chosen version supports.
+type Encoder struct {
+	w   *bufio.Writer
+	crc hash.Hash64
+	enc *rdbEncode
+
+	aux     [][2][]byte
+	auxKeys map[string]bool
+
+	begun bool
+	ended bool
+
+	obj    *rdbObject
+	direct bool // obj header already written, members are written as they come
+	count  int64
+
+	err error
+}
+
+// NewEncoder returns an Encoder writing a RDB of the given version (1 to 9) to w.
+func NewEncoder(w io.Writer, version int) (*Encoder, error) {
+	if version < 1 || version > rdbVersion {
+		return nil, errors.Errorf("rdb: unsupported RDB version number %d", version)
+	}
+	e := &Encoder{
+		w:       bufio.NewWriter(w),
+		crc:     New(),
+		auxKeys: make(map[string]bool),
+	}
+	e.enc = &rdbEncode{w: io.MultiWriter(e.w, e.crc), version: version, intBuf: make([]byte, 8)}
+	return e, nil
+}
+
+// SetAux adds an AUX field written right after the header. Aux fields received
+// from the decoder with the same key are dropped. It must be called before BeginRDB.
+func (e *Encoder) SetAux(key, value string) {
+	e.aux = append(e.aux, [2][]byte{[]byte(key), []byte(value)})
+	e.auxKeys[key] = true
+}
+
+// Err returns the first error the encoder met, the RDB is incomplete if it is not nil.
+func (e *Encoder) Err() error {
+	return e.err
+}
+
+func (e *Encoder) fail(err error) {
+	if e.err == nil && err != nil {
+		e.err = err
+	}
+}
+
+func (e *Encoder) begin() {
+	if e.begun || e.err != nil {
+		return
+	}
+	e.begun = true
+	_, err := fmt.Fprintf(e.enc.w, "REDIS%04d", e.enc.version)
+	if err != nil {
+		e.fail(err)
+		return
+	}
+	for _, kv := range e.aux {
+		e.fail(e.enc.writeAux(kv[0], kv[1]))
+	}
+}
+
+func (e *Encoder) BeginRDB() {
+	e.begin()
+}
+
+func (e *Encoder) Aux(key, value []byte) {
+	e.begin()
+	if e.err != nil || e.auxKeys[string(key)] {
+		return
+	}
+	e.fail(e.enc.writeAux(key, value))
+}
+
+func (e *Encoder) BeginDatabase(n int) {
+	e.begin()
+	if e.err != nil {
+		return
+	}
+	if err := e.enc.writeByte(rdbOpCodeSelectDB); err != nil {
+		e.fail(err)
+		return
+	}
+	e.fail(e.enc.writeLength(uint64(n)))
+}
+
+func (e *Encoder) ResizeDatabase(dbSize, expiresSize uint32) {
+	e.begin()
+	if e.err != nil || e.enc.version < rdbVersionAux {
+		return
+	}
+	if err := e.enc.writeByte(rdbOpCodeResizeDB); err != nil {
+		e.fail(err)
+		return
+	}
+	if err := e.enc.writeLength(uint64(dbSize)); err != nil {
+		e.fail(err)
+		return
+	}
+	e.fail(e.enc.writeLength(uint64(expiresSize)))
+}
+
+func (e *Encoder) EndDatabase(n int) {}
+
+func (e *Encoder) Set(key, value []byte, expiry int64) {
+	e.begin()
+	if e.err != nil {
+		return
+	}
+	obj := &rdbObject{typ: TypeString, key: key, expiry: expiry, values: [][]byte{value}}
+	e.fail(e.enc.writeObject(obj))
+}
+
+func (e *Encoder) BeginHash(key []byte, length, expiry int64) {
+	e.beginObject(TypeHash, key, length, expiry)
+}
+
+func (e *Encoder) Hset(key, field, value []byte) {
+	if e.direct {
+		if e.err == nil {
+			e.fail(e.enc.writeString(field))
+		}
+		e.member(value)
+		return
+	}
+	if e.obj != nil {
+		e.obj.fields = append(e.obj.fields, field)
+		e.obj.values = append(e.obj.values, value)
+	}
+}
+
+func (e *Encoder) EndHash(key []byte) {
+	e.endObject()
+}
+
+func (e *Encoder) BeginSet(key []byte, cardinality, expiry int64) {
+	e.beginObject(TypeSet, key, cardinality, expiry)
+}
+
+func (e *Encoder) Sadd(key, member []byte) {
+	if e.direct {
+		e.member(member)
+		return
+	}
+	if e.obj != nil {
+		e.obj.values = append(e.obj.values, member)
+	}
+}
+
+func (e *Encoder) EndSet(key []byte) {
+	e.endObject()
+}
+
+func (e *Encoder) BeginList(key []byte, length, expiry int64) {
+	e.beginObject(TypeList, key, length, expiry)
+}
+
+func (e *Encoder) Rpush(key, value []byte) {
+	if e.direct {
+		e.member(value)
+		return
+	}
+	if e.obj != nil {
+		e.obj.values = append(e.obj.values, value)
+	}
+}
+
+func (e *Encoder) EndList(key []byte) {
+	e.endObject()
+}
+
+func (e *Encoder) BeginZSet(key []byte, cardinality, expiry int64) {
+	e.beginObject(TypeZSet, key, cardinality, expiry)
+}
+
+func (e *Encoder) Zadd(key []byte, score float64, member []byte) {
+	if e.direct {
+		if e.err != nil {
+			return
+		}
+		if err := e.enc.writeString(member); err != nil {
+			e.fail(err)
+			return
+		}
+		if e.enc.version >= rdbVersionZSet2 {
+			e.fail(e.enc.writeBinaryFloat64(score))
+		} else {
+			e.fail(e.enc.writeFloat64(score))
+		}
+		e.count++
+		return
+	}
+	if e.obj != nil {
+		e.obj.values = append(e.obj.values, member)
+		e.obj.scores = append(e.obj.scores, score)
+	}
+}
+
+func (e *Encoder) EndZSet(key []byte) {
+	e.endObject()
+}
+
+func (e *Encoder) BeginStream(key []byte, cardinality, expiry int64) {
+	if e.enc.version < rdbVersionStream {
+		e.fail(errors.Errorf("rdb: stream %s needs RDB version %d", key, rdbVersionStream))
+		return
+	}
+	// the number of entries is only known at EndStream, streams are always buffered.
+	e.beginObject(TypeStreamListPacks, key, -1, expiry)
+}
+
+func (e *Encoder) Xadd(key, streamID, listpack []byte) {
+	if e.obj != nil {
+		e.fail(e.obj.xadd(streamID, listpack))
+	}
+}
+
+// XaddEntry implements StreamEntryDecoder, the fields and values may hold spaces.
+func (e *Encoder) XaddEntry(key, streamID []byte, fields []FieldValue) {
+	if e.obj != nil {
+		e.fail(e.obj.xaddEntry(streamID, fields))
+	}
+}
+
+func (e *Encoder) EndStream(key []byte) {
+	e.endObject()
+}
+
+func (e *Encoder) EndRDB() {
+	e.begin()
+	if e.err != nil || e.ended {
+		return
+	}
+	e.ended = true
+	if err := e.enc.writeByte(rdbOpCodeEOF); err != nil {
+		e.fail(err)
+		return
+	}
+	if e.enc.version >= rdbVersionChecksum {
+		if _, err := e.w.Write(e.crc.Sum(nil)); err != nil {
+			e.fail(err)
+			return
+		}
+	}
+	e.fail(e.w.Flush())
+}
+
+func (e *Encoder) beginObject(typ ValueType, key []byte, length, expiry int64) {
+	e.begin()
+	if e.err != nil {
+		return
+	}
+	e.obj = &rdbObject{typ: typ, key: key, expiry: expiry, length: length}
+	e.direct = false
+	e.count = 0
+	if length < 0 || length <= rdbEncodeBufferMaxEntries {
+		return
+	}
+	// too large for any compact encoding, write the header now and stream the members.
+	e.direct = true
+	typ = e.obj.plainType(e.enc.version)
+	if err := e.enc.writeHeader(e.obj, typ); err != nil {
+		e.fail(err)
+		return
+	}
+	e.fail(e.enc.writeLength(uint64(length)))
+}
+
+func (e *Encoder) member(value []byte) {
+	if e.err != nil {
+		return
+	}
+	e.fail(e.enc.writeString(value))
+	e.count++
+}
+
+func (e *Encoder) endObject() {
+	obj := e.obj
+	e.obj = nil
+	if obj == nil || e.err != nil {
+		e.direct = false
+		return
+	}
+	if e.direct {
+		e.direct = false
+		if e.count != obj.length {
+			e.fail(errors.Errorf("rdb: key %s announced %d members, got %d", obj.key, obj.length, e.count))
+		}
+		return
+	}
+	if len(obj.values) == 0 && obj.typ != TypeStreamListPacks {
+		return // redis does not keep empty collections
+	}
+	e.fail(e.enc.writeObject(obj))
+}
+
+// rdbObject buffers one key until its encoding can be chosen.
+type rdbObject struct {
+	typ    ValueType // logical type: TypeString, TypeList, TypeSet, TypeZSet, TypeHash or TypeStreamListPacks
+	key    []byte
+	expiry int64
+	length int64
+	fields [][]byte // hash fields
+	values [][]byte
+	scores []float64
+	stream []streamEntry
+}
+
+// plainType is the non compact on disk type of the object.
+func (o *rdbObject) plainType(version int) ValueType {
+	if o.typ == TypeZSet && version >= rdbVersionZSet2 {
+		return TypeZSet2
+	}
+	return o.typ
+}
+
+// encoding picks the on disk type of the object for the given version.
+func (o *rdbObject) encoding(version int) ValueType {
+	switch o.typ {
+	case TypeList:
+		if version >= rdbVersionAux {
+			return TypeListQuicklist
+		}
+		if version >= rdbVersionCompact && len(o.values) <= rdbListMaxZiplistEntries && maxLen(o.values) <= rdbListMaxZiplistValue {
+			return TypeListZiplist
+		}
+	case TypeSet:
+		if version >= rdbVersionCompact && len(o.values) <= rdbSetMaxIntsetEntries {
+			if _, ok := intsetWidth(o.values); ok {
+				return TypeSetIntset
+			}
+		}
+	case TypeZSet:
+		if version >= rdbVersionCompact && len(o.values) <= rdbZSetMaxZiplistEntries && maxLen(o.values) <= rdbZSetMaxZiplistValue {
+			return TypeZSetZiplist
+		}
+	case TypeHash:
+		if version >= rdbVersionHashZiplist && len(o.values) <= rdbHashMaxZiplistEntries &&
+			maxLen(o.fields) <= rdbHashMaxZiplistValue && maxLen(o.values) <= rdbHashMaxZiplistValue {
+			return TypeHashZiplist
+		}
+	}
+	return o.plainType(version)
+}
+
+func maxLen(bs [][]byte) int {
+	max := 0
+	for _, b := range bs {
+		if len(b) > max {
+			max = len(b)
+		}
+	}
+	return max
+}
+
+// rdbEncode is the counterpart of rdbDecode.
+type rdbEncode struct {
+	w       io.Writer
+	version int
+	intBuf  []byte
+}
+
+func (e *rdbEncode) write(b []byte) error {
+	_, err := e.w.Write(b)
+	return err
+}
+
+func (e *rdbEncode) writeByte(b byte) error {
+	return e.write([]byte{b})
+}
+
+func (e *rdbEncode) writeAux(key, value []byte) error {
+	if e.version < rdbVersionAux {
+		return nil
+	}
+	if err := e.writeByte(rdbOpCodeAux); err != nil {
+		return err
+	}
+	if err := e.writeString(key); err != nil {
+		return err
+	}
+	return e.writeString(value)
+}
+
+func (e *rdbEncode) writeLength(length uint64) error {
+	switch {
+	case length < 1<<6:
+		return e.writeByte(byte(length) | rdb6bitLen<<6)
+	case length < 1<<14:
+		return e.write([]byte{byte(length>>8) | rdb14bitLen<<6, byte(length)})
+	case length <= math.MaxUint32:
+		e.intBuf[0] = rdb32bitLen
+		binary.BigEndian.PutUint32(e.intBuf[1:], uint32(length))
+		return e.write(e.intBuf[:5])
+	default:
+		if err := e.writeByte(rdb64bitLen); err != nil {
+			return err
+		}
+		binary.BigEndian.PutUint64(e.intBuf, length)
+		return e.write(e.intBuf)
+	}
+}
+
+func (e *rdbEncode) writeString(s []byte) error {
+	if len(s) <= 11 {
+		if i, ok := parseInt(s); ok {
+			switch {
+			case i >= math.MinInt8 && i <= math.MaxInt8:
+				return e.write([]byte{rdbEncVal<<6 | rdbEncInt8, byte(int8(i))})
+			case i >= math.MinInt16 && i <= math.MaxInt16:
+				e.intBuf[0] = rdbEncVal<<6 | rdbEncInt16
+				binary.LittleEndian.PutUint16(e.intBuf[1:], uint16(int16(i)))
+				return e.write(e.intBuf[:3])
+			case i >= math.MinInt32 && i <= math.MaxInt32:
+				e.intBuf[0] = rdbEncVal<<6 | rdbEncInt32
+				binary.LittleEndian.PutUint32(e.intBuf[1:], uint32(int32(i)))
+				return e.write(e.intBuf[:5])
+			}
+		}
+	}
+	// under 20 bytes lzf is unable to compress anything.
+	if len(s) > 20 {
+		if compressed := lzfCompress(s); compressed != nil {
+			if err := e.writeByte(rdbEncVal<<6 | rdbEncLZF); err != nil {
+				return err
+			}
+			if err := e.writeLength(uint64(len(compressed))); err != nil {
+				return err
+			}
+			if err := e.writeLength(uint64(len(s))); err != nil {
+				return err
+			}
+			return e.write(compressed)
+		}
+	}
+	if err := e.writeLength(uint64(len(s))); err != nil {
+		return err
+	}
+	return e.write(s)
+}
+
+// Doubles are saved as strings prefixed by their length, see readFloat64.
+func (e *rdbEncode) writeFloat64(f float64) error {
+	switch {
+	case math.IsNaN(f):
+		return e.writeByte(253)
+	case math.IsInf(f, 1):
+		return e.writeByte(254)
+	case math.IsInf(f, -1):
+		return e.writeByte(255)
+	}
+	s := strconv.FormatFloat(f, 'g', -1, 64)
+	if err := e.writeByte(byte(len(s))); err != nil {
+		return err
+	}
+	return e.write([]byte(s))
+}
+
+func (e *rdbEncode) writeBinaryFloat64(f float64) error {
+	binary.LittleEndian.PutUint64(e.intBuf, math.Float64bits(f))
+	return e.write(e.intBuf)
+}
+
+func (e *rdbEncode) writeExpiry(expiry int64) error {
+	if expiry <= 0 {
+		return nil
+	}
+	if e.version >= rdbVersionExpiryMS {
+		e.intBuf[0] = rdbOpCodeExpiryMS
+		if err := e.write(e.intBuf[:1]); err != nil {
+			return err
+		}
+		binary.LittleEndian.PutUint64(e.intBuf, uint64(expiry))
+		return e.write(e.intBuf)
+	}
+	e.intBuf[0] = rdbOpCodeExpiry
+	binary.LittleEndian.PutUint32(e.intBuf[1:], uint32(expiry/1000))
+	return e.write(e.intBuf[:5])
+}
+
+// writeHeader writes the expiry, type and key that precede every value in a RDB file.
+func (e *rdbEncode) writeHeader(o *rdbObject, typ ValueType) error {
+	if err := e.writeExpiry(o.expiry); err != nil {
+		return err
+	}
+	if err := e.writeByte(byte(typ)); err != nil {
+		return err
+	}
+	return e.writeString(o.key)
+}
+
+func (e *rdbEncode) writeObject(o *rdbObject) error {
+	typ := o.encoding(e.version)
+	if err := e.writeHeader(o, typ); err != nil {
+		return err
+	}
+	return e.writeValue(o, typ)
+}
+
+// writeValue writes the value of o encoded as typ, without key and type byte.
+func (e *rdbEncode) writeValue(o *rdbObject, typ ValueType) error {
+	switch typ {
+	case TypeString:
+		return e.writeString(o.values[0])
+	case TypeList, TypeSet:
+		if err := e.writeLength(uint64(len(o.values))); err != nil {
+			return err
+		}
+		for _, v := range o.values {
+			if err := e.writeString(v); err != nil {
+				return err
+			}
+		}
+	case TypeZSet, TypeZSet2:
+		if err := e.writeLength(uint64(len(o.values))); err != nil {
+			return err
+		}
+		for i, v := range o.values {
+			if err := e.writeString(v); err != nil {
+				return err
+			}
+			var err error
+			if typ == TypeZSet2 {
+				err = e.writeBinaryFloat64(o.scores[i])
+			} else {
+				err = e.writeFloat64(o.scores[i])
+			}
+			if err != nil {
+				return err
+			}
+		}
+	case TypeHash:
+		if err := e.writeLength(uint64(len(o.values))); err != nil {
+			return err
+		}
+		for i, v := range o.values {
+			if err := e.writeString(o.fields[i]); err != nil {
+				return err
+			}
+			if err := e.writeString(v); err != nil {
+				return err
+			}
+		}
+	case TypeListZiplist:
+		return e.writeString(encodeZiplist(o.values))
+	case TypeListQuicklist:
+		var nodes [][]byte
+		start, size := 0, 0
+		for i, v := range o.values {
+			size += len(v)
+			if i+1-start >= rdbQuicklistNodeEntries || size >= rdbQuicklistNodeBytes {
+				nodes = append(nodes, encodeZiplist(o.values[start:i+1]))
+				start, size = i+1, 0
+			}
+		}
+		if start < len(o.values) {
+			nodes = append(nodes, encodeZiplist(o.values[start:]))
+		}
+		if err := e.writeLength(uint64(len(nodes))); err != nil {
+			return err
+		}
+		for _, node := range nodes {
+			if err := e.writeString(node); err != nil {
+				return err
+			}
+		}
+	case TypeSetIntset:
+		return e.writeString(encodeIntset(o.values))
+	case TypeZSetZiplist:
+		entries := make([][]byte, 0, 2*len(o.values))
+		for i, v := range o.values {
+			entries = append(entries, v, []byte(strconv.FormatFloat(o.scores[i], 'g', -1, 64)))
+		}
+		return e.writeString(encodeZiplist(entries))
+	case TypeHashZiplist:
+		entries := make([][]byte, 0, 2*len(o.values))
+		for i, v := range o.values {
+			entries = append(entries, o.fields[i], v)
+		}
+		return e.writeString(encodeZiplist(entries))
+	case TypeStreamListPacks:
+		return e.writeStream(o)
+	default:
+		return errors.Errorf("rdb: unable to encode key %s as type %d", o.key, typ)
+	}
+	return nil
+}
+
+type streamEntry struct {
+	ms, seq uint64
+	fields  [][]byte
+	values  [][]byte
+}
+
+// xadd adds an entry of one field to the stream o, as Xadd passes it.
+func (o *rdbObject) xadd(id, listpack []byte) error {
+	fields, err := splitStreamEntry(listpack)
+	if err != nil {
+		return errors.Wrapf(err, "rdb: stream %s entry %s", o.key, id)
+	}
+	return o.xaddEntry(id, fields)
+}
+
+// xaddEntry adds an entry to the stream o, its fields and values are copied.
+func (o *rdbObject) xaddEntry(id []byte, fields []FieldValue) error {
+	ms, seq, err := parseStreamID(id)
+	if err != nil {
+		return err
+	}
+	entry := streamEntry{ms: ms, seq: seq}
+	for _, f := range fields {
+		entry.fields = append(entry.fields, []byte(f.Field))
+		entry.values = append(entry.values, []byte(f.Value))
+	}
+	o.stream = append(o.stream, entry)
+	return nil
+}
+
+func parseStreamID(id []byte) (uint64, uint64, error) {
+	i := bytes.IndexByte(id, '-')
+	if i < 0 {
+		return 0, 0, errors.Errorf("rdb: invalid stream id %s", id)
+	}
+	ms, err := strconv.ParseUint(string(id[:i]), 10, 64)
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "rdb: invalid stream id %s", id)
+	}
+	seq, err := strconv.ParseUint(string(id[i+1:]), 10, 64)
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "rdb: invalid stream id %s", id)
+	}
+	return ms, seq, nil
+}
+
+// writeStream writes a stream without consumer groups.
+func (e *rdbEncode) writeStream(o *rdbObject) error {
+	entries := o.stream
+	nodes := (len(entries) + rdbStreamNodeMaxEntries - 1) / rdbStreamNodeMaxEntries
+	if err := e.writeLength(uint64(nodes)); err != nil {
+		return err
+	}
+	for start := 0; start < len(entries); start += rdbStreamNodeMaxEntries {
+		end := start + rdbStreamNodeMaxEntries
+		if end > len(entries) {
+			end = len(entries)
+		}
+		master := entries[start]
+		binary.BigEndian.PutUint64(e.intBuf, master.ms)
+		id := append([]byte{}, e.intBuf...)
+		binary.BigEndian.PutUint64(e.intBuf, master.seq)
+		id = append(id, e.intBuf...)
+		if err := e.writeString(id); err != nil {
+			return err
+		}
+		if err := e.writeString(encodeStreamNode(entries[start:end])); err != nil {
+			return err
+		}
+	}
+
+	var lastMs, lastSeq uint64
+	if len(entries) > 0 {
+		lastMs, lastSeq = entries[len(entries)-1].ms, entries[len(entries)-1].seq
+	}
+	for _, n := range []uint64{uint64(len(entries)), lastMs, lastSeq, 0} { // items, last_id, last_seq, groups
+		if err := e.writeLength(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeStreamNode builds the listpack of one stream node, the first entry is the master entry.
+func encodeStreamNode(entries []streamEntry) []byte {
+	master := entries[0]
+	lp := newListpack()
+	lp.appendInt(int64(len(entries))) // count
+	lp.appendInt(0)                   // deleted
+	lp.appendInt(int64(len(master.fields)))
+	for _, f := range master.fields {
+		lp.append(f)
+	}
+	lp.appendInt(0)
+	for _, entry := range entries {
+		same := len(entry.fields) == len(master.fields)
+		for i := 0; same && i < len(entry.fields); i++ {
+			same = bytes.Equal(entry.fields[i], master.fields[i])
+		}
+		flags := int64(rdbStreamItemFlagNone)
+		if same {
+			flags |= rdbStreamItemFlangSameFields
+		}
+		lp.appendInt(flags)
+		lp.appendInt(int64(entry.ms - master.ms))
+		lp.appendInt(int64(entry.seq - master.seq))
+		count := int64(len(entry.fields)) + 3
+		if same {
+			for _, v := range entry.values {
+				lp.append(v)
+			}
+		} else {
+			lp.appendInt(int64(len(entry.fields)))
+			for i, f := range entry.fields {
+				lp.append(f)
+				lp.append(entry.values[i])
+			}
+			count += int64(len(entry.fields)) + 1
+		}
+		lp.appendInt(count)
+	}
+	return lp.bytes()
+}
+
+// parseInt reports whether s is the canonical representation of an int64,
+// which is the condition for redis to store it as an integer.
+func parseInt(s []byte) (int64, bool) {
+	if len(s) == 0 || len(s) > 20 {
+		return 0, false
+	}
+	i, err := strconv.ParseInt(string(s), 10, 64)
+	if err != nil || strconv.FormatInt(i, 10) != string(s) {
+		return 0, false
+	}
+	return i, true
+}
+
+func encodeZiplist(entries [][]byte) []byte {
+	buf := make([]byte, 10, 11+len(entries)*4)
+	tail, prevlen := 10, 0
+	for _, entry := range entries {
+		tail = len(buf)
+		if prevlen < 254 {
+			buf = append(buf, byte(prevlen))
+		} else {
+			buf = append(buf, 254, 0, 0, 0, 0)
+			binary.LittleEndian.PutUint32(buf[len(buf)-4:], uint32(prevlen))
+		}
+		if i, ok := parseInt(entry); ok && len(entry) <= 32 {
+			buf = appendZiplistInt(buf, i)
+		} else {
+			l := len(entry)
+			switch {
+			case l <= 0x3f:
+				buf = append(buf, byte(l)|rdbZiplist6bitlenString<<6)
+			case l <= 0x3fff:
+				buf = append(buf, byte(l>>8)|rdbZiplist14bitlenString<<6, byte(l))
+			default:
+				buf = append(buf, rdbZiplist32bitlenString<<6, 0, 0, 0, 0)
+				binary.BigEndian.PutUint32(buf[len(buf)-4:], uint32(l))
+			}
+			buf = append(buf, entry...)
+		}
+		prevlen = len(buf) - tail
+	}
+	buf = append(buf, 0xff)
+	binary.LittleEndian.PutUint32(buf[0:], uint32(len(buf)))
+	binary.LittleEndian.PutUint32(buf[4:], uint32(tail))
+	length := len(entries)
+	if length > math.MaxUint16 {
+		length = math.MaxUint16
+	}
+	binary.LittleEndian.PutUint16(buf[8:], uint16(length))
+	return buf
+}
+
+func appendZiplistInt(buf []byte, i int64) []byte {
+	switch {
+	case i >= 0 && i <= 12:
+		return append(buf, byte(rdbZiplistInt4<<4|(i+1)))
+	case i >= math.MinInt8 && i <= math.MaxInt8:
+		return append(buf, rdbZiplistInt8, byte(int8(i)))
+	case i >= math.MinInt16 && i <= math.MaxInt16:
+		buf = append(buf, rdbZiplistInt16, 0, 0)
+		binary.LittleEndian.PutUint16(buf[len(buf)-2:], uint16(int16(i)))
+		return buf
+	case i >= -1<<23 && i < 1<<23:
+		return append(buf, rdbZiplistInt24, byte(i), byte(i>>8), byte(i>>16))
+	case i >= math.MinInt32 && i <= math.MaxInt32:
+		buf = append(buf, rdbZiplistInt32, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(buf[len(buf)-4:], uint32(int32(i)))
+		return buf
+	default:
+		buf = append(buf, rdbZiplistInt64, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint64(buf[len(buf)-8:], uint64(i))
+		return buf
+	}
+}
+
+// intsetWidth returns the byte width of the intset holding members, if they all are integers.
+func intsetWidth(members [][]byte) (int, bool) {
+	width := 2
+	for _, m := range members {
+		i, ok := parseInt(m)
+		if !ok {
+			return 0, false
+		}
+		if i < math.MinInt32 || i > math.MaxInt32 {
+			width = 8
+		} else if (i < math.MinInt16 || i > math.MaxInt16) && width < 4 {
+			width = 4
+		}
+	}
+	return width, true
+}
+
+func encodeIntset(members [][]byte) []byte {
+	width, _ := intsetWidth(members)
+	ints := make([]int64, len(members))
+	for i, m := range members {
+		ints[i], _ = parseInt(m)
+	}
+	sort.Slice(ints, func(i, j int) bool { return ints[i] < ints[j] })
+	buf := make([]byte, 8+width*len(ints))
+	binary.LittleEndian.PutUint32(buf[0:], uint32(width))
+	binary.LittleEndian.PutUint32(buf[4:], uint32(len(ints)))
+	for n, i := range ints {
+		p := buf[8+n*width:]
+		switch width {
+		case 2:
+			binary.LittleEndian.PutUint16(p, uint16(int16(i)))
+		case 4:
+			binary.LittleEndian.PutUint32(p, uint32(int32(i)))
+		case 8:
+			binary.LittleEndian.PutUint64(p, uint64(i))
+		}
+	}
+	return buf
+}
+
+type listpack struct {
+	buf []byte
+	n   int
+}
+
+func newListpack() *listpack {
+	return &listpack{buf: make([]byte, rdbLpHdrSize)}
+}
+
+func (lp *listpack) appendInt(i int64) {
+	start := len(lp.buf)
+	switch {
+	case i >= 0 && i <= 127:
+		lp.buf = append(lp.buf, byte(i)|rdbLpEncoding7BitUint)
+	case i >= -4096 && i <= 4095:
+		u := uint64(i) & 0x1fff
+		lp.buf = append(lp.buf, byte(u>>8)|rdbLpEncoding13BitInt, byte(u))
+	case i >= math.MinInt16 && i <= math.MaxInt16:
+		lp.buf = append(lp.buf, rdbLpEncoding16BitInt, byte(i), byte(i>>8))
+	case i >= -1<<23 && i < 1<<23:
+		lp.buf = append(lp.buf, rdbLpEncoding24BitInt, byte(i), byte(i>>8), byte(i>>16))
+	case i >= math.MinInt32 && i <= math.MaxInt32:
+		lp.buf = append(lp.buf, rdbLpEncoding32BitInt, byte(i), byte(i>>8), byte(i>>16), byte(i>>24))
+	default:
+		lp.buf = append(lp.buf, rdbLpEncoding64BitInt, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint64(lp.buf[len(lp.buf)-8:], uint64(i))
+	}
+	lp.backlen(len(lp.buf) - start)
+}
+
+func (lp *listpack) append(s []byte) {
+	if i, ok := parseInt(s); ok {
+		lp.appendInt(i)
+		return
+	}
+	start := len(lp.buf)
+	l := len(s)
+	switch {
+	case l < 64:
+		lp.buf = append(lp.buf, byte(l)|rdbLpEncoding6BitStr)
+	case l < 4096:
+		lp.buf = append(lp.buf, byte(l>>8)|rdbLpEncoding12BitStr, byte(l))
+	default:
+		lp.buf = append(lp.buf, rdbLpEncoding32BitStr, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(lp.buf[len(lp.buf)-4:], uint32(l))
+	}
+	lp.buf = append(lp.buf, s...)
+	lp.backlen(len(lp.buf) - start)
+}
+
+// backlen closes an entry of l bytes with its length, readable from right to left.
+func (lp *listpack) backlen(l int) {
+	lp.n++
+	switch {
+	case l <= 127:
+		lp.buf = append(lp.buf, byte(l))
+	case l < 16383:
+		lp.buf = append(lp.buf, byte(l>>7), byte(l&127)|128)
+	case l < 2097151:
+		lp.buf = append(lp.buf, byte(l>>14), byte((l>>7)&127)|128, byte(l&127)|128)
+	case l < 268435455:
+		lp.buf = append(lp.buf, byte(l>>21), byte((l>>14)&127)|128, byte((l>>7)&127)|128, byte(l&127)|128)
+	default:
+		lp.buf = append(lp.buf, byte(l>>28), byte((l>>21)&127)|128, byte((l>>14)&127)|128, byte((l>>7)&127)|128, byte(l&127)|128)
+	}
+}
+
+func (lp *listpack) bytes() []byte {
+	buf := append(lp.buf, rdbLpEOF)
+	binary.LittleEndian.PutUint32(buf[0:], uint32(len(buf)))
+	n := lp.n
+	if n >= rdbLpHdrNumeleUnknown {
+		n = rdbLpHdrNumeleUnknown
+	}
+	binary.LittleEndian.PutUint16(buf[4:], uint16(n))
+	return buf
+}
+
+const (
+	lzfHashLog = 16
+	lzfMaxLit  = 1 << 5
+	lzfMaxOff  = 1 << 13
+	lzfMaxRef  = (1 << 8) + (1 << 3)
+)
+
+func lzfIndex(h uint32) int {
+	return int(((h >> (3*8 - lzfHashLog)) - h*5) & (1<<lzfHashLog - 1))
+}
+
+// lzfCompress is a port of liblzf lzf_compress, it returns nil when in
+// cannot be compressed by at least 4 bytes, like rdbSaveLzfStringObject.
+func lzfCompress(in []byte) []byte {
+	inLen := len(in)
+	if inLen <= 4 {
+		return nil
+	}
+	outLen := inLen - 4
+	out := make([]byte, outLen)
+	htab := make([]int, 1<<lzfHashLog) // position + 1 of the last occurrence of a hash
+	ip, op, lit := 0, 1, 0             // op starts after the first literal run length
+	hval := uint32(in[0])<<8 | uint32(in[1])
+	for ip < inLen-2 {
+		hval = hval<<8 | uint32(in[ip+2])
+		slot := lzfIndex(hval)
+		ref := htab[slot] - 1
+		htab[slot] = ip + 1
+		off := ip - ref - 1
+		if ref >= 0 && off < lzfMaxOff &&
+			in[ref+2] == in[ip+2] && in[ref] == in[ip] && in[ref+1] == in[ip+1] {
+			length := 2
+			maxlen := inLen - ip - length
+			if maxlen > lzfMaxRef {
+				maxlen = lzfMaxRef
+			}
+			undo := 0
+			if lit == 0 {
+				undo = 1
+			}
+			if op-undo+3+1 >= outLen {
+				return nil
+			}
+			out[op-lit-1] = byte(lit - 1) // stop run
+			op -= undo
+			for {
+				length++
+				if length >= maxlen || in[ref+length] != in[ip+length] {
+					break
+				}
+			}
+			length -= 2
+			ip++
+			if length < 7 {
+				out[op] = byte(off>>8) + byte(length<<5)
+				op++
+			} else {
+				out[op] = byte(off>>8) + 7<<5
+				out[op+1] = byte(length - 7)
+				op += 2
+			}
+			out[op] = byte(off)
+			op++
+			lit = 0
+			op++ // start run
+			ip += length + 1
+			if ip >= inLen-2 {
+				break
+			}
+			ip -= 2
+			hval = uint32(in[ip])<<8 | uint32(in[ip+1])
+			for n := 0; n < 2; n++ {
+				hval = hval<<8 | uint32(in[ip+2])
+				htab[lzfIndex(hval)] = ip + 1
+				ip++
+			}
+		} else {
+			if op >= outLen {
+				return nil
+			}
+			lit++
+			out[op] = in[ip]
+			op++
+			ip++
+			if lit == lzfMaxLit {
+				out[op-lit-1] = byte(lit - 1)
+				lit = 0
+				op++
+			}
+		}
+	}
+	if op+3 > outLen {
+		return nil
+	}
+	for ip < inLen {
+		lit++
+		out[op] = in[ip]
+		op++
+		ip++
+		if lit == lzfMaxLit {
+			out[op-lit-1] = byte(lit - 1)
+			lit = 0
+			op++
+		}
+	}
+	out[op-lit-1] = byte(lit - 1)
+	if lit == 0 {
+		op--
+	}
+	return out[:op]
+}
@@ -0,0 +1,400 @@
+package canal
+
+import (
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Filter selects the databases, keys and commands canal delivers.
+// Empty allow lists allow everything, the deny lists take precedence.
+//
+// A command with several keys is delivered when all of its keys match. Commands
+// whose keys are independent, like MSET or DEL, are cut down to the matching keys,
+// and renaming a matching key to one that does not match deletes it. When keys are
+// filtered, the commands whose keys canal does not know are dropped.
+type Filter struct {
+	// Keys are glob-style patterns as used by KEYS, KeyRegexps regular expressions.
+	Keys       []string
+	KeyRegexps []*regexp.Regexp
+
+	SkipKeys       []string
+	SkipKeyRegexps []*regexp.Regexp
+
+	DBs     []int
+	SkipDBs []int
+
+	// Commands are command names like "set", the case does not matter.
+	Commands     []string
+	SkipCommands []string
+}
+
+// MatchDB reports whether the database n is delivered.
+func (f *Filter) MatchDB(n int) bool {
+	for _, db := range f.SkipDBs {
+		if db == n {
+			return false
+		}
+	}
+	if len(f.DBs) == 0 {
+		return true
+	}
+	for _, db := range f.DBs {
+		if db == n {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchKey reports whether the key is delivered.
+func (f *Filter) MatchKey(key string) bool {
+	if matchKey(f.SkipKeys, f.SkipKeyRegexps, key) {
+		return false
+	}
+	if len(f.Keys) == 0 && len(f.KeyRegexps) == 0 {
+		return true
+	}
+	return matchKey(f.Keys, f.KeyRegexps, key)
+}
+
+// MatchCommand reports whether the commands called name are delivered.
+func (f *Filter) MatchCommand(name string) bool {
+	for _, skip := range f.SkipCommands {
+		if strings.EqualFold(skip, name) {
+			return false
+		}
+	}
+	if len(f.Commands) == 0 {
+		return true
+	}
+	for _, allow := range f.Commands {
+		if strings.EqualFold(allow, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *Filter) filtersKeys() bool {
+	return len(f.Keys) > 0 || len(f.KeyRegexps) > 0 || len(f.SkipKeys) > 0 || len(f.SkipKeyRegexps) > 0
+}
+
+// Command returns the part of cmd to deliver when it runs on database db, nil for nothing.
+func (f *Filter) Command(db int, cmd *Command) *Command {
+	name := strings.ToLower(cmd.CommandName())
+	if !f.MatchCommand(name) {
+		return nil
+	}
+	if name == "select" {
+		if len(cmd.D) > 1 {
+			if n, err := strconv.Atoi(cmd.D[1]); err == nil && !f.MatchDB(n) {
+				return nil
+			}
+		}
+		return cmd
+	}
+	if !f.MatchDB(db) {
+		return nil
+	}
+	if !f.filtersKeys() {
+		return cmd
+	}
+	idx, known := cmd.keyIndexes()
+	if !known {
+		log.Printf("[CANAL] filter drops %s, its keys are unknown.\n", cmd.CommandName())
+		return nil
+	}
+	matched := make([]bool, len(idx))
+	n := 0
+	for i, j := range idx {
+		if f.MatchKey(cmd.D[j]) {
+			matched[i] = true
+			n++
+		}
+	}
+	if n == len(idx) {
+		return cmd
+	}
+	if n == 0 {
+		return nil
+	}
+	if splitKeyCommands[name] {
+		step := commandKeySpecs[name].step
+		args := cmd.D[:1:1]
+		for i, j := range idx {
+			if matched[i] && j+step <= len(cmd.D) {
+				args = append(args, cmd.D[j:j+step]...)
+			}
+		}
+		return &Command{T: cmd.T, D: args, Offset: cmd.Offset}
+	}
+	if (name == "rename" || name == "renamenx") && matched[0] {
+		return &Command{T: cmd.T, D: []string{"DEL", cmd.D[1]}, Offset: cmd.Offset}
+	}
+	log.Printf("[CANAL] filter drops %s, only some of its keys match.\n", cmd.CommandName())
+	return nil
+}
+
+func matchKey(patterns []string, regexps []*regexp.Regexp, key string) bool {
+	for _, pattern := range patterns {
+		if globMatch(pattern, key) {
+			return true
+		}
+	}
+	for _, re := range regexps {
+		if re.MatchString(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// globMatch matches str against a glob-style pattern like redis does for KEYS:
+// `*`, `?`, `[...]` with ranges and `^` negation, and `\` escapes.
+func globMatch(pattern, str string) bool {
+	p, s := 0, 0
+	for p < len(pattern) && s < len(str) {
+		switch pattern[p] {
+		case '*':
+			for p+1 < len(pattern) && pattern[p+1] == '*' {
+				p++
+			}
+			if p+1 == len(pattern) {
+				return true
+			}
+			for ; s < len(str); s++ {
+				if globMatch(pattern[p+1:], str[s:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			s++
+		case '[':
+			p++
+			not := p < len(pattern) && pattern[p] == '^'
+			if not {
+				p++
+			}
+			match := false
+			for {
+				if p >= len(pattern) {
+					p--
+					break
+				}
+				if pattern[p] == '\\' && len(pattern)-p >= 2 {
+					p++
+					if pattern[p] == str[s] {
+						match = true
+					}
+				} else if pattern[p] == ']' {
+					break
+				} else if len(pattern)-p >= 3 && pattern[p+1] == '-' {
+					start, end := pattern[p], pattern[p+2]
+					if start > end {
+						start, end = end, start
+					}
+					p += 2
+					if str[s] >= start && str[s] <= end {
+						match = true
+					}
+				} else if pattern[p] == str[s] {
+					match = true
+				}
+				p++
+			}
+			if not {
+				match = !match
+			}
+			if !match {
+				return false
+			}
+			s++
+		case '\\':
+			if len(pattern)-p >= 2 {
+				p++
+			}
+			fallthrough
+		default:
+			if pattern[p] != str[s] {
+				return false
+			}
+			s++
+		}
+		p++
+		if s == len(str) {
+			for p < len(pattern) && pattern[p] == '*' {
+				p++
+			}
+			break
+		}
+	}
+	return p == len(pattern) && s == len(str)
+}
+
+// Decoder returns a Decoder handing to d the RDB events of the databases and keys f delivers.
+func (f *Filter) Decoder(d Decoder) Decoder {
+	fd := &filterDecoder{Decoder: d, f: f}
+	if _, ok := d.(ValueInfoDecoder); ok {
+		return &filterInfoDecoder{fd}
+	}
+	return fd
+}
+
+type filterDecoder struct {
+	Decoder
+	f    *Filter
+	db   int
+	skip bool
+}
+
+func (d *filterDecoder) drop(key []byte) bool {
+	return !d.f.MatchDB(d.db) || !d.f.MatchKey(string(key))
+}
+
+func (d *filterDecoder) BeginDatabase(n int) {
+	d.db = n
+	if d.f.MatchDB(n) {
+		d.Decoder.BeginDatabase(n)
+	}
+}
+
+func (d *filterDecoder) EndDatabase(n int) {
+	if d.f.MatchDB(n) {
+		d.Decoder.EndDatabase(n)
+	}
+}
+
+func (d *filterDecoder) ResizeDatabase(dbSize, expiresSize uint32) {
+	if d.f.MatchDB(d.db) {
+		d.Decoder.ResizeDatabase(dbSize, expiresSize)
+	}
+}
+
+func (d *filterDecoder) Eviction(key []byte, lruIdle, lfuFreq int64) {
+	if eviction, ok := d.Decoder.(EvictionDecoder); ok && !d.drop(key) {
+		eviction.Eviction(key, lruIdle, lfuFreq)
+	}
+}
+
+func (d *filterDecoder) Encoding(key []byte, typ ValueType) {
+	if encoding, ok := d.Decoder.(EncodingDecoder); ok && !d.drop(key) {
+		encoding.Encoding(key, typ)
+	}
+}
+
+// filterInfoDecoder is a filterDecoder of a ValueInfoDecoder, the values are only
+// counted when the decoder wants their ValueInfo.
+type filterInfoDecoder struct {
+	*filterDecoder
+}
+
+func (d *filterInfoDecoder) ValueInfo(key []byte, info ValueInfo) {
+	if !d.drop(key) {
+		d.Decoder.(ValueInfoDecoder).ValueInfo(key, info)
+	}
+}
+
+func (d *filterDecoder) Set(key, value []byte, expiry int64) {
+	if !d.drop(key) {
+		d.Decoder.Set(key, value, expiry)
+	}
+}
+
+func (d *filterDecoder) BeginHash(key []byte, length, expiry int64) {
+	if d.skip = d.drop(key); !d.skip {
+		d.Decoder.BeginHash(key, length, expiry)
+	}
+}
+
+func (d *filterDecoder) Hset(key, field, value []byte) {
+	if !d.skip {
+		d.Decoder.Hset(key, field, value)
+	}
+}
+
+func (d *filterDecoder) EndHash(key []byte) {
+	if !d.skip {
+		d.Decoder.EndHash(key)
+	}
+}
+
+func (d *filterDecoder) BeginSet(key []byte, cardinality, expiry int64) {
+	if d.skip = d.drop(key); !d.skip {
+		d.Decoder.BeginSet(key, cardinality, expiry)
+	}
+}
+
+func (d *filterDecoder) Sadd(key, member []byte) {
+	if !d.skip {
+		d.Decoder.Sadd(key, member)
+	}
+}
+
+func (d *filterDecoder) EndSet(key []byte) {
+	if !d.skip {
+		d.Decoder.EndSet(key)
+	}
+}
+
+func (d *filterDecoder) BeginList(key []byte, length, expiry int64) {
+	if d.skip = d.drop(key); !d.skip {
+		d.Decoder.BeginList(key, length, expiry)
+	}
+}
+
+func (d *filterDecoder) Rpush(key, value []byte) {
+	if !d.skip {
+		d.Decoder.Rpush(key, value)
+	}
+}
+
+func (d *filterDecoder) EndList(key []byte) {
+	if !d.skip {
+		d.Decoder.EndList(key)
+	}
+}
+
+func (d *filterDecoder) BeginZSet(key []byte, cardinality, expiry int64) {
+	if d.skip = d.drop(key); !d.skip {
+		d.Decoder.BeginZSet(key, cardinality, expiry)
+	}
+}
+
+func (d *filterDecoder) Zadd(key []byte, score float64, member []byte) {
+	if !d.skip {
+		d.Decoder.Zadd(key, score, member)
+	}
+}
+
+func (d *filterDecoder) EndZSet(key []byte) {
+	if !d.skip {
+		d.Decoder.EndZSet(key)
+	}
+}
+
+func (d *filterDecoder) BeginStream(key []byte, cardinality, expiry int64) {
+	if d.skip = d.drop(key); !d.skip {
+		d.Decoder.BeginStream(key, cardinality, expiry)
+	}
+}
+
+func (d *filterDecoder) Xadd(key, id, listpack []byte) {
+	if !d.skip {
+		d.Decoder.Xadd(key, id, listpack)
+	}
+}
+
+func (d *filterDecoder) XaddEntry(key, id []byte, fields []FieldValue) {
+	if !d.skip {
+		xaddEntry(d.Decoder, key, id, fields)
+	}
+}
+
+func (d *filterDecoder) EndStream(key []byte) {
+	if !d.skip {
+		d.Decoder.EndStream(key)
+	}
+}
@@ -5,32 +5,93 @@ import (
 	"log"
 	"strconv"
 	"sync/atomic"
+
+	"github.com/pkg/errors"
 )
 
 func (c *Canal) Command(cmd *Command) error {
+	if !c.loading && !c.offline {
+		cmd.Offset = atomic.LoadInt64(&c.offset)
+	}
+	if !c.loading {
+		switch {
+		case cmd.Type() == Multi:
+			c.begin(cmd)
+			return nil
+		case c.multi == nil:
+		case cmd.Type() == Exec:
+			return c.commit(cmd)
+		case cmd.Type() == Discard:
+			c.abort("discarded")
+			return nil
+		default:
+			c.queued = append(c.queued, cmd)
+			return nil
+		}
+	}
+	if cmd = c.route(cmd); cmd == nil {
+		return nil
+	}
 	return c.cmder.Command(cmd)
 }
 
+// route tracks the database selected by cmd and the scripts it loads, then filters
+// and rewrites it, nil if it is filtered out or its keys cannot be rewritten.
+func (c *Canal) route(cmd *Command) *Command {
+	c.scripts.track(cmd)
+	if c.expandEvalSha {
+		cmd = c.scripts.expand(cmd)
+	}
+	if cmd.Type() == Select && len(cmd.D) > 1 {
+		if n, err := strconv.Atoi(cmd.D[1]); err == nil {
+			c.db = n
+		}
+	}
+	if c.filter != nil {
+		if cmd = c.filter.Command(c.db, cmd); cmd == nil {
+			return nil
+		}
+	}
+	if c.rewrite != nil {
+		cmd = c.rewrite.Command(c.db, cmd)
+	}
+	return cmd
+}
+
+// skip reports whether the filter drops the key of the database being parsed.
+func (c *Canal) skip(key []byte) bool {
+	return c.filter != nil && (!c.filter.MatchDB(c.db) || !c.filter.MatchKey(string(key)))
+}
+
 func (c *Canal) set(n int64) {
 	atomic.StoreInt64(&c.offset, n)
 }
 
 func (c *Canal) Increment(n int64) {
-	atomic.AddInt64(&c.offset, n)
+	c.prev = atomic.AddInt64(&c.offset, n) - n
 }
 
+// Offset returns the offset acked to the master, the one before the MULTI of a
+// transaction not delivered yet.
 func (c *Canal) Offset() string {
+	if atomic.LoadInt32(&c.pending) == 1 {
+		return fmt.Sprintf("%d", atomic.LoadInt64(&c.txStart))
+	}
 	return fmt.Sprintf("%d", atomic.LoadInt64(&c.offset))
 }
 
 func (c *Canal) BeginRDB() {
+	c.loading = true
 	log.Printf("[CANAL] rdb parse.\n")
 }
 
 func (c *Canal) BeginDatabase(n int) {
 	c.db = n
 	cmd, _ := NewCommand("SELECT", fmt.Sprintf("%d", n))
-	c.Command(cmd)
+	c.deliver(cmd)
+	if c.dumper != nil {
+		c.dumper.BeginDatabase(n)
+	}
 }
 
 func (c *Canal) Aux(key, value []byte) {
@@ -42,6 +103,8 @@ func (c *Canal) Aux(key, value []byte) {
 		c.set(i)
 	} else if string(key) == "repl-id" {
 		c.runID = string(value)
+	} else if string(key) == "lua" {
+		c.scripts.add(string(value))
 	} else {
 		log.Printf("[CANAL] %s %s.\n", key, value)
 	}
@@ -51,51 +114,268 @@ func (c *Canal) ResizeDatabase(dbSize, expiresSize uint32) {}
 
 func (c *Canal) EndDatabase(n int) {}
 
+func (c *Canal) Eviction(key []byte, lruIdle, lfuFreq int64) {
+	if c.dumper != nil && !c.skip(key) {
+		c.dumper.Eviction(key, lruIdle, lfuFreq)
+	}
+}
+
 func (c *Canal) Set(key, value []byte, expiry int64) {
+	if c.skip(key) {
+		return
+	}
+	if c.dumper != nil {
+		c.dumper.Set(key, value, expiry)
+		return
+	}
 	cmd, _ := NewCommand("SET", string(key), string(value))
-	c.Command(cmd)
+	c.deliver(cmd)
 }
 
-func (c *Canal) BeginHash(key []byte, length, expiry int64) {}
+func (c *Canal) BeginHash(key []byte, length, expiry int64) {
+	c.skipKey = c.skip(key)
+	if c.skipKey {
+		return
+	}
+	if c.dumper != nil {
+		c.dumper.BeginHash(key, length, expiry)
+	} else if c.batch != nil {
+		c.batch.begin("HSET", key)
+	}
+}
 
 func (c *Canal) Hset(key, field, value []byte) {
+	if c.skipKey {
+		return
+	}
+	if c.dumper != nil {
+		c.dumper.Hset(key, field, value)
+		return
+	}
+	if c.batch != nil {
+		c.batch.add(field, value)
+		return
+	}
 	cmd, _ := NewCommand("HSET", string(key), string(field), string(value))
-	c.Command(cmd)
+	c.deliver(cmd)
+}
+func (c *Canal) EndHash(key []byte) {
+	if c.skipKey {
+		c.skipKey = false
+		return
+	}
+	if c.dumper != nil {
+		c.dumper.EndHash(key)
+	} else if c.batch != nil {
+		c.batch.end()
+	}
 }
-func (c *Canal) EndHash(key []byte) {}
 
-func (c *Canal) BeginSet(key []byte, cardinality, expiry int64) {}
+func (c *Canal) BeginSet(key []byte, cardinality, expiry int64) {
+	c.skipKey = c.skip(key)
+	if c.skipKey {
+		return
+	}
+	if c.dumper != nil {
+		c.dumper.BeginSet(key, cardinality, expiry)
+	} else if c.batch != nil {
+		c.batch.begin("SADD", key)
+	}
+}
 
 func (c *Canal) Sadd(key, member []byte) {
+	if c.skipKey {
+		return
+	}
+	if c.dumper != nil {
+		c.dumper.Sadd(key, member)
+		return
+	}
+	if c.batch != nil {
+		c.batch.add(member)
+		return
+	}
 	cmd, _ := NewCommand("SADD", string(key), string(member))
-	c.Command(cmd)
+	c.deliver(cmd)
+}
+func (c *Canal) EndSet(key []byte) {
+	if c.skipKey {
+		c.skipKey = false
+		return
+	}
+	if c.dumper != nil {
+		c.dumper.EndSet(key)
+	} else if c.batch != nil {
+		c.batch.end()
+	}
 }
-func (c *Canal) EndSet(key []byte) {}
 
-func (c *Canal) BeginList(key []byte, length, expiry int64) {}
+func (c *Canal) BeginList(key []byte, length, expiry int64) {
+	c.skipKey = c.skip(key)
+	if c.skipKey {
+		return
+	}
+	if c.dumper != nil {
+		c.dumper.BeginList(key, length, expiry)
+	} else if c.batch != nil {
+		c.batch.begin("RPUSH", key)
+	}
+}
 
 func (c *Canal) Rpush(key, value []byte) {
+	if c.skipKey {
+		return
+	}
+	if c.dumper != nil {
+		c.dumper.Rpush(key, value)
+		return
+	}
+	if c.batch != nil {
+		c.batch.add(value)
+		return
+	}
 	cmd, _ := NewCommand("RPUSH", string(key), string(value))
-	c.Command(cmd)
+	c.deliver(cmd)
+}
+func (c *Canal) EndList(key []byte) {
+	if c.skipKey {
+		c.skipKey = false
+		return
+	}
+	if c.dumper != nil {
+		c.dumper.EndList(key)
+	} else if c.batch != nil {
+		c.batch.end()
+	}
 }
-func (c *Canal) EndList(key []byte) {}
 
-func (c *Canal) BeginZSet(key []byte, cardinality, expiry int64) {}
+func (c *Canal) BeginZSet(key []byte, cardinality, expiry int64) {
+	c.skipKey = c.skip(key)
+	if c.skipKey {
+		return
+	}
+	if c.dumper != nil {
+		c.dumper.BeginZSet(key, cardinality, expiry)
+	} else if c.batch != nil {
+		c.batch.begin("ZADD", key)
+	}
+}
 
 func (c *Canal) Zadd(key []byte, score float64, member []byte) {
-	cmd, _ := NewCommand("ZADD", string(key), fmt.Sprintf("%f", score), string(member))
-	c.Command(cmd)
+	if c.skipKey {
+		return
+	}
+	if c.dumper != nil {
+		c.dumper.Zadd(key, score, member)
+		return
+	}
+	if c.batch != nil {
+		c.batch.add([]byte(formatScore(score)), member)
+		return
+	}
+	cmd, _ := NewCommand("ZADD", string(key), formatScore(score), string(member))
+	c.deliver(cmd)
+}
+func (c *Canal) EndZSet(key []byte) {
+	if c.skipKey {
+		c.skipKey = false
+		return
+	}
+	if c.dumper != nil {
+		c.dumper.EndZSet(key)
+	} else if c.batch != nil {
+		c.batch.end()
+	}
 }
-func (c *Canal) EndZSet(key []byte) {}
 
-func (c *Canal) BeginStream(key []byte, cardinality, expiry int64) {}
+func (c *Canal) BeginStream(key []byte, cardinality, expiry int64) {
+	c.skipKey = c.skip(key)
+	if c.skipKey {
+		return
+	}
+	if c.dumper != nil {
+		c.dumper.BeginStream(key, cardinality, expiry)
+	}
+}
 
+// Xadd adds an entry of one field, the fields and values of larger entries cannot
+// be told apart once joined, they go through XaddEntry.
 func (c *Canal) Xadd(key, id, listpack []byte) {
-	cmd, _ := NewCommand("XADD", string(key), string(id), string(listpack))
-	c.Command(cmd)
+	if c.skipKey {
+		return
+	}
+	fields, err := splitStreamEntry(listpack)
+	if err != nil {
+		c.fail(errors.Wrapf(err, "stream %s entry %s", key, id))
+		return
+	}
+	c.XaddEntry(key, id, fields)
+}
+
+// XaddEntry implements StreamEntryDecoder, an entry is an XADD of its fields and values.
+func (c *Canal) XaddEntry(key, id []byte, fields []FieldValue) {
+	if c.skipKey {
+		return
+	}
+	if c.dumper != nil {
+		c.dumper.XaddEntry(key, id, fields)
+		return
+	}
+	args := []string{"XADD", string(key), string(id)}
+	for _, f := range fields {
+		args = append(args, f.Field, f.Value)
+	}
+	cmd, _ := NewCommand(args...)
+	c.deliver(cmd)
+}
+func (c *Canal) EndStream(key []byte) {
+	if c.skipKey {
+		c.skipKey = false
+		return
+	}
+	if c.dumper != nil {
+		c.dumper.EndStream(key)
+	}
 }
-func (c *Canal) EndStream(key []byte) {}
 
 func (c *Canal) EndRDB() {
+	c.loading = false
 	log.Printf("[CANAL] end rdb parse.\n")
 }
+
+// formatScore formats a sorted set score without losing precision.
+func formatScore(score float64) string {
+	return strconv.FormatFloat(score, 'f', -1, 64)
+}
+
+func (c *Canal) fail(err error) {
+	if c.err == nil && err != nil {
+		c.err = err
+	}
+}
+
+// rdbErr returns the error which stopped the delivery of the RDB, or its RESTORE commands.
+func (c *Canal) rdbErr() error {
+	if c.err == nil && c.dumper != nil {
+		return c.dumper.Err()
+	}
+	if c.err == nil && c.batch != nil {
+		return c.batch.Err()
+	}
+	return c.err
+}
+
+// deliver passes a command of the RDB to the handler, none once it failed.
+func (c *Canal) deliver(cmd *Command) {
+	if c.rdbErr() == nil {
+		c.fail(c.Command(cmd))
+	}
+}
+
+func (c *Canal) restore(d *Dump) error {
+	cmd := d.Restore(c.cfg.RestoreReplace, c.cfg.RestoreAbsTTL)
+	if cmd == nil {
+		return nil
+	}
+	return c.Command(cmd)
+}
@@ -0,0 +1,288 @@
+package canal
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// BinaryEncoding is how JSONWriter writes keys and values, which may not be valid UTF-8.
+type BinaryEncoding int
+
+const (
+	// EscapedEncoding keeps valid UTF-8 as is and writes other bytes as \xHH, a backslash as \\.
+	EscapedEncoding BinaryEncoding = iota
+	// Base64Encoding writes every key and value in standard base64.
+	Base64Encoding
+)
+
+// Event sources.
+const (
+	SourceRDB    = "rdb"
+	SourceStream = "stream"
+	SourceAOF    = "aof"
+)
+
+// Event is one change as written by JSONWriter.
+type Event struct {
+	// Op is the lower case command name, or the RDB callback like "hset" or "zadd".
+	Op   string   `json:"op"`
+	DB   int      `json:"db"`
+	Keys []string `json:"keys,omitempty"`
+	// Args are all of the arguments of a command, or the members of an RDB callback,
+	// a sorted set score is a number, or a string for the infinities.
+	Args []interface{} `json:"args,omitempty"`
+	// Opaque is set for the scripts and functions, whose changes are not known from Args.
+	Opaque bool `json:"opaque,omitempty"`
+	// Expiry is the unix time in milliseconds an RDB key expires at.
+	Expiry int64  `json:"expiry,omitempty"`
+	Offset int64  `json:"offset"`
+	RunID  string `json:"run_id,omitempty"`
+	Source string `json:"source"`
+	// Time is the unix time in milliseconds the event was written.
+	Time int64 `json:"ts"`
+}
+
+// JSONWriter writes the RDB events it decodes and the commands it receives as
+// newline delimited JSON Events. It is not safe for concurrent use.
+type JSONWriter struct {
+	// RunID is the replication ID written with the events, the repl-id of an RDB sets it.
+	RunID string
+	// Source, when set, is the source of the commands received instead of rdb or
+	// stream as their offset says, like SourceAOF for the commands of an AOF.
+	Source string
+
+	w   *bufio.Writer
+	enc BinaryEncoding
+	db  int
+	// collection being decoded.
+	key    string
+	expiry int64
+
+	err error
+}
+
+func NewJSONWriter(w io.Writer, enc BinaryEncoding) *JSONWriter {
+	return &JSONWriter{w: bufio.NewWriter(w), enc: enc}
+}
+
+// Err returns the first error met while writing the RDB events.
+func (j *JSONWriter) Err() error {
+	return j.err
+}
+
+func (j *JSONWriter) Flush() error {
+	if err := j.w.Flush(); err != nil {
+		return err
+	}
+	return j.err
+}
+
+// Binary encodes b with the encoding of the writer.
+func (j *JSONWriter) Binary(b []byte) string {
+	return EncodeBinary(b, j.enc)
+}
+
+func (j *JSONWriter) write(e *Event) error {
+	if j.err != nil {
+		return j.err
+	}
+	e.RunID = j.RunID
+	e.Time = time.Now().UnixNano() / int64(time.Millisecond)
+	line, err := json.Marshal(e)
+	if err != nil {
+		j.err = err
+		return err
+	}
+	line = append(line, '\n')
+	if _, err := j.w.Write(line); err != nil {
+		j.err = err
+		return err
+	}
+	return nil
+}
+
+// Command writes cmd, from the full sync when its offset is negative unless Source is set.
+func (j *JSONWriter) Command(cmd *Command) error {
+	if cmd.Type() == Select && len(cmd.D) > 1 {
+		if n, err := strconv.Atoi(cmd.D[1]); err == nil {
+			j.db = n
+		}
+	}
+	e := commandEvent(cmd, j.db, j.enc)
+	if j.Source != "" {
+		e.Source = j.Source
+	}
+	return j.write(e)
+}
+
+// commandEvent returns the Event of cmd run on the database db.
+func commandEvent(cmd *Command, db int, enc BinaryEncoding) *Event {
+	e := &Event{Op: strings.ToLower(cmd.CommandName()), DB: db, Opaque: cmd.Opaque(), Offset: cmd.Offset, Source: SourceStream}
+	if cmd.Offset < 0 {
+		e.Source = SourceRDB
+	}
+	for _, key := range cmd.Keys() {
+		e.Keys = append(e.Keys, EncodeBinary([]byte(key), enc))
+	}
+	for _, arg := range cmd.D[1:] {
+		e.Args = append(e.Args, EncodeBinary([]byte(arg), enc))
+	}
+	return e
+}
+
+func (j *JSONWriter) rdb(op string, key []byte, expiry int64, args ...interface{}) {
+	j.write(&Event{Op: op, DB: j.db, Keys: []string{j.Binary(key)}, Args: args, Expiry: expiry, Offset: -1, Source: SourceRDB})
+}
+
+func (j *JSONWriter) begin(key []byte, expiry int64) {
+	j.key, j.expiry = j.Binary(key), expiry
+}
+
+func (j *JSONWriter) member(op string, args ...interface{}) {
+	j.write(&Event{Op: op, DB: j.db, Keys: []string{j.key}, Args: args, Expiry: j.expiry, Offset: -1, Source: SourceRDB})
+}
+
+func (j *JSONWriter) BeginRDB()                                 {}
+func (j *JSONWriter) ResizeDatabase(dbSize, expiresSize uint32) {}
+func (j *JSONWriter) EndDatabase(n int)                         {}
+
+func (j *JSONWriter) Aux(key, value []byte) {
+	if string(key) == "repl-id" {
+		j.RunID = string(value)
+	}
+}
+
+func (j *JSONWriter) BeginDatabase(n int) {
+	j.db = n
+	j.write(&Event{Op: "select", DB: n, Args: []interface{}{strconv.Itoa(n)}, Offset: -1, Source: SourceRDB})
+}
+
+func (j *JSONWriter) Set(key, value []byte, expiry int64) {
+	j.rdb("set", key, expiry, j.Binary(value))
+}
+
+func (j *JSONWriter) BeginHash(key []byte, length, expiry int64) { j.begin(key, expiry) }
+func (j *JSONWriter) Hset(key, field, value []byte) {
+	j.member("hset", j.Binary(field), j.Binary(value))
+}
+func (j *JSONWriter) EndHash(key []byte) {}
+
+func (j *JSONWriter) BeginSet(key []byte, cardinality, expiry int64) { j.begin(key, expiry) }
+func (j *JSONWriter) Sadd(key, member []byte)                        { j.member("sadd", j.Binary(member)) }
+func (j *JSONWriter) EndSet(key []byte)                              {}
+
+func (j *JSONWriter) BeginList(key []byte, length, expiry int64) { j.begin(key, expiry) }
+func (j *JSONWriter) Rpush(key, value []byte)                    { j.member("rpush", j.Binary(value)) }
+func (j *JSONWriter) EndList(key []byte)                         {}
+
+func (j *JSONWriter) BeginZSet(key []byte, cardinality, expiry int64) { j.begin(key, expiry) }
+func (j *JSONWriter) Zadd(key []byte, score float64, member []byte) {
+	var s interface{} = score
+	if math.IsInf(score, 0) || math.IsNaN(score) {
+		s = formatScore(score)
+	}
+	j.member("zadd", s, j.Binary(member))
+}
+func (j *JSONWriter) EndZSet(key []byte) {}
+
+func (j *JSONWriter) BeginStream(key []byte, cardinality, expiry int64) { j.begin(key, expiry) }
+
+// Xadd writes an entry of one field, the fields and values of larger entries cannot
+// be told apart once joined: Err reports them, they go through XaddEntry.
+func (j *JSONWriter) Xadd(key, id, listpack []byte) {
+	fields, err := splitStreamEntry(listpack)
+	if err != nil {
+		if j.err == nil {
+			j.err = errors.Wrapf(err, "stream %s entry %s", key, id)
+		}
+		return
+	}
+	j.XaddEntry(key, id, fields)
+}
+
+// XaddEntry implements StreamEntryDecoder, the args are the id then the fields and values.
+func (j *JSONWriter) XaddEntry(key, id []byte, fields []FieldValue) {
+	args := []interface{}{string(id)}
+	for _, f := range fields {
+		args = append(args, j.Binary([]byte(f.Field)), j.Binary([]byte(f.Value)))
+	}
+	j.member("xadd", args...)
+}
+
+func (j *JSONWriter) EndStream(key []byte) {}
+
+func (j *JSONWriter) EndRDB() {
+	if err := j.w.Flush(); err != nil && j.err == nil {
+		j.err = err
+	}
+}
+
+// EncodeBinary returns a key or value written with the encoding enc.
+func EncodeBinary(b []byte, enc BinaryEncoding) string {
+	if enc == Base64Encoding {
+		return base64.StdEncoding.EncodeToString(b)
+	}
+	return escapeBinary(b)
+}
+
+// escapeBinary returns b with the bytes which are not valid UTF-8 written as \xHH
+// and backslashes doubled, DecodeBinary reverses it.
+func escapeBinary(b []byte) string {
+	if utf8.Valid(b) && !strings.ContainsRune(string(b), '\\') {
+		return string(b)
+	}
+	var sb strings.Builder
+	for len(b) > 0 {
+		r, size := utf8.DecodeRune(b)
+		switch {
+		case r == utf8.RuneError && size <= 1:
+			sb.WriteString(`\x`)
+			sb.WriteString(strconv.FormatUint(uint64(b[0])>>4, 16))
+			sb.WriteString(strconv.FormatUint(uint64(b[0])&0xf, 16))
+		case r == '\\':
+			sb.WriteString(`\\`)
+		default:
+			sb.Write(b[:size])
+		}
+		b = b[size:]
+	}
+	return sb.String()
+}
+
+// DecodeBinary returns the bytes of a key or value written with the encoding enc.
+func DecodeBinary(s string, enc BinaryEncoding) ([]byte, error) {
+	if enc == Base64Encoding {
+		return base64.StdEncoding.DecodeString(s)
+	}
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b = append(b, s[i])
+			continue
+		}
+		switch {
+		case i+1 < len(s) && s[i+1] == '\\':
+			b = append(b, '\\')
+			i++
+		case i+3 < len(s) && s[i+1] == 'x':
+			n, err := strconv.ParseUint(s[i+2:i+4], 16, 8)
+			if err != nil {
+				return nil, errors.Errorf("invalid escape %q", s[i:i+4])
+			}
+			b = append(b, byte(n))
+			i += 3
+		default:
+			return nil, errors.Errorf("invalid escape at %d", i)
+		}
+	}
+	return b, nil
+}
@@ -0,0 +1,330 @@
+package canal
+
+import (
+	"strconv"
+	"strings"
+)
+
+// keySpec locates the keys of a command like the first key, last key and step
+// of the redis command table, a negative last counts from the end of the arguments.
+type keySpec struct {
+	first, last, step int
+}
+
+var commandKeySpecs = map[string]keySpec{
+	// strings
+	"set":         {1, 1, 1},
+	"setnx":       {1, 1, 1},
+	"setex":       {1, 1, 1},
+	"psetex":      {1, 1, 1},
+	"getset":      {1, 1, 1},
+	"getdel":      {1, 1, 1},
+	"getex":       {1, 1, 1},
+	"append":      {1, 1, 1},
+	"setrange":    {1, 1, 1},
+	"setbit":      {1, 1, 1},
+	"bitfield":    {1, 1, 1},
+	"incr":        {1, 1, 1},
+	"incrby":      {1, 1, 1},
+	"incrbyfloat": {1, 1, 1},
+	"decr":        {1, 1, 1},
+	"decrby":      {1, 1, 1},
+	"mset":        {1, -1, 2},
+	"msetnx":      {1, -1, 2},
+	"bitop":       {2, -1, 1},
+	"get":         {1, 1, 1},
+	"mget":        {1, -1, 1},
+	"strlen":      {1, 1, 1},
+	"getrange":    {1, 1, 1},
+	"substr":      {1, 1, 1},
+	"bitcount":    {1, 1, 1},
+	"bitpos":      {1, 1, 1},
+	"bitfield_ro": {1, 1, 1},
+	"lcs":         {1, 2, 1},
+	// keyspace
+	"del":       {1, -1, 1},
+	"unlink":    {1, -1, 1},
+	"exists":    {1, -1, 1},
+	"touch":     {1, -1, 1},
+	"expire":    {1, 1, 1},
+	"expireat":  {1, 1, 1},
+	"pexpire":   {1, 1, 1},
+	"pexpireat": {1, 1, 1},
+	"persist":   {1, 1, 1},
+	"move":      {1, 1, 1},
+	"rename":    {1, 2, 1},
+	"renamenx":  {1, 2, 1},
+	"copy":      {1, 2, 1},
+	"restore":   {1, 1, 1},
+	"type":      {1, 1, 1},
+	"ttl":       {1, 1, 1},
+	"pttl":      {1, 1, 1},
+	"dump":      {1, 1, 1},
+	// keyspace introspection
+	"expiretime":  {1, 1, 1},
+	"pexpiretime": {1, 1, 1},
+	"object":      {2, 2, 1},
+	// lists
+	"lpush":      {1, 1, 1},
+	"lpushx":     {1, 1, 1},
+	"rpush":      {1, 1, 1},
+	"rpushx":     {1, 1, 1},
+	"lpop":       {1, 1, 1},
+	"rpop":       {1, 1, 1},
+	"linsert":    {1, 1, 1},
+	"lrem":       {1, 1, 1},
+	"lset":       {1, 1, 1},
+	"ltrim":      {1, 1, 1},
+	"rpoplpush":  {1, 2, 1},
+	"brpoplpush": {1, 2, 1},
+	"lmove":      {1, 2, 1},
+	"blmove":     {1, 2, 1},
+	"blpop":      {1, -2, 1},
+	"brpop":      {1, -2, 1},
+	"lrange":     {1, 1, 1},
+	"llen":       {1, 1, 1},
+	"lindex":     {1, 1, 1},
+	"lpos":       {1, 1, 1},
+	// sets
+	"sadd":        {1, 1, 1},
+	"srem":        {1, 1, 1},
+	"spop":        {1, 1, 1},
+	"smove":       {1, 2, 1},
+	"sdiffstore":  {1, -1, 1},
+	"sinterstore": {1, -1, 1},
+	"sunionstore": {1, -1, 1},
+	"smembers":    {1, 1, 1},
+	"scard":       {1, 1, 1},
+	"sismember":   {1, 1, 1},
+	"smismember":  {1, 1, 1},
+	"srandmember": {1, 1, 1},
+	"sscan":       {1, 1, 1},
+	"sdiff":       {1, -1, 1},
+	"sinter":      {1, -1, 1},
+	"sunion":      {1, -1, 1},
+	// sorted sets
+	"zadd":             {1, 1, 1},
+	"zincrby":          {1, 1, 1},
+	"zrem":             {1, 1, 1},
+	"zremrangebylex":   {1, 1, 1},
+	"zremrangebyrank":  {1, 1, 1},
+	"zremrangebyscore": {1, 1, 1},
+	"zpopmin":          {1, 1, 1},
+	"zpopmax":          {1, 1, 1},
+	"zrangestore":      {1, 2, 1},
+	"bzpopmin":         {1, -2, 1},
+	"bzpopmax":         {1, -2, 1},
+	"zrange":           {1, 1, 1},
+	"zcard":            {1, 1, 1},
+	"zscore":           {1, 1, 1},
+	"zmscore":          {1, 1, 1},
+	"zrangebyscore":    {1, 1, 1},
+	"zrangebylex":      {1, 1, 1},
+	"zrevrange":        {1, 1, 1},
+	"zrevrangebyscore": {1, 1, 1},
+	"zrevrangebylex":   {1, 1, 1},
+	"zrank":            {1, 1, 1},
+	"zrevrank":         {1, 1, 1},
+	"zcount":           {1, 1, 1},
+	"zlexcount":        {1, 1, 1},
+	"zrandmember":      {1, 1, 1},
+	"zscan":            {1, 1, 1},
+	// hashes
+	"hset":         {1, 1, 1},
+	"hsetnx":       {1, 1, 1},
+	"hmset":        {1, 1, 1},
+	"hdel":         {1, 1, 1},
+	"hincrby":      {1, 1, 1},
+	"hincrbyfloat": {1, 1, 1},
+	"hget":         {1, 1, 1},
+	"hgetall":      {1, 1, 1},
+	"hlen":         {1, 1, 1},
+	"hmget":        {1, 1, 1},
+	"hexists":      {1, 1, 1},
+	"hkeys":        {1, 1, 1},
+	"hvals":        {1, 1, 1},
+	"hstrlen":      {1, 1, 1},
+	"hrandfield":   {1, 1, 1},
+	"hscan":        {1, 1, 1},
+	// hyperloglog, geo and streams
+	"pfadd":      {1, 1, 1},
+	"pfmerge":    {1, -1, 1},
+	"pfcount":    {1, -1, 1},
+	"pfdebug":    {2, 2, 1},
+	"geoadd":     {1, 1, 1},
+	"geopos":     {1, 1, 1},
+	"geodist":    {1, 1, 1},
+	"geohash":    {1, 1, 1},
+	"geosearch":  {1, 1, 1},
+	"xadd":       {1, 1, 1},
+	"xdel":       {1, 1, 1},
+	"xtrim":      {1, 1, 1},
+	"xsetid":     {1, 1, 1},
+	"xgroup":     {2, 2, 1},
+	"xack":       {1, 1, 1},
+	"xclaim":     {1, 1, 1},
+	"xautoclaim": {1, 1, 1},
+	"xlen":       {1, 1, 1},
+	"xrange":     {1, 1, 1},
+	"xrevrange":  {1, 1, 1},
+	"xpending":   {1, 1, 1},
+	"xinfo":      {2, 2, 1},
+	// GEOSEARCHSTORE dest src, the read only variants of GEORADIUS store nothing
+	"geosearchstore":       {1, 2, 1},
+	"georadius_ro":         {1, 1, 1},
+	"georadiusbymember_ro": {1, 1, 1},
+}
+
+// keylessCommands are the commands known to have no key, the replication stream
+// carries the first ones.
+var keylessCommands = map[string]bool{
+	"ping":         true,
+	"select":       true,
+	"multi":        true,
+	"exec":         true,
+	"discard":      true,
+	"flushdb":      true,
+	"flushall":     true,
+	"swapdb":       true,
+	"publish":      true,
+	"spublish":     true,
+	"script":       true,
+	"function":     true,
+	"replconf":     true,
+	"randomkey":    true,
+	"dbsize":       true,
+	"keys":         true,
+	"scan":         true,
+	"info":         true,
+	"config":       true,
+	"client":       true,
+	"echo":         true,
+	"time":         true,
+	"wait":         true,
+	"waitaof":      true,
+	"save":         true,
+	"bgsave":       true,
+	"bgrewriteaof": true,
+	"lastsave":     true,
+}
+
+// splitKeyCommands are the commands whose keys are independent of each other,
+// each key followed by step-1 arguments of its own, so a subset of them is a valid command.
+var splitKeyCommands = map[string]bool{
+	"mset":   true,
+	"msetnx": true,
+	"del":    true,
+	"unlink": true,
+	"exists": true,
+	"touch":  true,
+	"mget":   true,
+}
+
+// Keys returns the key arguments of the command, nil if it has none or is unknown.
+func (c *Command) Keys() []string {
+	idx, _ := c.keyIndexes()
+	if len(idx) == 0 {
+		return nil
+	}
+	keys := make([]string, len(idx))
+	for i, j := range idx {
+		keys[i] = c.D[j]
+	}
+	return keys
+}
+
+// keyIndexes returns the positions of the keys in c.D, and false when the command
+// is missing from the tables so its keys cannot be told.
+func (c *Command) keyIndexes() ([]int, bool) {
+	args := c.D
+	name := strings.ToLower(args[0])
+	switch name {
+	case "zunionstore", "zinterstore", "zdiffstore":
+		// ZUNIONSTORE dest numkeys key [key ...]
+		return append([]int{1}, numKeys(args, 2)...), true
+	case "zunion", "zinter", "zdiff", "sintercard", "zintercard", "lmpop", "zmpop":
+		// LMPOP numkeys key [key ...]
+		return numKeys(args, 1), true
+	case "eval", "evalsha", "eval_ro", "evalsha_ro", "fcall", "fcall_ro":
+		// EVAL script numkeys key [key ...]
+		return numKeys(args, 2), true
+	case "blmpop", "bzmpop":
+		// BLMPOP timeout numkeys key [key ...]
+		return numKeys(args, 2), true
+	case "sort", "sort_ro":
+		idx := []int{1}
+		for i := 2; i < len(args)-1; i++ {
+			if strings.EqualFold(args[i], "STORE") {
+				idx = append(idx, i+1)
+			}
+		}
+		return idx, true
+	case "georadius", "georadiusbymember":
+		idx := []int{1}
+		for i := 2; i < len(args)-1; i++ {
+			if strings.EqualFold(args[i], "STORE") || strings.EqualFold(args[i], "STOREDIST") {
+				idx = append(idx, i+1)
+			}
+		}
+		return idx, true
+	case "xread", "xreadgroup":
+		// XREAD ... STREAMS key [key ...] id [id ...]
+		for i := 1; i < len(args); i++ {
+			if strings.EqualFold(args[i], "STREAMS") {
+				n := (len(args) - i - 1) / 2
+				return keyRange(i+1, i+n, 1), true
+			}
+		}
+		return nil, true
+	case "migrate":
+		// MIGRATE host port key|"" db timeout [... KEYS key [key ...]]
+		if len(args) > 3 && args[3] != "" {
+			return []int{3}, true
+		}
+		for i := 6; i < len(args); i++ {
+			if strings.EqualFold(args[i], "KEYS") {
+				return keyRange(i+1, len(args)-1, 1), true
+			}
+		}
+		return nil, true
+	}
+	spec, ok := commandKeySpecs[name]
+	if !ok {
+		return nil, keylessCommands[name]
+	}
+	last := spec.last
+	if last < 0 {
+		last += len(args)
+	}
+	if last >= len(args) {
+		last = len(args) - 1
+	}
+	return keyRange(spec.first, last, spec.step), true
+}
+
+// numKeys returns the positions of the keys following a numkeys argument at pos.
+func numKeys(args []string, pos int) []int {
+	if pos >= len(args) {
+		return nil
+	}
+	n, err := strconv.Atoi(args[pos])
+	if err != nil || n <= 0 {
+		return nil
+	}
+	last := pos + n
+	if last >= len(args) {
+		last = len(args) - 1
+	}
+	return keyRange(pos+1, last, 1)
+}
+
+func keyRange(first, last, step int) []int {
+	if first > last {
+		return nil
+	}
+	idx := make([]int, 0, (last-first)/step+1)
+	for i := first; i <= last; i += step {
+		idx = append(idx, i)
+	}
+	return idx
+}
@@ -0,0 +1,440 @@
+package canal
+
+import (
+	"container/heap"
+	"math/bits"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// KeyMemory is the estimated memory redis uses for one key.
+type KeyMemory struct {
+	DB   int    `json:"db"`
+	Key  string `json:"key"`
+	Type string `json:"type"`
+	// Encoding is the OBJECT ENCODING of the value, like "ziplist" or "intset".
+	Encoding string `json:"encoding"`
+	// Bytes is the estimated memory of the key, its value and expiry.
+	Bytes    int64 `json:"bytes"`
+	Elements int64 `json:"elements"`
+	// LargestElement is the length of the biggest member, field or value.
+	LargestElement int64 `json:"largest_element"`
+	// Expiry is the unix time in milliseconds the key expires at, 0 if it does not.
+	Expiry int64 `json:"expiry,omitempty"`
+	// Serialized is the length of the value in the RDB.
+	Serialized int64 `json:"serialized,omitempty"`
+}
+
+// MemoryStats aggregates the keys of a database, type, encoding or prefix.
+type MemoryStats struct {
+	Keys     int64 `json:"keys"`
+	Expires  int64 `json:"expires"`
+	Elements int64 `json:"elements"`
+	Bytes    int64 `json:"bytes"`
+}
+
+func (s *MemoryStats) add(k *KeyMemory) {
+	s.Keys++
+	if k.Expiry > 0 {
+		s.Expires++
+	}
+	s.Elements += k.Elements
+	s.Bytes += k.Bytes
+}
+
+// MemoryReport is the memory analysis of an RDB.
+type MemoryReport struct {
+	Aux       map[string]string       `json:"aux"`
+	DBs       map[int]*MemoryStats    `json:"dbs"`
+	Types     map[string]*MemoryStats `json:"types"`
+	Encodings map[string]*MemoryStats `json:"encodings"`
+	Prefixes  map[string]*MemoryStats `json:"prefixes"`
+	// Largest are the biggest keys, the biggest first.
+	Largest []*KeyMemory `json:"largest"`
+	Total   MemoryStats  `json:"total"`
+}
+
+// Analyzer is a Decoder estimating the memory each key of an RDB uses once loaded
+// by redis, from the size classes of jemalloc and the layout of each encoding.
+// The estimates are close to MEMORY USAGE for the encodings of the RDB, which
+// redis may convert while loading if its configuration differs.
+type Analyzer struct {
+	// Top is the number of biggest keys kept in the report.
+	Top int
+	// Separator ends the prefix keys are aggregated by, a key without it has the prefix "".
+	Separator string
+	// OnKey, if set, is called with each key once decoded.
+	OnKey func(*KeyMemory)
+
+	report MemoryReport
+	db     int
+	big    keyHeap
+
+	// value being decoded.
+	typ     ValueType
+	encoded bool
+	key     *KeyMemory
+	// ziplist, quicklist or intset bytes and the size of the last ziplist entry.
+	packed   int64
+	prevSize int64
+	// intset entry width.
+	width int64
+}
+
+// NewAnalyzer returns an Analyzer keeping the top biggest keys and aggregating
+// keys by the prefix before their first colon.
+func NewAnalyzer(top int) *Analyzer {
+	return &Analyzer{Top: top, Separator: ":"}
+}
+
+// Report returns the analysis of the keys decoded so far.
+func (a *Analyzer) Report() *MemoryReport {
+	a.init()
+	largest := make([]*KeyMemory, len(a.big))
+	copy(largest, a.big)
+	sort.Slice(largest, func(i, j int) bool { return largest[i].Bytes > largest[j].Bytes })
+	a.report.Largest = largest
+	return &a.report
+}
+
+func (a *Analyzer) init() {
+	if a.report.Aux == nil {
+		a.report.Aux = make(map[string]string)
+		a.report.DBs = make(map[int]*MemoryStats)
+		a.report.Types = make(map[string]*MemoryStats)
+		a.report.Encodings = make(map[string]*MemoryStats)
+		a.report.Prefixes = make(map[string]*MemoryStats)
+	}
+}
+
+func (a *Analyzer) BeginRDB()                                 { a.init() }
+func (a *Analyzer) EndRDB()                                   {}
+func (a *Analyzer) ResizeDatabase(dbSize, expiresSize uint32) {}
+func (a *Analyzer) EndDatabase(n int)                         {}
+
+func (a *Analyzer) Aux(key, value []byte) {
+	a.init()
+	a.report.Aux[string(key)] = string(value)
+}
+
+func (a *Analyzer) BeginDatabase(n int) {
+	a.db = n
+}
+
+// Encoding implements EncodingDecoder.
+func (a *Analyzer) Encoding(key []byte, typ ValueType) {
+	a.typ, a.encoded = typ, true
+}
+
+// begin starts a key, typ is the encoding assumed if Encoding was not called.
+func (a *Analyzer) begin(typ ValueType, key []byte, expiry int64) {
+	a.init()
+	if !a.encoded {
+		a.typ = typ
+	}
+	a.key = &KeyMemory{
+		DB:       a.db,
+		Key:      string(key),
+		Type:     a.typ.Name(),
+		Encoding: a.typ.Encoding(),
+		Expiry:   expiry,
+	}
+	// the entry of the key space, the key and the value object.
+	a.key.Bytes = dictEntrySize + sdsSize(len(key)) + robjSize
+	if expiry > 0 {
+		a.key.Bytes += dictEntrySize
+	}
+	a.packed, a.prevSize, a.width = 0, 0, 2
+	switch a.typ {
+	case TypeListZiplist, TypeZSetZiplist, TypeHashZiplist, TypeHashZipmap, TypeListQuicklist,
+		TypeHashListpack, TypeZSetListpack, TypeSetListpack, TypeListQuicklist2:
+		a.packed = ziplistHeaderSize
+	case TypeSetIntset:
+		a.packed = intsetHeaderSize
+	case TypeZSet, TypeZSet2:
+		a.key.Bytes += zsetSize
+	case TypeList:
+		a.key.Bytes += listSize
+	case TypeStreamListPacks, TypeStreamListPacks2, TypeStreamListPacks3:
+		a.key.Bytes += streamSize
+	}
+}
+
+// element adds the members of one element of the value.
+func (a *Analyzer) element(members ...[]byte) {
+	a.key.Elements++
+	for _, m := range members {
+		if n := int64(len(m)); n > a.key.LargestElement {
+			a.key.LargestElement = n
+		}
+	}
+	switch a.typ {
+	case TypeListZiplist, TypeZSetZiplist, TypeHashZiplist, TypeHashZipmap, TypeListQuicklist,
+		TypeHashListpack, TypeZSetListpack, TypeSetListpack, TypeListQuicklist2:
+		for _, m := range members {
+			a.ziplistEntry(m)
+		}
+	case TypeSetIntset:
+		if n, err := strconv.ParseInt(string(members[0]), 10, 64); err == nil {
+			if n < -1<<31 || n >= 1<<31 {
+				a.width = 8
+			} else if (n < -1<<15 || n >= 1<<15) && a.width < 4 {
+				a.width = 4
+			}
+		}
+	case TypeSet:
+		a.key.Bytes += dictEntrySize + sdsSize(len(members[0]))
+	case TypeHash:
+		a.key.Bytes += dictEntrySize + sdsSize(len(members[0])) + sdsSize(len(members[1]))
+	case TypeZSet, TypeZSet2:
+		// the skiplist node, with 1.33 levels on average, holds the member the dict points to.
+		a.key.Bytes += dictEntrySize + mallocSize(skiplistNodeSize) + sdsSize(len(members[1]))
+	case TypeList:
+		a.key.Bytes += listNodeSize + robjSize + sdsSize(len(members[0]))
+	case TypeStreamListPacks, TypeStreamListPacks2, TypeStreamListPacks3:
+		// the listpack entries of the fields and values, with their ID.
+		for _, m := range members {
+			a.key.Bytes += int64(len(m)) + 2
+		}
+	}
+}
+
+// ziplistEntry adds a ziplist entry of value, whose header depends on the previous entry.
+func (a *Analyzer) ziplistEntry(value []byte) {
+	size := int64(1)
+	if a.prevSize >= 254 {
+		size = 5
+	}
+	if n, err := strconv.ParseInt(string(value), 10, 64); err == nil && strconv.FormatInt(n, 10) == string(value) {
+		switch {
+		case n >= 0 && n <= 12:
+			size++
+		case n >= -1<<7 && n < 1<<7:
+			size += 2
+		case n >= -1<<15 && n < 1<<15:
+			size += 3
+		case n >= -1<<23 && n < 1<<23:
+			size += 4
+		case n >= -1<<31 && n < 1<<31:
+			size += 5
+		default:
+			size += 9
+		}
+	} else {
+		switch l := int64(len(value)); {
+		case l <= 63:
+			size += 1 + l
+		case l <= 16383:
+			size += 2 + l
+		default:
+			size += 5 + l
+		}
+	}
+	a.prevSize = size
+	a.packed += size
+}
+
+// end ends the callbacks of a key, which is added once its ValueInfo is known
+// if it is read from an RDB.
+func (a *Analyzer) end() {
+	if !a.encoded {
+		a.finish(0)
+	}
+}
+
+// ValueInfo implements ValueInfoDecoder.
+func (a *Analyzer) ValueInfo(key []byte, info ValueInfo) {
+	if a.key == nil {
+		return
+	}
+	a.key.Serialized = info.Length
+	a.finish(info.Elements)
+}
+
+// finish adds the key, elements is the count its value is serialized with, or 0 if unknown.
+func (a *Analyzer) finish(elements int64) {
+	k := a.key
+	switch a.typ {
+	case TypeListZiplist, TypeZSetZiplist, TypeHashZiplist, TypeHashZipmap, TypeHashListpack, TypeZSetListpack, TypeSetListpack:
+		k.Bytes += mallocSize(a.packed + 1)
+	case TypeListQuicklist, TypeListQuicklist2:
+		// the ziplists of the RDB are the nodes, else they are at most 8kb,
+		// the default list-max-ziplist-size.
+		nodes := elements
+		if nodes <= 0 {
+			nodes = (a.packed + quicklistNodeBytes - 1) / quicklistNodeBytes
+		}
+		if nodes == 0 {
+			nodes = 1
+		}
+		k.Bytes += quicklistSize + nodes*(quicklistNodeSize+mallocSize(a.packed/nodes+1))
+	case TypeSetIntset:
+		k.Bytes += mallocSize(a.packed + a.width*k.Elements)
+	case TypeSet, TypeHash, TypeZSet, TypeZSet2:
+		k.Bytes += dictSize(k.Elements)
+	}
+	a.add(k)
+}
+
+// add aggregates the decoded key k.
+func (a *Analyzer) add(k *KeyMemory) {
+	a.key, a.encoded = nil, false
+	db, ok := a.report.DBs[k.DB]
+	if !ok {
+		db = &MemoryStats{}
+		a.report.DBs[k.DB] = db
+	}
+	db.add(k)
+	a.stats(a.report.Types, k.Type).add(k)
+	a.stats(a.report.Encodings, k.Encoding).add(k)
+	a.stats(a.report.Prefixes, a.prefix(k.Key)).add(k)
+	a.report.Total.add(k)
+	if a.Top > 0 {
+		if len(a.big) < a.Top {
+			heap.Push(&a.big, k)
+		} else if a.big[0].Bytes < k.Bytes {
+			a.big[0] = k
+			heap.Fix(&a.big, 0)
+		}
+	}
+	if a.OnKey != nil {
+		a.OnKey(k)
+	}
+}
+
+func (a *Analyzer) stats(m map[string]*MemoryStats, name string) *MemoryStats {
+	s, ok := m[name]
+	if !ok {
+		s = &MemoryStats{}
+		m[name] = s
+	}
+	return s
+}
+
+func (a *Analyzer) prefix(key string) string {
+	if a.Separator == "" {
+		return ""
+	}
+	if n := strings.Index(key, a.Separator); n >= 0 {
+		return key[:n]
+	}
+	return ""
+}
+
+func (a *Analyzer) Set(key, value []byte, expiry int64) {
+	a.begin(TypeString, key, expiry)
+	k := a.key
+	k.Elements, k.LargestElement = 1, int64(len(value))
+	if n, err := strconv.ParseInt(string(value), 10, 64); err == nil && strconv.FormatInt(n, 10) == string(value) {
+		// integers are kept in the value object, below 10000 they are shared.
+		k.Encoding = "int"
+	} else if len(value) <= embstrMaxSize {
+		// the string is allocated with its value object.
+		k.Encoding = "embstr"
+		k.Bytes += mallocSize(robjSize+sdsHeaderSize(len(value))+int64(len(value))+1) - robjSize
+	} else {
+		k.Encoding = "raw"
+		k.Bytes += sdsSize(len(value))
+	}
+	a.end()
+}
+
+func (a *Analyzer) BeginHash(key []byte, length, expiry int64) { a.begin(TypeHash, key, expiry) }
+func (a *Analyzer) Hset(key, field, value []byte)              { a.element(field, value) }
+func (a *Analyzer) EndHash(key []byte)                         { a.end() }
+
+func (a *Analyzer) BeginSet(key []byte, cardinality, expiry int64) { a.begin(TypeSet, key, expiry) }
+func (a *Analyzer) Sadd(key, member []byte)                        { a.element(member) }
+func (a *Analyzer) EndSet(key []byte)                              { a.end() }
+
+func (a *Analyzer) BeginList(key []byte, length, expiry int64) {
+	a.begin(TypeListQuicklist, key, expiry)
+}
+func (a *Analyzer) Rpush(key, value []byte) { a.element(value) }
+func (a *Analyzer) EndList(key []byte)      { a.end() }
+
+func (a *Analyzer) BeginZSet(key []byte, cardinality, expiry int64) { a.begin(TypeZSet2, key, expiry) }
+func (a *Analyzer) Zadd(key []byte, score float64, member []byte) {
+	a.element([]byte(formatScore(score)), member)
+}
+func (a *Analyzer) EndZSet(key []byte) { a.end() }
+
+func (a *Analyzer) BeginStream(key []byte, cardinality, expiry int64) {
+	a.begin(TypeStreamListPacks, key, expiry)
+}
+func (a *Analyzer) Xadd(key, id, listpack []byte) { a.element(id, listpack) }
+func (a *Analyzer) EndStream(key []byte)          { a.end() }
+
+// Sizes of the redis structures on 64 bits.
+const (
+	robjSize           = 16
+	dictEntrySize      = 24
+	dictStructSize     = 96
+	listSize           = 48
+	listNodeSize       = 24
+	zsetSize           = 16 + 32
+	skiplistNodeSize   = 45
+	quicklistSize      = 40
+	quicklistNodeSize  = 32
+	quicklistNodeBytes = 8192
+	streamSize         = 48 + 64
+	ziplistHeaderSize  = 10
+	intsetHeaderSize   = 8
+	embstrMaxSize      = 44
+)
+
+// mallocSize returns the size of the jemalloc size class n bytes are allocated from.
+func mallocSize(n int64) int64 {
+	switch {
+	case n <= 8:
+		return 8
+	case n <= 128:
+		return (n + 15) &^ 15
+	}
+	// four classes between powers of two.
+	spacing := int64(1) << uint(bits.Len64(uint64(n-1))-3)
+	return (n + spacing - 1) &^ (spacing - 1)
+}
+
+func sdsHeaderSize(n int) int64 {
+	switch {
+	case n < 1<<5:
+		return 1
+	case n < 1<<8:
+		return 3
+	case n < 1<<16:
+		return 5
+	case n < 1<<32:
+		return 9
+	}
+	return 17
+}
+
+// sdsSize returns the memory of a string of n bytes.
+func sdsSize(n int) int64 {
+	return mallocSize(sdsHeaderSize(n) + int64(n) + 1)
+}
+
+// dictSize returns the memory of a dict and its table of n entries, excluding the entries.
+func dictSize(n int64) int64 {
+	buckets := int64(4)
+	for buckets < n {
+		buckets <<= 1
+	}
+	return dictStructSize + mallocSize(buckets*8)
+}
+
+// keyHeap is a min heap of the biggest keys seen.
+type keyHeap []*KeyMemory
+
+func (h keyHeap) Len() int            { return len(h) }
+func (h keyHeap) Less(i, j int) bool  { return h[i].Bytes < h[j].Bytes }
+func (h keyHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *keyHeap) Push(x interface{}) { *h = append(*h, x.(*KeyMemory)) }
+func (h *keyHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
@@ -0,0 +1,248 @@
+package canal
+
+import (
+	"bufio"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// PointInTime is where RestoreCapture stops applying the commands of a capture.
+type PointInTime struct {
+	// Offset is the replication offset of the last command applied, negative for no limit.
+	Offset int64
+	// Time is the latest time a command applied was read from the master at, zero for no limit.
+	Time time.Time
+	// AllowSkipped restores the dataset even though some commands cannot be applied,
+	// like the scripts whose changes are not known: the keys they write are dropped
+	// and they are counted in Skipped. RestoreCapture fails on them otherwise.
+	AllowSkipped bool
+}
+
+// Restored describes the dataset RestoreCapture restored.
+type Restored struct {
+	// Offset is the replication offset of the dataset, Time the time the last
+	// command applied, or the end of the RDB, was read from the master at.
+	Offset int64
+	Time   time.Time
+	// Commands is the number of commands applied. Skipped counts, by name, the
+	// commands which could not be, as the scripts whose changes are not known,
+	// when the PointInTime allows them.
+	Commands int
+	Skipped  map[string]int
+}
+
+// errRestored stops the replay of a capture once the point in time is passed.
+var errRestored = errors.New("point in time reached")
+
+// RestoreCapture materializes the dataset of the master a capture was recorded
+// from as it was at a point in time: the RDB of the capture is loaded in memory,
+// the commands which follow are applied up to the point, then the dataset is
+// handed to d as an RDB, like to an Encoder to write a new RDB. A transaction is
+// applied whole or not at all. The keys expired at the time of the dataset are
+// left out.
+//
+// The capture must begin with a full sync. The Filter of cfg applies, the Rewrite
+// and the options of the delivery of commands do not.
+func RestoreCapture(cfg *Config, dir string, at PointInTime, d Decoder) (*Restored, error) {
+	ds, res, err := restoreCapture(cfg, dir, at)
+	if err != nil {
+		return nil, err
+	}
+	ds.decode(d, res.Time.UnixNano()/int64(time.Millisecond))
+	return res, nil
+}
+
+// RestoreCaptureCommands is RestoreCapture delivering the dataset to commandDecode
+// as the commands of a full sync, like to a Target, rewritten, batched or as RESTORE
+// commands as cfg says. The commands have no replication offset.
+func RestoreCaptureCommands(cfg *Config, dir string, at PointInTime, commandDecode CommandDecoder) (*Restored, error) {
+	if commandDecode == nil {
+		return nil, errors.Errorf("command decode is nil.")
+	}
+	ds, res, err := restoreCapture(cfg, dir, at)
+	if err != nil {
+		return nil, err
+	}
+	c, err := newCanal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	c.cmder = commandDecode
+	c.offline = true
+	ds.decode(c, res.Time.UnixNano()/int64(time.Millisecond))
+	if err := c.rdbErr(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func restoreCapture(cfg *Config, dir string, at PointInTime) (*dataset, *Restored, error) {
+	r, err := OpenCapture(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer r.Close()
+	// the commands are applied as the master sent them.
+	rc := *cfg
+	rc.Rewrite, rc.Buffer, rc.ExpandEvalSha, rc.Restore, rc.BatchCount = nil, nil, false, false, 0
+
+	rs := &restorer{at: at, r: &timedReader{c: r}, res: &Restored{Offset: -1, Skipped: make(map[string]int)}}
+	rs.ds = newDataset(func() int64 { return rs.now })
+	if rs.c, err = captureCanal(&rc, rs.r, &restoreRDB{dataset: rs.ds, rs: rs}); err != nil {
+		return nil, nil, err
+	}
+	err = rs.c.replay(rs)
+	if errors.Cause(err) == errRestored {
+		err = nil
+	}
+	if err == nil {
+		err = rs.err
+	}
+	if err == nil && !rs.loaded {
+		err = errors.Errorf("the capture in %s has no RDB, it does not begin with a full sync.", dir)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return rs.ds, rs.res, nil
+}
+
+// restorer applies the commands of a capture to the dataset until the point in time.
+type restorer struct {
+	at  PointInTime
+	c   *Canal
+	r   *timedReader
+	ds  *dataset
+	res *Restored
+	// now is the time the command applied was read at, in milliseconds.
+	now    int64
+	loaded bool
+	err    error
+}
+
+// restoreRDB loads the RDB of the capture into the dataset.
+type restoreRDB struct {
+	*dataset
+	rs *restorer
+}
+
+func (d *restoreRDB) EndRDB() {
+	rs := d.rs
+	rs.loaded = true
+	rs.res.Offset, rs.res.Time = atomic.LoadInt64(&rs.c.offset), rs.time()
+	if rs.at.Offset >= 0 && rs.at.Offset < rs.res.Offset {
+		rs.err = errors.Errorf("the capture starts at offset %d, after %d.", rs.res.Offset, rs.at.Offset)
+	} else if !rs.at.Time.IsZero() && rs.at.Time.Before(rs.res.Time) {
+		rs.err = errors.Errorf("the capture starts at %s, after %s.", rs.res.Time.Format(time.RFC3339), rs.at.Time.Format(time.RFC3339))
+	}
+}
+
+// time returns the time the bytes the canal parsed last were read at.
+func (rs *restorer) time() time.Time {
+	pos := rs.r.read - int64(len(rs.r.data))
+	if b, ok := rs.c.replica.r.(*bufio.Reader); ok {
+		pos -= int64(b.Buffered())
+	}
+	return rs.r.time(pos)
+}
+
+// past reports whether a command at offset, read at t, is past the point in time.
+func (rs *restorer) past(offset int64, t time.Time) bool {
+	return (rs.at.Offset >= 0 && offset > rs.at.Offset) || (!rs.at.Time.IsZero() && t.After(rs.at.Time))
+}
+
+func (rs *restorer) Command(cmd *Command) error {
+	if rs.err != nil {
+		return rs.err
+	}
+	t := rs.time()
+	if rs.past(cmd.Offset, t) {
+		return errRestored
+	}
+	rs.apply(cmd, t)
+	rs.res.Offset, rs.res.Time = cmd.Offset, t
+	return rs.err
+}
+
+func (rs *restorer) Transaction(tx *Transaction) error {
+	if rs.err != nil {
+		return rs.err
+	}
+	t := rs.time()
+	if rs.past(tx.Offset, t) {
+		return errRestored
+	}
+	rs.ds.db = tx.DB
+	for _, cmd := range tx.Commands {
+		rs.apply(cmd, t)
+	}
+	rs.res.Offset, rs.res.Time = tx.Offset, t
+	return rs.err
+}
+
+func (rs *restorer) apply(cmd *Command, t time.Time) {
+	rs.now = t.UnixNano() / int64(time.Millisecond)
+	if _, err := rs.ds.apply(cmd); err != nil {
+		name := strings.ToLower(cmd.CommandName())
+		if !rs.at.AllowSkipped {
+			if rs.err == nil {
+				rs.err = errors.Wrapf(err, "%s at offset %d cannot be applied", name, cmd.Offset)
+			}
+			return
+		}
+		if rs.res.Skipped[name] == 0 {
+			log.Printf("[CANAL] %s not applied: %v\n", name, err)
+		}
+		rs.res.Skipped[name]++
+		rs.ds.drop(cmd)
+		return
+	}
+	rs.res.Commands++
+}
+
+// timedReader reads the stream of a capture, keeping the time of the records
+// whose bytes may not be parsed yet.
+type timedReader struct {
+	c *CaptureReader
+	// read is the bytes of the records read, data the rest of the last one.
+	read  int64
+	data  []byte
+	spans []captureSpan
+}
+
+// captureSpan is the end of a record in the stream and the time it was read at.
+type captureSpan struct {
+	end  int64
+	time time.Time
+}
+
+func (t *timedReader) Read(p []byte) (int, error) {
+	for len(t.data) == 0 {
+		rec, err := t.c.Next()
+		if err != nil {
+			return 0, err
+		}
+		t.data = rec.Data
+		t.read += int64(len(rec.Data))
+		t.spans = append(t.spans, captureSpan{end: t.read, time: rec.Time})
+	}
+	n := copy(p, t.data)
+	t.data = t.data[n:]
+	return n, nil
+}
+
+// time returns the time the record of the byte before pos was read at, the
+// records before are forgotten.
+func (t *timedReader) time(pos int64) time.Time {
+	for len(t.spans) > 1 && t.spans[0].end < pos {
+		t.spans = t.spans[1:]
+	}
+	if len(t.spans) == 0 {
+		return time.Time{}
+	}
+	return t.spans[0].time
+}
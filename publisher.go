@@ -0,0 +1,464 @@
+package canal
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type PublisherConfig struct {
+	// Backlog is the number of changes kept for the subscribers resuming from an
+	// offset, 10000 by default. A transaction counts as one.
+	Backlog int
+}
+
+func NewPublisherConfig() *PublisherConfig {
+	return &PublisherConfig{Backlog: 10000}
+}
+
+// Publisher is a CommandDecoder publishing the commands of canal to subscribers,
+// so several consumers follow a master over one replication link. Subscribers
+// read JSON Events over HTTP, as server-sent events, or over TCP, one per line.
+//
+// A subscription is a query string: db, key, skip-db, skip-key, command and
+// skip-command are the Filter of the subscriber, they may be repeated. binary=base64
+// encodes the keys and values in base64. offset, or the Last-Event-ID of server-sent
+// events, resumes after the change at that replication offset, the subscription
+// fails if the backlog does not have it any more. Without, the subscriber gets the
+// changes published from now on.
+//
+// The commands of a full sync are not published. A full sync after commands were
+// published loses the changes in between: the subscribers are disconnected and the
+// backlog emptied, resuming from an offset before it fails.
+type Publisher struct {
+	cfg *PublisherConfig
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// backlog is the last changes published, first the sequence number of backlog[0].
+	// start is the offset subscribers may resume from, the one of the last change
+	// dropped or of the first published, -1 before. epoch counts the full syncs.
+	backlog []*published
+	first   int64
+	start   int64
+	epoch   int
+	// db is the database selected in the stream.
+	db          int
+	subscribers map[*subscriber]bool
+	listeners   []net.Listener
+	closed      bool
+}
+
+// published is a command, or the commands of a transaction, published.
+type published struct {
+	offset int64
+	// time is the unix time in milliseconds it was published at.
+	time int64
+	tx   bool
+	cmds []*Command
+	// dbs are the databases the commands run on.
+	dbs []int
+}
+
+// subscriber is a consumer of the changes published.
+type subscriber struct {
+	filter *Filter
+	enc    BinaryEncoding
+	// offset is the one of the last change the subscriber has, -1 for none.
+	offset int64
+	epoch  int
+	// next is the sequence number of the next change to send.
+	next int64
+	gone bool
+}
+
+var errPublisherClosed = errors.New("publisher is closed.")
+
+// NewPublisher returns a Publisher, Serve and ServeHTTP accept its subscribers.
+func NewPublisher(cfg *PublisherConfig) *Publisher {
+	p := &Publisher{cfg: cfg, start: -1, subscribers: make(map[*subscriber]bool)}
+	if cfg.Backlog <= 0 {
+		c := *cfg
+		c.Backlog = 10000
+		p.cfg = &c
+	}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// Subscribers returns the number of subscribers connected.
+func (p *Publisher) Subscribers() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.subscribers)
+}
+
+func (p *Publisher) Command(cmd *Command) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if cmd.Offset < 0 {
+		p.resync()
+		return nil
+	}
+	pub := &published{offset: cmd.Offset}
+	p.add(pub, cmd)
+	p.publish(pub)
+	return nil
+}
+
+func (p *Publisher) Transaction(tx *Transaction) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.db = tx.DB
+	pub := &published{offset: tx.Offset, tx: true}
+	for _, cmd := range tx.Commands {
+		p.add(pub, cmd)
+	}
+	p.publish(pub)
+	return nil
+}
+
+// add adds cmd to pub unless it does not change the dataset, p.mu is held.
+func (p *Publisher) add(pub *published, cmd *Command) {
+	switch {
+	case cmd.Type() == Select && len(cmd.D) > 1:
+		if n, err := strconv.Atoi(cmd.D[1]); err == nil {
+			p.db = n
+		}
+	case strings.EqualFold(cmd.CommandName(), "ping"):
+	default:
+		pub.cmds = append(pub.cmds, cmd)
+		pub.dbs = append(pub.dbs, p.db)
+	}
+}
+
+// publish appends pub to the backlog and wakes the subscribers, p.mu is held.
+func (p *Publisher) publish(pub *published) {
+	if len(pub.cmds) == 0 {
+		return
+	}
+	pub.time = time.Now().UnixNano() / int64(time.Millisecond)
+	if p.start < 0 {
+		p.start = pub.offset
+	}
+	p.backlog = append(p.backlog, pub)
+	if len(p.backlog) > 2*p.cfg.Backlog {
+		n := len(p.backlog) - p.cfg.Backlog
+		p.start = p.backlog[n-1].offset
+		p.first += int64(n)
+		p.backlog = append([]*published(nil), p.backlog[n:]...)
+	}
+	p.cond.Broadcast()
+}
+
+// resync empties the backlog on a full sync following published changes, p.mu is held.
+func (p *Publisher) resync() {
+	if p.start < 0 {
+		return
+	}
+	p.first += int64(len(p.backlog))
+	p.backlog, p.start, p.db = nil, -1, 0
+	p.epoch++
+	p.cond.Broadcast()
+}
+
+// subscription returns the subscriber asking for the query string q.
+func subscription(q url.Values) (*subscriber, error) {
+	s := &subscriber{filter: &Filter{}, offset: -1}
+	for key, vals := range q {
+		for _, val := range vals {
+			var err error
+			switch key {
+			case "db", "skip-db":
+				var n int
+				if n, err = strconv.Atoi(val); err == nil && key == "db" {
+					s.filter.DBs = append(s.filter.DBs, n)
+				} else if err == nil {
+					s.filter.SkipDBs = append(s.filter.SkipDBs, n)
+				}
+			case "key":
+				s.filter.Keys = append(s.filter.Keys, val)
+			case "skip-key":
+				s.filter.SkipKeys = append(s.filter.SkipKeys, val)
+			case "command":
+				s.filter.Commands = append(s.filter.Commands, val)
+			case "skip-command":
+				s.filter.SkipCommands = append(s.filter.SkipCommands, val)
+			case "binary":
+				switch val {
+				case "escaped":
+					s.enc = EscapedEncoding
+				case "base64":
+					s.enc = Base64Encoding
+				default:
+					err = errors.Errorf("unknown binary encoding")
+				}
+			case "offset":
+				if val != "" {
+					s.offset, err = strconv.ParseInt(val, 10, 64)
+				}
+			default:
+				err = errors.Errorf("unknown parameter")
+			}
+			if err != nil {
+				return nil, errors.Errorf("invalid %s %q: %v", key, val, err)
+			}
+		}
+	}
+	return s, nil
+}
+
+// subscribe registers s, from the offset it asks for.
+func (p *Publisher) subscribe(s *subscriber) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return errPublisherClosed
+	}
+	s.epoch = p.epoch
+	s.next = p.first + int64(len(p.backlog))
+	if s.offset >= 0 {
+		if p.start < 0 || s.offset < p.start {
+			return errors.Errorf("offset %d is not in the backlog", s.offset)
+		}
+		for s.next > p.first && p.backlog[s.next-p.first-1].offset > s.offset {
+			s.next--
+		}
+	}
+	p.subscribers[s] = true
+	return nil
+}
+
+// leave makes the follow of s return.
+func (p *Publisher) leave(s *subscriber) {
+	p.mu.Lock()
+	s.gone = true
+	p.cond.Broadcast()
+	p.mu.Unlock()
+}
+
+// follow hands the changes published to send as they come, until s leaves, the
+// publisher is closed, send fails or s cannot follow any more.
+func (p *Publisher) follow(s *subscriber, send func(events []*Event, offset int64) error) error {
+	defer func() {
+		p.mu.Lock()
+		delete(p.subscribers, s)
+		p.mu.Unlock()
+	}()
+	for {
+		p.mu.Lock()
+		for s.next == p.first+int64(len(p.backlog)) && !p.closed && !s.gone && s.epoch == p.epoch {
+			p.cond.Wait()
+		}
+		switch {
+		case p.closed:
+			p.mu.Unlock()
+			return errPublisherClosed
+		case s.gone:
+			p.mu.Unlock()
+			return nil
+		case s.epoch != p.epoch:
+			p.mu.Unlock()
+			return errors.Errorf("master resynced, changes were lost")
+		case s.next < p.first:
+			p.mu.Unlock()
+			return errors.Errorf("subscriber fell out of the backlog")
+		}
+		pubs := append([]*published(nil), p.backlog[s.next-p.first:]...)
+		s.next += int64(len(pubs))
+		p.mu.Unlock()
+		for _, pub := range pubs {
+			if events := s.events(pub); len(events) > 0 {
+				if err := send(events, pub.offset); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// events returns the Events of pub the subscriber asked for, a transaction
+// between a multi and an exec.
+func (s *subscriber) events(pub *published) []*Event {
+	var events []*Event
+	for i, cmd := range pub.cmds {
+		if cmd = s.filter.Command(pub.dbs[i], cmd); cmd != nil {
+			events = append(events, commandEvent(cmd, pub.dbs[i], s.enc))
+		}
+	}
+	if pub.tx && len(events) > 0 {
+		events = append([]*Event{{Op: "multi", DB: events[0].DB}}, events...)
+		events = append(events, &Event{Op: "exec", DB: events[len(events)-1].DB})
+	}
+	for _, e := range events {
+		e.Offset, e.Source, e.Time = pub.offset, SourceStream, pub.time
+	}
+	return events
+}
+
+// ServeHTTP streams the changes as server-sent events to the subscriber asking
+// with the query string of r. The id of the last event of a change is its offset.
+func (p *Publisher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	s, err := subscription(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		if s.offset, err = strconv.ParseInt(id, 10, 64); err != nil {
+			http.Error(w, fmt.Sprintf("invalid Last-Event-ID %q", id), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := p.subscribe(s); err == errPublisherClosed {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-r.Context().Done():
+			p.leave(s)
+		case <-done:
+		}
+	}()
+	err = p.follow(s, func(events []*Event, offset int64) error {
+		var buf []byte
+		for i, e := range events {
+			data, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			if i == len(events)-1 {
+				buf = append(buf, "id: "...)
+				buf = strconv.AppendInt(buf, offset, 10)
+				buf = append(buf, '\n')
+			}
+			buf = append(buf, "data: "...)
+			buf = append(buf, data...)
+			buf = append(buf, '\n', '\n')
+		}
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintf(w, "event: error\ndata: %s\n\n", err)
+		flusher.Flush()
+	}
+}
+
+// Serve accepts the subscribers connecting to ln until the publisher is closed.
+// A subscriber sends its query string on a line, then reads the changes as JSON
+// Events, one per line. A line {"error": "..."} ends the subscription.
+func (p *Publisher) Serve(ln net.Listener) error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return errPublisherClosed
+	}
+	p.listeners = append(p.listeners, ln)
+	p.mu.Unlock()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			p.mu.Lock()
+			closed := p.closed
+			p.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		go p.serve(conn)
+	}
+}
+
+// serve reads the subscription of conn, then streams the changes to it.
+func (p *Publisher) serve(conn net.Conn) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	q, err := url.ParseQuery(strings.TrimSpace(line))
+	var s *subscriber
+	if err == nil {
+		s, err = subscription(q)
+	}
+	if err == nil {
+		err = p.subscribe(s)
+	}
+	if err == nil {
+		// the subscriber sends nothing more, reading tells when it is gone.
+		go func() {
+			io.Copy(ioutil.Discard, rd)
+			p.leave(s)
+		}()
+		err = p.follow(s, func(events []*Event, offset int64) error {
+			var buf []byte
+			for _, e := range events {
+				data, err := json.Marshal(e)
+				if err != nil {
+					return err
+				}
+				buf = append(append(buf, data...), '\n')
+			}
+			conn.SetWriteDeadline(time.Now().Add(time.Minute))
+			_, err := conn.Write(buf)
+			return err
+		})
+	}
+	if err != nil {
+		log.Printf("[CANAL] publisher: subscriber %s: %v.\n", conn.RemoteAddr(), err)
+		line, _ := json.Marshal(map[string]string{"error": err.Error()})
+		conn.SetWriteDeadline(time.Now().Add(time.Second))
+		conn.Write(append(line, '\n'))
+	}
+}
+
+// Close stops serving, the subscribers are disconnected.
+func (p *Publisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	for _, ln := range p.listeners {
+		ln.Close()
+	}
+	p.cond.Broadcast()
+	return nil
+}
@@ -14,21 +14,31 @@ import (
 )
 
 func DecodeStream(r io.Reader, d Decoder) error {
-	decoder := &rdbDecode{d, make([]byte, 8), bufio.NewReader(r)}
-	return decoder.decode(false)
+	_, err := decodeStream(r, d)
+	return err
+}
+
+// decodeStream is DecodeStream returning the version of the RDB, which tells
+// whether a checksum follows it.
+func decodeStream(r io.Reader, d Decoder) (int, error) {
+	decoder := &rdbDecode{event: d, intBuf: make([]byte, 8), r: bufio.NewReader(r)}
+	err := decoder.decode(false)
+	return decoder.version, err
 }
 
 func DecodeFile(r io.Reader, d Decoder) error {
-	decoder := &rdbDecode{d, make([]byte, 8), bufio.NewReader(r)}
+	decoder := &rdbDecode{event: d, intBuf: make([]byte, 8), r: bufio.NewReader(r)}
 	return decoder.decode(true)
 }
 
+// DecodeDump hands the DUMP payload of key to d as an RDB of one key. Payloads of
+// redis up to 7.2, RDB version 11, are decoded, newer ones are refused.
 func DecodeDump(dump []byte, db int, key []byte, expiry int64, d Decoder) error {
 	err := verifyDump(dump)
 	if err != nil {
 		return err
 	}
-	decoder := &rdbDecode{d, make([]byte, 8), bytes.NewReader(dump[1:])}
+	decoder := &rdbDecode{event: d, intBuf: make([]byte, 8), r: bytes.NewReader(dump[1:])}
 	decoder.event.BeginRDB()
 	decoder.event.BeginDatabase(db)
 	err = decoder.readObject(key, ValueType(dump[0]), expiry)
@@ -41,6 +51,10 @@ type rdbDecode struct {
 	event  Decoder
 	intBuf []byte
 	r      ByteReader
+	// elements is the count the value being read is serialized with.
+	elements int64
+	// version is the version of the RDB, known once the header is read.
+	version int
 }
 
 func (d *rdbDecode) Parse(dr Decoder) error {
@@ -56,8 +70,8 @@ func (d *rdbDecode) decode(file bool) error {
 	d.event.BeginRDB()
 	var db uint64
 	var expiry int64
-	var lruIdle uint64
-	var lfuFreq int
+	lruIdle, lfuFreq := int64(-1), int64(-1)
+	eviction, _ := d.event.(EvictionDecoder)
 	firstDB := true
 	for {
 		objType, err := d.r.ReadByte()
@@ -67,7 +81,7 @@ func (d *rdbDecode) decode(file bool) error {
 		switch objType {
 		case rdbOpCodeFreq:
 			b, err := d.r.ReadByte()
-			lfuFreq = int(b)
+			lfuFreq = int64(b)
 			if err != nil {
 				return err
 			}
@@ -76,7 +90,7 @@ func (d *rdbDecode) decode(file bool) error {
 			if err != nil {
 				return err
 			}
-			lruIdle = uint64(idle)
+			lruIdle = int64(idle)
 		case rdbOpCodeAux:
 			auxKey, err := d.readString()
 			if err != nil {
@@ -124,36 +138,66 @@ func (d *rdbDecode) decode(file bool) error {
 			return nil
 		case rdbOpCodeModuleAux:
 
+		case rdbOpCodeFunction2:
+			// the code of a library of functions, which is not a key.
+			if _, err := d.readString(); err != nil {
+				return err
+			}
+		case rdbOpCodeFunctionPreGA:
+			return errors.Errorf("rdb: the functions of a redis 7 release candidate are not supported")
 		default:
 			key, err := d.readString()
 			if err != nil {
 				return err
 			}
+			if eviction != nil && (lruIdle >= 0 || lfuFreq >= 0) {
+				eviction.Eviction(key, lruIdle, lfuFreq)
+			}
 			err = d.readObject(key, ValueType(objType), expiry)
 			if err != nil {
 				return err
 			}
-			_, _ = lfuFreq, lruIdle
 			expiry = 0
-			lfuFreq = 0
-			lruIdle = 0
+			lfuFreq = -1
+			lruIdle = -1
 		}
 	}
 }
 
 func (d *rdbDecode) readObject(key []byte, typ ValueType, expiry int64) error {
+	if encoding, ok := d.event.(EncodingDecoder); ok {
+		encoding.Encoding(key, typ)
+	}
+	info, ok := d.event.(ValueInfoDecoder)
+	if !ok {
+		return d.readValue(key, typ, expiry)
+	}
+	r := &countingReader{r: d.r}
+	d.r, d.elements = r, 0
+	err := d.readValue(key, typ, expiry)
+	d.r = r.r
+	if err != nil {
+		return err
+	}
+	info.ValueInfo(key, ValueInfo{Length: r.n, Elements: d.elements})
+	return nil
+}
+
+func (d *rdbDecode) readValue(key []byte, typ ValueType, expiry int64) error {
 	switch typ {
 	case TypeString:
 		value, err := d.readString()
 		if err != nil {
 			return err
 		}
+		d.elements = 1
 		d.event.Set(key, value, expiry)
 	case TypeList:
 		length, _, err := d.readLength()
 		if err != nil {
 			return err
 		}
+		d.elements = int64(length)
 		d.event.BeginList(key, int64(length), expiry)
 		for length > 0 {
 			length--
@@ -169,10 +213,14 @@ func (d *rdbDecode) readObject(key []byte, typ ValueType, expiry int64) error {
 		if err != nil {
 			return err
 		}
+		d.elements = int64(length)
 		d.event.BeginList(key, int64(-1), expiry)
 		for length > 0 {
 			length--
-			d.readZiplist(key, 0, false)
+			err = d.readZiplist(key, 0, false)
+			if err != nil {
+				return err
+			}
 		}
 		d.event.EndList(key)
 	case TypeSet:
@@ -180,6 +228,7 @@ func (d *rdbDecode) readObject(key []byte, typ ValueType, expiry int64) error {
 		if err != nil {
 			return err
 		}
+		d.elements = int64(cardinality)
 		d.event.BeginSet(key, int64(cardinality), expiry)
 		for cardinality > 0 {
 			cardinality--
@@ -197,6 +246,7 @@ func (d *rdbDecode) readObject(key []byte, typ ValueType, expiry int64) error {
 		if err != nil {
 			return err
 		}
+		d.elements = int64(cardinality)
 		d.event.BeginZSet(key, int64(cardinality), expiry)
 		for cardinality > 0 {
 			cardinality--
@@ -224,6 +274,7 @@ func (d *rdbDecode) readObject(key []byte, typ ValueType, expiry int64) error {
 		if err != nil {
 			return err
 		}
+		d.elements = int64(length)
 		d.event.BeginHash(key, int64(length), expiry)
 		for length > 0 {
 			length--
@@ -248,8 +299,16 @@ func (d *rdbDecode) readObject(key []byte, typ ValueType, expiry int64) error {
 		return d.readZiplistZset(key, expiry)
 	case TypeHashZiplist:
 		return d.readZiplistHash(key, expiry)
-	case TypeStreamListPacks:
-		return d.readStream(key, expiry)
+	case TypeHashListpack:
+		return d.readListpackHash(key, expiry)
+	case TypeZSetListpack:
+		return d.readListpackZset(key, expiry)
+	case TypeSetListpack:
+		return d.readListpackSet(key, expiry)
+	case TypeListQuicklist2:
+		return d.readQuicklist2(key, expiry)
+	case TypeStreamListPacks, TypeStreamListPacks2, TypeStreamListPacks3:
+		return d.readStream(key, typ, expiry)
 	case TypeModule:
 		fallthrough
 	case TypeModule2:
@@ -285,14 +344,15 @@ func (d *rdbDecode) readStreamID() (uint64, uint64, error) {
 	return binary.BigEndian.Uint64(ms), binary.BigEndian.Uint64(seq), nil
 }
 
-func (d *rdbDecode) readStream(key []byte, expiry int64) error {
+func (d *rdbDecode) readStream(key []byte, typ ValueType, expiry int64) error {
 	cardinality, _, err := d.readLength()
 	if err != nil {
 		return err
 	}
+	d.elements = int64(cardinality)
 	d.event.BeginStream(key, int64(cardinality), expiry)
 
-	data := make([]byte, 0)
+	var fields []FieldValue
 
 	for cardinality > 0 {
 		cardinality--
@@ -379,7 +439,7 @@ func (d *rdbDecode) readStream(key []byte, expiry int64) error {
 			if err != nil {
 				return err
 			}
-			_ms, err := readuInt(ms)
+			_ms, err := readInt(ms)
 			if err != nil {
 				return err
 			}
@@ -388,19 +448,15 @@ func (d *rdbDecode) readStream(key []byte, expiry int64) error {
 			if err != nil {
 				return err
 			}
-			_seq, err := readuInt(seq)
+			_seq, err := readInt(seq)
 			if err != nil {
 				return err
 			}
 
-			epoch += _ms
-			sequence += _seq
+			// entry ids are stored as a difference with the master entry id.
+			id := []byte(fmt.Sprintf("%d-%d", epoch+uint64(_ms), sequence+uint64(_seq)))
+			removed := (flagInt & rdbStreamItemFlagDeleted) != 0
 
-			delete := false
-			if (int(flagInt) & rdbStreamItemFlagNone) != 0 {
-				delete = false
-			}
-			_ = delete
 			if (flagInt & rdbStreamItemFlangSameFields) != 0 {
 				/*
 				* SAMEFIELD
@@ -410,17 +466,16 @@ func (d *rdbDecode) readStream(key []byte, expiry int64) error {
 				 */
 
 				for i := 0; i < int(num_fields); i++ {
-					data = append(data, tempFileds[i]...)
-					data = append(data, ' ')
 					value, err := readListPackV2(listpack)
 					if err != nil {
 						return err
 					}
-					data = append(data, value...)
-					data = append(data, ' ')
+					fields = append(fields, FieldValue{string(tempFileds[i]), string(value)})
+				}
+				if !removed {
+					xaddEntry(d.event, key, id, fields)
 				}
-				d.event.Xadd(key, []byte(fmt.Sprintf("%d-%d", epoch, sequence)), data[0:len(data)-1])
-				data = data[:0]
+				fields = fields[:0]
 			} else {
 				/*
 				 * NONEFIELD
@@ -441,19 +496,16 @@ func (d *rdbDecode) readStream(key []byte, expiry int64) error {
 					if err != nil {
 						return err
 					}
-					data = append(data, field...)
-					data = append(data, ' ')
-
 					value, err := readListPackV2(listpack)
 					if err != nil {
 						return err
 					}
-					data = append(data, value...)
-					data = append(data, ' ')
-
+					fields = append(fields, FieldValue{string(field), string(value)})
+				}
+				if !removed {
+					xaddEntry(d.event, key, id, fields)
 				}
-				d.event.Xadd(key, []byte(fmt.Sprintf("%d-%d", epoch+_ms, sequence)), data[0:len(data)-1])
-				data = data[:0]
+				fields = fields[:0]
 			}
 			readListPackV2(listpack) // lp-count
 		}
@@ -468,45 +520,48 @@ func (d *rdbDecode) readStream(key []byte, expiry int64) error {
 
 	}
 
-	for i := 0; i < 3; i++ {
-		_, _, err = d.readLength() // items , last_id, last_seq
-		if err != nil {
+	// items, last id, then from version 2 first id, max deleted id and entries added.
+	lengths := 3
+	if typ != TypeStreamListPacks {
+		lengths = 8
+	}
+	for i := 0; i < lengths; i++ {
+		if _, _, err = d.readLength(); err != nil {
 			return err
 		}
 	}
 
-	//TODO output consumer groups
+	// the consumer groups are skipped.
 	groupsCount, _, err := d.readLength()
 	if err != nil {
 		return err
 	}
-
 	for groupsCount > 0 {
 		groupsCount--
-		cgname, err := d.readString()
-		if err != nil {
+		if _, err := d.readString(); err != nil { // name
 			return err
 		}
-		gIDms, _, err := d.readLength()
-		if err != nil {
-			return err
+		// last id, then from version 2 entries read.
+		lengths := 2
+		if typ != TypeStreamListPacks {
+			lengths = 3
 		}
-		gIDseq, _, err := d.readLength()
-		if err != nil {
-			return err
+		for i := 0; i < lengths; i++ {
+			if _, _, err = d.readLength(); err != nil {
+				return err
+			}
 		}
-		_, _, _ = cgname, gIDms, gIDseq
-		// fmt.Printf("cgname=%s last_cg_entry_id %d-%d\n", cgname, gIDms, gIDseq)
-
 		pelSize, _, err := d.readLength()
 		if err != nil {
 			return err
 		}
 		for pelSize > 0 {
 			pelSize--
-			eid := make([]byte, 16) //deliveryTime 8 byte deliveryCount 8 byte
-			_, err := io.ReadFull(d.r, eid)
-			if err != nil {
+			// id 16 bytes, delivery time 8 bytes, then the delivery count.
+			if _, err := io.ReadFull(d.r, make([]byte, 24)); err != nil {
+				return err
+			}
+			if _, _, err := d.readLength(); err != nil {
 				return err
 			}
 		}
@@ -517,19 +572,24 @@ func (d *rdbDecode) readStream(key []byte, expiry int64) error {
 		}
 		for consumersNum > 0 {
 			consumersNum--
-			_, err = d.readString() // cname
-			if err != nil {
+			if _, err = d.readString(); err != nil { // name
 				return err
 			}
-			pelSize, _, err := d.readLength() // pending
+			// seen time, then from version 3 active time.
+			times := 8
+			if typ == TypeStreamListPacks3 {
+				times = 16
+			}
+			if _, err := io.ReadFull(d.r, make([]byte, times)); err != nil {
+				return err
+			}
+			pelSize, _, err := d.readLength() // pending ids
 			if err != nil {
 				return err
 			}
 			for pelSize > 0 {
 				pelSize--
-				rawid := make([]byte, 16) //eid
-				_, err = io.ReadFull(d.r, rawid)
-				if err != nil {
+				if _, err := io.ReadFull(d.r, make([]byte, 16)); err != nil {
 					return err
 				}
 			}
@@ -560,6 +620,7 @@ func (d *rdbDecode) readZipmap(key []byte, expiry int64) error {
 	} else {
 		length = int(lenByte)
 	}
+	d.elements = int64(length) * 2
 	d.event.BeginHash(key, int64(length), expiry)
 	for i := 0; i < length; i++ {
 		field, err := readZipmapItem(buf, false)
@@ -660,121 +721,105 @@ func readListPackV2(slice *sliceBuffer) (value []byte, err error) {
 	if special, err = slice.ReadByte(); err != nil {
 		return nil, err
 	}
-	if (special & rdbLpEncoding7BitUintMask) == rdbLpEncoding7BitUint { // mask 128 -> 0xxx xxxx
-		slice.Skip(1)
-		value = i642bytes((uint64(special) & 0x7f)) //  0x7f 127
-
-	} else if (special & rdbLpEncoding6BitStrMask) == rdbLpEncoding6BitStr { // mask 192 -> 00xx xxxx
-		len := special & 0x3f // 0x3f  63
-		skip := 1 + int(len)
-		value, err = slice.First(int(len))
-		if err != nil {
+	var size int // <encoding-type> + <element-data>, needed to skip <element-tot-len>
+	var intBytes []byte
+	switch {
+	case (special & rdbLpEncoding7BitUintMask) == rdbLpEncoding7BitUint: // mask 128 -> 0xxx xxxx
+		value = []byte(strconv.FormatUint(uint64(special&0x7f), 10))
+		size = 1
+	case (special & rdbLpEncoding6BitStrMask) == rdbLpEncoding6BitStr: // mask 192 -> 10xx xxxx
+		length := int(special & 0x3f)
+		if value, err = slice.Slice(length); err != nil {
 			return nil, err
 		}
-		slice.Skip(int(skip))
-
-	} else if (special & rdbLpEncoding13BitIntMask) == rdbLpEncoding13BitInt { // mask 224 -> 000x xxxx
+		size = 1 + length
+	case (special & rdbLpEncoding13BitIntMask) == rdbLpEncoding13BitInt: // mask 224 -> 110x xxxx
 		next, err := slice.ReadByte()
 		if err != nil {
 			return nil, err
 		}
-		value = i642bytes(((uint64(special&0x1f) << 8) | uint64(next)))
-		slice.Skip(2)
-
-	} else if (special & rdbLpEncoding16BitIntMask) == rdbLpEncoding16BitInt { // mask 255
-		value, err = slice.First(2)
-		if err != nil {
-			return nil, err
+		i := int64(special&0x1f)<<8 | int64(next)
+		if i >= 1<<12 {
+			i -= 1 << 13
 		}
-		slice.Skip(3)
-
-	} else if (special & rdbLpEncoding24BitIntMask) == rdbLpEncoding24BitInt {
-		value, err = slice.First(3)
-		if err != nil {
+		value = []byte(strconv.FormatInt(i, 10))
+		size = 2
+	case special == rdbLpEncoding16BitInt:
+		if intBytes, err = slice.Slice(2); err != nil {
 			return nil, err
 		}
-		slice.Skip(4)
-
-	} else if (special & rdbLpEncoding32BitIntMask) == rdbLpEncoding32BitInt {
-		value, err = slice.First(4)
-		if err != nil {
+		value = []byte(strconv.FormatInt(int64(int16(binary.LittleEndian.Uint16(intBytes))), 10))
+		size = 3
+	case special == rdbLpEncoding24BitInt:
+		if intBytes, err = slice.Slice(3); err != nil {
 			return nil, err
 		}
-		slice.Skip(5)
-
-	} else if (special & rdbLpEncoding64BitIntMask) == rdbLpEncoding64BitInt {
-		value, err = slice.First(8)
-		if err != nil {
+		i := int32(uint32(intBytes[0])<<8|uint32(intBytes[1])<<16|uint32(intBytes[2])<<24) >> 8
+		value = []byte(strconv.FormatInt(int64(i), 10))
+		size = 4
+	case special == rdbLpEncoding32BitInt:
+		if intBytes, err = slice.Slice(4); err != nil {
 			return nil, err
 		}
-		slice.Skip(9)
-
-	} else if (special & rdbLpEncoding12BitStrMask) == rdbLpEncoding12BitStr {
-		b, err := slice.ReadByte()
-		if err != nil {
+		value = []byte(strconv.FormatInt(int64(int32(binary.LittleEndian.Uint32(intBytes))), 10))
+		size = 5
+	case special == rdbLpEncoding64BitInt:
+		if intBytes, err = slice.Slice(8); err != nil {
 			return nil, err
 		}
-		len := ((uint64(special) & 0x0f) << 8) | uint64(b)
-		value, err = slice.First(int(len))
-		if err != nil {
+		value = []byte(strconv.FormatInt(int64(binary.LittleEndian.Uint64(intBytes)), 10))
+		size = 9
+	case special == rdbLpEncoding32BitStr:
+		if intBytes, err = slice.Slice(4); err != nil {
 			return nil, err
 		}
-		slice.Skip(2 + int(len))
-
-	} else if (special & rdbLpEncoding32BitStrMask) == rdbLpEncoding32BitStr {
-		len, err := slice.First(4)
-		if err != nil {
+		length := int(binary.LittleEndian.Uint32(intBytes))
+		if value, err = slice.Slice(length); err != nil {
 			return nil, err
 		}
-		realLength, err := readuInt(len)
+		size = 5 + length
+	case (special & rdbLpEncoding12BitStrMask) == rdbLpEncoding12BitStr:
+		b, err := slice.ReadByte()
 		if err != nil {
 			return nil, err
 		}
-		value, err = slice.First(int(realLength))
-		if err != nil {
+		length := int(special&0x0f)<<8 | int(b)
+		if value, err = slice.Slice(length); err != nil {
 			return nil, err
 		}
-		slice.Skip(5 + int(realLength))
-
-	} else {
+		size = 2 + length
+	default:
 		return nil, errors.Errorf("Unsupported operation exception %q\n", special)
 	}
 	// <element-tot-len>
+	slice.Skip(lpBacklenSize(size))
 
 	return value, nil
 }
 
-func readuInt(intBytes []byte) (uint64, error) {
-	if len(intBytes) == 3 {
-		intBytes = append([]byte{0}, intBytes...)
-	}
-	bytesBuffer := bytes.NewBuffer(intBytes)
-	switch len(intBytes) {
-	case 1:
-		var tmp uint8
-		err := binary.Read(bytesBuffer, binary.BigEndian, &tmp)
-		return uint64(tmp), err
-	case 2:
-		var tmp uint16
-		err := binary.Read(bytesBuffer, binary.BigEndian, &tmp)
-		return uint64(tmp), err
-	case 4:
-		var tmp uint32
-		err := binary.Read(bytesBuffer, binary.BigEndian, &tmp)
-		return uint64(tmp), err
-	case 8:
-		var tmp uint64
-		err := binary.Read(bytesBuffer, binary.BigEndian, &tmp)
-		return uint64(tmp), err
+// lpBacklenSize is the number of bytes used to store the length of an entry of size bytes.
+func lpBacklenSize(size int) int {
+	switch {
+	case size <= 127:
+		return 1
+	case size < 16383:
+		return 2
+	case size < 2097151:
+		return 3
+	case size < 268435455:
+		return 4
 	default:
-		return 0, fmt.Errorf("%s", "BytesToInt bytes lenth is invaild!")
+		return 5
 	}
 }
 
-func i642bytes(i uint64) []byte {
-	var buf = make([]byte, 8)
-	binary.BigEndian.PutUint64(buf, uint64(i))
-	return buf
+// listpack integers are returned as strings by readListPackV2.
+func readuInt(intBytes []byte) (uint64, error) {
+	return strconv.ParseUint(string(intBytes), 10, 64)
+}
+
+func readInt(intBytes []byte) (int64, error) {
+	return strconv.ParseInt(string(intBytes), 10, 64)
 }
 
 func (d *rdbDecode) readZiplist(key []byte, expiry int64, addListEvents bool) error {
@@ -788,6 +833,7 @@ func (d *rdbDecode) readZiplist(key []byte, expiry int64, addListEvents bool) er
 		return err
 	}
 	if addListEvents {
+		d.elements = length
 		d.event.BeginList(key, length, expiry)
 	}
 	for i := int64(0); i < length; i++ {
@@ -813,6 +859,7 @@ func (d *rdbDecode) readZiplistZset(key []byte, expiry int64) error {
 	if err != nil {
 		return err
 	}
+	d.elements = cardinality
 	cardinality /= 2
 	d.event.BeginZSet(key, cardinality, expiry)
 	for i := int64(0); i < cardinality; i++ {
@@ -844,6 +891,7 @@ func (d *rdbDecode) readZiplistHash(key []byte, expiry int64) error {
 	if err != nil {
 		return err
 	}
+	d.elements = length
 	length /= 2
 	d.event.BeginHash(key, length, expiry)
 	for i := int64(0); i < length; i++ {
@@ -861,6 +909,119 @@ func (d *rdbDecode) readZiplistHash(key []byte, expiry int64) error {
 	return nil
 }
 
+// readListpack reads a string holding a listpack and returns its elements.
+func (d *rdbDecode) readListpack() ([][]byte, error) {
+	lp, err := d.readString()
+	if err != nil {
+		return nil, err
+	}
+	buf := newSliceBuffer(lp)
+	buf.Skip(6) // total-bytes 4, num-elements 2
+	var elements [][]byte
+	for {
+		if buf.i >= len(buf.s) {
+			return nil, errors.Errorf("rdb: listpack without end")
+		}
+		if buf.s[buf.i] == rdbLpEOF {
+			return elements, nil
+		}
+		element, err := readListPackV2(buf)
+		if err != nil {
+			return nil, err
+		}
+		elements = append(elements, element)
+	}
+}
+
+func (d *rdbDecode) readListpackHash(key []byte, expiry int64) error {
+	elements, err := d.readListpack()
+	if err != nil {
+		return err
+	}
+	if len(elements)%2 != 0 {
+		return errors.Errorf("rdb: hash %s has a field without value", key)
+	}
+	d.elements = int64(len(elements))
+	d.event.BeginHash(key, int64(len(elements)/2), expiry)
+	for i := 0; i < len(elements); i += 2 {
+		d.event.Hset(key, elements[i], elements[i+1])
+	}
+	d.event.EndHash(key)
+	return nil
+}
+
+func (d *rdbDecode) readListpackZset(key []byte, expiry int64) error {
+	elements, err := d.readListpack()
+	if err != nil {
+		return err
+	}
+	if len(elements)%2 != 0 {
+		return errors.Errorf("rdb: sorted set %s has a member without score", key)
+	}
+	d.elements = int64(len(elements))
+	d.event.BeginZSet(key, int64(len(elements)/2), expiry)
+	for i := 0; i < len(elements); i += 2 {
+		score, err := strconv.ParseFloat(string(elements[i+1]), 64)
+		if err != nil {
+			return err
+		}
+		d.event.Zadd(key, score, elements[i])
+	}
+	d.event.EndZSet(key)
+	return nil
+}
+
+func (d *rdbDecode) readListpackSet(key []byte, expiry int64) error {
+	elements, err := d.readListpack()
+	if err != nil {
+		return err
+	}
+	d.elements = int64(len(elements))
+	d.event.BeginSet(key, int64(len(elements)), expiry)
+	for _, member := range elements {
+		d.event.Sadd(key, member)
+	}
+	d.event.EndSet(key)
+	return nil
+}
+
+// readQuicklist2 reads the quicklist of RDB version 10, its nodes are a plain
+// element or a listpack of elements.
+func (d *rdbDecode) readQuicklist2(key []byte, expiry int64) error {
+	nodes, _, err := d.readLength()
+	if err != nil {
+		return err
+	}
+	d.elements = int64(nodes)
+	d.event.BeginList(key, -1, expiry)
+	for ; nodes > 0; nodes-- {
+		container, _, err := d.readLength()
+		if err != nil {
+			return err
+		}
+		switch container {
+		case rdbQuicklistNodePlain:
+			value, err := d.readString()
+			if err != nil {
+				return err
+			}
+			d.event.Rpush(key, value)
+		case rdbQuicklistNodePacked:
+			elements, err := d.readListpack()
+			if err != nil {
+				return err
+			}
+			for _, value := range elements {
+				d.event.Rpush(key, value)
+			}
+		default:
+			return errors.Errorf("rdb: unknown quicklist container %d for key %s", container, key)
+		}
+	}
+	d.event.EndList(key)
+	return nil
+}
+
 func readZiplistLength(buf *sliceBuffer) (int64, error) {
 	buf.Seek(8, 0) // skip the zlbytes and zltail
 	lenBytes, err := buf.Slice(2)
@@ -955,6 +1116,7 @@ func (d *rdbDecode) readIntset(key []byte, expiry int64) error {
 	}
 	cardinality := binary.LittleEndian.Uint32(lenBytes)
 
+	d.elements = int64(cardinality)
 	d.event.BeginSet(key, int64(cardinality), expiry)
 	for i := uint32(0); i < cardinality; i++ {
 		intBytes, err := buf.Slice(int(intSize))
@@ -976,6 +1138,26 @@ func (d *rdbDecode) readIntset(key []byte, expiry int64) error {
 	return nil
 }
 
+// countingReader counts the bytes read, the serialized length of a value.
+type countingReader struct {
+	r ByteReader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
 func skipLine(r io.Reader) error {
 	br := bufio.NewReader(r)
 	_, _, err := br.ReadLine()
@@ -1015,9 +1197,13 @@ func (d *rdbDecode) checkHeader(file bool) error {
 	}
 
 	version, _ := strconv.ParseInt(string(header[5:]), 10, 64)
-	if version < 1 || version > rdbVersion {
+	if version < 1 {
 		return fmt.Errorf("rdb: invalid RDB version number %d", version)
 	}
+	if version > rdbReadVersion {
+		return fmt.Errorf("rdb: RDB version %d is not supported, the newest is %d of redis 7.2", version, rdbReadVersion)
+	}
+	d.version = int(version)
 
 	return nil
 }
@@ -1162,25 +1348,20 @@ func (d *rdbDecode) readLength() (uint64, bool, error) {
 			return 0, false, errors.Wrap(err, "readfailed")
 		}
 		return (uint64(b&0x3f) << 8) | uint64(bb), false, nil
-	case rdb32bitLen:
-		bb, err := d.readUint32()
-		if err != nil {
-			return 0, false, err
-		}
-		return uint64(bb), false, nil
-	case rdb64bitLen:
-		bb, err := d.readUint64()
-		if err != nil {
-			return 0, false, err
-		}
-		return bb, false, nil
 	case rdbEncVal:
 		// When the first two bits are 11, the next object is encoded.
 		// The next 6 bits indicate the encoding type.
 		return uint64(b & 0x3f), true, nil
 	default:
 		// When the first two bits are 10, the next 6 bits are discarded.
-		// The next 4 bytes are the length.
+		// The next 4 bytes are the length, or the next 8 bytes with rdb64bitLen.
+		if b == rdb64bitLen {
+			_, err := io.ReadFull(d.r, d.intBuf)
+			if err != nil {
+				return 0, false, errors.Wrap(err, "readfailed")
+			}
+			return binary.BigEndian.Uint64(d.intBuf), false, nil
+		}
 		length, err := d.readUint32Big()
 		return uint64(length), false, err
 	}
@@ -1192,8 +1373,8 @@ func verifyDump(d []byte) error {
 		return fmt.Errorf("rdb: invalid dump length")
 	}
 	version := binary.LittleEndian.Uint16(d[len(d)-10:])
-	if version > uint16(rdbVersion) {
-		return fmt.Errorf("rdb: invalid version %d, expecting %d", version, rdbVersion)
+	if version > uint16(rdbReadVersion) {
+		return fmt.Errorf("rdb: DUMP version %d is not supported, the newest is %d of redis 7.2", version, rdbReadVersion)
 	}
 
 	if binary.LittleEndian.Uint64(d[len(d)-8:]) != Digest(d[:len(d)-8]) {
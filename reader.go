@@ -6,6 +6,9 @@ import (
 	"strconv"
 )
 
+// maxMultiBulkLength is the largest array a Reader accepts, as redis does.
+const maxMultiBulkLength = 1024 * 1024
+
 // Reader is a specialized RESP Value type reader.
 type Reader struct {
 	rd *bufio.Reader
@@ -184,7 +187,7 @@ func (rd *Reader) readArrayValue(multibulk bool) (val Value, n int, err error) {
 	var l int
 	l, rn, err = rd.readInt()
 	n += rn
-	if err != nil || l > 1024*1024 {
+	if err != nil || l > maxMultiBulkLength {
 		if _, ok := err.(*ErrProtocol); ok {
 			if multibulk {
 				return NilValue, n, &ErrProtocol{Msg: "invalid multibulk length"}
@@ -0,0 +1,474 @@
+package canal
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type RelayConfig struct {
+	// Backlog is the least bytes of the stream kept for the partial resyncs of the
+	// replicas, 1MB by default.
+	Backlog int
+	// Password, when set, must be given by the replicas with AUTH.
+	Password string
+	// RDBVersion is the version of the RDB of the full syncs, it must not be newer
+	// than the one of the replicas. 9 by default.
+	RDBVersion int
+}
+
+func NewRelayConfig() *RelayConfig {
+	return &RelayConfig{Backlog: 1 << 20, RDBVersion: 9}
+}
+
+// Relay serves the replication stream of canal to redis replicas, so they sync
+// from it instead of the master. It is the Decoder and the CommandDecoder of
+// RunSnapshot: it keeps the dataset in a Store to send it as the RDB of the full
+// syncs, and the commands in a backlog for the partial resyncs.
+//
+// The relay has its own replication ID and offsets: they count the bytes of the
+// commands it relays, which may be filtered. A full sync of canal starts a new
+// replication ID, the replicas then sync again. Replicas wait until the first
+// RDB is loaded. The full syncs of replicas are refused while the Store has
+// commands it could not apply, until canal full syncs again; partial resyncs
+// go on as the backlog has the commands.
+type Relay struct {
+	cfg   *RelayConfig
+	store *Store
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// id and offset are the replication ID and offset of the stream, backlog its
+	// last bytes up to offset. epoch counts the replication IDs.
+	id      string
+	offset  int64
+	backlog []byte
+	epoch   int
+	ready   bool
+	// db is the database selected in the stream, it is selected again after a
+	// full sync as the replica does not know it.
+	db        int
+	reselect  bool
+	replicas  map[*relayReplica]bool
+	listeners []net.Listener
+	closed    bool
+}
+
+// relayReplica is a replica synced from the relay.
+type relayReplica struct {
+	conn  net.Conn
+	epoch int
+	// next is the offset of the next byte to send, ack the last offset it acked.
+	next int64
+	ack  int64
+	gone bool
+}
+
+// NewRelay returns a Relay, Serve accepts its replicas.
+func NewRelay(cfg *RelayConfig) *Relay {
+	r := &Relay{cfg: cfg, store: NewStore(), id: replicationID(), replicas: make(map[*relayReplica]bool)}
+	if r.cfg.Backlog <= 0 || r.cfg.RDBVersion <= 0 {
+		c := *cfg
+		if c.Backlog <= 0 {
+			c.Backlog = 1 << 20
+		}
+		if c.RDBVersion <= 0 {
+			c.RDBVersion = 9
+		}
+		r.cfg = &c
+	}
+	r.cond = sync.NewCond(&r.mu)
+	return r
+}
+
+// replicationID returns a random replication ID, 40 hex characters as redis.
+// The tests replace it to get the same RDB on every run.
+var replicationID = func() string {
+	b := make([]byte, 20)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Store returns the Store of the dataset relayed.
+func (r *Relay) Store() *Store {
+	return r.store
+}
+
+// Position returns the replication ID and offset of the stream relayed.
+func (r *Relay) Position() (string, int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.id, r.offset
+}
+
+// Replicas returns the offsets the replicas acked, by address.
+func (r *Relay) Replicas() map[string]int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	acks := make(map[string]int64, len(r.replicas))
+	for rep := range r.replicas {
+		acks[rep.conn.RemoteAddr().String()] = rep.ack
+	}
+	return acks
+}
+
+func (r *Relay) BeginRDB() {
+	r.mu.Lock()
+	if r.ready {
+		// the dataset is loaded again, the replicas must sync it again.
+		log.Printf("[CANAL] relay: full sync, %d replicas resync.\n", len(r.replicas))
+		r.id, r.offset, r.backlog = replicationID(), 0, nil
+		r.epoch++
+		r.cond.Broadcast()
+	}
+	r.mu.Unlock()
+	r.store.BeginRDB()
+}
+
+func (r *Relay) EndRDB() {
+	r.store.EndRDB()
+	r.mu.Lock()
+	r.ready, r.reselect = true, true
+	r.cond.Broadcast()
+	r.mu.Unlock()
+}
+
+func (r *Relay) Aux(key, value []byte)                     {}
+func (r *Relay) ResizeDatabase(dbSize, expiresSize uint32) {}
+func (r *Relay) BeginDatabase(n int)                       { r.store.BeginDatabase(n) }
+func (r *Relay) EndDatabase(n int)                         {}
+func (r *Relay) Set(key, value []byte, expiry int64)       { r.store.Set(key, value, expiry) }
+func (r *Relay) BeginHash(key []byte, length, expiry int64) {
+	r.store.BeginHash(key, length, expiry)
+}
+func (r *Relay) Hset(key, field, value []byte) { r.store.Hset(key, field, value) }
+func (r *Relay) EndHash(key []byte)            { r.store.EndHash(key) }
+func (r *Relay) BeginSet(key []byte, cardinality, expiry int64) {
+	r.store.BeginSet(key, cardinality, expiry)
+}
+func (r *Relay) Sadd(key, member []byte) { r.store.Sadd(key, member) }
+func (r *Relay) EndSet(key []byte)       { r.store.EndSet(key) }
+func (r *Relay) BeginList(key []byte, length, expiry int64) {
+	r.store.BeginList(key, length, expiry)
+}
+func (r *Relay) Rpush(key, value []byte) { r.store.Rpush(key, value) }
+func (r *Relay) EndList(key []byte)      { r.store.EndList(key) }
+func (r *Relay) BeginZSet(key []byte, cardinality, expiry int64) {
+	r.store.BeginZSet(key, cardinality, expiry)
+}
+func (r *Relay) Zadd(key []byte, score float64, member []byte) { r.store.Zadd(key, score, member) }
+func (r *Relay) EndZSet(key []byte)                            { r.store.EndZSet(key) }
+func (r *Relay) BeginStream(key []byte, cardinality, expiry int64) {
+	r.store.BeginStream(key, cardinality, expiry)
+}
+func (r *Relay) Xadd(key, id, listpack []byte) { r.store.Xadd(key, id, listpack) }
+func (r *Relay) XaddEntry(key, id []byte, fields []FieldValue) {
+	r.store.XaddEntry(key, id, fields)
+}
+func (r *Relay) EndStream(key []byte) { r.store.EndStream(key) }
+
+// Command applies cmd to the dataset and relays it.
+func (r *Relay) Command(cmd *Command) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.store.Command(cmd)
+	r.relay(cmd)
+	r.cond.Broadcast()
+	return nil
+}
+
+// Transaction applies tx to the dataset and relays it as MULTI, its commands and EXEC.
+func (r *Relay) Transaction(tx *Transaction) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.store.Transaction(tx)
+	if r.reselect || r.db != tx.DB {
+		r.relay(&Command{D: []string{"SELECT", strconv.Itoa(tx.DB)}})
+	}
+	r.relay(&Command{D: []string{"MULTI"}})
+	for _, cmd := range tx.Commands {
+		r.relay(cmd)
+	}
+	r.relay(&Command{D: []string{"EXEC"}})
+	r.cond.Broadcast()
+	return nil
+}
+
+// relay appends cmd to the stream, after the SELECT of the database if the
+// replicas may not know it. r.mu is held.
+func (r *Relay) relay(cmd *Command) {
+	switch name := strings.ToLower(cmd.D[0]); {
+	case name == "select":
+		if len(cmd.D) > 1 {
+			if n, err := strconv.Atoi(cmd.D[1]); err == nil {
+				r.db = n
+			}
+		}
+		r.reselect = false
+	case r.reselect && name != "ping" && name != "replconf":
+		r.append([]string{"SELECT", strconv.Itoa(r.db)})
+		r.reselect = false
+	}
+	r.append(cmd.D)
+}
+
+// append appends the RESP array of args to the stream and trims the backlog, r.mu is held.
+func (r *Relay) append(args []string) {
+	n := len(r.backlog)
+	r.backlog = append(r.backlog, '*')
+	r.backlog = strconv.AppendInt(r.backlog, int64(len(args)), 10)
+	r.backlog = append(r.backlog, '\r', '\n')
+	for _, arg := range args {
+		r.backlog = append(r.backlog, '$')
+		r.backlog = strconv.AppendInt(r.backlog, int64(len(arg)), 10)
+		r.backlog = append(r.backlog, '\r', '\n')
+		r.backlog = append(r.backlog, arg...)
+		r.backlog = append(r.backlog, '\r', '\n')
+	}
+	r.offset += int64(len(r.backlog) - n)
+	if len(r.backlog) > 2*r.cfg.Backlog {
+		r.backlog = append([]byte(nil), r.backlog[len(r.backlog)-r.cfg.Backlog:]...)
+	}
+}
+
+// start returns the offset of the first byte of the backlog, r.mu is held.
+func (r *Relay) start() int64 {
+	return r.offset - int64(len(r.backlog)) + 1
+}
+
+// snapshot returns the dataset as an RDB at the offset of the stream, r.mu is held.
+// It fails while the Store skipped commands since the full sync of canal: their
+// keys are missing from the dataset, the replicas wait for the next full sync.
+func (r *Relay) snapshot() ([]byte, error) {
+	var buf bytes.Buffer
+	enc, err := NewEncoder(&buf, r.cfg.RDBVersion)
+	if err != nil {
+		return nil, err
+	}
+	enc.SetAux("repl-id", r.id)
+	enc.SetAux("repl-offset", strconv.FormatInt(r.offset, 10))
+	r.store.mu.RLock()
+	if len(r.store.skipped) > 0 {
+		skipped := make([]string, 0, len(r.store.skipped))
+		for name := range r.store.skipped {
+			skipped = append(skipped, name)
+		}
+		r.store.mu.RUnlock()
+		sort.Strings(skipped)
+		return nil, errors.Errorf("no full sync, the dataset differs from the master as %s could not be applied.", strings.Join(skipped, ", "))
+	}
+	r.store.ds.decode(enc, r.store.now())
+	r.store.mu.RUnlock()
+	if err := enc.Err(); err != nil {
+		return nil, err
+	}
+	// the replica does not know the database selected in the stream any more.
+	r.reselect = true
+	return buf.Bytes(), nil
+}
+
+// Serve accepts the replicas connecting to ln until the relay is closed.
+func (r *Relay) Serve(ln net.Listener) error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return errors.Errorf("relay is closed.")
+	}
+	r.listeners = append(r.listeners, ln)
+	r.mu.Unlock()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			r.mu.Lock()
+			closed := r.closed
+			r.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		go r.serve(conn)
+	}
+}
+
+// serve answers the handshake of a replica, then syncs it.
+func (r *Relay) serve(conn net.Conn) {
+	defer conn.Close()
+	rd, wr := NewReader(conn), NewWriter(conn)
+	authed := r.cfg.Password == ""
+	for {
+		v, _, _, err := rd.ReadMultiBulk()
+		if err != nil {
+			return
+		}
+		vals := v.Array()
+		if len(vals) == 0 {
+			continue
+		}
+		args := make([]string, len(vals))
+		for i := range vals {
+			args[i] = vals[i].String()
+		}
+		switch name := strings.ToLower(args[0]); {
+		case name == "auth":
+			if authed = args[len(args)-1] == r.cfg.Password; authed {
+				wr.WriteSimpleString("OK")
+			} else {
+				wr.WriteError(errors.New("WRONGPASS invalid password"))
+			}
+		case !authed:
+			wr.WriteError(errors.New("NOAUTH Authentication required."))
+		case name == "ping":
+			wr.WriteSimpleString("PONG")
+		case name == "replconf":
+			wr.WriteSimpleString("OK")
+		case name == "psync" || name == "sync":
+			wr.Flush()
+			if err := r.sync(conn, rd, args); err != nil {
+				log.Printf("[CANAL] relay: replica %s: %v.\n", conn.RemoteAddr(), err)
+			}
+			return
+		default:
+			wr.WriteError(errors.Errorf("ERR unknown command '%s'", args[0]))
+		}
+		if err := wr.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// sync answers PSYNC with a partial resync if the backlog has the offset asked
+// for, with a full sync otherwise, then sends the stream until the replica is gone.
+func (r *Relay) sync(conn net.Conn, rd *Reader, args []string) error {
+	r.mu.Lock()
+	for !r.ready && !r.closed {
+		r.cond.Wait()
+	}
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	rep := &relayReplica{conn: conn, epoch: r.epoch, ack: -1}
+	var header []byte
+	var rdb []byte
+	if next, ok := r.resumable(args); ok {
+		rep.next = next
+		header = []byte(fmt.Sprintf("+CONTINUE %s\r\n", r.id))
+	} else {
+		var err error
+		if rdb, err = r.snapshot(); err != nil {
+			r.mu.Unlock()
+			return err
+		}
+		rep.next = r.offset + 1
+		// the stream of a full sync starts with a PING as the one of redis.
+		r.append([]string{"PING"})
+		r.cond.Broadcast()
+		if strings.EqualFold(args[0], "psync") {
+			header = []byte(fmt.Sprintf("+FULLRESYNC %s %d\r\n", r.id, rep.next-1))
+		}
+		header = append(header, fmt.Sprintf("$%d\r\n", len(rdb))...)
+	}
+	r.replicas[rep] = true
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		delete(r.replicas, rep)
+		r.mu.Unlock()
+	}()
+
+	if _, err := conn.Write(append(header, rdb...)); err != nil {
+		return err
+	}
+	go r.acks(rep, rd)
+	return r.stream(rep)
+}
+
+// resumable returns the offset of the next byte to send for PSYNC id offset,
+// false if the backlog does not have it.
+func (r *Relay) resumable(args []string) (int64, bool) {
+	if len(args) < 3 || !strings.EqualFold(args[0], "psync") || args[1] != r.id {
+		return 0, false
+	}
+	next, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil || next < r.start() || next > r.offset+1 {
+		return 0, false
+	}
+	return next, true
+}
+
+// acks reads the REPLCONF ACK of the replica until it is gone.
+func (r *Relay) acks(rep *relayReplica, rd *Reader) {
+	for {
+		v, _, _, err := rd.ReadMultiBulk()
+		r.mu.Lock()
+		if err != nil {
+			rep.gone = true
+			r.cond.Broadcast()
+			r.mu.Unlock()
+			return
+		}
+		if vals := v.Array(); len(vals) > 2 && strings.EqualFold(vals[1].String(), "ack") {
+			if n, err := strconv.ParseInt(vals[2].String(), 10, 64); err == nil {
+				rep.ack = n
+			}
+		}
+		r.mu.Unlock()
+	}
+}
+
+// stream sends the stream to the replica as it grows.
+func (r *Relay) stream(rep *relayReplica) error {
+	for {
+		r.mu.Lock()
+		for rep.next > r.offset && !r.closed && !rep.gone && rep.epoch == r.epoch {
+			r.cond.Wait()
+		}
+		switch {
+		case r.closed || rep.gone:
+			r.mu.Unlock()
+			return nil
+		case rep.epoch != r.epoch:
+			r.mu.Unlock()
+			return errors.Errorf("master resynced, the replica must sync again")
+		case rep.next < r.start():
+			r.mu.Unlock()
+			return errors.Errorf("replica fell out of the backlog at %d", rep.next)
+		}
+		data := append([]byte(nil), r.backlog[rep.next-r.start():]...)
+		rep.next = r.offset + 1
+		r.mu.Unlock()
+		rep.conn.SetWriteDeadline(time.Now().Add(time.Minute))
+		if _, err := rep.conn.Write(data); err != nil {
+			return err
+		}
+	}
+}
+
+// Close stops serving, the replicas are disconnected.
+func (r *Relay) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	for _, ln := range r.listeners {
+		ln.Close()
+	}
+	for rep := range r.replicas {
+		rep.conn.Close()
+	}
+	r.cond.Broadcast()
+	return nil
+}
@@ -17,15 +17,20 @@ type canaler interface {
 	OffsetHandler
 	CommandDecoder
 	acker
+	// rdbErr returns the error met while delivering the RDB, the Decoder
+	// methods return none.
+	rdbErr() error
 }
 
 type replica struct {
 	r ByteReader
 	c canaler
+	// rdb, when set, receives the RDB of a full sync instead of c.
+	rdb Decoder
 }
 
 func newReplica(rd io.Reader, c canaler) *replica {
-	return &replica{bufio.NewReader(rd), c}
+	return &replica{r: bufio.NewReader(rd), c: c}
 }
 
 func (r *replica) dumpFromFile() error {
@@ -36,6 +41,30 @@ func (r *replica) dumpFromFile() error {
 	return nil
 }
 
+// fullSync reads the reply to PSYNC and decodes the RDB of the full sync into d.
+func (r *replica) fullSync(d Decoder) error {
+	resp := NewReader(r.r)
+	for {
+		val, _, err := resp.ReadValue()
+		if err != nil {
+			return err
+		}
+		switch val.Type() {
+		case SimpleString:
+			if strings.HasPrefix(val.String(), "CONTINUE") {
+				return errors.Errorf("master continues the replication, no full sync.")
+			}
+		case Error:
+			return errors.Errorf("full sync failed: %s.", val.String())
+		case Rdb:
+			if err := DecodeStream(r.r, d); err != nil {
+				return err
+			}
+			return r.c.rdbErr()
+		}
+	}
+}
+
 func (r *replica) dumpAndParse(close chan *replica) error {
 	isMark := false
 	resp := NewReader(r.r)
@@ -47,6 +76,11 @@ func (r *replica) dumpAndParse(close chan *replica) error {
 		}
 		val, n, err := resp.ReadValue()
 		if err != nil {
+			select {
+			case <-close:
+				return nil
+			default:
+			}
 			return err
 		}
 		if isMark {
@@ -62,29 +96,36 @@ func (r *replica) dumpAndParse(close chan *replica) error {
 		case Integer:
 			continue
 		case BulkString:
-			if strings.HasPrefix(val.String(), "PING") { // first ping lost 4 bit `*1\r\n`
-				r.c.Increment(int64(4))
-			}
-
+			continue
 		case Array:
-			cmd, err := NewCommand(buildStrCommand(val.String())...)
+			cmd, err := newValueCommand(val)
 			if err != nil {
 				return err
 			}
-			r.c.Command(cmd)
+			if err := r.c.Command(cmd); err != nil {
+				return err
+			}
 		case Rdb:
 			_, offset := val.ReplInfo()
 			r.c.Increment(offset)
 
-			err = DecodeStream(r.r, r.c)
+			var d Decoder = r.c
+			if r.rdb != nil {
+				d = r.rdb
+			}
+			version, err := decodeStream(r.r, d)
 			if err != nil {
 				return err
 			}
-			// skip crc64 check sum
-			_, _, err = resp.ReadValue()
-			if err != nil {
+			if err := r.c.rdbErr(); err != nil {
 				return err
 			}
+			// the RDB ends with a crc64 checksum since version 5.
+			if version >= 5 {
+				if _, err := io.ReadFull(r.r, make([]byte, 8)); err != nil {
+					return err
+				}
+			}
 			isMark = true
 		case CRLF:
 			continue
@@ -0,0 +1,100 @@
+package canal
+
+import (
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// KeyRule rewrites a key of the database db, returning the key unchanged to keep it.
+type KeyRule func(db int, key string) string
+
+// PrefixRule prepends prefix to every key.
+func PrefixRule(prefix string) KeyRule {
+	return func(db int, key string) string {
+		return prefix + key
+	}
+}
+
+// RegexpRule replaces the matches of re in every key by repl, which may refer
+// to the submatches like regexp.ReplaceAllString.
+func RegexpRule(re *regexp.Regexp, repl string) KeyRule {
+	return func(db int, key string) string {
+		return re.ReplaceAllString(key, repl)
+	}
+}
+
+// Rewrite renames the keys and databases of the commands canal delivers,
+// for example to merge several redis into one.
+type Rewrite struct {
+	// DB maps source databases to target ones, the others are kept.
+	DB map[int]int
+	// Keys are applied in order to every key argument.
+	Keys []KeyRule
+}
+
+func (r *Rewrite) mapDB(n int) int {
+	if to, ok := r.DB[n]; ok {
+		return to
+	}
+	return n
+}
+
+func (r *Rewrite) mapDBArg(arg string) string {
+	n, err := strconv.Atoi(arg)
+	if err != nil {
+		return arg
+	}
+	return strconv.Itoa(r.mapDB(n))
+}
+
+func (r *Rewrite) mapKey(db int, key string) string {
+	for _, rule := range r.Keys {
+		key = rule(db, key)
+	}
+	return key
+}
+
+// Command returns cmd, run on the source database db, with its keys and databases
+// rewritten. With key rules, it returns nil for a command whose keys are unknown:
+// delivered unchanged, it would write the keys under their source names.
+func (r *Rewrite) Command(db int, cmd *Command) *Command {
+	args := make([]string, len(cmd.D))
+	copy(args, cmd.D)
+	if len(r.DB) > 0 {
+		for _, i := range dbIndexes(args) {
+			args[i] = r.mapDBArg(args[i])
+		}
+	}
+	if len(r.Keys) > 0 {
+		idx, known := cmd.keyIndexes()
+		if !known {
+			log.Printf("[CANAL] rewrite drops %s, its keys are unknown.\n", cmd.CommandName())
+			return nil
+		}
+		for _, i := range idx {
+			args[i] = r.mapKey(db, args[i])
+		}
+	}
+	return &Command{T: cmd.T, D: args, Offset: cmd.Offset}
+}
+
+// dbIndexes returns the positions of the database arguments in args.
+func dbIndexes(args []string) []int {
+	switch strings.ToLower(args[0]) {
+	case "select":
+		return keyRange(1, len(args)-1, 1)
+	case "move":
+		return keyRange(2, len(args)-1, 1)
+	case "swapdb":
+		return keyRange(1, len(args)-1, 1)
+	case "copy":
+		for i := 3; i < len(args)-1; i++ {
+			if strings.EqualFold(args[i], "DB") {
+				return []int{i + 1}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package canal
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"log"
+	"strings"
+)
+
+// Opaque reports whether the changes of the command cannot be known from its
+// arguments, as a script or a function runs: only the keys it declares are known.
+func (c *Command) Opaque() bool {
+	switch strings.ToLower(c.D[0]) {
+	case "eval", "evalsha", "eval_ro", "evalsha_ro", "fcall", "fcall_ro":
+		return true
+	}
+	return false
+}
+
+// ScriptSHA returns the SHA1 digest EVALSHA runs script with, in lower case hex.
+func ScriptSHA(script string) string {
+	sum := sha1.Sum([]byte(script))
+	return hex.EncodeToString(sum[:])
+}
+
+// scriptCache keeps the scripts a master loaded by their SHA1, from the lua aux
+// fields of the RDB and the SCRIPT LOAD and EVAL of the stream.
+type scriptCache struct {
+	scripts map[string]string
+}
+
+func (s *scriptCache) add(script string) {
+	if s.scripts == nil {
+		s.scripts = make(map[string]string)
+	}
+	s.scripts[ScriptSHA(script)] = script
+}
+
+// track caches the script cmd loads, or forgets all of them on SCRIPT FLUSH.
+func (s *scriptCache) track(cmd *Command) {
+	switch cmd.Type() {
+	case Eval:
+		if len(cmd.D) > 1 {
+			s.add(cmd.D[1])
+		}
+	case Script:
+		if len(cmd.D) > 2 && strings.EqualFold(cmd.D[1], "load") {
+			s.add(cmd.D[2])
+		} else if len(cmd.D) > 1 && strings.EqualFold(cmd.D[1], "flush") {
+			s.scripts = nil
+		}
+	}
+}
+
+// expand turns EVALSHA into the EVAL of the cached script, cmd is returned as is
+// if it is not an EVALSHA or the script is not known.
+func (s *scriptCache) expand(cmd *Command) *Command {
+	if cmd.Type() != EvalSha || len(cmd.D) < 2 {
+		return cmd
+	}
+	script, ok := s.scripts[strings.ToLower(cmd.D[1])]
+	if !ok {
+		log.Printf("[CANAL] script %s is not known, evalsha is not expanded.\n", cmd.D[1])
+		return cmd
+	}
+	args := make([]string, len(cmd.D))
+	copy(args, cmd.D)
+	args[0], args[1] = "EVAL", script
+	return &Command{T: cmd.T, D: args, Offset: cmd.Offset}
+}
+
+// Script returns the script of the master with the SHA1 sha, it must be called from the CommandDecoder.
+func (c *Canal) Script(sha string) (string, bool) {
+	script, ok := c.scripts.scripts[strings.ToLower(sha)]
+	return script, ok
+}
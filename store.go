@@ -0,0 +1,417 @@
+package canal
+
+import (
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Store is a read-only copy in memory of the dataset of a master, kept up to date
+// by canal as the Decoder of the RDB of the full sync and the CommandDecoder of
+// the stream, like c.RunSnapshot(store, store). Its lookups may be called from any
+// goroutine meanwhile.
+//
+// The RDB of a full sync is loaded aside and replaces the dataset once loaded.
+// Transactions are applied at once. Expired keys are left out of the lookups
+// until the master deletes them. The commands which cannot be applied, like the
+// scripts whose changes are not known, are logged and counted by Skipped, and
+// the keys they write are dropped as KeysDropped says: they are missing until
+// the master sets them again or a full sync loads them.
+type Store struct {
+	mu sync.RWMutex
+	ds *dataset
+	// loading is the dataset of the full sync being loaded.
+	loading *dataset
+	offset  int64
+	skipped map[string]int
+	now     func() int64
+
+	wmu      sync.Mutex
+	watchers map[int]func(Change)
+	next     int
+}
+
+// DatasetLoaded is the change of a Store once the RDB of a full sync replaced its dataset.
+type DatasetLoaded struct {
+	ChangeHeader
+	// Keys is the number of keys loaded, expired ones included.
+	Keys int
+}
+
+// KeysDropped is the change of a Store which could not apply Command: Keys are
+// dropped as they may differ from the master. Keys is empty if the keys of
+// Command are not known, the Store may then differ from the master anywhere.
+type KeysDropped struct {
+	ChangeHeader
+	Keys    []string
+	Command *Command
+	Err     error
+}
+
+// StreamEntry is an entry of a stream of a Store.
+type StreamEntry struct {
+	ID     string
+	Fields []FieldValue
+}
+
+// NewStore returns an empty Store.
+func NewStore() *Store {
+	s := &Store{offset: -1, skipped: make(map[string]int), watchers: make(map[int]func(Change))}
+	s.now = func() int64 {
+		return time.Now().UnixNano() / int64(time.Millisecond)
+	}
+	s.ds = newDataset(s.now)
+	return s
+}
+
+// Watch calls fn with every change applied from now on, from the goroutine of canal
+// once the lookups see it. It returns the function stopping the calls.
+func (s *Store) Watch(fn func(Change)) func() {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	id := s.next
+	s.next++
+	s.watchers[id] = fn
+	return func() {
+		s.wmu.Lock()
+		delete(s.watchers, id)
+		s.wmu.Unlock()
+	}
+}
+
+func (s *Store) notify(changes []Change) {
+	if len(changes) == 0 {
+		return
+	}
+	s.wmu.Lock()
+	fns := make([]func(Change), 0, len(s.watchers))
+	ids := make([]int, 0, len(s.watchers))
+	for id := range s.watchers {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		fns = append(fns, s.watchers[id])
+	}
+	s.wmu.Unlock()
+	for _, change := range changes {
+		for _, fn := range fns {
+			fn(change)
+		}
+	}
+}
+
+// Command applies cmd.
+func (s *Store) Command(cmd *Command) error {
+	s.mu.Lock()
+	changes := s.apply(cmd)
+	if cmd.Offset >= 0 {
+		s.offset = cmd.Offset
+	}
+	s.mu.Unlock()
+	s.notify(changes)
+	return nil
+}
+
+// Transaction applies the commands of tx at once.
+func (s *Store) Transaction(tx *Transaction) error {
+	s.mu.Lock()
+	s.ds.db = tx.DB
+	var changes []Change
+	for _, cmd := range tx.Commands {
+		changes = append(changes, s.apply(cmd)...)
+	}
+	if tx.Offset >= 0 {
+		s.offset = tx.Offset
+	}
+	s.mu.Unlock()
+	s.notify(changes)
+	return nil
+}
+
+// apply applies cmd to the dataset, s.mu is held.
+func (s *Store) apply(cmd *Command) []Change {
+	changes, err := s.ds.apply(cmd)
+	if err != nil {
+		s.skip(strings.ToLower(cmd.CommandName()), err)
+		h := ChangeHeader{DB: s.ds.db, Offset: cmd.Offset}
+		return []Change{&KeysDropped{ChangeHeader: h, Keys: s.ds.drop(cmd), Command: cmd, Err: err}}
+	}
+	return changes
+}
+
+// skip logs and counts a command which could not be applied, s.mu is held.
+func (s *Store) skip(name string, err error) {
+	if s.skipped[name] == 0 {
+		log.Printf("[CANAL] store: %s not applied: %v\n", name, err)
+	}
+	s.skipped[name]++
+}
+
+// Offset returns the replication offset of the last command applied, -1 if none.
+func (s *Store) Offset() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.offset
+}
+
+// Skipped returns the number of commands which could not be applied since the
+// last full sync, by name.
+func (s *Store) Skipped() map[string]int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	skipped := make(map[string]int, len(s.skipped))
+	for name, n := range s.skipped {
+		skipped[name] = n
+	}
+	return skipped
+}
+
+func (s *Store) BeginRDB() {
+	s.loading = newDataset(s.now)
+}
+
+func (s *Store) EndRDB() {
+	if s.loading == nil {
+		return
+	}
+	n := 0
+	for _, keys := range s.loading.dbs {
+		n += len(keys)
+	}
+	s.mu.Lock()
+	s.ds, s.loading = s.loading, nil
+	// the commands skipped before no longer make the dataset differ from the master.
+	s.skipped = make(map[string]int)
+	if s.ds.err != nil {
+		s.skip("xadd", s.ds.err)
+	}
+	s.mu.Unlock()
+	s.notify([]Change{&DatasetLoaded{ChangeHeader: ChangeHeader{Offset: -1}, Keys: n}})
+}
+
+// loader returns the dataset the RDB is loaded into.
+func (s *Store) loader() *dataset {
+	if s.loading == nil {
+		s.BeginRDB()
+	}
+	return s.loading
+}
+
+func (s *Store) Aux(key, value []byte)                     {}
+func (s *Store) ResizeDatabase(dbSize, expiresSize uint32) {}
+func (s *Store) BeginDatabase(n int)                       { s.loader().BeginDatabase(n) }
+func (s *Store) EndDatabase(n int)                         {}
+func (s *Store) Set(key, value []byte, expiry int64)       { s.loader().Set(key, value, expiry) }
+func (s *Store) BeginHash(key []byte, length, expiry int64) {
+	s.loader().BeginHash(key, length, expiry)
+}
+func (s *Store) Hset(key, field, value []byte) { s.loader().Hset(key, field, value) }
+func (s *Store) EndHash(key []byte)            { s.loader().EndHash(key) }
+func (s *Store) BeginSet(key []byte, cardinality, expiry int64) {
+	s.loader().BeginSet(key, cardinality, expiry)
+}
+func (s *Store) Sadd(key, member []byte) { s.loader().Sadd(key, member) }
+func (s *Store) EndSet(key []byte)       { s.loader().EndSet(key) }
+func (s *Store) BeginList(key []byte, length, expiry int64) {
+	s.loader().BeginList(key, length, expiry)
+}
+func (s *Store) Rpush(key, value []byte) { s.loader().Rpush(key, value) }
+func (s *Store) EndList(key []byte)      { s.loader().EndList(key) }
+func (s *Store) BeginZSet(key []byte, cardinality, expiry int64) {
+	s.loader().BeginZSet(key, cardinality, expiry)
+}
+func (s *Store) Zadd(key []byte, score float64, member []byte) { s.loader().Zadd(key, score, member) }
+func (s *Store) EndZSet(key []byte)                            { s.loader().EndZSet(key) }
+func (s *Store) BeginStream(key []byte, cardinality, expiry int64) {
+	s.loader().BeginStream(key, cardinality, expiry)
+}
+func (s *Store) Xadd(key, id, listpack []byte) { s.loader().Xadd(key, id, listpack) }
+func (s *Store) XaddEntry(key, id []byte, fields []FieldValue) {
+	s.loader().XaddEntry(key, id, fields)
+}
+func (s *Store) EndStream(key []byte) { s.loader().EndStream(key) }
+
+// live returns the entry of key in db if it is not expired, s.mu is held.
+func (s *Store) live(db int, key string) *entry {
+	e := s.ds.dbs[db][key]
+	if e == nil || (e.expiry > 0 && e.expiry <= s.now()) {
+		return nil
+	}
+	return e
+}
+
+// lookup returns the entry of key in db if it holds typ and is not expired, s.mu is held.
+func (s *Store) lookup(db int, key string, typ ValueType) *entry {
+	if e := s.live(db, key); e != nil && e.typ == typ {
+		return e
+	}
+	return nil
+}
+
+// Exists reports whether key exists in db.
+func (s *Store) Exists(db int, key string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.live(db, key) != nil
+}
+
+// Type returns the type of key in db as TYPE does, none if it does not exist.
+func (s *Store) Type(db int, key string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e := s.live(db, key)
+	if e == nil {
+		return "none"
+	}
+	return e.typ.Name()
+}
+
+// ExpireAt returns the unix time in milliseconds key expires at, 0 if it does not.
+func (s *Store) ExpireAt(db int, key string) int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if e := s.live(db, key); e != nil {
+		return e.expiry
+	}
+	return 0
+}
+
+// Keys returns the keys of db, in order.
+func (s *Store) Keys(db int) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var keys []string
+	for key := range s.ds.dbs[db] {
+		if s.live(db, key) != nil {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Get returns the string of key, false if it is not a string.
+func (s *Store) Get(db int, key string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if e := s.lookup(db, key, TypeString); e != nil {
+		return e.str, true
+	}
+	return "", false
+}
+
+// HGet returns the value of field of the hash of key.
+func (s *Store) HGet(db int, key, field string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if e := s.lookup(db, key, TypeHash); e != nil {
+		v, ok := e.hash[field]
+		return v, ok
+	}
+	return "", false
+}
+
+// HGetAll returns the fields and values of the hash of key, nil if it is not a hash.
+func (s *Store) HGetAll(db int, key string) map[string]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e := s.lookup(db, key, TypeHash)
+	if e == nil {
+		return nil
+	}
+	hash := make(map[string]string, len(e.hash))
+	for f, v := range e.hash {
+		hash[f] = v
+	}
+	return hash
+}
+
+// LRange returns the elements of the list of key from start to stop included,
+// negative indexes count from the end as for LRANGE.
+func (s *Store) LRange(db int, key string, start, stop int) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e := s.lookup(db, key, TypeList)
+	if e == nil {
+		return nil
+	}
+	i, j, _ := listRange(strconv.Itoa(start), strconv.Itoa(stop), len(e.list))
+	return append([]string(nil), e.list[i:j]...)
+}
+
+// SMembers returns the members of the set of key, in order.
+func (s *Store) SMembers(db int, key string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e := s.lookup(db, key, TypeSet)
+	if e == nil {
+		return nil
+	}
+	members := make([]string, 0, len(e.set))
+	for m := range e.set {
+		members = append(members, m)
+	}
+	sort.Strings(members)
+	return members
+}
+
+// SIsMember reports whether member is in the set of key.
+func (s *Store) SIsMember(db int, key, member string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e := s.lookup(db, key, TypeSet)
+	return e != nil && e.set[member]
+}
+
+// ZRange returns the members of the sorted set of key by rank, from start to
+// stop included, negative ranks count from the end as for ZRANGE.
+func (s *Store) ZRange(db int, key string, start, stop int) []ScoredMember {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e := s.lookup(db, key, TypeZSet)
+	if e == nil {
+		return nil
+	}
+	members := sortedMembers(e.zset)
+	i, j, _ := listRange(strconv.Itoa(start), strconv.Itoa(stop), len(members))
+	var scored []ScoredMember
+	for _, m := range members[i:j] {
+		scored = append(scored, ScoredMember{Member: m, Score: e.zset[m]})
+	}
+	return scored
+}
+
+// ZScore returns the score of member in the sorted set of key.
+func (s *Store) ZScore(db int, key, member string) (float64, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if e := s.lookup(db, key, TypeZSet); e != nil {
+		score, ok := e.zset[member]
+		return score, ok
+	}
+	return 0, false
+}
+
+// XRange returns the entries of the stream of key, up to count if it is positive.
+func (s *Store) XRange(db int, key string, count int) []StreamEntry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e := s.lookup(db, key, TypeStreamListPacks)
+	if e == nil {
+		return nil
+	}
+	var entries []StreamEntry
+	for _, item := range e.stream {
+		if count > 0 && len(entries) == count {
+			break
+		}
+		entry := StreamEntry{ID: strconv.FormatUint(item.ms, 10) + "-" + strconv.FormatUint(item.seq, 10)}
+		entry.Fields = append([]FieldValue(nil), item.fields...)
+		entries = append(entries, entry)
+	}
+	return entries
+}
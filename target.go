@@ -0,0 +1,220 @@
+package canal
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+type TargetConfig struct {
+	Address  string
+	Password string
+	// TLS, when set, connects to the target over TLS.
+	TLS *tls.Config
+	// Pipeline is the number of commands sent to the target before waiting for their replies.
+	Pipeline int
+	// DB maps the databases of the source to the ones of the target, unmapped databases are kept.
+	DB map[int]int
+	// OnError is called for every command the target replied an error to,
+	// replication stops if it returns an error. By default the error is logged and skipped.
+	OnError func(cmd *Command, err error) error
+}
+
+func NewTargetConfig(addr string) *TargetConfig {
+	return &TargetConfig{Address: addr, Pipeline: 128}
+}
+
+// Target is a CommandDecoder replaying every command into another redis.
+// Commands are pipelined, Applied reports the offset of the last command the target replied to.
+type Target struct {
+	cfg  *TargetConfig
+	conn net.Conn
+	wr   *Writer
+	rd   *Reader
+
+	queue     chan *Command
+	inflight  chan *Command
+	done      chan struct{}
+	closeOnce sync.Once
+
+	applied int64
+
+	mu  sync.Mutex
+	err error
+}
+
+func NewTarget(cfg *TargetConfig) (*Target, error) {
+	conn, err := dialRedis(cfg.Address, cfg.TLS)
+	if err != nil {
+		return nil, err
+	}
+	pipeline := cfg.Pipeline
+	if pipeline < 1 {
+		pipeline = 1
+	}
+	t := &Target{
+		cfg:      cfg,
+		conn:     conn,
+		wr:       NewWriter(conn),
+		rd:       NewReader(conn),
+		queue:    make(chan *Command, pipeline),
+		inflight: make(chan *Command, pipeline),
+		done:     make(chan struct{}),
+		applied:  -1,
+	}
+	if cfg.Password != "" {
+		if err := t.auth(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	go t.writeLoop()
+	go t.readLoop()
+	return t, nil
+}
+
+// dialRedis connects to the redis at addr, over TLS when tlsConfig is set.
+func dialRedis(addr string, tlsConfig *tls.Config) (net.Conn, error) {
+	if tlsConfig != nil {
+		return tls.Dial("tcp", addr, tlsConfig)
+	}
+	return net.Dial("tcp", addr)
+}
+
+func (t *Target) auth() error {
+	if err := t.wr.WriteMultiBulk("AUTH", t.cfg.Password); err != nil {
+		return err
+	}
+	if err := t.wr.Flush(); err != nil {
+		return err
+	}
+	reply, _, err := t.rd.ReadValue()
+	if err != nil {
+		return err
+	}
+	if reply.Type() == Error {
+		return errors.Errorf("target auth failed: %s", reply.String())
+	}
+	return nil
+}
+
+// Command queues cmd to the target, it blocks when Pipeline commands are waiting
+// for their replies. It must not be called after Close.
+func (t *Target) Command(cmd *Command) error {
+	if err := t.Err(); err != nil {
+		return err
+	}
+	name := cmd.CommandName()
+	switch {
+	case strings.EqualFold(name, "ping"), strings.EqualFold(name, "replconf"):
+		return nil
+	case strings.EqualFold(name, "select") && len(cmd.D) > 1:
+		if db, err := strconv.Atoi(cmd.D[1]); err == nil {
+			if mapped, ok := t.cfg.DB[db]; ok {
+				cmd = &Command{T: cmd.T, D: []string{cmd.D[0], strconv.Itoa(mapped)}, Offset: cmd.Offset}
+			}
+		}
+	}
+	t.queue <- cmd
+	return nil
+}
+
+// Applied returns the replication offset of the last command applied by the target, -1 if none.
+func (t *Target) Applied() int64 {
+	return atomic.LoadInt64(&t.applied)
+}
+
+func (t *Target) Err() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
+}
+
+func (t *Target) fail(err error) {
+	if err == nil {
+		return
+	}
+	t.mu.Lock()
+	if t.err == nil {
+		t.err = err
+	}
+	t.mu.Unlock()
+	// unblock the reader waiting for replies which will never come.
+	t.conn.Close()
+}
+
+// Close waits for the replies of the queued commands and closes the connection.
+// It may be called more than once.
+func (t *Target) Close() error {
+	t.closeOnce.Do(func() {
+		close(t.queue)
+		<-t.done
+		t.conn.Close()
+	})
+	return t.Err()
+}
+
+func (t *Target) writeLoop() {
+	defer close(t.inflight)
+	for cmd := range t.queue {
+		if t.Err() != nil {
+			continue
+		}
+		select {
+		case t.inflight <- cmd:
+		default:
+			// the pipeline is full, let the target answer before waiting.
+			if err := t.wr.Flush(); err != nil {
+				t.fail(err)
+				continue
+			}
+			t.inflight <- cmd
+		}
+		err := t.wr.WriteMultiBulk(cmd.CommandName(), cmd.Args()...)
+		if err == nil && len(t.queue) == 0 {
+			err = t.wr.Flush()
+		}
+		t.fail(err)
+	}
+	if t.Err() == nil {
+		t.fail(t.wr.Flush())
+	}
+}
+
+func (t *Target) readLoop() {
+	defer close(t.done)
+	for cmd := range t.inflight {
+		if t.Err() != nil {
+			continue
+		}
+		reply, _, err := t.rd.ReadValue()
+		if err != nil {
+			t.fail(err)
+			continue
+		}
+		if reply.Type() == Error {
+			err = t.onError(cmd, reply.Error())
+			if err != nil {
+				t.fail(err)
+				continue
+			}
+		}
+		if cmd.Offset >= 0 {
+			atomic.StoreInt64(&t.applied, cmd.Offset)
+		}
+	}
+}
+
+func (t *Target) onError(cmd *Command, err error) error {
+	if t.cfg.OnError != nil {
+		return t.cfg.OnError(cmd, err)
+	}
+	log.Printf("[CANAL] target %s: %v.\n", cmd.CommandName(), err)
+	return nil
+}
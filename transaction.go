@@ -0,0 +1,75 @@
+package canal
+
+import (
+	"log"
+	"sync/atomic"
+)
+
+// Transaction is a MULTI/EXEC block of the replication stream, delivered once its
+// EXEC is received. Blocks which are discarded or cut by the end of the stream are dropped.
+type Transaction struct {
+	// DB is the database selected when the transaction begins, its commands may select others.
+	DB int
+	// Offset is the replication offset of the EXEC. The commands of the transaction
+	// carry the offset before the MULTI, so a position saved in the middle of the
+	// block replays all of it.
+	Offset int64
+	// Commands are the commands between MULTI and EXEC, filtered and rewritten.
+	Commands []*Command
+}
+
+// begin buffers the commands following MULTI until EXEC, the offset acked to the
+// master stays the one before MULTI meanwhile.
+func (c *Canal) begin(multi *Command) {
+	if c.multi != nil {
+		c.abort("not executed")
+	}
+	if !c.offline {
+		multi.Offset = c.prev
+	}
+	c.multi, c.queued = multi, nil
+	c.txDB = c.db
+	atomic.StoreInt64(&c.txStart, multi.Offset)
+	atomic.StoreInt32(&c.pending, 1)
+}
+
+// abort drops the transaction being buffered.
+func (c *Canal) abort(reason string) {
+	log.Printf("[CANAL] transaction of %d commands %s, dropped.\n", len(c.queued), reason)
+	c.multi, c.queued = nil, nil
+	atomic.StoreInt32(&c.pending, 0)
+}
+
+// commit delivers the transaction ended by exec, to the Transaction method of the
+// CommandDecoder when it has one.
+func (c *Canal) commit(exec *Command) error {
+	multi, queued := c.multi, c.queued
+	c.multi, c.queued = nil, nil
+	defer atomic.StoreInt32(&c.pending, 0)
+
+	tx := &Transaction{DB: c.txDB, Offset: exec.Offset}
+	if c.rewrite != nil {
+		tx.DB = c.rewrite.mapDB(tx.DB)
+	}
+	for _, cmd := range queued {
+		cmd.Offset = multi.Offset
+		if cmd = c.route(cmd); cmd != nil {
+			tx.Commands = append(tx.Commands, cmd)
+		}
+	}
+	if len(tx.Commands) == 0 {
+		return nil
+	}
+	if decoder, ok := c.cmder.(TransactionDecoder); ok {
+		return decoder.Transaction(tx)
+	}
+	if err := c.cmder.Command(multi); err != nil {
+		return err
+	}
+	for _, cmd := range tx.Commands {
+		if err := c.cmder.Command(cmd); err != nil {
+			return err
+		}
+	}
+	return c.cmder.Command(exec)
+}
@@ -0,0 +1,406 @@
+package canal
+
+import (
+	"bufio"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// VerifyConfig configures Verify.
+type VerifyConfig struct {
+	// Source is the master replicated to the target. Its Filter limits the keys
+	// verified and its Rewrite renames them as canal delivered them to the target,
+	// Position, Restore and batches are ignored.
+	Source *Config
+	// Target is the redis the source is replicated to, its DB map applies and
+	// Pipeline is the number of keys dumped at once.
+	Target *TargetConfig
+	// ScanCount is the COUNT hint of the SCANs of the target, 1000 by default.
+	ScanCount int
+	// DiffOptions tune the comparison, the expiries of the target are computed
+	// from PTTL so ExpiryTolerance should allow for the duration of the check.
+	DiffOptions
+}
+
+// Verify checks the target matches the source without stopping the replication:
+// it compares the digest of every key of a full sync of the source to the one of
+// the key dumped from the target, while following the replication stream of the
+// source. Keys which differ but were changed by the stream during the check are
+// counted as Changed, the others are handed to fn. The databases of the differences
+// are the ones of the target.
+//
+// With a source Filter, the keys of the target it does not deliver are ignored,
+// when the Rewrite renames keys too every key of the target is compared.
+//
+// The target must run redis 7.2 or older, its DUMP payloads of RDB version 11 at
+// most: a newer target is refused before the full sync of the source.
+func Verify(cfg *VerifyConfig, fn func(*KeyDiff) error) (*DiffSummary, error) {
+	v := &verifier{cfg: cfg, count: cfg.ScanCount, pipeline: cfg.Target.Pipeline}
+	if v.count <= 0 {
+		v.count = 1000
+	}
+	if v.pipeline <= 0 {
+		v.pipeline = 1
+	}
+	v.changed = &changedKeys{mapDB: v.targetDB, keys: make(map[int]map[string]bool), dbs: make(map[int]bool)}
+
+	conn, err := dialRedis(cfg.Target.Address, cfg.Target.TLS)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	v.conn, v.rd, v.wr = conn, NewReader(conn), NewWriter(conn)
+	if cfg.Target.Password != "" {
+		if _, err := v.do([]interface{}{"AUTH", cfg.Target.Password}); err != nil {
+			return nil, errors.Wrap(err, "target auth failed")
+		}
+	}
+	if err := v.checkVersion(); err != nil {
+		return nil, err
+	}
+
+	source := *cfg.Source
+	source.Position, source.Restore, source.BatchCount = nil, false, 0
+	c, err := NewCanal(&source)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	src := newDigestSorter(&cfg.DiffOptions)
+	defer src.close()
+	snapshot := &verifySnapshot{loaded: make(chan struct{})}
+	snapshot.Digester = NewDigester(func(k *KeyDigest) error {
+		if r := cfg.Source.Rewrite; r != nil {
+			k.Key = r.mapKey(k.DB, k.Key)
+			k.DB = r.mapDB(k.DB)
+		}
+		k.DB = v.targetDB(k.DB)
+		return src.add(k)
+	})
+	errc := make(chan error, 1)
+	go func() {
+		errc <- c.RunSnapshot(snapshot, v.changed)
+	}()
+	select {
+	case <-snapshot.loaded:
+	case err := <-errc:
+		if err == nil {
+			err = errors.Errorf("replication stopped before the full sync.")
+		}
+		return nil, err
+	}
+	if err := snapshot.Err(); err != nil {
+		return nil, err
+	}
+
+	dst := newDigestSorter(&cfg.DiffOptions)
+	defer dst.close()
+	if err := v.scan(dst); err != nil {
+		return nil, errors.Wrap(err, "target")
+	}
+	select {
+	case err := <-errc:
+		// without the stream, changed keys would be reported as differences.
+		return nil, errors.Errorf("replication stopped during the check: %v", err)
+	default:
+	}
+
+	a, err := src.sorted()
+	if err != nil {
+		return nil, err
+	}
+	b, err := dst.sorted()
+	if err != nil {
+		return nil, err
+	}
+	return diffDigests(a, b, cfg.ExpiryTolerance, v.changed.has, fn)
+}
+
+// verifySnapshot digests the RDB of the full sync, loaded is closed at its end.
+type verifySnapshot struct {
+	*Digester
+	loaded chan struct{}
+}
+
+func (s *verifySnapshot) EndRDB() {
+	s.Digester.EndRDB()
+	close(s.loaded)
+}
+
+type verifier struct {
+	cfg      *VerifyConfig
+	count    int
+	pipeline int
+	changed  *changedKeys
+
+	conn net.Conn
+	rd   *Reader
+	wr   *Writer
+}
+
+// targetDB returns the database of the target the source database db is written to.
+func (v *verifier) targetDB(db int) int {
+	if to, ok := v.cfg.Target.DB[db]; ok {
+		return to
+	}
+	return db
+}
+
+// sourceDB returns the database of the source replicated to the target database db,
+// -1 if none is.
+func (v *verifier) sourceDB(db int) int {
+	r := v.cfg.Source.Rewrite
+	candidates := []int{db}
+	if r != nil {
+		for n := range r.DB {
+			candidates = append(candidates, n)
+		}
+	}
+	for n := range v.cfg.Target.DB {
+		candidates = append(candidates, n)
+	}
+	sort.Ints(candidates)
+	for _, n := range candidates {
+		to := n
+		if r != nil {
+			to = r.mapDB(n)
+		}
+		if v.targetDB(to) == db {
+			return n
+		}
+	}
+	return -1
+}
+
+// keep reports whether the key of the target database db is compared.
+func (v *verifier) keep(db int, key string) bool {
+	n := v.sourceDB(db)
+	if n < 0 {
+		return false
+	}
+	f := v.cfg.Source.Filter
+	if f == nil {
+		return true
+	}
+	if !f.MatchDB(n) {
+		return false
+	}
+	return (v.cfg.Source.Rewrite != nil && len(v.cfg.Source.Rewrite.Keys) > 0) || f.MatchKey(key)
+}
+
+// do sends the commands in one pipeline and returns their replies.
+func (v *verifier) do(cmds ...[]interface{}) ([]Value, error) {
+	for _, cmd := range cmds {
+		if err := v.wr.WriteMultiBulk(cmd[0].(string), cmd[1:]...); err != nil {
+			return nil, err
+		}
+	}
+	if err := v.wr.Flush(); err != nil {
+		return nil, err
+	}
+	replies := make([]Value, len(cmds))
+	for i := range cmds {
+		reply, _, err := v.rd.ReadValue()
+		if err != nil {
+			return nil, err
+		}
+		if reply.Type() == Error {
+			return nil, errors.Errorf("%s: %s", cmds[i][0], reply.String())
+		}
+		replies[i] = reply
+	}
+	return replies, nil
+}
+
+// checkVersion fails if the target runs a redis newer than 7.2, whose DUMP payloads
+// DecodeDump does not read. A target which does not tell its version is let through.
+func (v *verifier) checkVersion() error {
+	replies, err := v.do([]interface{}{"INFO", "server"})
+	if err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(strings.NewReader(replies[0].String()))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "redis_version:") {
+			continue
+		}
+		version := strings.TrimPrefix(line, "redis_version:")
+		parts := strings.SplitN(version, ".", 3)
+		if len(parts) < 2 {
+			return nil
+		}
+		major, _ := strconv.Atoi(parts[0])
+		minor, _ := strconv.Atoi(parts[1])
+		if major > 7 || (major == 7 && minor > 2) {
+			return errors.Errorf("target runs redis %s, Verify supports targets up to redis 7.2.", version)
+		}
+	}
+	return nil
+}
+
+// databases returns the databases of the target holding keys.
+func (v *verifier) databases() ([]int, error) {
+	replies, err := v.do([]interface{}{"INFO", "keyspace"})
+	if err != nil {
+		return nil, err
+	}
+	var dbs []int
+	scanner := bufio.NewScanner(strings.NewReader(replies[0].String()))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "db") {
+			continue
+		}
+		if n := strings.IndexByte(line, ':'); n > 0 {
+			if db, err := strconv.Atoi(line[2:n]); err == nil {
+				dbs = append(dbs, db)
+			}
+		}
+	}
+	return dbs, nil
+}
+
+// scan digests every key of the target into dst.
+func (v *verifier) scan(dst *digestSorter) error {
+	dbs, err := v.databases()
+	if err != nil {
+		return err
+	}
+	d := NewDigester(dst.add)
+	for _, db := range dbs {
+		if _, err := v.do([]interface{}{"SELECT", strconv.Itoa(db)}); err != nil {
+			return err
+		}
+		cursor := "0"
+		for {
+			replies, err := v.do([]interface{}{"SCAN", cursor, "COUNT", strconv.Itoa(v.count)})
+			if err != nil {
+				return err
+			}
+			reply := replies[0].Array()
+			if len(reply) != 2 {
+				return errors.Errorf("unexpected SCAN reply %q", replies[0].String())
+			}
+			var keys []string
+			for _, k := range reply[1].Array() {
+				if key := k.String(); v.keep(db, key) {
+					keys = append(keys, key)
+				}
+			}
+			for len(keys) > 0 {
+				n := v.pipeline
+				if n > len(keys) {
+					n = len(keys)
+				}
+				if err := v.dump(d, db, keys[:n]); err != nil {
+					return err
+				}
+				keys = keys[n:]
+			}
+			if cursor = reply[0].String(); cursor == "0" {
+				break
+			}
+		}
+	}
+	return d.Err()
+}
+
+// dump digests the keys of the database db, the ones deleted since they were scanned are skipped.
+func (v *verifier) dump(d *Digester, db int, keys []string) error {
+	cmds := make([][]interface{}, 0, 2*len(keys))
+	for _, key := range keys {
+		cmds = append(cmds, []interface{}{"DUMP", key}, []interface{}{"PTTL", key})
+	}
+	replies, err := v.do(cmds...)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	for i, key := range keys {
+		dump, pttl := replies[2*i], replies[2*i+1]
+		if dump.IsNull() {
+			continue
+		}
+		var expiry int64
+		if ttl := int64(pttl.Integer()); ttl > 0 {
+			expiry = now + ttl
+		}
+		if err := DecodeDump(dump.Bytes(), db, []byte(key), expiry, d); err != nil {
+			return errors.Wrapf(err, "key %q", key)
+		}
+	}
+	return nil
+}
+
+// changedKeys is a CommandDecoder recording the keys of the target the commands change.
+type changedKeys struct {
+	mapDB func(int) int
+
+	mu   sync.Mutex
+	db   int
+	keys map[int]map[string]bool
+	// dbs are flushed or swapped databases, all of them when all is set.
+	dbs map[int]bool
+	all bool
+}
+
+func (c *changedKeys) add(db int, key string) {
+	keys, ok := c.keys[db]
+	if !ok {
+		keys = make(map[string]bool)
+		c.keys[db] = keys
+	}
+	keys[key] = true
+}
+
+func (c *changedKeys) Command(cmd *Command) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch cmd.Type() {
+	case Select:
+		if len(cmd.D) > 1 {
+			if n, err := strconv.Atoi(cmd.D[1]); err == nil {
+				c.db = c.mapDB(n)
+			}
+		}
+	case FlushAll:
+		c.all = true
+	case FlushDB:
+		c.dbs[c.db] = true
+	case SwapDB:
+		for _, arg := range cmd.D[1:] {
+			if n, err := strconv.Atoi(arg); err == nil {
+				c.dbs[c.mapDB(n)] = true
+			}
+		}
+	default:
+		keys := cmd.Keys()
+		for _, key := range keys {
+			c.add(c.db, key)
+		}
+		// MOVE and COPY write the keys to another database too.
+		for _, i := range dbIndexes(cmd.D) {
+			if n, err := strconv.Atoi(cmd.D[i]); err == nil {
+				for _, key := range keys {
+					c.add(c.mapDB(n), key)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// has reports whether the key of d was changed.
+func (c *changedKeys) has(d *KeyDiff) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.all || c.dbs[d.DB] || c.keys[d.DB][d.Key]
+}